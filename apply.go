@@ -0,0 +1,1142 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ajg/form"
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/healer"
+	"github.com/tsuru/tsuru/iaas"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/nodecontainer"
+	"gopkg.in/yaml.v1"
+)
+
+// clusterManifest is the declarative description of the admin-owned objects
+// of a tsuru cluster, as read by the apply command.
+type clusterManifest struct {
+	Pools          []poolSpec          `yaml:"pools,omitempty"`
+	Templates      []templateSpec      `yaml:"templates,omitempty"`
+	NodeContainers []nodeContainerSpec `yaml:"nodecontainers,omitempty"`
+	Healing        []healingSpec       `yaml:"healing,omitempty"`
+	AutoScale      []autoScaleRuleSpec `yaml:"autoscale,omitempty"`
+}
+
+type poolSpec struct {
+	Name        string   `yaml:"name"`
+	Public      bool     `yaml:"public,omitempty"`
+	Default     bool     `yaml:"default,omitempty"`
+	Provisioner string   `yaml:"provisioner,omitempty"`
+	Teams       []string `yaml:"teams,omitempty"`
+}
+
+type templateSpec struct {
+	Name   string            `yaml:"name"`
+	IaaS   string            `yaml:"iaas"`
+	Params map[string]string `yaml:"params,omitempty"`
+}
+
+// nodeContainerSpec describes a node container for one pool. An empty pool
+// means the entry applies to every pool. Only the fields listed here are
+// compared against the live configuration.
+type nodeContainerSpec struct {
+	Name       string            `yaml:"name"`
+	Pool       string            `yaml:"pool,omitempty"`
+	Image      string            `yaml:"image,omitempty"`
+	Env        []string          `yaml:"env,omitempty"`
+	Binds      []string          `yaml:"binds,omitempty"`
+	Privileged bool              `yaml:"privileged,omitempty"`
+	Network    string            `yaml:"network,omitempty"`
+	Restart    string            `yaml:"restart,omitempty"`
+	LogDriver  string            `yaml:"log-driver,omitempty"`
+	LogOpts    map[string]string `yaml:"log-opts,omitempty"`
+}
+
+// healingSpec describes the node healing configuration of a pool. Fields
+// left out of the manifest keep being inherited from the default entry,
+// which has an empty pool.
+type healingSpec struct {
+	Pool            string `yaml:"pool,omitempty"`
+	Enabled         *bool  `yaml:"enabled,omitempty"`
+	MaxUnresponsive *int   `yaml:"max-unresponsive,omitempty"`
+	MaxUnsuccessful *int   `yaml:"max-unsuccessful,omitempty"`
+}
+
+type autoScaleRuleSpec struct {
+	Pool               string  `yaml:"pool,omitempty"`
+	Enabled            bool    `yaml:"enabled"`
+	MaxContainerCount  int     `yaml:"max-container-count,omitempty"`
+	MaxMemoryRatio     float32 `yaml:"max-memory-ratio,omitempty"`
+	ScaleDownRatio     float32 `yaml:"scale-down-ratio,omitempty"`
+	NoRebalanceOnScale bool    `yaml:"no-rebalance-on-scale,omitempty"`
+}
+
+func readManifest(r io.Reader) (*clusterManifest, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var manifest clusterManifest
+	err = yaml.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse manifest")
+	}
+	return &manifest, manifest.validate()
+}
+
+func (m *clusterManifest) validate() error {
+	seen := map[string]bool{}
+	check := func(kind, name string) error {
+		key := kind + "\x00" + name
+		if seen[key] {
+			return errors.Errorf("duplicated %s %q in manifest", kind, name)
+		}
+		seen[key] = true
+		return nil
+	}
+	var defaultPools []string
+	for _, p := range m.Pools {
+		if p.Name == "" {
+			return errors.New("pool name is required")
+		}
+		if err := check("pool", p.Name); err != nil {
+			return err
+		}
+		if p.Default {
+			defaultPools = append(defaultPools, p.Name)
+		}
+	}
+	if len(defaultPools) > 1 {
+		return errors.Errorf("only one default pool is allowed, got %s", strings.Join(defaultPools, ", "))
+	}
+	for _, t := range m.Templates {
+		if t.Name == "" || t.IaaS == "" {
+			return errors.New("template name and iaas are required")
+		}
+		if err := check("template", t.Name); err != nil {
+			return err
+		}
+	}
+	for _, n := range m.NodeContainers {
+		if n.Name == "" {
+			return errors.New("node container name is required")
+		}
+		if err := check("node container", nodeContainerKey(n.Name, n.Pool)); err != nil {
+			return err
+		}
+	}
+	for _, h := range m.Healing {
+		if err := check("healing config for pool", h.Pool); err != nil {
+			return err
+		}
+	}
+	for _, r := range m.AutoScale {
+		if err := check("autoscale rule for pool", r.Pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterChange is a single step of an apply plan.
+type clusterChange struct {
+	action  string
+	kind    string
+	name    string
+	details []string
+	apply   func(client *cmd.Client) error
+}
+
+func (c *clusterChange) String() string {
+	symbol := map[string]string{"create": "+", "update": "~", "delete": "-"}[c.action]
+	line := fmt.Sprintf("%s %s %s", symbol, c.kind, strconv.Quote(c.name))
+	if len(c.details) > 0 {
+		line += "\n    " + strings.Join(c.details, "\n    ")
+	}
+	return line
+}
+
+// clusterPlan holds the changes needed to make the live cluster match a
+// manifest. Creations and updates run first, in dependency order (pools
+// before anything that references them), and deletions run last, in reverse
+// order.
+type clusterPlan struct {
+	changes []*clusterChange
+	deletes []*clusterChange
+}
+
+func (p *clusterPlan) add(c *clusterChange) {
+	if c.action == "delete" {
+		p.deletes = append([]*clusterChange{c}, p.deletes...)
+		return
+	}
+	p.changes = append(p.changes, c)
+}
+
+func (p *clusterPlan) steps() []*clusterChange {
+	return append(append([]*clusterChange{}, p.changes...), p.deletes...)
+}
+
+func buildClusterPlan(client *cmd.Client, m *clusterManifest, prune bool) (*clusterPlan, error) {
+	var plan clusterPlan
+	planners := []func(*cmd.Client, *clusterManifest, bool, *clusterPlan) error{
+		planPools,
+		planTemplates,
+		planNodeContainers,
+		planHealing,
+		planAutoScale,
+	}
+	for _, planner := range planners {
+		err := planner(client, m, prune, &plan)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &plan, nil
+}
+
+type applyCmd struct {
+	cmd.ConfirmationCommand
+	fs     *gnuflag.FlagSet
+	file   string
+	prune  bool
+	dryRun bool
+}
+
+func (c *applyCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "apply",
+		Usage: "apply -f/--file <cluster.yaml> [--prune] [--dry-run] [-y]",
+		Desc: `Makes the cluster configuration match a YAML manifest. Pools, machine
+templates, node containers, node healing configuration and autoscale rules
+described in the manifest are compared with the ones in the tsuru API and a
+plan with the needed changes is displayed before anything is applied.
+
+Objects that are not in the manifest are left untouched, unless the
+[[--prune]] flag is used, in which case they are removed. The [[--dry-run]]
+flag displays the plan without applying it. When the manifest is read from
+stdin, with [[-f -]], the confirmation can't be asked and [[-y]] is required to
+apply the plan.
+
+Node containers in a pool whose env variables, binds or log options are
+removed, or that are no longer privileged, are recreated, as the API only merges
+new values into them. Such changes are refused for the default configuration
+of a node container.
+
+Example manifest:
+
+  pools:
+  - name: prod
+    provisioner: docker
+    teams: [team1, team2]
+  templates:
+  - name: small
+    iaas: ec2
+    params:
+      type: t2.small
+  nodecontainers:
+  - name: big-sibling
+    image: tsuru/bs:v1
+    env: [HOST_PROC=/prochost]
+  healing:
+  - enabled: true
+    max-unresponsive: 300
+  autoscale:
+  - pool: prod
+    enabled: true
+    max-container-count: 10`,
+		MinArgs: 0,
+	}
+}
+
+func (c *applyCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+		msg := "YAML manifest describing the cluster (use - to read from stdin)"
+		c.fs.StringVar(&c.file, "file", "", msg)
+		c.fs.StringVar(&c.file, "f", "", msg)
+		c.fs.BoolVar(&c.prune, "prune", false, "Remove objects that are not described in the manifest")
+		c.fs.BoolVar(&c.dryRun, "dry-run", false, "Only display the plan, without applying it")
+	}
+	return c.fs
+}
+
+func (c *applyCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	if c.file == "" {
+		return errors.New("the manifest file is required, use -f/--file")
+	}
+	if c.file == "-" && !c.dryRun && !assumeYes(c.fs) {
+		return errors.New("the manifest is read from stdin, use -y to apply it without confirmation")
+	}
+	manifest, err := c.readManifest(ctx)
+	if err != nil {
+		return err
+	}
+	plan, err := buildClusterPlan(client, manifest, c.prune)
+	if err != nil {
+		return err
+	}
+	steps := plan.steps()
+	if len(steps) == 0 {
+		fmt.Fprintln(ctx.Stdout, "No changes, the cluster matches the manifest.")
+		return nil
+	}
+	fmt.Fprintln(ctx.Stdout, "Plan:")
+	for _, step := range steps {
+		fmt.Fprintln(ctx.Stdout, step)
+	}
+	fmt.Fprintf(ctx.Stdout, "\n%s.\n", planSummary(steps))
+	if c.dryRun {
+		return nil
+	}
+	if !c.Confirm(ctx, "Are you sure you want to apply these changes?") {
+		return nil
+	}
+	for _, step := range steps {
+		err = step.apply(client)
+		if err != nil {
+			return errors.Wrapf(err, "unable to %s %s %q", step.action, step.kind, step.name)
+		}
+	}
+	fmt.Fprintln(ctx.Stdout, "Manifest successfully applied.")
+	return nil
+}
+
+func (c *applyCmd) readManifest(ctx *cmd.Context) (*clusterManifest, error) {
+	if c.file == "-" {
+		return readManifest(ctx.Stdin)
+	}
+	f, err := os.Open(c.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readManifest(f)
+}
+
+// assumeYes reports whether -y was given to a command embedding
+// cmd.ConfirmationCommand.
+func assumeYes(fs *gnuflag.FlagSet) bool {
+	if fs == nil {
+		return false
+	}
+	f := fs.Lookup("y")
+	return f != nil && f.Value.String() == "true"
+}
+
+func planSummary(steps []*clusterChange) string {
+	counts := map[string]int{}
+	for _, step := range steps {
+		counts[step.action]++
+	}
+	return fmt.Sprintf("%d to create, %d to update, %d to delete", counts["create"], counts["update"], counts["delete"])
+}
+
+// doForm sends a form encoded request to the tsuru API.
+func doForm(client *cmd.Client, method, u string, values url.Values) error {
+	var body io.Reader
+	if values != nil {
+		body = strings.NewReader(values.Encode())
+	}
+	request, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if values != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	_, err = client.Do(request)
+	return err
+}
+
+func listPools(client *cmd.Client) ([]provision.Pool, error) {
+	u, err := cmd.GetURL("/pools")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var pools []provision.Pool
+	if resp.StatusCode == http.StatusNoContent {
+		return pools, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&pools)
+	if err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+func planPools(client *cmd.Client, m *clusterManifest, prune bool, plan *clusterPlan) error {
+	pools, err := listPools(client)
+	if err != nil {
+		return err
+	}
+	live := map[string]provision.Pool{}
+	for _, p := range pools {
+		live[p.Name] = p
+	}
+	declared := map[string]bool{}
+	for _, spec := range m.Pools {
+		spec := spec
+		declared[spec.Name] = true
+		current, ok := live[spec.Name]
+		if !ok {
+			plan.add(&clusterChange{
+				action:  "create",
+				kind:    "pool",
+				name:    spec.Name,
+				details: poolDetails(spec),
+				apply: func(client *cmd.Client) error {
+					return createPool(client, spec)
+				},
+			})
+			continue
+		}
+		var details []string
+		values := url.Values{}
+		if current.Public != spec.Public {
+			details = append(details, fmt.Sprintf("public: %t => %t", current.Public, spec.Public))
+			values.Set("public", strconv.FormatBool(spec.Public))
+		}
+		if current.Default != spec.Default {
+			details = append(details, fmt.Sprintf("default: %t => %t", current.Default, spec.Default))
+			values.Set("default", strconv.FormatBool(spec.Default))
+			values.Set("force", strconv.FormatBool(spec.Default))
+		}
+		if spec.Provisioner != "" && current.Provisioner != spec.Provisioner {
+			details = append(details, fmt.Sprintf("provisioner: %q => %q", current.Provisioner, spec.Provisioner))
+			values.Set("provisioner", spec.Provisioner)
+		}
+		toAdd, toRemove := diffStrings(current.Teams, spec.Teams)
+		if len(toAdd) > 0 {
+			details = append(details, fmt.Sprintf("add teams: %s", strings.Join(toAdd, ", ")))
+		}
+		if len(toRemove) > 0 {
+			details = append(details, fmt.Sprintf("remove teams: %s", strings.Join(toRemove, ", ")))
+		}
+		if len(details) == 0 {
+			continue
+		}
+		plan.add(&clusterChange{
+			action:  "update",
+			kind:    "pool",
+			name:    spec.Name,
+			details: details,
+			apply: func(client *cmd.Client) error {
+				if len(values) > 0 {
+					u, err := cmd.GetURL("/pools/" + spec.Name)
+					if err != nil {
+						return err
+					}
+					err = doForm(client, "PUT", u, values)
+					if err != nil {
+						return err
+					}
+				}
+				return updatePoolTeams(client, spec.Name, toAdd, toRemove)
+			},
+		})
+	}
+	if !prune {
+		return nil
+	}
+	for _, p := range pools {
+		name := p.Name
+		if declared[name] {
+			continue
+		}
+		plan.add(&clusterChange{
+			action: "delete",
+			kind:   "pool",
+			name:   name,
+			apply: func(client *cmd.Client) error {
+				u, err := cmd.GetURL("/pools/" + name)
+				if err != nil {
+					return err
+				}
+				return doForm(client, "DELETE", u, nil)
+			},
+		})
+	}
+	return nil
+}
+
+func poolDetails(spec poolSpec) []string {
+	details := []string{
+		fmt.Sprintf("public: %t", spec.Public),
+		fmt.Sprintf("default: %t", spec.Default),
+	}
+	if spec.Provisioner != "" {
+		details = append(details, fmt.Sprintf("provisioner: %s", spec.Provisioner))
+	}
+	if len(spec.Teams) > 0 {
+		details = append(details, fmt.Sprintf("teams: %s", strings.Join(spec.Teams, ", ")))
+	}
+	return details
+}
+
+func createPool(client *cmd.Client, spec poolSpec) error {
+	u, err := cmd.GetURL("/pools")
+	if err != nil {
+		return err
+	}
+	values := url.Values{}
+	values.Set("name", spec.Name)
+	values.Set("public", strconv.FormatBool(spec.Public))
+	values.Set("default", strconv.FormatBool(spec.Default))
+	values.Set("force", strconv.FormatBool(spec.Default))
+	values.Set("provisioner", spec.Provisioner)
+	err = doForm(client, "POST", u, values)
+	if err != nil {
+		return err
+	}
+	return updatePoolTeams(client, spec.Name, spec.Teams, nil)
+}
+
+func updatePoolTeams(client *cmd.Client, pool string, toAdd, toRemove []string) error {
+	if len(toAdd) > 0 {
+		values := url.Values{"team": toAdd}
+		u, err := cmd.GetURL(fmt.Sprintf("/pools/%s/team", pool))
+		if err != nil {
+			return err
+		}
+		err = doForm(client, "POST", u, values)
+		if err != nil {
+			return err
+		}
+	}
+	if len(toRemove) > 0 {
+		values := url.Values{"team": toRemove}
+		u, err := cmd.GetURL(fmt.Sprintf("/pools/%s/team?%s", pool, values.Encode()))
+		if err != nil {
+			return err
+		}
+		return doForm(client, "DELETE", u, nil)
+	}
+	return nil
+}
+
+// diffStrings returns the items in desired missing from current and the
+// items in current missing from desired, both sorted.
+func diffStrings(current, desired []string) ([]string, []string) {
+	currentSet := map[string]bool{}
+	for _, item := range current {
+		currentSet[item] = true
+	}
+	desiredSet := map[string]bool{}
+	for _, item := range desired {
+		desiredSet[item] = true
+	}
+	var toAdd, toRemove []string
+	for item := range desiredSet {
+		if !currentSet[item] {
+			toAdd = append(toAdd, item)
+		}
+	}
+	for item := range currentSet {
+		if !desiredSet[item] {
+			toRemove = append(toRemove, item)
+		}
+	}
+	sort.Strings(toAdd)
+	sort.Strings(toRemove)
+	return toAdd, toRemove
+}
+
+func planTemplates(client *cmd.Client, m *clusterManifest, prune bool, plan *clusterPlan) error {
+	if len(m.Templates) == 0 && !prune {
+		return nil
+	}
+	templates, err := listTemplates(client)
+	if err != nil {
+		return err
+	}
+	live := map[string]iaas.Template{}
+	for _, t := range templates {
+		live[t.Name] = t
+	}
+	declared := map[string]bool{}
+	for _, spec := range m.Templates {
+		spec := spec
+		declared[spec.Name] = true
+		current, ok := live[spec.Name]
+		if ok && current.IaaSName != spec.IaaS {
+			// The template is recreated in a single step, as deletions
+			// only run after all creations.
+			details := []string{fmt.Sprintf("iaas: %s => %s, the template will be recreated", current.IaaSName, spec.IaaS)}
+			plan.add(&clusterChange{
+				action:  "update",
+				kind:    "template",
+				name:    spec.Name,
+				details: append(details, paramsDetails(nil, spec.Params)...),
+				apply: func(client *cmd.Client) error {
+					err := removeTemplate(client, spec.Name)
+					if err != nil {
+						return err
+					}
+					return createTemplate(client, spec)
+				},
+			})
+			continue
+		}
+		if !ok {
+			plan.add(&clusterChange{
+				action:  "create",
+				kind:    "template",
+				name:    spec.Name,
+				details: append([]string{"iaas: " + spec.IaaS}, paramsDetails(nil, spec.Params)...),
+				apply: func(client *cmd.Client) error {
+					return createTemplate(client, spec)
+				},
+			})
+			continue
+		}
+		currentParams := map[string]string{}
+		for _, data := range current.Data {
+			currentParams[data.Name] = data.Value
+		}
+		details := paramsDetails(currentParams, spec.Params)
+		if len(details) == 0 {
+			continue
+		}
+		plan.add(&clusterChange{
+			action:  "update",
+			kind:    "template",
+			name:    spec.Name,
+			details: details,
+			apply: func(client *cmd.Client) error {
+				return updateTemplate(client, spec, currentParams)
+			},
+		})
+	}
+	if !prune {
+		return nil
+	}
+	for _, t := range templates {
+		name := t.Name
+		if declared[name] {
+			continue
+		}
+		plan.add(&clusterChange{
+			action: "delete",
+			kind:   "template",
+			name:   name,
+			apply: func(client *cmd.Client) error {
+				return removeTemplate(client, name)
+			},
+		})
+	}
+	return nil
+}
+
+// paramsDetails describes, in a stable order, what changes from current to
+// desired.
+func paramsDetails(current, desired map[string]string) []string {
+	var details []string
+	for name, value := range desired {
+		old, ok := current[name]
+		if !ok {
+			details = append(details, fmt.Sprintf("%s: %s", name, value))
+		} else if old != value {
+			details = append(details, fmt.Sprintf("%s: %s => %s", name, old, value))
+		}
+	}
+	for name, old := range current {
+		if _, ok := desired[name]; !ok {
+			details = append(details, fmt.Sprintf("%s: %s => (removed)", name, old))
+		}
+	}
+	sort.Strings(details)
+	return details
+}
+
+func templateData(params map[string]string) iaas.TemplateDataList {
+	data := make(iaas.TemplateDataList, 0, len(params))
+	for name, value := range params {
+		data = append(data, iaas.TemplateData{Name: name, Value: value})
+	}
+	sort.Sort(data)
+	return data
+}
+
+func createTemplate(client *cmd.Client, spec templateSpec) error {
+	template := iaas.Template{Name: spec.Name, IaaSName: spec.IaaS, Data: templateData(spec.Params)}
+	values, err := form.EncodeToValues(&template)
+	if err != nil {
+		return err
+	}
+	u, err := cmd.GetURL("/iaas/templates")
+	if err != nil {
+		return err
+	}
+	return doForm(client, "POST", u, values)
+}
+
+// updateTemplate sends every desired param, plus empty values for the ones
+// that must be removed, as the API merges params on update.
+func updateTemplate(client *cmd.Client, spec templateSpec, current map[string]string) error {
+	params := map[string]string{}
+	for name := range current {
+		params[name] = ""
+	}
+	for name, value := range spec.Params {
+		params[name] = value
+	}
+	template := iaas.Template{Name: spec.Name, Data: templateData(params)}
+	values, err := form.EncodeToValues(&template)
+	if err != nil {
+		return err
+	}
+	u, err := cmd.GetURL("/iaas/templates/" + spec.Name)
+	if err != nil {
+		return err
+	}
+	return doForm(client, "PUT", u, values)
+}
+
+func removeTemplate(client *cmd.Client, name string) error {
+	u, err := cmd.GetURL("/iaas/templates/" + name)
+	if err != nil {
+		return err
+	}
+	return doForm(client, "DELETE", u, nil)
+}
+
+func nodeContainerKey(name, pool string) string {
+	if pool == "" {
+		return name
+	}
+	return name + " (pool " + pool + ")"
+}
+
+func planNodeContainers(client *cmd.Client, m *clusterManifest, prune bool, plan *clusterPlan) error {
+	if len(m.NodeContainers) == 0 && !prune {
+		return nil
+	}
+	groups, err := listNodeContainers(client)
+	if err != nil {
+		return err
+	}
+	live := map[string]map[string]nodecontainer.NodeContainerConfig{}
+	for _, group := range groups {
+		live[group.Name] = group.ConfigPools
+	}
+	declared := map[string]bool{}
+	for _, spec := range m.NodeContainers {
+		spec := spec
+		key := nodeContainerKey(spec.Name, spec.Pool)
+		declared[key] = true
+		current, ok := live[spec.Name][spec.Pool]
+		if !ok {
+			plan.add(&clusterChange{
+				action:  "create",
+				kind:    "node container",
+				name:    key,
+				details: spec.diff(nil),
+				apply: func(client *cmd.Client) error {
+					return saveNodeContainer(client, "/docker/nodecontainers", spec.config(), spec.Pool)
+				},
+			})
+			continue
+		}
+		details := spec.diff(&current)
+		if len(details) == 0 {
+			continue
+		}
+		// The API merges the new configuration into the stored one, so
+		// removed entries and disabled flags only go away by recreating the
+		// node container.
+		if removed := spec.removedFields(&current); len(removed) > 0 {
+			if spec.Pool == "" {
+				return errors.Errorf("node container %q: removing %s from the default configuration is not supported, remove it with node-container-delete and apply the manifest again", spec.Name, strings.Join(removed, ", "))
+			}
+			details = append(details, "the node container will be recreated")
+			plan.add(&clusterChange{
+				action:  "update",
+				kind:    "node container",
+				name:    key,
+				details: details,
+				apply: func(client *cmd.Client) error {
+					err := removeNodeContainer(client, spec.Name, spec.Pool)
+					if err != nil {
+						return err
+					}
+					return saveNodeContainer(client, "/docker/nodecontainers", spec.config(), spec.Pool)
+				},
+			})
+			continue
+		}
+		plan.add(&clusterChange{
+			action:  "update",
+			kind:    "node container",
+			name:    key,
+			details: details,
+			apply: func(client *cmd.Client) error {
+				return saveNodeContainer(client, "/docker/nodecontainers/"+spec.Name, spec.config(), spec.Pool)
+			},
+		})
+	}
+	if !prune {
+		return nil
+	}
+	for _, group := range groups {
+		pools := make([]string, 0, len(group.ConfigPools))
+		for pool := range group.ConfigPools {
+			pools = append(pools, pool)
+		}
+		sort.Strings(pools)
+		for _, pool := range pools {
+			name, pool := group.Name, pool
+			key := nodeContainerKey(name, pool)
+			if declared[key] {
+				continue
+			}
+			plan.add(&clusterChange{
+				action: "delete",
+				kind:   "node container",
+				name:   key,
+				apply: func(client *cmd.Client) error {
+					return removeNodeContainer(client, name, pool)
+				},
+			})
+		}
+	}
+	return nil
+}
+
+func removeNodeContainer(client *cmd.Client, name, pool string) error {
+	values := url.Values{"pool": []string{pool}}
+	u, err := cmd.GetURL(fmt.Sprintf("/docker/nodecontainers/%s?%s", name, values.Encode()))
+	if err != nil {
+		return err
+	}
+	return doForm(client, "DELETE", u, nil)
+}
+
+func saveNodeContainer(client *cmd.Client, path string, config nodecontainer.NodeContainerConfig, pool string) error {
+	values, err := nodeContainerValues(config, pool)
+	if err != nil {
+		return err
+	}
+	u, err := cmd.GetURL(path)
+	if err != nil {
+		return err
+	}
+	return doForm(client, "POST", u, values)
+}
+
+func (s *nodeContainerSpec) config() nodecontainer.NodeContainerConfig {
+	var config nodecontainer.NodeContainerConfig
+	config.Name = s.Name
+	config.Config.Image = s.Image
+	config.Config.Env = s.Env
+	config.HostConfig.Binds = s.Binds
+	config.HostConfig.Privileged = s.Privileged
+	config.HostConfig.NetworkMode = s.Network
+	config.HostConfig.RestartPolicy.Name = s.Restart
+	config.HostConfig.LogConfig.Type = s.LogDriver
+	config.HostConfig.LogConfig.Config = s.LogOpts
+	return config
+}
+
+// nodeContainerValues encodes the node container the same way
+// node-container-add and node-container-update do.
+func nodeContainerValues(config nodecontainer.NodeContainerConfig, pool string) (url.Values, error) {
+	val, err := form.EncodeToValues(config)
+	if err != nil {
+		return nil, err
+	}
+	for k := range val {
+		lower := strings.ToLower(k)
+		if lower == k {
+			continue
+		}
+		val[lower] = val[k]
+		delete(val, k)
+	}
+	val.Set("name", config.Name)
+	val.Set("pool", pool)
+	return val, nil
+}
+
+// diff describes the fields declared in the spec that differ from current.
+// A nil current means the node container does not exist yet.
+func (s *nodeContainerSpec) diff(current *nodecontainer.NodeContainerConfig) []string {
+	desired := s.config()
+	if current == nil {
+		current = &nodecontainer.NodeContainerConfig{}
+	}
+	var details []string
+	compare := func(field string, old, new interface{}, declared bool) {
+		if declared && !reflect.DeepEqual(old, new) {
+			details = append(details, fmt.Sprintf("%s: %v => %v", field, old, new))
+		}
+	}
+	compare("image", current.Config.Image, desired.Config.Image, s.Image != "")
+	compare("env", sortedCopy(current.Config.Env), sortedCopy(desired.Config.Env), len(s.Env) > 0)
+	compare("binds", sortedCopy(current.HostConfig.Binds), sortedCopy(desired.HostConfig.Binds), len(s.Binds) > 0)
+	compare("privileged", current.HostConfig.Privileged, desired.HostConfig.Privileged, true)
+	compare("network", current.HostConfig.NetworkMode, desired.HostConfig.NetworkMode, s.Network != "")
+	compare("restart", current.HostConfig.RestartPolicy.Name, desired.HostConfig.RestartPolicy.Name, s.Restart != "")
+	compare("log-driver", current.HostConfig.LogConfig.Type, desired.HostConfig.LogConfig.Type, s.LogDriver != "")
+	compare("log-opts", formatParams(current.HostConfig.LogConfig.Config), formatParams(desired.HostConfig.LogConfig.Config), len(s.LogOpts) > 0)
+	return details
+}
+
+// removedFields lists the fields whose change can't be merged into current:
+// env variables, binds and log options left out of the spec, and privileged
+// being disabled.
+func (s *nodeContainerSpec) removedFields(current *nodecontainer.NodeContainerConfig) []string {
+	var removed []string
+	if len(s.Env) > 0 {
+		keys := map[string]bool{}
+		for _, env := range s.Env {
+			keys[strings.SplitN(env, "=", 2)[0]] = true
+		}
+		for _, env := range current.Config.Env {
+			if !keys[strings.SplitN(env, "=", 2)[0]] {
+				removed = append(removed, "env")
+				break
+			}
+		}
+	}
+	if len(s.Binds) > 0 {
+		binds := map[string]bool{}
+		for _, bind := range s.Binds {
+			binds[bind] = true
+		}
+		for _, bind := range current.HostConfig.Binds {
+			if !binds[bind] {
+				removed = append(removed, "binds")
+				break
+			}
+		}
+	}
+	if current.HostConfig.Privileged && !s.Privileged {
+		removed = append(removed, "privileged")
+	}
+	if len(s.LogOpts) > 0 {
+		for opt := range current.HostConfig.LogConfig.Config {
+			if _, ok := s.LogOpts[opt]; !ok {
+				removed = append(removed, "log-opts")
+				break
+			}
+		}
+	}
+	return removed
+}
+
+func sortedCopy(items []string) []string {
+	result := make([]string, len(items))
+	copy(result, items)
+	sort.Strings(result)
+	return result
+}
+
+func planHealing(client *cmd.Client, m *clusterManifest, prune bool, plan *clusterPlan) error {
+	if len(m.Healing) == 0 && !prune {
+		return nil
+	}
+	live, err := getNodeHealingConfig(client)
+	if err != nil {
+		return err
+	}
+	declared := map[string]bool{}
+	for _, spec := range m.Healing {
+		spec := spec
+		declared[spec.Pool] = true
+		current, ok := live[spec.Pool]
+		values := url.Values{}
+		var details []string
+		if spec.Enabled != nil && (!ok || current.EnabledInherited || current.Enabled == nil || *current.Enabled != *spec.Enabled) {
+			details = append(details, fmt.Sprintf("enabled: %s => %t", healingValue(current.Enabled, current.EnabledInherited), *spec.Enabled))
+			values.Set("Enabled", strconv.FormatBool(*spec.Enabled))
+		}
+		if spec.MaxUnresponsive != nil && (!ok || current.MaxUnresponsiveTimeInherited || current.MaxUnresponsiveTime == nil || *current.MaxUnresponsiveTime != *spec.MaxUnresponsive) {
+			details = append(details, fmt.Sprintf("max-unresponsive: %s => %d", healingValue(current.MaxUnresponsiveTime, current.MaxUnresponsiveTimeInherited), *spec.MaxUnresponsive))
+			values.Set("MaxUnresponsiveTime", strconv.Itoa(*spec.MaxUnresponsive))
+		}
+		if spec.MaxUnsuccessful != nil && (!ok || current.MaxTimeSinceSuccessInherited || current.MaxTimeSinceSuccess == nil || *current.MaxTimeSinceSuccess != *spec.MaxUnsuccessful) {
+			details = append(details, fmt.Sprintf("max-unsuccessful: %s => %d", healingValue(current.MaxTimeSinceSuccess, current.MaxTimeSinceSuccessInherited), *spec.MaxUnsuccessful))
+			values.Set("MaxTimeSinceSuccess", strconv.Itoa(*spec.MaxUnsuccessful))
+		}
+		if len(details) == 0 {
+			continue
+		}
+		action := "update"
+		if !ok || !hasOwnHealingConfig(current) {
+			action = "create"
+		}
+		values.Set("pool", spec.Pool)
+		plan.add(&clusterChange{
+			action:  action,
+			kind:    "healing config",
+			name:    spec.Pool,
+			details: details,
+			apply: func(client *cmd.Client) error {
+				u, err := cmd.GetURLVersion("1.3", "/healing/node")
+				if err != nil {
+					return err
+				}
+				return doForm(client, "POST", u, values)
+			},
+		})
+	}
+	if !prune {
+		return nil
+	}
+	pools := make([]string, 0, len(live))
+	for pool, conf := range live {
+		if pool != "" && !declared[pool] && hasOwnHealingConfig(conf) {
+			pools = append(pools, pool)
+		}
+	}
+	sort.Strings(pools)
+	for _, pool := range pools {
+		pool := pool
+		plan.add(&clusterChange{
+			action: "delete",
+			kind:   "healing config",
+			name:   pool,
+			apply: func(client *cmd.Client) error {
+				values := url.Values{"pool": []string{pool}}
+				u, err := cmd.GetURLVersion("1.3", "/healing/node?"+values.Encode())
+				if err != nil {
+					return err
+				}
+				return doForm(client, "DELETE", u, nil)
+			},
+		})
+	}
+	return nil
+}
+
+func hasOwnHealingConfig(conf healer.NodeHealerConfig) bool {
+	return !conf.EnabledInherited || !conf.MaxUnresponsiveTimeInherited || !conf.MaxTimeSinceSuccessInherited
+}
+
+func healingValue(value interface{}, inherited bool) string {
+	if inherited {
+		return "(inherited)"
+	}
+	v := reflect.ValueOf(value)
+	if v.IsNil() {
+		return "(unset)"
+	}
+	return fmt.Sprintf("%v", v.Elem().Interface())
+}
+
+func planAutoScale(client *cmd.Client, m *clusterManifest, prune bool, plan *clusterPlan) error {
+	if len(m.AutoScale) == 0 && !prune {
+		return nil
+	}
+	rules, err := getAutoScaleRules(client)
+	if err != nil {
+		return err
+	}
+	live := map[string]autoScaleRule{}
+	for _, r := range rules {
+		live[r.MetadataFilter] = r
+	}
+	declared := map[string]bool{}
+	for _, spec := range m.AutoScale {
+		desired := autoScaleRule{
+			MetadataFilter:    spec.Pool,
+			MaxContainerCount: spec.MaxContainerCount,
+			MaxMemoryRatio:    spec.MaxMemoryRatio,
+			ScaleDownRatio:    spec.ScaleDownRatio,
+			PreventRebalance:  spec.NoRebalanceOnScale,
+			Enabled:           spec.Enabled,
+		}
+		declared[spec.Pool] = true
+		current, ok := live[spec.Pool]
+		current.Error = ""
+		if ok && current == desired {
+			continue
+		}
+		action := "update"
+		details := autoScaleRuleDetails(current, desired)
+		if !ok {
+			action = "create"
+			details = autoScaleRuleDetails(autoScaleRule{}, desired)
+		}
+		plan.add(&clusterChange{
+			action:  action,
+			kind:    "autoscale rule",
+			name:    spec.Pool,
+			details: details,
+			apply: func(client *cmd.Client) error {
+				values, err := form.EncodeToValues(desired)
+				if err != nil {
+					return err
+				}
+				u, err := cmd.GetURL("/docker/autoscale/rules")
+				if err != nil {
+					return err
+				}
+				return doForm(client, "POST", u, values)
+			},
+		})
+	}
+	if !prune {
+		return nil
+	}
+	for _, r := range rules {
+		pool := r.MetadataFilter
+		if declared[pool] {
+			continue
+		}
+		plan.add(&clusterChange{
+			action: "delete",
+			kind:   "autoscale rule",
+			name:   pool,
+			apply: func(client *cmd.Client) error {
+				u, err := cmd.GetURL("/docker/autoscale/rules/" + pool)
+				if err != nil {
+					return err
+				}
+				return doForm(client, "DELETE", u, nil)
+			},
+		})
+	}
+	return nil
+}
+
+func autoScaleRuleDetails(current, desired autoScaleRule) []string {
+	var details []string
+	add := func(field string, old, new interface{}) {
+		if old != new {
+			details = append(details, fmt.Sprintf("%s: %v => %v", field, old, new))
+		}
+	}
+	add("enabled", current.Enabled, desired.Enabled)
+	add("max-container-count", current.MaxContainerCount, desired.MaxContainerCount)
+	add("max-memory-ratio", current.MaxMemoryRatio, desired.MaxMemoryRatio)
+	add("scale-down-ratio", current.ScaleDownRatio, desired.ScaleDownRatio)
+	add("no-rebalance-on-scale", current.PreventRebalance, desired.PreventRebalance)
+	return details
+}
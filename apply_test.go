@@ -0,0 +1,451 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) writeManifest(c *check.C, data string) string {
+	path := filepath.Join(c.MkDir(), "cluster.yaml")
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	c.Assert(err, check.IsNil)
+	return path
+}
+
+func (s *S) TestApplyRunDryRun(c *check.C) {
+	manifest := s.writeManifest(c, `
+pools:
+- name: p1
+  public: true
+  provisioner: docker
+  teams: [t1, t2]
+- name: p2
+  teams: [t3]
+`)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{
+			Message: `[{"Name": "p1", "Teams": ["t1"], "Provisioner": "docker"}, {"Name": "old"}]`,
+			Status:  http.StatusOK,
+		},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/pools")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest, "--dry-run"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Plan:
+~ pool "p1"
+    public: false => true
+    add teams: t2
++ pool "p2"
+    public: false
+    default: false
+    teams: t3
+
+1 to create, 1 to update, 0 to delete.
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestApplyRunNoChanges(c *check.C) {
+	manifest := s.writeManifest(c, `
+autoscale:
+- pool: p1
+  enabled: true
+  max-container-count: 10
+`)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Status: http.StatusNoContent},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/pools")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"MetadataFilter": "p1", "MaxContainerCount": 10, "Enabled": true, "Error": "some error"}]`,
+					Status:  http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/autoscale/rules")
+				},
+			},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "No changes, the cluster matches the manifest.\n")
+}
+
+func (s *S) TestApplyRunPrune(c *check.C) {
+	manifest := s.writeManifest(c, `
+templates:
+- name: tpl1
+  iaas: ec2
+  params:
+    region: us
+nodecontainers:
+- name: bs
+  image: tsuru/bs:v2
+healing:
+- enabled: true
+`)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Status: http.StatusNoContent},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/pools")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"Name": "tpl1", "IaaSName": "ec2", "Data": [{"Name": "region", "Value": "eu"}, {"Name": "key", "Value": "k1"}]},
+					{"Name": "tpl2", "IaaSName": "ec2"}]`,
+					Status: http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/iaas/templates")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"Name": "bs", "ConfigPools": {"": {"Name": "bs", "Config": {"Image": "tsuru/bs:v1"}}}}]`,
+					Status:  http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `{"": {"Enabled": true, "MaxUnresponsiveTime": 300}, "p1": {"Enabled": false, "EnabledInherited": false, "MaxUnresponsiveTimeInherited": true, "MaxTimeSinceSuccessInherited": true}}`,
+					Status:  http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/1.3/healing/node")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"MetadataFilter": "p1", "Enabled": true}]`,
+					Status:  http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/autoscale/rules")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					req.ParseForm()
+					return req.Method == "PUT" && strings.HasSuffix(req.URL.Path, "/iaas/templates/tpl1") &&
+						req.Form.Get("Data.0.Name") == "key" && req.Form.Get("Data.0.Value") == "" &&
+						req.Form.Get("Data.1.Name") == "region" && req.Form.Get("Data.1.Value") == "us"
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					req.ParseForm()
+					return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers/bs") &&
+						req.Form.Get("name") == "bs" && req.Form.Get("pool") == "" &&
+						req.Form.Get("config.image") == "tsuru/bs:v2"
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/docker/autoscale/rules/p1")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/1.3/healing/node") &&
+						req.URL.Query().Get("pool") == "p1"
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/iaas/templates/tpl2")
+				},
+			},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest, "--prune", "-y"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Plan:
+~ template "tpl1"
+    key: k1 => (removed)
+    region: eu => us
+~ node container "bs"
+    image: tsuru/bs:v1 => tsuru/bs:v2
+- autoscale rule "p1"
+- healing config "p1"
+- template "tpl2"
+
+0 to create, 2 to update, 3 to delete.
+Manifest successfully applied.
+`
+	c.Assert(buf.String(), check.Equals, expected)
+	c.Assert(trans.ConditionalTransports, check.HasLen, 0)
+}
+
+func (s *S) TestApplyRunCreateHealingConfig(c *check.C) {
+	manifest := s.writeManifest(c, `
+healing:
+- pool: p1
+  max-unresponsive: 120
+`)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Status: http.StatusNoContent},
+				CondFunc: func(req *http.Request) bool {
+					return strings.HasSuffix(req.URL.Path, "/pools")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Message: `{"": {"Enabled": true, "MaxUnresponsiveTime": 300}}`, Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/1.3/healing/node")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					req.ParseForm()
+					return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/1.3/healing/node") &&
+						req.Form.Get("pool") == "p1" && req.Form.Get("MaxUnresponsiveTime") == "120" &&
+						req.Form.Get("Enabled") == ""
+				},
+			},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest, "-y"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s)Plan:\n\+ healing config "p1"\n    max-unresponsive: \(unset\) => 120\n.*Manifest successfully applied.\n`)
+	c.Assert(trans.ConditionalTransports, check.HasLen, 0)
+}
+
+func (s *S) TestApplyRunRecreateTemplateOnIaaSChange(c *check.C) {
+	manifest := s.writeManifest(c, `
+templates:
+- name: tpl1
+  iaas: dockermachine
+  params:
+    region: us
+`)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Status: http.StatusNoContent},
+				CondFunc: func(req *http.Request) bool {
+					return strings.HasSuffix(req.URL.Path, "/pools")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"Name": "tpl1", "IaaSName": "ec2", "Data": [{"Name": "region", "Value": "us"}]}]`,
+					Status:  http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/iaas/templates")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/iaas/templates/tpl1")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusCreated},
+				CondFunc: func(req *http.Request) bool {
+					req.ParseForm()
+					return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/iaas/templates") &&
+						req.Form.Get("Name") == "tpl1" && req.Form.Get("IaaSName") == "dockermachine"
+				},
+			},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest, "-y"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s)Plan:
+~ template "tpl1"
+    iaas: ec2 => dockermachine, the template will be recreated
+    region: us
+
+0 to create, 1 to update, 0 to delete.
+Manifest successfully applied.
+`)
+	c.Assert(trans.ConditionalTransports, check.HasLen, 0)
+}
+
+func (s *S) TestApplyRunRecreateNodeContainerOnRemovedEnv(c *check.C) {
+	manifest := s.writeManifest(c, `
+nodecontainers:
+- name: bs
+  pool: p1
+  image: tsuru/bs:v1
+  env: [A=1]
+`)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Status: http.StatusNoContent},
+				CondFunc: func(req *http.Request) bool {
+					return strings.HasSuffix(req.URL.Path, "/pools")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"Name": "bs", "ConfigPools": {"p1": {"Name": "bs", "Config": {"Image": "tsuru/bs:v1", "Env": ["A=1", "B=2"]}}}}]`,
+					Status:  http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers/bs") &&
+						req.URL.Query().Get("pool") == "p1"
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					req.ParseForm()
+					return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers") &&
+						req.Form.Get("name") == "bs" && req.Form.Get("pool") == "p1" &&
+						req.Form.Get("config.env.0") == "A=1" && req.Form.Get("config.env.1") == ""
+				},
+			},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest, "-y"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Plan:
+~ node container "bs (pool p1)"
+    env: [A=1 B=2] => [A=1]
+    the node container will be recreated
+
+0 to create, 1 to update, 0 to delete.
+Manifest successfully applied.
+`
+	c.Assert(buf.String(), check.Equals, expected)
+	c.Assert(trans.ConditionalTransports, check.HasLen, 0)
+}
+
+func (s *S) TestApplyRunRejectsUnprivilegedDefaultNodeContainer(c *check.C) {
+	manifest := s.writeManifest(c, "nodecontainers:\n- name: bs\n  image: tsuru/bs:v1\n")
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Status: http.StatusNoContent},
+				CondFunc: func(req *http.Request) bool {
+					return strings.HasSuffix(req.URL.Path, "/pools")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"Name": "bs", "ConfigPools": {"": {"Name": "bs", "Config": {"Image": "tsuru/bs:v1"}, "HostConfig": {"Privileged": true}}}}]`,
+					Status:  http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers")
+				},
+			},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest, "--dry-run"})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, client)
+	c.Assert(err, check.ErrorMatches, `node container "bs": removing privileged from the default configuration is not supported, remove it with node-container-delete and apply the manifest again`)
+}
+
+func (s *S) TestApplyRunFromStdinRequiresYes(c *check.C) {
+	context := cmd.Context{Stdout: &bytes.Buffer{}, Stdin: strings.NewReader("pools:\n- name: p1\n")}
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", "-"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "the manifest is read from stdin, use -y to apply it without confirmation")
+}
+
+func (s *S) TestApplyRunAborted(c *check.C) {
+	manifest := s.writeManifest(c, "pools:\n- name: p1\n")
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf, Stdin: strings.NewReader("n\n")}
+	trans := &cmdtest.Transport{Status: http.StatusNoContent}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := applyCmd{}
+	command.Flags().Parse(true, []string{"-f", manifest})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*Are you sure you want to apply these changes\? \(y/n\) Abort.\n`)
+}
+
+func (s *S) TestApplyRunRequiresFile(c *check.C) {
+	context := cmd.Context{}
+	command := applyCmd{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "the manifest file is required, use -f/--file")
+}
+
+func (s *S) TestReadManifestValidation(c *check.C) {
+	_, err := readManifest(strings.NewReader("pools:\n- name: p1\n  default: true\n- name: p2\n  default: true\n"))
+	c.Assert(err, check.ErrorMatches, "only one default pool is allowed, got p1, p2")
+	_, err = readManifest(strings.NewReader("templates:\n- name: t1\n  iaas: ec2\n- name: t1\n  iaas: ec2\n"))
+	c.Assert(err, check.ErrorMatches, `duplicated template "t1" in manifest`)
+	_, err = readManifest(strings.NewReader("nodecontainers:\n- name: bs\n- name: bs\n  pool: p1\n"))
+	c.Assert(err, check.IsNil)
+	_, err = readManifest(strings.NewReader("pools: [\n"))
+	c.Assert(err, check.ErrorMatches, "unable to parse manifest: .*")
+}
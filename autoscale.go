@@ -0,0 +1,398 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/docker-cluster/cluster"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// The types below mirror the unexported ones used by the docker provisioner
+// API, so autoscale data can be decoded and rendered with the same field
+// names.
+
+type autoScaleEvent struct {
+	ID            interface{}
+	MetadataValue string
+	Action        string
+	Reason        string
+	StartTime     time.Time
+	EndTime       time.Time
+	Successful    bool
+	Error         string
+	Node          cluster.Node
+	Log           string
+	Nodes         []cluster.Node
+}
+
+type autoScaleRule struct {
+	MetadataFilter    string `bson:"_id"`
+	Error             string `bson:"-"`
+	MaxContainerCount int
+	ScaleDownRatio    float32
+	MaxMemoryRatio    float32
+	Enabled           bool
+	PreventRebalance  bool
+}
+
+type scalerResult struct {
+	ToAdd       int
+	ToRemove    []cluster.Node
+	ToRebalance bool
+	Reason      string
+}
+
+// action returns the action name used in the autoscale history for the
+// result, or an empty string when there's nothing to do.
+func (r *scalerResult) action() string {
+	switch {
+	case r.ToAdd > 0:
+		return "add"
+	case len(r.ToRemove) > 0:
+		return "remove"
+	case r.ToRebalance:
+		return "rebalance"
+	}
+	return ""
+}
+
+const autoScaleEventKind = "autoscale"
+
+// autoScaleEventData is the custom data saved at the end of each autoscale
+// event, evtCustomData in the docker provisioner.
+type autoScaleEventData struct {
+	Result *scalerResult
+	Nodes  []cluster.Node
+	Rule   *autoScaleRule
+}
+
+type autoScaleConfig struct {
+	WaitTimeNewMachine  time.Duration
+	RunInterval         time.Duration
+	TotalMemoryMetadata string
+	Enabled             bool
+}
+
+type listAutoScaleHistoryCmd struct {
+	fs   *gnuflag.FlagSet
+	page int
+}
+
+func (c *listAutoScaleHistoryCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "docker-autoscale-list",
+		Usage: "docker-autoscale-list [--page/-p 1]",
+		Desc:  "List node auto scale history.",
+	}
+}
+
+func (c *listAutoScaleHistoryCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		c.fs.IntVar(&c.page, "page", 1, "Current page")
+		c.fs.IntVar(&c.page, "p", 1, "Current page")
+	}
+	return c.fs
+}
+
+func (c *listAutoScaleHistoryCmd) formatted() {}
+
+func (c *listAutoScaleHistoryCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	if c.page < 1 {
+		c.page = 1
+	}
+	limit := 20
+	skip := (c.page - 1) * limit
+	history, err := listAutoScaleHistory(client, skip, limit)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 && !machineReadable() {
+		ctx.Stdout.Write([]byte("There is no auto scales yet.\n"))
+		return nil
+	}
+	timeFormat := time.Stamp
+	if machineReadable() {
+		timeFormat = time.RFC3339
+	}
+	l := listing{
+		Headers:       cmd.Row{"Start", "Finish", "Success", "Metadata", "Action", "Reason", "Error"},
+		LineSeparator: true,
+		Data:          history,
+	}
+	for _, event := range history {
+		finish := "in progress"
+		if !event.EndTime.IsZero() {
+			finish = event.EndTime.Local().Format(timeFormat)
+		}
+		l.Rows = append(l.Rows, cmd.Row{
+			event.StartTime.Local().Format(timeFormat),
+			finish,
+			fmt.Sprintf("%t", event.Successful),
+			event.MetadataValue,
+			event.Action,
+			event.Reason,
+			event.Error,
+		})
+	}
+	return render(ctx.Stdout, &l)
+}
+
+func listAutoScaleHistory(client *cmd.Client, skip, limit int) ([]autoScaleEvent, error) {
+	u, err := cmd.GetURL(fmt.Sprintf("/docker/autoscale?skip=%d&limit=%d", skip, limit))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	history := []autoScaleEvent{}
+	if resp.StatusCode == http.StatusNoContent {
+		return history, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&history)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// autoScaleInfo is the machine-readable output of docker-autoscale-info.
+type autoScaleInfo struct {
+	Config autoScaleConfig
+	Rules  []autoScaleRule
+}
+
+type autoScaleInfoCmd struct{}
+
+func (c *autoScaleInfoCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "docker-autoscale-info",
+		Usage: "docker-autoscale-info",
+		Desc: `Display the current configuration for tsuru autoscale,
+including the set of rules and the current metadata filter.
+
+The metadata filter is the value that defines which node metadata will be used
+to group autoscale rules. A common approach is to use the "pool" as the
+filter. Then autoscale can be configured for each matching rule value.`,
+	}
+}
+
+func (c *autoScaleInfoCmd) formatted() {}
+
+func (c *autoScaleInfoCmd) Run(context *cmd.Context, client *cmd.Client) error {
+	config, err := getAutoScaleConfig(client)
+	if err != nil {
+		return err
+	}
+	info := autoScaleInfo{Config: *config, Rules: []autoScaleRule{}}
+	if !config.Enabled && !machineReadable() {
+		fmt.Fprintln(context.Stdout, "auto-scale is disabled")
+		return nil
+	}
+	if config.Enabled {
+		info.Rules, err = getAutoScaleRules(client)
+		if err != nil {
+			return err
+		}
+	}
+	l := listing{
+		Headers: autoScaleRuleHeaders,
+		Data:    info,
+	}
+	for _, rule := range info.Rules {
+		l.Rows = append(l.Rows, autoScaleRuleRow(&rule))
+	}
+	if !machineReadable() {
+		fmt.Fprint(context.Stdout, "Rules:\n")
+	}
+	return render(context.Stdout, &l)
+}
+
+var autoScaleRuleHeaders = cmd.Row{
+	"Pool",
+	"Max container count",
+	"Max memory ratio",
+	"Scale down ratio",
+	"Rebalance on scale",
+	"Enabled",
+}
+
+func autoScaleRuleRow(rule *autoScaleRule) cmd.Row {
+	return cmd.Row{
+		rule.MetadataFilter,
+		strconv.Itoa(rule.MaxContainerCount),
+		strconv.FormatFloat(float64(rule.MaxMemoryRatio), 'f', 4, 32),
+		strconv.FormatFloat(float64(rule.ScaleDownRatio), 'f', 4, 32),
+		strconv.FormatBool(!rule.PreventRebalance),
+		strconv.FormatBool(rule.Enabled),
+	}
+}
+
+func getAutoScaleConfig(client *cmd.Client) (*autoScaleConfig, error) {
+	u, err := cmd.GetURL("/docker/autoscale/config")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var config autoScaleConfig
+	err = json.NewDecoder(resp.Body).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func getAutoScaleRules(client *cmd.Client) ([]autoScaleRule, error) {
+	u, err := cmd.GetURL("/docker/autoscale/rules")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var rules []autoScaleRule
+	err = json.NewDecoder(resp.Body).Decode(&rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+type autoScaleEventInfoCmd struct{}
+
+func (c *autoScaleEventInfoCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "autoscale-event-info",
+		Usage: "autoscale-event-info <event-id>",
+		Desc: `Shows the details of a single node auto scale run: the rule used, the
+decision made by the scaler with its reason, the nodes chosen for removal or
+added to the pool and the log of the run.
+
+The IDs of the auto scale events are listed by "event-list --kind
+autoscale".`,
+		MinArgs: 1,
+	}
+}
+
+func (c *autoScaleEventInfoCmd) Run(context *cmd.Context, client *cmd.Client) error {
+	e, err := getEvent(client, context.Args[0])
+	if err != nil {
+		return err
+	}
+	if e.Kind.Name != autoScaleEventKind {
+		return errors.Errorf("event %s is not an auto scale event", context.Args[0])
+	}
+	var data autoScaleEventData
+	if e.EndCustomData.Kind != 0 {
+		err = e.EndCustomData.Unmarshal(&data)
+		if err != nil {
+			return errors.Wrap(err, "unable to decode the auto scale data")
+		}
+	}
+	return renderAutoScaleEvent(context.Stdout, e, &data, time.Now())
+}
+
+func renderAutoScaleEvent(w io.Writer, e *eventDetails, data *autoScaleEventData, now time.Time) error {
+	end := "running"
+	if !e.Running {
+		end = e.EndTime.Local().Format(time.Stamp)
+	}
+	action, reason := "none", ""
+	if data.Result != nil {
+		reason = data.Result.Reason
+		if a := data.Result.action(); a != "" {
+			action = a
+		}
+	}
+	fields := [][2]string{
+		{"ID", e.UniqueID},
+		{"Pool", e.Target.Value},
+		{"Start", e.StartTime.Local().Format(time.Stamp)},
+		{"End", fmt.Sprintf("%s (%s)", end, e.duration(now))},
+		{"Status", colorfyEventStatus(&e.eventEntry)},
+	}
+	if e.Error != "" {
+		fields = append(fields, [2]string{"Error", cmd.Colorfy(e.Error, "red", "", "")})
+	}
+	fields = append(fields, [2]string{"Action", action})
+	if reason != "" {
+		fields = append(fields, [2]string{"Reason", reason})
+	}
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s: %s\n", cmd.Colorfy(f[0], "", "", "bold"), f[1])
+	}
+	if data.Rule != nil {
+		fmt.Fprintf(w, "%s:\n", cmd.Colorfy("Rule", "", "", "bold"))
+		err := render(w, &listing{Headers: autoScaleRuleHeaders, Rows: []cmd.Row{autoScaleRuleRow(data.Rule)}})
+		if err != nil {
+			return err
+		}
+	}
+	tables := []struct {
+		title string
+		nodes []cluster.Node
+	}{
+		{"Nodes chosen for removal", nil},
+		{"Added nodes", nil},
+	}
+	if data.Result != nil {
+		tables[0].nodes = data.Result.ToRemove
+		if data.Result.ToAdd > 0 {
+			tables[1].nodes = data.Nodes
+		}
+	}
+	for _, t := range tables {
+		if len(t.nodes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", cmd.Colorfy(t.title, "", "", "bold"))
+		l := listing{Headers: cmd.Row{"Address", "Metadata"}, LineSeparator: true}
+		for _, node := range t.nodes {
+			l.Rows = append(l.Rows, cmd.Row{node.Address, formatParams(node.CleanMetadata())})
+		}
+		err := render(w, &l)
+		if err != nil {
+			return err
+		}
+	}
+	if e.Log != "" {
+		fmt.Fprintf(w, "%s:\n", cmd.Colorfy("Log", "", "", "bold"))
+		for _, line := range strings.Split(strings.TrimRight(e.Log, "\n"), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+	return nil
+}
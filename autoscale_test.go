@@ -0,0 +1,202 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tsuru/docker-cluster/cluster"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const autoScaleHistoryJSON = `[
+	{"StartTime": "2016-03-02T10:00:00Z", "EndTime": "2016-03-02T10:05:00Z", "Successful": true,
+	 "MetadataValue": "pool1", "Action": "add", "Reason": "too many containers"},
+	{"StartTime": "2016-03-02T11:00:00Z", "Successful": false, "MetadataValue": "pool2",
+	 "Action": "rebalance", "Error": "something went wrong"}
+]`
+
+func (s *S) TestListAutoScaleHistoryCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: autoScaleHistoryJSON, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/autoscale") &&
+				req.URL.Query().Get("skip") == "20" && req.URL.Query().Get("limit") == "20"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listAutoScaleHistoryCmd{}
+	command.Flags().Parse(true, []string{"--page", "2"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	first := time.Date(2016, time.March, 2, 10, 0, 0, 0, time.UTC).Local().Format(time.Stamp)
+	firstEnd := time.Date(2016, time.March, 2, 10, 5, 0, 0, time.UTC).Local().Format(time.Stamp)
+	second := time.Date(2016, time.March, 2, 11, 0, 0, 0, time.UTC).Local().Format(time.Stamp)
+	expected := `+-----------------+-----------------+---------+----------+-----------+---------------------+----------------------+
+| Start           | Finish          | Success | Metadata | Action    | Reason              | Error                |
++-----------------+-----------------+---------+----------+-----------+---------------------+----------------------+
+| ` + first + ` | ` + firstEnd + ` | true    | pool1    | add       | too many containers |                      |
++-----------------+-----------------+---------+----------+-----------+---------------------+----------------------+
+| ` + second + ` | in progress     | false   | pool2    | rebalance |                     | something went wrong |
++-----------------+-----------------+---------+----------+-----------+---------------------+----------------------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestListAutoScaleHistoryCmdRunNoContent(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Status: http.StatusNoContent}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listAutoScaleHistoryCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "There is no auto scales yet.\n")
+	outputFormat = "json"
+	buf.Reset()
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "[]\n")
+}
+
+func (s *S) TestListAutoScaleHistoryCmdRunJSON(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: autoScaleHistoryJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listAutoScaleHistoryCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s)\[\n  \{\n    "ID": null,\n    "MetadataValue": "pool1",\n    "Action": "add",.*"pool2".*`)
+}
+
+func autoScaleInfoTransport(config string) http.RoundTripper {
+	return &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Message: config, Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/autoscale/config")
+				},
+			},
+			{
+				Transport: cmdtest.Transport{
+					Message: `[{"MetadataFilter": "", "MaxContainerCount": 10, "MaxMemoryRatio": 0.9, "ScaleDownRatio": 1.33, "Enabled": true},
+					{"MetadataFilter": "pool1", "MaxContainerCount": 20, "PreventRebalance": true}]`,
+					Status: http.StatusOK,
+				},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/autoscale/rules")
+				},
+			},
+		},
+	}
+}
+
+func (s *S) TestAutoScaleInfoCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: autoScaleInfoTransport(`{"Enabled": true}`)}, nil, s.manager)
+	command := autoScaleInfoCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Rules:
++-------+---------------------+------------------+------------------+--------------------+---------+
+| Pool  | Max container count | Max memory ratio | Scale down ratio | Rebalance on scale | Enabled |
++-------+---------------------+------------------+------------------+--------------------+---------+
+|       | 10                  | 0.9000           | 1.3300           | true               | true    |
+| pool1 | 20                  | 0.0000           | 0.0000           | false              | false   |
++-------+---------------------+------------------+------------------+--------------------+---------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestAutoScaleInfoCmdRunDisabled(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: autoScaleInfoTransport(`{"Enabled": false}`)}, nil, s.manager)
+	command := autoScaleInfoCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "auto-scale is disabled\n")
+}
+
+func (s *S) TestAutoScaleInfoCmdRunYAML(c *check.C) {
+	outputFormat = "yaml"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: autoScaleInfoTransport(`{"Enabled": true, "RunInterval": 3600000000000}`)}, nil, s.manager)
+	command := autoScaleInfoCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s)Config:\n  Enabled: true\n  RunInterval: 3\.6e\+12\n.*Rules:\n- Enabled: true\n.*  MetadataFilter: ""\n.*- Enabled: false\n.*  MetadataFilter: pool1\n.*`)
+}
+
+func (s *S) TestAutoScaleEventInfoCmdRun(c *check.C) {
+	defer disableColors()()
+	data, err := bson.Marshal(autoScaleEventData{
+		Result: &scalerResult{
+			ToRemove: []cluster.Node{{Address: "http://n2:2375", Metadata: map[string]string{"pool": "pool1", "LastSuccess": "x"}}},
+			Reason:   "number of free slots is 30",
+		},
+		Nodes: []cluster.Node{{Address: "http://n1:2375"}, {Address: "http://n2:2375"}},
+		Rule:  &autoScaleRule{MetadataFilter: "pool1", MaxContainerCount: 10, ScaleDownRatio: 1.33, Enabled: true},
+	})
+	c.Assert(err, check.IsNil)
+	raw := base64.StdEncoding.EncodeToString(data)
+	e := `{"UniqueID": "5728bc4f1c1d2b2bc2a3e4a1", "StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:00:05Z",
+	"Target": {"Type": "pool", "Value": "pool1"}, "Kind": {"Type": "internal", "Name": "autoscale"},
+	"EndCustomData": {"Kind": 3, "Data": "` + raw + `"}, "Log": "removing node\ndone\n"}`
+	client := cmd.NewClient(&http.Client{Transport: &cmdtest.Transport{Message: e, Status: http.StatusOK}}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Args: []string{"5728bc4f1c1d2b2bc2a3e4a1"}}
+	command := autoScaleEventInfoCmd{}
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC).Local()
+	expected := `ID: 5728bc4f1c1d2b2bc2a3e4a1
+Pool: pool1
+Start: ` + start.Format(time.Stamp) + `
+End: ` + start.Add(5*time.Second).Format(time.Stamp) + ` (5s)
+Status: success
+Action: remove
+Reason: number of free slots is 30
+Rule:
++-------+---------------------+------------------+------------------+--------------------+---------+
+| Pool  | Max container count | Max memory ratio | Scale down ratio | Rebalance on scale | Enabled |
++-------+---------------------+------------------+------------------+--------------------+---------+
+| pool1 | 10                  | 0.0000           | 1.3300           | true               | true    |
++-------+---------------------+------------------+------------------+--------------------+---------+
+Nodes chosen for removal:
++----------------+------------+
+| Address        | Metadata   |
++----------------+------------+
+| http://n2:2375 | pool=pool1 |
++----------------+------------+
+Log:
+    removing node
+    done
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestAutoScaleEventInfoCmdRunNotAutoScale(c *check.C) {
+	e := `{"UniqueID": "5728bc4f1c1d2b2bc2a3e4a1", "Kind": {"Type": "permission", "Name": "node.update"}}`
+	client := cmd.NewClient(&http.Client{Transport: &cmdtest.Transport{Message: e, Status: http.StatusOK}}, nil, s.manager)
+	context := cmd.Context{Stdout: &bytes.Buffer{}, Args: []string{"5728bc4f1c1d2b2bc2a3e4a1"}}
+	command := autoScaleEventInfoCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "event 5728bc4f1c1d2b2bc2a3e4a1 is not an auto scale event")
+}
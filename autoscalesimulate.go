@@ -0,0 +1,480 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/docker-cluster/cluster"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/provision"
+)
+
+// unitRunning reports whether the container is counted by the auto scale,
+// which ignores containers that are created, building or stopped.
+func unitRunning(unit nodeUnit) bool {
+	switch unit.Status {
+	case "created", "building", "stopped":
+		return false
+	}
+	return true
+}
+
+// autoScaleSimulation is the outcome of running the auto scale for a pool
+// without acting on it. Message explains why no scaler ran.
+type autoScaleSimulation struct {
+	Pool    string
+	Rule    *autoScaleRule `json:",omitempty"`
+	Scaler  string         `json:",omitempty"`
+	Nodes   []string
+	Result  *scalerResult `json:",omitempty"`
+	Message string        `json:",omitempty"`
+	Error   string        `json:",omitempty"`
+}
+
+// autoScaleSimulator runs the logic of the auto scalers from the docker
+// provisioner against the current nodes and containers.
+type autoScaleSimulator struct {
+	config  *autoScaleConfig
+	rules   []autoScaleRule
+	plans   []plan
+	planner *rebalancePlanner
+}
+
+func newAutoScaleSimulator(client *cmd.Client) (*autoScaleSimulator, error) {
+	config, err := getAutoScaleConfig(client)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := getAutoScaleRules(client)
+	if err != nil {
+		return nil, err
+	}
+	plans, err := listPlans(client)
+	if err != nil {
+		return nil, err
+	}
+	planner, err := newRebalancePlanner(client)
+	if err != nil {
+		return nil, err
+	}
+	return &autoScaleSimulator{config: config, rules: rules, plans: plans, planner: planner}, nil
+}
+
+// pools returns the enabled nodes of each pool, as the auto scale runs once
+// for each pool with the nodes that have the pool metadata.
+func (s *autoScaleSimulator) pools() map[string][]provision.NodeSpec {
+	pools := map[string][]provision.NodeSpec{}
+	for _, node := range s.planner.nodes {
+		pool := node.Metadata["pool"]
+		if pool == "" || !schedulableStatuses[node.Status] {
+			continue
+		}
+		pools[pool] = append(pools[pool], node)
+	}
+	return pools
+}
+
+// ruleFor returns the rule for the pool, falling back to the rule without a
+// metadata filter.
+func (s *autoScaleSimulator) ruleFor(pool string) *autoScaleRule {
+	var fallback *autoScaleRule
+	for i := range s.rules {
+		switch s.rules[i].MetadataFilter {
+		case pool:
+			return &s.rules[i]
+		case "":
+			fallback = &s.rules[i]
+		}
+	}
+	return fallback
+}
+
+func (s *autoScaleSimulator) simulate(pool string, nodes []provision.NodeSpec) autoScaleSimulation {
+	sim := autoScaleSimulation{Pool: pool}
+	for _, node := range nodes {
+		sim.Nodes = append(sim.Nodes, node.Address)
+	}
+	sim.Rule = s.ruleFor(pool)
+	if sim.Rule == nil {
+		sim.Message = fmt.Sprintf("no auto scale rule for %s", pool)
+		return sim
+	}
+	if !sim.Rule.Enabled {
+		sim.Message = fmt.Sprintf("auto scale rule disabled for %s", pool)
+		return sim
+	}
+	var err error
+	if sim.Rule.MaxContainerCount > 0 {
+		sim.Scaler = "count"
+		sim.Result, err = s.countScale(sim.Rule, nodes)
+	} else {
+		sim.Scaler = "memory"
+		sim.Result, err = s.memoryScale(sim.Rule, nodes)
+	}
+	if err != nil {
+		sim.Result = nil
+		sim.Error = err.Error()
+		return sim
+	}
+	if !sim.Rule.PreventRebalance {
+		s.checkRebalance(pool, nodes, sim.Result)
+	}
+	return sim
+}
+
+func (s *autoScaleSimulator) countScale(rule *autoScaleRule, nodes []provision.NodeSpec) (*scalerResult, error) {
+	totalCount, _ := s.containerGap(nodes, nil)
+	freeSlots := (len(nodes) * rule.MaxContainerCount) - totalCount
+	reason := fmt.Sprintf("number of free slots is %d", freeSlots)
+	scaledMaxCount := int(float32(rule.MaxContainerCount) * rule.ScaleDownRatio)
+	if scaledMaxCount <= 0 {
+		return nil, errors.Errorf("invalid rule, scale down ratio needs to be greater than 1.0, got %f", rule.ScaleDownRatio)
+	}
+	if freeSlots > scaledMaxCount {
+		chosen := chooseNodesForRemoval(nodes, freeSlots/scaledMaxCount)
+		if len(chosen) == 0 {
+			return &scalerResult{}, nil
+		}
+		return &scalerResult{ToRemove: clusterNodes(chosen), Reason: reason}, nil
+	}
+	if freeSlots >= 0 {
+		return &scalerResult{}, nil
+	}
+	nodesToAdd := -freeSlots / rule.MaxContainerCount
+	if freeSlots%rule.MaxContainerCount != 0 {
+		nodesToAdd++
+	}
+	return &scalerResult{ToAdd: nodesToAdd, Reason: reason}, nil
+}
+
+type nodeMemoryData struct {
+	maxMemory int64
+	reserved  int64
+}
+
+func (s *autoScaleSimulator) nodesMemoryData(rule *autoScaleRule, nodes []provision.NodeSpec) (map[string]nodeMemoryData, error) {
+	result := make(map[string]nodeMemoryData, len(nodes))
+	for _, node := range nodes {
+		totalMemory, _ := strconv.ParseFloat(node.Metadata[s.config.TotalMemoryMetadata], 64)
+		if totalMemory == 0.0 {
+			return nil, errors.Errorf("no value found for memory metadata (%s) in node %s", s.config.TotalMemoryMetadata, node.Address)
+		}
+		data := nodeMemoryData{maxMemory: int64(float64(rule.MaxMemoryRatio) * totalMemory)}
+		for _, unit := range s.planner.units[node.Address] {
+			if unitRunning(unit) {
+				data.reserved += s.planner.apps[unit.AppName].Plan.Memory
+			}
+		}
+		result[node.Address] = data
+	}
+	return result, nil
+}
+
+func (s *autoScaleSimulator) maxPlanMemory() (int64, error) {
+	var maxPlanMemory int64
+	for _, p := range s.plans {
+		if p.Memory > maxPlanMemory {
+			maxPlanMemory = p.Memory
+		}
+	}
+	if maxPlanMemory != 0 {
+		return maxPlanMemory, nil
+	}
+	for _, p := range s.plans {
+		if p.Default {
+			return p.Memory, nil
+		}
+	}
+	return 0, errors.New("couldn't get default plan")
+}
+
+func (s *autoScaleSimulator) memoryScale(rule *autoScaleRule, nodes []provision.NodeSpec) (*scalerResult, error) {
+	maxPlanMemory, err := s.maxPlanMemory()
+	if err != nil {
+		return nil, err
+	}
+	memoryData, err := s.nodesMemoryData(rule, nodes)
+	if err != nil {
+		return nil, err
+	}
+	var totalReserved, totalMem int64
+	for _, node := range nodes {
+		totalReserved += memoryData[node.Address].reserved
+		totalMem += memoryData[node.Address].maxMemory
+	}
+	memPerNode := totalMem / int64(len(nodes))
+	if memPerNode == 0 {
+		return nil, errors.Errorf("invalid rule, max memory ratio needs to be greater than 0, got %f", rule.MaxMemoryRatio)
+	}
+	scaledMaxPlan := int64(float32(maxPlanMemory) * rule.ScaleDownRatio)
+	toRemoveCount := len(nodes) - int(((totalReserved+scaledMaxPlan)/memPerNode)+1)
+	if toRemoveCount > 0 {
+		chosen := chooseNodesForRemoval(nodes, toRemoveCount)
+		if len(chosen) > 0 {
+			return &scalerResult{
+				ToRemove: clusterNodes(chosen),
+				Reason:   fmt.Sprintf("containers can be distributed in only %d nodes", len(nodes)-len(chosen)),
+			}, nil
+		}
+	}
+	totalReserved, totalMem = 0, 0
+	for _, node := range nodes {
+		data := memoryData[node.Address]
+		if maxPlanMemory > data.maxMemory {
+			return nil, errors.Errorf("aborting, impossible to fit max plan memory of %d bytes, node max available memory is %d", maxPlanMemory, data.maxMemory)
+		}
+		totalReserved += data.reserved
+		totalMem += data.maxMemory
+		if data.maxMemory-data.reserved >= maxPlanMemory {
+			return &scalerResult{}, nil
+		}
+	}
+	nodesToAdd := int((totalReserved + maxPlanMemory) / totalMem)
+	if nodesToAdd == 0 {
+		return &scalerResult{}, nil
+	}
+	return &scalerResult{
+		ToAdd:  nodesToAdd,
+		Reason: fmt.Sprintf("can't add %d bytes to an existing node", maxPlanMemory),
+	}, nil
+}
+
+// containerGap returns the number of running containers in the nodes and the
+// difference between the node with most and the node with least containers,
+// after the given moves.
+func (s *autoScaleSimulator) containerGap(nodes []provision.NodeSpec, moves []rebalanceMove) (int, int) {
+	moved := make(map[string]string, len(moves))
+	for _, move := range moves {
+		if move.To != "" {
+			moved[move.Container] = move.To
+		}
+	}
+	counts := map[string]int{}
+	for _, node := range s.planner.nodes {
+		for _, unit := range s.planner.units[node.Address] {
+			if !unitRunning(unit) {
+				continue
+			}
+			addr := node.Address
+			if to, ok := moved[unit.ID]; ok {
+				addr = to
+			}
+			counts[addr]++
+		}
+	}
+	total, maxCount, minCount := 0, 0, -1
+	for _, node := range nodes {
+		count := counts[node.Address]
+		if count > maxCount {
+			maxCount = count
+		}
+		if minCount == -1 || count < minCount {
+			minCount = count
+		}
+		total += count
+	}
+	return total, maxCount - minCount
+}
+
+// checkRebalance marks the result for rebalance when nodes are added or when
+// a rebalance of the pool would change the gap between nodes by more than 2
+// containers.
+func (s *autoScaleSimulator) checkRebalance(pool string, nodes []provision.NodeSpec, result *scalerResult) {
+	if len(result.ToRemove) > 0 {
+		return
+	}
+	if result.ToAdd > 0 {
+		result.ToRebalance = true
+		return
+	}
+	moves := s.planner.plan(nil, map[string]string{"pool": pool})
+	if len(moves) == 0 {
+		return
+	}
+	_, gap := s.containerGap(nodes, nil)
+	_, gapAfter := s.containerGap(nodes, moves)
+	if math.Abs(float64(gap-gapAfter)) > 2.0 {
+		result.ToRebalance = true
+		if result.Reason == "" {
+			result.Reason = fmt.Sprintf("gap is %d, after rebalance gap will be %d", gap, gapAfter)
+		}
+	}
+}
+
+// chooseNodesForRemoval returns up to toRemoveCount nodes that can be removed
+// without leaving a metadata group empty, like chooseNodeForRemoval in the
+// docker provisioner.
+func chooseNodesForRemoval(nodes []provision.NodeSpec, toRemoveCount int) []provision.NodeSpec {
+	nodes = append([]provision.NodeSpec(nil), nodes...)
+	var chosen []provision.NodeSpec
+	remaining := nodes[:]
+	for _, node := range nodes {
+		if !canRemoveNode(node, remaining) {
+			continue
+		}
+		for i := range remaining {
+			if remaining[i].Address == node.Address {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+		chosen = append(chosen, node)
+		if len(chosen) >= toRemoveCount {
+			break
+		}
+	}
+	return chosen
+}
+
+func canRemoveNode(chosen provision.NodeSpec, nodes []provision.NodeSpec) bool {
+	if len(nodes) == 1 {
+		return false
+	}
+	groups, err := splitNodeMetadata(nodes)
+	if err != nil {
+		return false
+	}
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if matchesMetadata(chosen, group.metadata) {
+			return len(group.nodes) > 1
+		}
+	}
+	return false
+}
+
+func clusterNodes(nodes []provision.NodeSpec) []cluster.Node {
+	result := make([]cluster.Node, len(nodes))
+	for i, node := range nodes {
+		result[i] = cluster.Node{Address: node.Address, Metadata: node.Metadata}
+	}
+	return result
+}
+
+type autoScaleSimulateCmd struct {
+	fs   *gnuflag.FlagSet
+	rule string
+}
+
+func (c *autoScaleSimulateCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "autoscale-simulate",
+		Usage: "autoscale-simulate [--rule/-r <metadata-filter>]",
+		Desc: `Runs the node auto scale logic against the current nodes and containers,
+without acting on its decisions. For each pool it displays the rule and the
+scaler used, and whether the auto scale would add nodes, remove nodes (and
+which ones) or rebalance containers, along with the reason.
+
+The [[--rule]] flag limits the simulation to the pool matching the metadata
+filter of a rule.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *autoScaleSimulateCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		rule := "Simulate only the pool matching this metadata filter"
+		c.fs.StringVar(&c.rule, "rule", "", rule)
+		c.fs.StringVar(&c.rule, "r", "", rule)
+	}
+	return c.fs
+}
+
+func (c *autoScaleSimulateCmd) formatted() {}
+
+func (c *autoScaleSimulateCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	simulator, err := newAutoScaleSimulator(client)
+	if err != nil {
+		return err
+	}
+	pools := simulator.pools()
+	var names []string
+	if c.rule != "" {
+		if _, ok := pools[c.rule]; !ok {
+			return errors.Errorf("no enabled nodes found in pool %q", c.rule)
+		}
+		names = []string{c.rule}
+	} else {
+		for name := range pools {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	simulations := make([]autoScaleSimulation, len(names))
+	for i, name := range names {
+		simulations[i] = simulator.simulate(name, pools[name])
+	}
+	if !simulator.config.Enabled && !machineReadable() {
+		fmt.Fprintln(ctx.Stdout, "auto-scale is disabled, showing what it would do if it was enabled.")
+	}
+	l := listing{
+		Headers:       cmd.Row{"Pool", "Rule", "Scaler", "Nodes", "Action", "Reason"},
+		LineSeparator: true,
+		Data:          simulations,
+	}
+	for _, sim := range simulations {
+		var rule string
+		if sim.Rule != nil {
+			rule = sim.Rule.MetadataFilter
+			if rule == "" {
+				rule = "(default)"
+			}
+		}
+		action, reason := formatSimulationResult(&sim)
+		l.Rows = append(l.Rows, cmd.Row{sim.Pool, rule, sim.Scaler, strconv.Itoa(len(sim.Nodes)), action, reason})
+	}
+	return render(ctx.Stdout, &l)
+}
+
+// formatSimulationResult returns the action and reason cells of a
+// simulation. Machine-readable output gets the actions in a single line,
+// separated by ";", and no colors.
+func formatSimulationResult(sim *autoScaleSimulation) (string, string) {
+	plain := machineReadable()
+	switch {
+	case sim.Error != "" && plain:
+		return "error", sim.Error
+	case sim.Error != "":
+		return "error", cmd.Colorfy(sim.Error, "red", "", "")
+	case sim.Result == nil:
+		return "none", sim.Message
+	}
+	var actions []string
+	if sim.Result.ToAdd > 0 {
+		actions = append(actions, fmt.Sprintf("add %d nodes", sim.Result.ToAdd))
+	}
+	if len(sim.Result.ToRemove) > 0 {
+		if !plain {
+			actions = append(actions, "remove:")
+		}
+		for _, node := range sim.Result.ToRemove {
+			if plain {
+				actions = append(actions, "remove "+node.Address)
+			} else {
+				actions = append(actions, node.Address)
+			}
+		}
+	}
+	if sim.Result.ToRebalance {
+		actions = append(actions, "rebalance")
+	}
+	if len(actions) == 0 {
+		return "none", sim.Result.Reason
+	}
+	if plain {
+		return strings.Join(actions, ";"), sim.Result.Reason
+	}
+	return strings.Join(actions, "\n"), sim.Result.Reason
+}
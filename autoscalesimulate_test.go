@@ -0,0 +1,236 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/tsuru/docker-cluster/cluster"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"github.com/tsuru/tsuru/provision"
+	"gopkg.in/check.v1"
+)
+
+func newTestSimulator(nodes []provision.NodeSpec, units map[string][]nodeUnit, rules ...autoScaleRule) *autoScaleSimulator {
+	return &autoScaleSimulator{
+		config: &autoScaleConfig{TotalMemoryMetadata: "memory", Enabled: true},
+		rules:  rules,
+		plans:  []plan{{Name: "small", Memory: 512, Default: true}, {Name: "large", Memory: 1024}},
+		planner: &rebalancePlanner{
+			nodes: nodes,
+			units: units,
+			apps: map[string]*appInfo{
+				"myapp": {Name: "myapp", Pool: "p1", Plan: plan{Name: "small", Memory: 512}},
+			},
+		},
+	}
+}
+
+func testUnits(count int, status string) []nodeUnit {
+	units := make([]nodeUnit, count)
+	for i := range units {
+		units[i] = nodeUnit{ID: fmt.Sprintf("%s-%d", status, i), AppName: "myapp", ProcessName: "web", Status: status}
+	}
+	return units
+}
+
+func testPoolNodes(addrs ...string) []provision.NodeSpec {
+	nodes := make([]provision.NodeSpec, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = provision.NodeSpec{Address: addr, Status: "ready", Metadata: map[string]string{"pool": "p1", "memory": "4096"}}
+	}
+	return nodes
+}
+
+func (s *S) TestAutoScaleSimulatorCountScaleAdd(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375", "http://n2:2375")
+	units := map[string][]nodeUnit{
+		"http://n1:2375": append(testUnits(4, "started"), testUnits(2, "stopped")...),
+		"http://n2:2375": testUnits(3, "started"),
+	}
+	sim := newTestSimulator(nodes, units)
+	result, err := sim.countScale(&autoScaleRule{MaxContainerCount: 3, ScaleDownRatio: 1.333, Enabled: true}, nodes)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, &scalerResult{ToAdd: 1, Reason: "number of free slots is -1"})
+}
+
+func (s *S) TestAutoScaleSimulatorCountScaleRemove(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375", "http://n2:2375", "http://n3:2375")
+	units := map[string][]nodeUnit{"http://n1:2375": testUnits(1, "started")}
+	sim := newTestSimulator(nodes, units)
+	result, err := sim.countScale(&autoScaleRule{MaxContainerCount: 4, ScaleDownRatio: 1.333, Enabled: true}, nodes)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Reason, check.Equals, "number of free slots is 11")
+	c.Assert(result.ToRemove, check.HasLen, 2)
+	c.Assert(result.ToRemove[0].Address, check.Equals, "http://n1:2375")
+	c.Assert(result.ToRemove[1].Address, check.Equals, "http://n3:2375")
+	c.Assert(nodes[1].Address, check.Equals, "http://n2:2375")
+}
+
+func (s *S) TestAutoScaleSimulatorCountScaleNothingToDo(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375", "http://n2:2375")
+	units := map[string][]nodeUnit{"http://n1:2375": testUnits(3, "started")}
+	sim := newTestSimulator(nodes, units)
+	result, err := sim.countScale(&autoScaleRule{MaxContainerCount: 3, ScaleDownRatio: 1.333, Enabled: true}, nodes)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, &scalerResult{})
+}
+
+func (s *S) TestAutoScaleSimulatorMemoryScaleAdd(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375")
+	units := map[string][]nodeUnit{"http://n1:2375": testUnits(6, "started")}
+	sim := newTestSimulator(nodes, units)
+	result, err := sim.memoryScale(&autoScaleRule{MaxMemoryRatio: 0.8, ScaleDownRatio: 1.333, Enabled: true}, nodes)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, &scalerResult{ToAdd: 1, Reason: "can't add 1024 bytes to an existing node"})
+}
+
+func (s *S) TestAutoScaleSimulatorMemoryScaleRemove(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375", "http://n2:2375", "http://n3:2375")
+	units := map[string][]nodeUnit{"http://n1:2375": testUnits(2, "started")}
+	sim := newTestSimulator(nodes, units)
+	result, err := sim.memoryScale(&autoScaleRule{MaxMemoryRatio: 0.8, ScaleDownRatio: 1.333, Enabled: true}, nodes)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Reason, check.Equals, "containers can be distributed in only 1 nodes")
+	c.Assert(result.ToRemove, check.HasLen, 2)
+}
+
+func (s *S) TestAutoScaleSimulatorMemoryScaleErrors(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375")
+	sim := newTestSimulator(nodes, map[string][]nodeUnit{})
+	_, err := sim.memoryScale(&autoScaleRule{MaxMemoryRatio: 0.2, ScaleDownRatio: 1.333, Enabled: true}, nodes)
+	c.Assert(err, check.ErrorMatches, "aborting, impossible to fit max plan memory of 1024 bytes, node max available memory is 819")
+	delete(nodes[0].Metadata, "memory")
+	_, err = sim.memoryScale(&autoScaleRule{MaxMemoryRatio: 0.8, ScaleDownRatio: 1.333, Enabled: true}, nodes)
+	c.Assert(err, check.ErrorMatches, `no value found for memory metadata \(memory\) in node http://n1:2375`)
+}
+
+func (s *S) TestAutoScaleSimulatorSimulateRebalance(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375", "http://n2:2375")
+	units := map[string][]nodeUnit{"http://n1:2375": testUnits(6, "started")}
+	sim := newTestSimulator(nodes, units, autoScaleRule{MaxContainerCount: 10, ScaleDownRatio: 5, Enabled: true})
+	result := sim.simulate("p1", nodes)
+	c.Assert(result.Error, check.Equals, "")
+	c.Assert(result.Scaler, check.Equals, "count")
+	c.Assert(result.Rule.MetadataFilter, check.Equals, "")
+	c.Assert(result.Result, check.DeepEquals, &scalerResult{ToRebalance: true, Reason: "gap is 6, after rebalance gap will be 0"})
+	sim.rules[0].PreventRebalance = true
+	result = sim.simulate("p1", nodes)
+	c.Assert(result.Result, check.DeepEquals, &scalerResult{})
+}
+
+func (s *S) TestAutoScaleSimulatorSimulateNoRule(c *check.C) {
+	nodes := testPoolNodes("http://n1:2375")
+	sim := newTestSimulator(nodes, nil, autoScaleRule{MetadataFilter: "p2", Enabled: true})
+	result := sim.simulate("p1", nodes)
+	c.Assert(result.Message, check.Equals, "no auto scale rule for p1")
+	sim.rules = append(sim.rules, autoScaleRule{MetadataFilter: "p1"})
+	result = sim.simulate("p1", nodes)
+	c.Assert(result.Message, check.Equals, "auto scale rule disabled for p1")
+	c.Assert(result.Result, check.IsNil)
+}
+
+func (s *S) TestCanRemoveNode(c *check.C) {
+	nodes := []provision.NodeSpec{
+		{Address: "http://n1:2375", Metadata: map[string]string{"pool": "p1", "zone": "a"}},
+		{Address: "http://n2:2375", Metadata: map[string]string{"pool": "p1", "zone": "a"}},
+		{Address: "http://n3:2375", Metadata: map[string]string{"pool": "p1", "zone": "b"}},
+	}
+	c.Assert(canRemoveNode(nodes[0], nodes), check.Equals, true)
+	c.Assert(canRemoveNode(nodes[2], nodes), check.Equals, false)
+	c.Assert(canRemoveNode(nodes[0], nodes[:1]), check.Equals, false)
+	chosen := chooseNodesForRemoval(nodes, 3)
+	c.Assert(chosen, check.HasLen, 1)
+	c.Assert(chosen[0].Address, check.Equals, "http://n1:2375")
+}
+
+func (s *S) TestAutoScaleSimulateCmdRun(c *check.C) {
+	defer disableColors()()
+	nodes := `{"nodes": [
+	{"Address": "http://n1:2375", "Status": "ready", "Metadata": {"pool": "p1"}},
+	{"Address": "http://n2:2375", "Status": "ready", "Metadata": {"pool": "p1"}},
+	{"Address": "http://n3:2375", "Status": "disabled", "Metadata": {"pool": "p1"}},
+	{"Address": "http://n4:2375", "Status": "ready", "Metadata": {"pool": "p2"}}
+]}`
+	units := `[{"ID": "c1", "AppName": "myapp", "ProcessName": "web", "Status": "started"},
+	{"ID": "c2", "AppName": "myapp", "ProcessName": "web", "Status": "started"},
+	{"ID": "c3", "AppName": "myapp", "ProcessName": "web", "Status": "started"}]`
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/docker/autoscale/config", `{"TotalMemoryMetadata": "memory", "Enabled": false}`),
+			getTransport("/docker/autoscale/rules", `[{"MetadataFilter": "p1", "MaxContainerCount": 1, "ScaleDownRatio": 1.333, "Enabled": true}]`),
+			getTransport("/plans", `[{"name": "small", "memory": 512, "default": true}]`),
+			getTransport("/node", nodes),
+			getTransport("/node/http://n1:2375/containers", units),
+			getTransport("/apps/myapp", `{"name": "myapp", "pool": "p1", "plan": {"name": "small", "memory": 512}}`),
+			getTransport("/node/http://n2:2375/containers", ""),
+			getTransport("/node/http://n3:2375/containers", ""),
+			getTransport("/node/http://n4:2375/containers", ""),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := autoScaleSimulateCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `auto-scale is disabled, showing what it would do if it was enabled.
++------+------+--------+-------+-------------+----------------------------+
+| Pool | Rule | Scaler | Nodes | Action      | Reason                     |
++------+------+--------+-------+-------------+----------------------------+
+| p1   | p1   | count  | 2     | add 1 nodes | number of free slots is -1 |
+|      |      |        |       | rebalance   |                            |
++------+------+--------+-------+-------------+----------------------------+
+| p2   |      |        | 1     | none        | no auto scale rule for p2  |
++------+------+--------+-------+-------------+----------------------------+
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestAutoScaleSimulateCmdRunUnknownPool(c *check.C) {
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/docker/autoscale/config", `{"Enabled": true}`),
+			getTransport("/docker/autoscale/rules", `[]`),
+			getTransport("/plans", `[]`),
+			getTransport("/node", `{"nodes": []}`),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := autoScaleSimulateCmd{}
+	command.Flags().Parse(true, []string{"--rule", "p9"})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, client)
+	c.Assert(err, check.ErrorMatches, `no enabled nodes found in pool "p9"`)
+}
+
+func (s *S) TestFormatSimulationResultRemove(c *check.C) {
+	sim := autoScaleSimulation{Result: &scalerResult{
+		ToRemove: []cluster.Node{{Address: "http://n1:2375"}, {Address: "http://n2:2375"}},
+		Reason:   "number of free slots is 12",
+	}}
+	action, reason := formatSimulationResult(&sim)
+	c.Assert(action, check.Equals, "remove:\nhttp://n1:2375\nhttp://n2:2375")
+	c.Assert(reason, check.Equals, "number of free slots is 12")
+}
+
+func (s *S) TestFormatSimulationResultMachineReadable(c *check.C) {
+	os.Unsetenv("TSURU_DISABLE_COLORS")
+	outputFormat = "csv"
+	sim := autoScaleSimulation{Result: &scalerResult{
+		ToAdd:       1,
+		ToRemove:    []cluster.Node{{Address: "http://n1:2375"}, {Address: "http://n2:2375"}},
+		ToRebalance: true,
+	}}
+	action, _ := formatSimulationResult(&sim)
+	c.Assert(action, check.Equals, "add 1 nodes;remove http://n1:2375;remove http://n2:2375;rebalance")
+	sim = autoScaleSimulation{Error: "no value found for memory metadata"}
+	action, reason := formatSimulationResult(&sim)
+	c.Assert(action, check.Equals, "error")
+	c.Assert(reason, check.Equals, "no value found for memory metadata")
+}
@@ -0,0 +1,650 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ajg/form"
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru-client/tsuru/admin"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/healer"
+	"github.com/tsuru/tsuru/iaas"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/nodecontainer"
+)
+
+// clusterArchiveVersion is the version of the archive layout written by
+// cluster-export. cluster-import refuses archives with a newer version.
+const clusterArchiveVersion = 1
+
+type clusterArchiveMetadata struct {
+	Version int       `json:"version"`
+	Target  string    `json:"target"`
+	Created time.Time `json:"created"`
+}
+
+type plan struct {
+	Name     string `json:"name"`
+	Memory   int64  `json:"memory"`
+	Swap     int64  `json:"swap"`
+	CpuShare int    `json:"cpushare"`
+	Default  bool   `json:"default,omitempty"`
+	Router   string `json:"router,omitempty"`
+}
+
+type role struct {
+	Name        string `json:"name"`
+	ContextType string `json:"context"`
+	Description string
+	SchemeNames []string `json:"scheme_names,omitempty"`
+	Events      []string `json:"events,omitempty"`
+}
+
+// archivedPlatform is a platform as stored in the archive. The API does not
+// expose the Dockerfile used to build a platform, so it is left empty on
+// export, meaning the tsuru/<name> image. It may be edited in the archive
+// before importing it.
+type archivedPlatform struct {
+	platform
+	Dockerfile string `json:",omitempty"`
+}
+
+// clusterArchive is the content of the archive written by cluster-export: a
+// gzipped tarball with one JSON file per kind of object, in the same format
+// used by the tsuru API.
+type clusterArchive struct {
+	Metadata       clusterArchiveMetadata
+	Pools          []provision.Pool
+	Plans          []plan
+	Platforms      []archivedPlatform
+	Templates      []iaas.Template
+	NodeContainers []nodecontainer.NodeContainerConfigGroup
+	Healing        map[string]healer.NodeHealerConfig
+	AutoScale      []autoScaleRule
+	Roles          []role
+}
+
+func (a *clusterArchive) files() map[string]interface{} {
+	return map[string]interface{}{
+		"metadata.json":       &a.Metadata,
+		"pools.json":          &a.Pools,
+		"plans.json":          &a.Plans,
+		"platforms.json":      &a.Platforms,
+		"templates.json":      &a.Templates,
+		"nodecontainers.json": &a.NodeContainers,
+		"healing.json":        &a.Healing,
+		"autoscale.json":      &a.AutoScale,
+		"roles.json":          &a.Roles,
+	}
+}
+
+func (a *clusterArchive) write(w io.Writer) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	files := a.files()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := json.MarshalIndent(files[name], "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		err = tarWriter.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: a.Metadata.Created,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tarWriter.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	err := tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func readClusterArchive(r io.Reader) (*clusterArchive, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid cluster archive")
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	var archive clusterArchive
+	files := archive.files()
+	found := map[string]bool{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid cluster archive")
+		}
+		dst, ok := files[header.Name]
+		if !ok {
+			continue
+		}
+		err = json.NewDecoder(tarReader).Decode(dst)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s in cluster archive", header.Name)
+		}
+		found[header.Name] = true
+	}
+	if !found["metadata.json"] {
+		return nil, errors.New("invalid cluster archive: metadata.json not found")
+	}
+	if archive.Metadata.Version > clusterArchiveVersion {
+		return nil, errors.Errorf("cluster archive version %d is not supported, the newest supported version is %d", archive.Metadata.Version, clusterArchiveVersion)
+	}
+	return &archive, nil
+}
+
+func listPlans(client *cmd.Client) ([]plan, error) {
+	u, err := cmd.GetURL("/plans")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var plans []plan
+	if resp.StatusCode == http.StatusNoContent {
+		return plans, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&plans)
+	if err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+func listRoles(client *cmd.Client) ([]role, error) {
+	u, err := cmd.GetURL("/roles")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var roles []role
+	if resp.StatusCode == http.StatusNoContent {
+		return roles, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&roles)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+type clusterExportCmd struct{}
+
+func (c *clusterExportCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "cluster-export",
+		Usage: "cluster-export <file>",
+		Desc: `Exports the admin configuration of the current target to a versioned
+archive: pools and their teams, plans, platforms, machine templates, node
+containers, node healing configuration, autoscale rules and roles, including
+default roles.
+
+The archive is a gzipped tarball with one JSON file per kind of object and can
+be imported into another target with [[cluster-import]].`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *clusterExportCmd) Run(context *cmd.Context, client *cmd.Client) error {
+	target, err := cmd.ReadTarget()
+	if err != nil {
+		return err
+	}
+	archive := clusterArchive{
+		Metadata: clusterArchiveMetadata{
+			Version: clusterArchiveVersion,
+			Target:  target,
+			Created: time.Now().UTC().Truncate(time.Second),
+		},
+	}
+	archive.Pools, err = listPools(client)
+	if err != nil {
+		return err
+	}
+	archive.Plans, err = listPlans(client)
+	if err != nil {
+		return err
+	}
+	platforms, err := listPlatforms(client)
+	if err != nil {
+		return err
+	}
+	for _, p := range platforms {
+		archive.Platforms = append(archive.Platforms, archivedPlatform{platform: p})
+	}
+	archive.Templates, err = listTemplates(client)
+	if err != nil {
+		return err
+	}
+	archive.NodeContainers, err = listNodeContainers(client)
+	if err != nil {
+		return err
+	}
+	archive.Healing, err = getNodeHealingConfig(client)
+	if err != nil {
+		return err
+	}
+	archive.AutoScale, err = getAutoScaleRules(client)
+	if err != nil {
+		return err
+	}
+	archive.Roles, err = listRoles(client)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(context.Args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = archive.write(file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Cluster configuration from %s exported to %s.\n", target, context.Args[0])
+	return nil
+}
+
+type clusterImportCmd struct {
+	cmd.ConfirmationCommand
+	fs *gnuflag.FlagSet
+}
+
+func (c *clusterImportCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "cluster-import",
+		Usage: "cluster-import <file> [-y]",
+		Desc: `Imports an archive created by [[cluster-export]] into the current target.
+
+Objects are created in dependency order: roles, plans, platforms, pools,
+machine templates, node containers, node healing configuration and autoscale
+rules. Objects that already exist in the target are skipped, except for node
+healing configuration and autoscale rules, which are overwritten. Teams
+referenced by pools must already exist in the target.
+
+Platforms are built from the tsuru/<name> image, unless a "Dockerfile" URL is
+set for them in the platforms.json file of the archive.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *clusterImportCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+	}
+	return c.fs
+}
+
+func (c *clusterImportCmd) Run(context *cmd.Context, client *cmd.Client) error {
+	file, err := os.Open(context.Args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	archive, err := readClusterArchive(file)
+	if err != nil {
+		return err
+	}
+	target, err := cmd.ReadTarget()
+	if err != nil {
+		return err
+	}
+	question := fmt.Sprintf("Are you sure you want to import the configuration exported from %s into %s?", archive.Metadata.Target, target)
+	if !c.Confirm(context, question) {
+		return nil
+	}
+	importer := clusterImporter{context: context, client: client, archive: archive}
+	steps := []func() error{
+		importer.roles,
+		importer.plans,
+		importer.platforms,
+		importer.pools,
+		importer.templates,
+		importer.nodeContainers,
+		importer.healing,
+		importer.autoScale,
+	}
+	for _, step := range steps {
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(context.Stdout, "Cluster configuration successfully imported.")
+	return nil
+}
+
+// clusterImporter replays the objects of an archive against the current
+// target.
+type clusterImporter struct {
+	context *cmd.Context
+	client  *cmd.Client
+	archive *clusterArchive
+}
+
+func (i *clusterImporter) imported(kind, name string) {
+	fmt.Fprintf(i.context.Stdout, "%s %q imported.\n", kind, name)
+}
+
+func (i *clusterImporter) skipped(kind, name string) {
+	fmt.Fprintf(i.context.Stdout, "%s %q already exists, skipped.\n", kind, name)
+}
+
+func (i *clusterImporter) post(path string, values url.Values) error {
+	u, err := cmd.GetURL(path)
+	if err != nil {
+		return err
+	}
+	return doForm(i.client, "POST", u, values)
+}
+
+func (i *clusterImporter) roles() error {
+	existing, err := listRoles(i.client)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, r := range existing {
+		names[r.Name] = true
+	}
+	for _, r := range i.archive.Roles {
+		if names[r.Name] {
+			i.skipped("role", r.Name)
+			continue
+		}
+		values := url.Values{}
+		values.Set("name", r.Name)
+		values.Set("context", r.ContextType)
+		values.Set("description", r.Description)
+		err = i.post("/roles", values)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import role %q", r.Name)
+		}
+		if len(r.SchemeNames) > 0 {
+			err = i.post(fmt.Sprintf("/roles/%s/permissions", r.Name), url.Values{"permission": r.SchemeNames})
+			if err != nil {
+				return errors.Wrapf(err, "unable to import permissions of role %q", r.Name)
+			}
+		}
+		if len(r.Events) > 0 {
+			values = url.Values{}
+			for _, evt := range r.Events {
+				values.Add(evt, r.Name)
+			}
+			err = i.post("/role/default", values)
+			if err != nil {
+				return errors.Wrapf(err, "unable to import default role %q", r.Name)
+			}
+		}
+		i.imported("role", r.Name)
+	}
+	return nil
+}
+
+func (i *clusterImporter) plans() error {
+	existing, err := listPlans(i.client)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, p := range existing {
+		names[p.Name] = true
+	}
+	for _, p := range i.archive.Plans {
+		if names[p.Name] {
+			i.skipped("plan", p.Name)
+			continue
+		}
+		values := url.Values{}
+		values.Set("name", p.Name)
+		values.Set("memory", strconv.FormatInt(p.Memory, 10))
+		values.Set("swap", strconv.FormatInt(p.Swap, 10))
+		values.Set("cpushare", strconv.Itoa(p.CpuShare))
+		values.Set("default", strconv.FormatBool(p.Default))
+		values.Set("router", p.Router)
+		err = i.post("/plans", values)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import plan %q", p.Name)
+		}
+		i.imported("plan", p.Name)
+	}
+	return nil
+}
+
+func (i *clusterImporter) platforms() error {
+	existing, err := listPlatforms(i.client)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, p := range existing {
+		names[p.Name] = true
+	}
+	for _, p := range i.archive.Platforms {
+		if names[p.Name] {
+			i.skipped("platform", p.Name)
+			continue
+		}
+		add := admin.PlatformAdd{}
+		var args []string
+		if p.Dockerfile != "" {
+			args = []string{"--dockerfile", p.Dockerfile}
+		}
+		err = add.Flags().Parse(true, args)
+		if err != nil {
+			return err
+		}
+		ctx := *i.context
+		ctx.Args = []string{p.Name}
+		err = add.Run(&ctx, i.client)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import platform %q", p.Name)
+		}
+		if p.Disabled {
+			u, err := cmd.GetURL("/platforms/" + p.Name)
+			if err != nil {
+				return err
+			}
+			err = doForm(i.client, "PUT", u, url.Values{"disabled": []string{"true"}})
+			if err != nil {
+				return errors.Wrapf(err, "unable to disable platform %q", p.Name)
+			}
+		}
+		i.imported("platform", p.Name)
+	}
+	return nil
+}
+
+func (i *clusterImporter) pools() error {
+	existing, err := listPools(i.client)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, p := range existing {
+		names[p.Name] = true
+	}
+	for _, p := range i.archive.Pools {
+		if names[p.Name] {
+			i.skipped("pool", p.Name)
+			continue
+		}
+		spec := poolSpec{
+			Name:        p.Name,
+			Public:      p.Public,
+			Default:     p.Default,
+			Provisioner: p.Provisioner,
+			Teams:       p.Teams,
+		}
+		err = createPool(i.client, spec)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import pool %q", p.Name)
+		}
+		i.imported("pool", p.Name)
+	}
+	return nil
+}
+
+func (i *clusterImporter) templates() error {
+	existing, err := listTemplates(i.client)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, t := range existing {
+		names[t.Name] = true
+	}
+	for _, t := range i.archive.Templates {
+		if names[t.Name] {
+			i.skipped("template", t.Name)
+			continue
+		}
+		values, err := form.EncodeToValues(&t)
+		if err != nil {
+			return err
+		}
+		err = i.post("/iaas/templates", values)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import template %q", t.Name)
+		}
+		i.imported("template", t.Name)
+	}
+	return nil
+}
+
+func (i *clusterImporter) nodeContainers() error {
+	existing, err := listNodeContainers(i.client)
+	if err != nil {
+		return err
+	}
+	live := map[string]bool{}
+	for _, group := range existing {
+		for pool := range group.ConfigPools {
+			live[nodeContainerKey(group.Name, pool)] = true
+		}
+	}
+	for _, group := range i.archive.NodeContainers {
+		// The entry for all pools sorts first, pool specific entries are
+		// only valid once it exists.
+		pools := make([]string, 0, len(group.ConfigPools))
+		for pool := range group.ConfigPools {
+			pools = append(pools, pool)
+		}
+		sort.Strings(pools)
+		for _, pool := range pools {
+			key := nodeContainerKey(group.Name, pool)
+			if live[key] {
+				i.skipped("node container", key)
+				continue
+			}
+			config := group.ConfigPools[pool]
+			config.Name = group.Name
+			config.PinnedImage = ""
+			err = saveNodeContainer(i.client, "/docker/nodecontainers", config, pool)
+			if err != nil {
+				return errors.Wrapf(err, "unable to import node container %q", key)
+			}
+			i.imported("node container", key)
+		}
+	}
+	return nil
+}
+
+func (i *clusterImporter) healing() error {
+	pools := make([]string, 0, len(i.archive.Healing))
+	for pool, conf := range i.archive.Healing {
+		if hasOwnHealingConfig(conf) {
+			pools = append(pools, pool)
+		}
+	}
+	sort.Strings(pools)
+	for _, pool := range pools {
+		conf := i.archive.Healing[pool]
+		values := url.Values{"pool": []string{pool}}
+		if !conf.EnabledInherited && conf.Enabled != nil {
+			values.Set("Enabled", strconv.FormatBool(*conf.Enabled))
+		}
+		if !conf.MaxUnresponsiveTimeInherited && conf.MaxUnresponsiveTime != nil {
+			values.Set("MaxUnresponsiveTime", strconv.Itoa(*conf.MaxUnresponsiveTime))
+		}
+		if !conf.MaxTimeSinceSuccessInherited && conf.MaxTimeSinceSuccess != nil {
+			values.Set("MaxTimeSinceSuccess", strconv.Itoa(*conf.MaxTimeSinceSuccess))
+		}
+		u, err := cmd.GetURLVersion("1.3", "/healing/node")
+		if err != nil {
+			return err
+		}
+		err = doForm(i.client, "POST", u, values)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import healing config for pool %q", pool)
+		}
+		i.imported("healing config", pool)
+	}
+	return nil
+}
+
+func (i *clusterImporter) autoScale() error {
+	for _, rule := range i.archive.AutoScale {
+		rule.Error = ""
+		values, err := form.EncodeToValues(rule)
+		if err != nil {
+			return err
+		}
+		err = i.post("/docker/autoscale/rules", values)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import autoscale rule %q", rule.MetadataFilter)
+		}
+		i.imported("autoscale rule", rule.MetadataFilter)
+	}
+	return nil
+}
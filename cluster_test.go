@@ -0,0 +1,247 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"github.com/tsuru/tsuru/healer"
+	"github.com/tsuru/tsuru/iaas"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/nodecontainer"
+	"gopkg.in/check.v1"
+)
+
+func getTransport(path, message string) cmdtest.ConditionalTransport {
+	status := http.StatusOK
+	if message == "" {
+		status = http.StatusNoContent
+	}
+	return cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: message, Status: status},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, path)
+		},
+	}
+}
+
+func okTransport(condFunc func(*http.Request) bool) cmdtest.ConditionalTransport {
+	return cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc:  condFunc,
+	}
+}
+
+func (s *S) TestClusterArchiveWriteRead(c *check.C) {
+	archive := clusterArchive{
+		Metadata:  clusterArchiveMetadata{Version: 1, Target: "http://tsuru.io", Created: time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)},
+		Pools:     []provision.Pool{{Name: "p1", Teams: []string{"t1"}}},
+		Plans:     []plan{{Name: "small", Memory: 512}},
+		Platforms: []archivedPlatform{{platform: platform{Name: "python"}, Dockerfile: "http://dockerfile"}},
+		Templates: []iaas.Template{{Name: "tpl1", IaaSName: "ec2"}},
+		Roles:     []role{{Name: "deployer", ContextType: "team", Events: []string{"team-create"}}},
+	}
+	var buf bytes.Buffer
+	err := archive.write(&buf)
+	c.Assert(err, check.IsNil)
+	read, err := readClusterArchive(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(*read, check.DeepEquals, archive)
+}
+
+func (s *S) TestReadClusterArchiveNewerVersion(c *check.C) {
+	archive := clusterArchive{Metadata: clusterArchiveMetadata{Version: clusterArchiveVersion + 1}}
+	var buf bytes.Buffer
+	err := archive.write(&buf)
+	c.Assert(err, check.IsNil)
+	_, err = readClusterArchive(&buf)
+	c.Assert(err, check.ErrorMatches, "cluster archive version 2 is not supported, the newest supported version is 1")
+}
+
+func (s *S) TestReadClusterArchiveInvalid(c *check.C) {
+	_, err := readClusterArchive(strings.NewReader("not an archive"))
+	c.Assert(err, check.ErrorMatches, "invalid cluster archive: .*")
+}
+
+func (s *S) TestClusterExportRun(c *check.C) {
+	path := filepath.Join(c.MkDir(), "cluster.tar.gz")
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf, Args: []string{path}}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/pools", `[{"Name": "p1", "Teams": ["t1"], "Public": false, "Default": true, "Provisioner": "docker"}]`),
+			getTransport("/plans", `[{"name": "small", "memory": 536870912, "swap": 0, "cpushare": 100, "default": true}]`),
+			getTransport("/platforms", `[{"Name": "python"}, {"Name": "ruby", "Disabled": true}]`),
+			getTransport("/iaas/templates", `[{"Name": "tpl1", "IaaSName": "ec2", "Data": [{"Name": "region", "Value": "us"}]}]`),
+			getTransport("/docker/nodecontainers", nodeContainersJSON),
+			getTransport("/1.3/healing/node", `{"": {"Enabled": true, "MaxUnresponsiveTime": 300}}`),
+			getTransport("/docker/autoscale/rules", `[{"MetadataFilter": "p1", "MaxContainerCount": 10, "Enabled": true}]`),
+			getTransport("/roles", `[{"name": "deployer", "context": "team", "Description": "deploys", "scheme_names": ["app.deploy"], "events": ["team-create"]}]`),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := clusterExportCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Cluster configuration from http://localhost exported to "+path+".\n")
+	file, err := os.Open(path)
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	archive, err := readClusterArchive(file)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Metadata.Version, check.Equals, clusterArchiveVersion)
+	c.Assert(archive.Metadata.Target, check.Equals, "http://localhost")
+	c.Assert(archive.Pools, check.DeepEquals, []provision.Pool{{Name: "p1", Teams: []string{"t1"}, Default: true, Provisioner: "docker"}})
+	c.Assert(archive.Plans, check.DeepEquals, []plan{{Name: "small", Memory: 536870912, CpuShare: 100, Default: true}})
+	c.Assert(archive.Platforms, check.DeepEquals, []archivedPlatform{
+		{platform: platform{Name: "python"}},
+		{platform: platform{Name: "ruby", Disabled: true}},
+	})
+	c.Assert(archive.Templates, check.HasLen, 1)
+	c.Assert(archive.NodeContainers, check.HasLen, 2)
+	c.Assert(*archive.Healing[""].MaxUnresponsiveTime, check.Equals, 300)
+	c.Assert(archive.AutoScale, check.DeepEquals, []autoScaleRule{{MetadataFilter: "p1", MaxContainerCount: 10, Enabled: true}})
+	c.Assert(archive.Roles, check.DeepEquals, []role{
+		{Name: "deployer", ContextType: "team", Description: "deploys", SchemeNames: []string{"app.deploy"}, Events: []string{"team-create"}},
+	})
+	c.Assert(trans.ConditionalTransports, check.HasLen, 0)
+}
+
+func (s *S) TestClusterImportRun(c *check.C) {
+	enabled := true
+	archive := clusterArchive{
+		Metadata:  clusterArchiveMetadata{Version: 1, Target: "http://staging"},
+		Pools:     []provision.Pool{{Name: "p1", Teams: []string{"t1"}, Provisioner: "docker"}},
+		Plans:     []plan{{Name: "small", Memory: 512, CpuShare: 100}},
+		Platforms: []archivedPlatform{{platform: platform{Name: "python", Disabled: true}}},
+		Templates: []iaas.Template{{Name: "tpl1", IaaSName: "ec2", Data: iaas.TemplateDataList{{Name: "region", Value: "us"}}}},
+		NodeContainers: []nodecontainer.NodeContainerConfigGroup{{
+			Name: "bs",
+			ConfigPools: map[string]nodecontainer.NodeContainerConfig{
+				"p1": {Name: "bs", PinnedImage: "bs@sha256:abc"},
+				"":   {Name: "bs"},
+			},
+		}},
+		Roles: []role{
+			{Name: "admin", ContextType: "global"},
+			{Name: "deployer", ContextType: "team", Description: "deploys", SchemeNames: []string{"app.deploy"}, Events: []string{"team-create"}},
+		},
+		AutoScale: []autoScaleRule{{MetadataFilter: "p1", MaxContainerCount: 10, Enabled: true, Error: "some error"}},
+	}
+	archive.Healing = map[string]healer.NodeHealerConfig{"": {Enabled: &enabled}}
+	path := filepath.Join(c.MkDir(), "cluster.tar.gz")
+	file, err := os.Create(path)
+	c.Assert(err, check.IsNil)
+	err = archive.write(file)
+	c.Assert(err, check.IsNil)
+	file.Close()
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf, Args: []string{path}}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", `[{"name": "admin", "context": "global"}]`),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles") &&
+					req.FormValue("name") == "deployer" && req.FormValue("context") == "team" &&
+					req.FormValue("description") == "deploys"
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles/deployer/permissions") &&
+					req.FormValue("permission") == "app.deploy"
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/role/default") &&
+					req.FormValue("team-create") == "deployer"
+			}),
+			getTransport("/plans", "[]"),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/plans") &&
+					req.FormValue("name") == "small" && req.FormValue("memory") == "512" &&
+					req.FormValue("cpushare") == "100"
+			}),
+			getTransport("/platforms", ""),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/platforms") &&
+					req.FormValue("name") == "python"
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "PUT" && strings.HasSuffix(req.URL.Path, "/platforms/python") &&
+					req.FormValue("disabled") == "true"
+			}),
+			getTransport("/pools", ""),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/pools") &&
+					req.FormValue("name") == "p1" && req.FormValue("provisioner") == "docker"
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/pools/p1/team") &&
+					req.FormValue("team") == "t1"
+			}),
+			getTransport("/iaas/templates", "[]"),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/iaas/templates") &&
+					req.FormValue("Name") == "tpl1" && req.FormValue("IaaSName") == "ec2" &&
+					req.FormValue("Data.0.Value") == "us"
+			}),
+			getTransport("/docker/nodecontainers", `[{"Name": "bs", "ConfigPools": {"p1": {"Name": "bs"}}}]`),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers") &&
+					req.FormValue("name") == "bs" && req.FormValue("pool") == ""
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/1.3/healing/node") &&
+					req.FormValue("pool") == "" && req.FormValue("Enabled") == "true" &&
+					req.FormValue("MaxUnresponsiveTime") == ""
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/autoscale/rules") &&
+					req.FormValue("MetadataFilter") == "p1" && req.FormValue("MaxContainerCount") == "10" &&
+					req.FormValue("Error") == ""
+			}),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := clusterImportCmd{}
+	command.Flags().Parse(true, []string{"-y"})
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `role "admin" already exists, skipped.
+role "deployer" imported.
+plan "small" imported.
+platform "python" imported.
+pool "p1" imported.
+template "tpl1" imported.
+node container "bs" imported.
+node container "bs (pool p1)" already exists, skipped.
+healing config "" imported.
+autoscale rule "p1" imported.
+Cluster configuration successfully imported.
+`
+	c.Assert(buf.String(), check.Equals, expected)
+	c.Assert(trans.ConditionalTransports, check.HasLen, 0)
+}
+
+func (s *S) TestClusterImportRunAborted(c *check.C) {
+	archive := clusterArchive{Metadata: clusterArchiveMetadata{Version: 1, Target: "http://staging"}}
+	path := filepath.Join(c.MkDir(), "cluster.tar.gz")
+	file, err := os.Create(path)
+	c.Assert(err, check.IsNil)
+	err = archive.write(file)
+	c.Assert(err, check.IsNil)
+	file.Close()
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf, Stdin: strings.NewReader("n\n"), Args: []string{path}}
+	command := clusterImportCmd{}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Are you sure you want to import the configuration exported from http://staging into http://localhost? (y/n) Abort.\n")
+}
@@ -0,0 +1,450 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/provision"
+)
+
+func postContainerMove(ctx *cmd.Context, client *cmd.Client, path string, v url.Values) error {
+	u, err := cmd.GetURL(path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return cmd.StreamJSONResponse(ctx.Stdout, resp)
+}
+
+// rebalanceMove is a container move planned by containers-rebalance --plan.
+type rebalanceMove struct {
+	Container string
+	App       string
+	Process   string
+	From      string
+	To        string
+	Error     string `json:",omitempty"`
+}
+
+// schedulableStatuses are the node statuses of nodes the docker scheduler
+// may choose for new containers.
+var schedulableStatuses = map[string]bool{
+	"ready":           true,
+	"waiting":         true,
+	"ready for retry": true,
+}
+
+// ignoredGroupMetadata are node metadata that don't count when grouping
+// nodes, the same as the scheduler ignores.
+var ignoredGroupMetadata = []string{"Failures", "DisabledUntil", "LastError", "LastSuccess", "iaas-id"}
+
+// rebalancePlanner computes the moves of a rebalance without performing them,
+// with the nodes and containers of the cluster as they are now.
+type rebalancePlanner struct {
+	nodes []provision.NodeSpec
+	units map[string][]nodeUnit
+	apps  map[string]*appInfo
+}
+
+func newRebalancePlanner(client *cmd.Client) (*rebalancePlanner, error) {
+	result, err := listNodes(client)
+	if err != nil {
+		return nil, err
+	}
+	p := rebalancePlanner{
+		nodes: result.Nodes,
+		units: make(map[string][]nodeUnit, len(result.Nodes)),
+		apps:  map[string]*appInfo{},
+	}
+	for _, node := range p.nodes {
+		units, err := listNodeUnits(client, node.Address)
+		if err != nil {
+			return nil, err
+		}
+		p.units[node.Address] = units
+		for _, unit := range units {
+			if _, ok := p.apps[unit.AppName]; ok {
+				continue
+			}
+			p.apps[unit.AppName], err = getAppInfo(client, unit.AppName)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &p, nil
+}
+
+// appInfo holds the fields of an app used to plan container moves.
+type appInfo struct {
+	Name string `json:"name"`
+	Pool string `json:"pool"`
+	Plan plan   `json:"plan"`
+}
+
+func getAppInfo(client *cmd.Client, appName string) (*appInfo, error) {
+	u, err := cmd.GetURL("/apps/" + appName)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var app appInfo
+	err = json.NewDecoder(resp.Body).Decode(&app)
+	if err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// plan returns the moves of a rebalance of the containers from the given apps
+// in the nodes matching the metadata filter. Like the rebalance in the docker
+// provisioner, all these containers are ignored while choosing the
+// destinations, which are picked one at a time among the enabled nodes in the
+// pool of each app.
+func (p *rebalancePlanner) plan(appFilter []string, metadataFilter map[string]string) []rebalanceMove {
+	apps := make(map[string]bool, len(appFilter))
+	for _, app := range appFilter {
+		apps[app] = true
+	}
+	var moves []rebalanceMove
+	hostCount := map[string]int{}
+	appCount := map[string]map[string]int{}
+	for _, node := range p.nodes {
+		matches := matchesMetadata(node, metadataFilter)
+		for _, unit := range p.units[node.Address] {
+			if matches && (len(apps) == 0 || apps[unit.AppName]) {
+				moves = append(moves, rebalanceMove{
+					Container: unit.ID,
+					App:       unit.AppName,
+					Process:   unit.ProcessName,
+					From:      node.Address,
+				})
+				continue
+			}
+			hostCount[node.Address]++
+			key := unit.AppName + "/" + unit.ProcessName
+			if appCount[key] == nil {
+				appCount[key] = map[string]int{}
+			}
+			appCount[key][node.Address]++
+		}
+	}
+	for i := range moves {
+		move := &moves[i]
+		pool := p.apps[move.App].Pool
+		var nodes []provision.NodeSpec
+		for _, node := range p.nodes {
+			if schedulableStatuses[node.Status] && nodePool(node) == pool {
+				nodes = append(nodes, node)
+			}
+		}
+		if len(nodes) == 0 {
+			move.Error = fmt.Sprintf("No nodes found with one of the following metadata: pool=%s", pool)
+			continue
+		}
+		key := move.App + "/" + move.Process
+		if appCount[key] == nil {
+			appCount[key] = map[string]int{}
+		}
+		move.To = chooseNode(nodes, hostCount, appCount[key])
+		hostCount[move.To]++
+		appCount[key][move.To]++
+	}
+	return moves
+}
+
+func matchesMetadata(node provision.NodeSpec, filter map[string]string) bool {
+	for key, value := range filter {
+		if node.Metadata[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// chooseNode returns the node with the minimum value for the tuple [(number
+// of containers for app-process in the node group), (number of containers for
+// app-process), (number of containers)], the node the docker scheduler picks
+// for a new container in minMaxNodes.
+func chooseNode(nodes []provision.NodeSpec, hostCount, appCount map[string]int) string {
+	groups := nodeGroups(nodes)
+	groupCount := map[int]int{}
+	for _, node := range nodes {
+		groupCount[groups[node.Address]] += appCount[node.Address]
+	}
+	var chosen string
+	var minScore uint64 = 1<<64 - 1
+	for _, node := range nodes {
+		var appGroupCount int
+		if group, ok := groups[node.Address]; ok {
+			appGroupCount = groupCount[group]
+		}
+		score := uint64(appGroupCount)<<42 + uint64(appCount[node.Address])<<21 + uint64(hostCount[node.Address])
+		if score < minScore {
+			minScore = score
+			chosen = node.Address
+		}
+	}
+	return chosen
+}
+
+// nodeMetadataGroup is a set of nodes sharing the same values for the
+// metadata that isn't the same in all nodes.
+type nodeMetadataGroup struct {
+	metadata map[string]string
+	nodes    []string
+}
+
+// splitNodeMetadata groups the nodes by the metadata that isn't the same in
+// all of them, like splitMetadata in the docker provisioner. Nodes without
+// such metadata are left out of the groups.
+func splitNodeMetadata(nodes []provision.NodeSpec) ([]nodeMetadataGroup, error) {
+	metadata := make([]map[string]string, len(nodes))
+	for i, node := range nodes {
+		metadata[i] = make(map[string]string, len(node.Metadata))
+		for k, v := range node.Metadata {
+			metadata[i][k] = v
+		}
+		for _, k := range ignoredGroupMetadata {
+			delete(metadata[i], k)
+		}
+	}
+	exclusive := make([]map[string]string, len(nodes))
+	for i := range nodes {
+		for k, v := range metadata[i] {
+			for j := range nodes {
+				if i != j && metadata[j][k] != v {
+					if exclusive[i] == nil {
+						exclusive[i] = map[string]string{}
+					}
+					exclusive[i][k] = v
+					break
+				}
+			}
+		}
+	}
+	var groups []nodeMetadataGroup
+	same := map[int]bool{}
+	for i := range exclusive {
+		members := []string{nodes[i].Address}
+		for j := range exclusive {
+			if i == j {
+				continue
+			}
+			diff := 0
+			for k, v := range exclusive[i] {
+				if exclusive[j][k] != v {
+					diff++
+				}
+			}
+			if diff > 0 && (diff < len(exclusive[i]) || diff > len(exclusive[j])) {
+				return nil, errors.Errorf("unbalanced metadata for node group: %v vs %v", exclusive[i], exclusive[j])
+			}
+			if diff == 0 {
+				same[j] = true
+				members = append(members, nodes[j].Address)
+			}
+		}
+		if !same[i] && exclusive[i] != nil {
+			groups = append(groups, nodeMetadataGroup{metadata: exclusive[i], nodes: members})
+		}
+	}
+	return groups, nil
+}
+
+// nodeGroups returns the index of the metadata group of each node address.
+// When the nodes have unbalanced metadata no groups are returned, as the
+// scheduler ignores them too.
+func nodeGroups(nodes []provision.NodeSpec) map[string]int {
+	groups := map[string]int{}
+	split, err := splitNodeMetadata(nodes)
+	if err != nil {
+		return nil
+	}
+	for i, group := range split {
+		for _, addr := range group.nodes {
+			groups[addr] = i
+		}
+	}
+	return groups
+}
+
+type rebalanceMoveList []rebalanceMove
+
+func (l rebalanceMoveList) Len() int      { return len(l) }
+func (l rebalanceMoveList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l rebalanceMoveList) Less(i, j int) bool {
+	if l[i].From != l[j].From {
+		return l[i].From < l[j].From
+	}
+	return l[i].Container < l[j].Container
+}
+
+type containersRebalance struct {
+	cmd.ConfirmationCommand
+	fs       *gnuflag.FlagSet
+	pool     string
+	apps     cmd.StringSliceFlag
+	metadata cmd.MapFlag
+	dry      bool
+	plan     bool
+}
+
+func (c *containersRebalance) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "containers-rebalance",
+		Usage: "containers-rebalance [--pool/-p <pool>] [--app/-a <appname>]... [--metadata/-m <key>=<value>]... [--dry] [--plan] [-y]",
+		Desc: `Moves containers, creating them in the nodes chosen by the scheduler, so that
+the containers of each app are spread evenly among the nodes in its pool.
+
+The [[--pool]], [[--app]] and [[--metadata]] flags limit the rebalance to
+containers in the nodes from the pool, to containers from the apps and to
+containers in the nodes with the metadata, respectively.
+
+With [[--dry]] the rebalance is run by the API without moving any container,
+and the moves it would make are displayed.
+
+With [[--plan]] nothing is sent to the API either, the planned moves are
+computed locally and displayed grouped by the node where each container is now.
+The plan is computed the same way the scheduler chooses nodes, except that
+node memory limits are not considered, and it needs one request per node and
+per app.
+
+This command replaces the containers-rebalance command of the docker
+provisioner.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *containersRebalance) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+		pool := "Rebalance only containers in nodes from this pool"
+		c.fs.StringVar(&c.pool, "pool", "", pool)
+		c.fs.StringVar(&c.pool, "p", "", pool)
+		app := "Rebalance only containers from this app"
+		c.fs.Var(&c.apps, "app", app)
+		c.fs.Var(&c.apps, "a", app)
+		metadata := "Rebalance only containers in nodes with this metadata"
+		c.fs.Var(&c.metadata, "metadata", metadata)
+		c.fs.Var(&c.metadata, "m", metadata)
+		c.fs.BoolVar(&c.dry, "dry", false, "Run the rebalance in the API without moving containers")
+		c.fs.BoolVar(&c.plan, "plan", false, "Only display the moves planned locally, without calling the rebalance in the API")
+	}
+	return c.fs
+}
+
+func (c *containersRebalance) formatted() {}
+
+func (c *containersRebalance) metadataFilter() map[string]string {
+	filter := map[string]string{}
+	for k, v := range c.metadata {
+		filter[k] = v
+	}
+	if c.pool != "" {
+		filter["pool"] = c.pool
+	}
+	return filter
+}
+
+func (c *containersRebalance) Run(ctx *cmd.Context, client *cmd.Client) error {
+	if c.plan {
+		return c.runPlan(ctx, client)
+	}
+	if machineReadable() {
+		return errors.New("--format is only supported with --plan")
+	}
+	ctx.RawOutput()
+	if !c.dry && !c.Confirm(ctx, "Are you sure you want to rebalance containers?") {
+		return nil
+	}
+	v := url.Values{}
+	v.Set("Dry", strconv.FormatBool(c.dry))
+	for k, value := range c.metadataFilter() {
+		v.Set("MetadataFilter."+k, value)
+	}
+	for i, app := range c.apps {
+		v.Set("AppFilter."+strconv.Itoa(i), app)
+	}
+	return postContainerMove(ctx, client, "/docker/containers/rebalance", v)
+}
+
+func (c *containersRebalance) runPlan(ctx *cmd.Context, client *cmd.Client) error {
+	planner, err := newRebalancePlanner(client)
+	if err != nil {
+		return err
+	}
+	moves := rebalanceMoveList(planner.plan(c.apps, c.metadataFilter()))
+	sort.Sort(moves)
+	if len(moves) == 0 && !machineReadable() {
+		fmt.Fprintln(ctx.Stdout, "No containers found to rebalance.")
+		return nil
+	}
+	if machineReadable() {
+		l := listing{
+			Headers: cmd.Row{"Node", "Container", "App", "Process", "Destination", "Error"},
+			Data:    moves,
+		}
+		for _, m := range moves {
+			l.Rows = append(l.Rows, cmd.Row{m.From, m.Container, m.App, m.Process, m.To, m.Error})
+		}
+		return render(ctx.Stdout, &l)
+	}
+	l := listing{
+		Headers:       cmd.Row{"Node", "Container", "App", "Process", "Destination"},
+		LineSeparator: true,
+		Data:          moves,
+	}
+	for i := 0; i < len(moves); {
+		row := cmd.Row{moves[i].From, "", "", "", ""}
+		var lines [4][]string
+		for ; i < len(moves) && moves[i].From == row[0]; i++ {
+			to := moves[i].To
+			if moves[i].Error != "" {
+				to = cmd.Colorfy(moves[i].Error, "red", "", "")
+			}
+			lines[0] = append(lines[0], moves[i].Container)
+			lines[1] = append(lines[1], moves[i].App)
+			lines[2] = append(lines[2], moves[i].Process)
+			lines[3] = append(lines[3], to)
+		}
+		for j := range lines {
+			row[j+1] = strings.Join(lines[j], "\n")
+		}
+		l.Rows = append(l.Rows, row)
+	}
+	err = render(ctx.Stdout, &l)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.Stdout, "%d containers would be moved, nothing was changed.\n", len(moves))
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"github.com/tsuru/tsuru/provision"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestContainersRebalanceRun(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{
+			Message: `{"Message": "Rebalancing 1 units...\n"}` + "\n" + `{"Message": "Containers successfully rebalanced!\n"}` + "\n",
+			Status:  http.StatusOK,
+		},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/containers/rebalance") &&
+				req.Form.Get("Dry") == "false" && req.Form.Get("MetadataFilter.pool") == "p1" &&
+				req.Form.Get("MetadataFilter.zone") == "a" && req.Form.Get("AppFilter.0") == "app1" &&
+				req.Form.Get("AppFilter.1") == "app2"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := containersRebalance{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-m", "zone=a", "-a", "app1", "--app", "app2", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Rebalancing 1 units...\nContainers successfully rebalanced!\n")
+}
+
+func (s *S) TestContainersRebalanceRunDry(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{
+			Message: `{"Message": "Rebalancing 1 units...\n"}` + "\n" + `{"Message": "Would move unit a1 from 10.0.0.1 to 10.0.0.2\n"}` + "\n",
+			Status:  http.StatusOK,
+		},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/containers/rebalance") &&
+				req.Form.Get("Dry") == "true" && req.Form.Get("MetadataFilter.pool") == "p1"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := containersRebalance{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "--dry"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Rebalancing 1 units...\nWould move unit a1 from 10.0.0.1 to 10.0.0.2\n")
+}
+
+func (s *S) TestContainersRebalanceRunAborted(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Stdin: strings.NewReader("n\n")}
+	command := containersRebalance{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Are you sure you want to rebalance containers? (y/n) Abort.\n")
+}
+
+func (s *S) TestContainersRebalanceRunFormatRequiresPlan(c *check.C) {
+	outputFormat = "json"
+	command := containersRebalance{}
+	err := command.Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, "--format is only supported with --plan")
+}
+
+const rebalanceNodesJSON = `{"nodes": [
+	{"Address": "http://10.0.0.1:2375", "Status": "ready", "Metadata": {"pool": "p1"}},
+	{"Address": "http://10.0.0.2:2375", "Status": "ready", "Metadata": {"pool": "p1"}},
+	{"Address": "http://10.0.0.3:2375", "Status": "disabled", "Metadata": {"pool": "p1"}},
+	{"Address": "http://10.0.0.4:2375", "Status": "ready", "Metadata": {"pool": "p2"}}
+]}`
+
+func rebalancePlanTransport() http.RoundTripper {
+	return &cmdtest.MultiConditionalTransport{ConditionalTransports: []cmdtest.ConditionalTransport{
+		getTransport("/1.2/node", rebalanceNodesJSON),
+		getTransport("/1.2/node/http://10.0.0.1:2375/containers", `[
+			{"ID": "a1", "AppName": "myapp", "ProcessName": "web"},
+			{"ID": "a2", "AppName": "myapp", "ProcessName": "web"},
+			{"ID": "a3", "AppName": "myapp", "ProcessName": "web"},
+			{"ID": "b1", "AppName": "other", "ProcessName": "web"}
+		]`),
+		getTransport("/apps/myapp", `{"name": "myapp", "pool": "p1"}`),
+		getTransport("/apps/other", `{"name": "other", "pool": "p1"}`),
+		getTransport("/1.2/node/http://10.0.0.2:2375/containers", ""),
+		getTransport("/1.2/node/http://10.0.0.3:2375/containers", `[{"ID": "c1", "AppName": "myapp", "ProcessName": "worker"}]`),
+		getTransport("/1.2/node/http://10.0.0.4:2375/containers", `[{"ID": "d1", "AppName": "lost", "ProcessName": "web"}]`),
+		getTransport("/apps/lost", `{"name": "lost", "pool": "p3"}`),
+	}}
+}
+
+func (s *S) TestContainersRebalanceRunPlan(c *check.C) {
+	restore := disableColors()
+	defer restore()
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	client := cmd.NewClient(&http.Client{Transport: rebalancePlanTransport()}, nil, s.manager)
+	command := containersRebalance{}
+	err := command.Flags().Parse(true, []string{"--plan", "-a", "myapp", "-a", "lost"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `+----------------------+-----------+-------+---------+------------------------------------------------------------+
+| Node                 | Container | App   | Process | Destination                                                |
++----------------------+-----------+-------+---------+------------------------------------------------------------+
+| http://10.0.0.1:2375 | a1        | myapp | web     | http://10.0.0.2:2375                                       |
+|                      | a2        | myapp | web     | http://10.0.0.1:2375                                       |
+|                      | a3        | myapp | web     | http://10.0.0.2:2375                                       |
++----------------------+-----------+-------+---------+------------------------------------------------------------+
+| http://10.0.0.3:2375 | c1        | myapp | worker  | http://10.0.0.1:2375                                       |
++----------------------+-----------+-------+---------+------------------------------------------------------------+
+| http://10.0.0.4:2375 | d1        | lost  | web     | No nodes found with one of the following metadata: pool=p3 |
++----------------------+-----------+-------+---------+------------------------------------------------------------+
+5 containers would be moved, nothing was changed.
+`)
+}
+
+func (s *S) TestContainersRebalanceRunPlanCSV(c *check.C) {
+	os.Unsetenv("TSURU_DISABLE_COLORS")
+	outputFormat = "csv"
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	client := cmd.NewClient(&http.Client{Transport: rebalancePlanTransport()}, nil, s.manager)
+	command := containersRebalance{}
+	err := command.Flags().Parse(true, []string{"--plan", "-a", "myapp", "-a", "lost"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Node,Container,App,Process,Destination,Error
+http://10.0.0.1:2375,a1,myapp,web,http://10.0.0.2:2375,
+http://10.0.0.1:2375,a2,myapp,web,http://10.0.0.1:2375,
+http://10.0.0.1:2375,a3,myapp,web,http://10.0.0.2:2375,
+http://10.0.0.3:2375,c1,myapp,worker,http://10.0.0.1:2375,
+http://10.0.0.4:2375,d1,lost,web,,No nodes found with one of the following metadata: pool=p3
+`)
+}
+
+func (s *S) TestContainersRebalanceRunPlanNothingToMove(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	client := cmd.NewClient(&http.Client{Transport: rebalancePlanTransport()}, nil, s.manager)
+	command := containersRebalance{}
+	err := command.Flags().Parse(true, []string{"--plan", "-p", "p9"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "No containers found to rebalance.\n")
+}
+
+func (s *S) TestRebalancePlannerPlanPool(c *check.C) {
+	planner := rebalancePlanner{
+		nodes: []provision.NodeSpec{
+			{Address: "n1", Status: "ready", Metadata: map[string]string{"pool": "p1"}},
+			{Address: "n2", Status: "ready", Metadata: map[string]string{"pool": "p1"}},
+			{Address: "n3", Status: "ready", Metadata: map[string]string{"pool": "p2"}},
+		},
+		units: map[string][]nodeUnit{
+			"n1": {{ID: "a1", AppName: "a", ProcessName: "web"}, {ID: "a2", AppName: "a", ProcessName: "web"}},
+			"n2": {{ID: "b1", AppName: "b", ProcessName: "web"}},
+			"n3": {{ID: "a3", AppName: "a", ProcessName: "web"}},
+		},
+		apps: map[string]*appInfo{"a": {Name: "a", Pool: "p1"}, "b": {Name: "b", Pool: "p1"}},
+	}
+	moves := planner.plan(nil, map[string]string{"pool": "p2"})
+	c.Assert(moves, check.DeepEquals, []rebalanceMove{
+		{Container: "a3", App: "a", Process: "web", From: "n3", To: "n2"},
+	})
+	moves = planner.plan([]string{"a"}, nil)
+	c.Assert(moves, check.DeepEquals, []rebalanceMove{
+		{Container: "a1", App: "a", Process: "web", From: "n1", To: "n1"},
+		{Container: "a2", App: "a", Process: "web", From: "n1", To: "n2"},
+		{Container: "a3", App: "a", Process: "web", From: "n3", To: "n1"},
+	})
+}
+
+func (s *S) TestChooseNode(c *check.C) {
+	nodes := []provision.NodeSpec{{Address: "n1"}, {Address: "n2"}, {Address: "n3"}}
+	c.Assert(chooseNode(nodes, nil, nil), check.Equals, "n1")
+	c.Assert(chooseNode(nodes, map[string]int{"n1": 2, "n2": 1, "n3": 3}, nil), check.Equals, "n2")
+	c.Assert(chooseNode(nodes, map[string]int{"n1": 2, "n2": 1, "n3": 3}, map[string]int{"n2": 1}), check.Equals, "n1")
+}
+
+func (s *S) TestChooseNodeGroups(c *check.C) {
+	nodes := []provision.NodeSpec{
+		{Address: "n1", Metadata: map[string]string{"pool": "p1", "zone": "a"}},
+		{Address: "n2", Metadata: map[string]string{"pool": "p1", "zone": "a"}},
+		{Address: "n3", Metadata: map[string]string{"pool": "p1", "zone": "b"}},
+	}
+	appCount := map[string]int{"n1": 1}
+	c.Assert(chooseNode(nodes, nil, appCount), check.Equals, "n3")
+}
+
+func (s *S) TestNodeGroups(c *check.C) {
+	nodes := []provision.NodeSpec{
+		{Address: "n1", Metadata: map[string]string{"pool": "p1", "zone": "a", "LastSuccess": "2016", "iaas-id": "i1"}},
+		{Address: "n2", Metadata: map[string]string{"pool": "p1", "zone": "b", "LastSuccess": "2017", "iaas-id": "i2"}},
+		{Address: "n3", Metadata: map[string]string{"pool": "p1", "zone": "a"}},
+	}
+	c.Assert(nodeGroups(nodes), check.DeepEquals, map[string]int{"n1": 0, "n3": 0, "n2": 1})
+	c.Assert(nodeGroups(nodes[:1]), check.DeepEquals, map[string]int{})
+	nodes[2].Metadata["rack"] = "r1"
+	c.Assert(nodeGroups(nodes), check.IsNil)
+}
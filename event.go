@@ -0,0 +1,597 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The types below mirror the event types from the tsuru API, whose fields
+// can't be used directly outside the event package.
+
+type eventTarget struct {
+	Type  string
+	Value string
+}
+
+type eventKind struct {
+	Type string
+	Name string
+}
+
+type eventOwner struct {
+	Type string
+	Name string
+}
+
+type eventEntry struct {
+	UniqueID   string
+	StartTime  time.Time
+	EndTime    time.Time
+	Target     eventTarget
+	Kind       eventKind
+	Owner      eventOwner
+	Error      string
+	Running    bool
+	Cancelable bool
+}
+
+// status returns a short description of the event state, as displayed in
+// listings.
+func (e *eventEntry) status() string {
+	switch {
+	case e.Running:
+		return "running"
+	case e.Error != "":
+		return "error"
+	}
+	return "success"
+}
+
+// duration returns how long the event took, or has been running until now.
+func (e *eventEntry) duration(now time.Time) time.Duration {
+	end := e.EndTime
+	if e.Running || end.IsZero() {
+		end = now
+	}
+	return end.Sub(e.StartTime) / time.Second * time.Second
+}
+
+type eventCancelInfo struct {
+	Owner     string
+	StartTime time.Time
+	AckTime   time.Time
+	Reason    string
+	Asked     bool
+	Canceled  bool
+}
+
+// eventDetails is an event along with its custom data and log, as returned by
+// the event info API.
+type eventDetails struct {
+	eventEntry
+	StartCustomData bson.Raw
+	EndCustomData   bson.Raw
+	OtherCustomData bson.Raw
+	Log             string
+	CancelInfo      eventCancelInfo
+}
+
+// listEvents returns the events matching the given filter, using the same
+// field names accepted by the API, like kindname and target.type.
+func listEvents(client *cmd.Client, filter url.Values) ([]eventEntry, error) {
+	var events []eventEntry
+	err := decodeEvents(client, filter, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// listEventDetails is like listEvents, but includes the custom data of the
+// events.
+func listEventDetails(client *cmd.Client, filter url.Values) ([]eventDetails, error) {
+	var events []eventDetails
+	err := decodeEvents(client, filter, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func decodeEvents(client *cmd.Client, filter url.Values, events interface{}) error {
+	u, err := cmd.GetURLVersion("1.1", "/events?"+filter.Encode())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(events)
+}
+
+// eventFilter holds the flags shared by event-list and event-tail, which are
+// translated into the filters accepted by the API.
+type eventFilter struct {
+	targetType  string
+	targetValue string
+	kind        string
+	owner       string
+	running     bool
+	errorOnly   bool
+	since       string
+	until       string
+}
+
+func (f *eventFilter) flags(fs *gnuflag.FlagSet) {
+	targetType := "Filter events by target type (app, node, container, pool, iaas, role, etc.)"
+	fs.StringVar(&f.targetType, "target-type", "", targetType)
+	fs.StringVar(&f.targetType, "t", "", targetType)
+	targetValue := "Filter events by target value, like the node address or the pool name"
+	fs.StringVar(&f.targetValue, "target-value", "", targetValue)
+	fs.StringVar(&f.targetValue, "v", "", targetValue)
+	kind := "Filter events by kind name, like node.update or healer"
+	fs.StringVar(&f.kind, "kind", "", kind)
+	fs.StringVar(&f.kind, "k", "", kind)
+	owner := "Filter events by owner name"
+	fs.StringVar(&f.owner, "owner", "", owner)
+	fs.StringVar(&f.owner, "o", "", owner)
+	running := "Show only events that are still running"
+	fs.BoolVar(&f.running, "running", false, running)
+	fs.BoolVar(&f.running, "r", false, running)
+	fs.BoolVar(&f.errorOnly, "errors", false, "Show only events that finished with an error")
+	fs.StringVar(&f.since, "since", "", "Show only events started after the given time, either in RFC 3339 format or as a duration relative to now, like 2h")
+	fs.StringVar(&f.until, "until", "", "Show only events started before the given time, either in RFC 3339 format or as a duration relative to now, like 2h")
+}
+
+func (f *eventFilter) values(now time.Time) (url.Values, error) {
+	values := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	set("target.type", f.targetType)
+	set("target.value", f.targetValue)
+	set("kindname", f.kind)
+	set("ownername", f.owner)
+	if f.running {
+		values.Set("running", "true")
+	}
+	if f.errorOnly {
+		values.Set("erroronly", "true")
+	}
+	for key, value := range map[string]string{"since": f.since, "until": f.until} {
+		if value == "" {
+			continue
+		}
+		t, err := parseEventTime(value, now)
+		if err != nil {
+			return nil, errors.Errorf("invalid value for --%s: %q", key, value)
+		}
+		values.Set(key, t.UTC().Format(time.RFC3339))
+	}
+	return values, nil
+}
+
+// parseEventTime parses either a time in RFC 3339 format or a duration, which
+// is subtracted from now. Besides the units accepted by time.ParseDuration,
+// durations may be given in days, like 30d.
+func parseEventTime(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func formatEventStart(e *eventEntry, now time.Time) string {
+	start := e.StartTime.Local().Format(time.Stamp)
+	if e.Running {
+		return fmt.Sprintf("%s (running for %s)", start, e.duration(now))
+	}
+	return fmt.Sprintf("%s (%s)", start, e.duration(now))
+}
+
+func formatEventTarget(t eventTarget) string {
+	return fmt.Sprintf("%s: %s", t.Type, t.Value)
+}
+
+func colorfyEventStatus(e *eventEntry) string {
+	switch e.status() {
+	case "error":
+		return cmd.Colorfy("error", "red", "", "")
+	case "running":
+		return cmd.Colorfy("running", "yellow", "", "")
+	}
+	return cmd.Colorfy("success", "green", "", "")
+}
+
+type eventList struct {
+	fs     *gnuflag.FlagSet
+	filter eventFilter
+	limit  int
+}
+
+func (c *eventList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "event-list",
+		Usage: "event-list [-t/--target-type <type>] [-v/--target-value <value>] [-k/--kind <kind>] [-o/--owner <owner>] [-r/--running] [--errors] [--since <time>] [--until <time>] [-l/--limit 20]",
+		Desc: `Lists the most recent events in tsuru, like node updates, healing and deploys,
+newest first.
+
+The [[--since]] and [[--until]] flags accept either a time in RFC 3339 format,
+like 2016-05-01T10:00:00Z, or a duration relative to now, like 30m, 2h or 7d.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *eventList) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		c.filter.flags(c.fs)
+		limit := "Maximum number of events to list (the API allows at most 100)"
+		c.fs.IntVar(&c.limit, "limit", 20, limit)
+		c.fs.IntVar(&c.limit, "l", 20, limit)
+	}
+	return c.fs
+}
+
+func (c *eventList) formatted() {}
+
+func (c *eventList) Run(context *cmd.Context, client *cmd.Client) error {
+	now := time.Now()
+	filter, err := c.filter.values(now)
+	if err != nil {
+		return err
+	}
+	if c.limit > 0 {
+		filter.Set("limit", strconv.Itoa(c.limit))
+	}
+	events, err := listEvents(client, filter)
+	if err != nil {
+		return err
+	}
+	if events == nil {
+		events = []eventEntry{}
+	}
+	l := listing{
+		Headers: cmd.Row{"ID", "Start (duration)", "Status", "Owner", "Kind", "Target"},
+		Data:    events,
+	}
+	for i := range events {
+		e := &events[i]
+		status := e.status()
+		if !machineReadable() {
+			status = colorfyEventStatus(e)
+		}
+		l.Rows = append(l.Rows, cmd.Row{
+			e.UniqueID,
+			formatEventStart(e, now),
+			status,
+			e.Owner.Name,
+			e.Kind.Name,
+			formatEventTarget(e.Target),
+		})
+	}
+	return render(context.Stdout, &l)
+}
+
+type eventInfo struct{}
+
+func (c *eventInfo) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "event-info",
+		Usage:   "event-info <event-id>",
+		Desc:    "Shows the details of an event, including its custom data and log.",
+		MinArgs: 1,
+	}
+}
+
+func (c *eventInfo) Run(context *cmd.Context, client *cmd.Client) error {
+	e, err := getEvent(client, context.Args[0])
+	if err != nil {
+		return err
+	}
+	return renderEventDetails(context.Stdout, e, time.Now())
+}
+
+func getEvent(client *cmd.Client, id string) (*eventDetails, error) {
+	u, err := cmd.GetURLVersion("1.1", "/events/"+id)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var e eventDetails
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func renderEventDetails(w io.Writer, e *eventDetails, now time.Time) error {
+	end := "running"
+	if !e.Running {
+		end = e.EndTime.Local().Format(time.Stamp)
+	}
+	fields := [][2]string{
+		{"ID", e.UniqueID},
+		{"Start", e.StartTime.Local().Format(time.Stamp)},
+		{"End", fmt.Sprintf("%s (%s)", end, e.duration(now))},
+		{"Target", formatEventTarget(e.Target)},
+		{"Kind", fmt.Sprintf("%s(%s)", e.Kind.Type, e.Kind.Name)},
+		{"Owner", fmt.Sprintf("%s(%s)", e.Owner.Type, e.Owner.Name)},
+		{"Status", colorfyEventStatus(&e.eventEntry)},
+	}
+	if e.Error != "" {
+		fields = append(fields, [2]string{"Error", cmd.Colorfy(e.Error, "red", "", "")})
+	}
+	fields = append(fields, [2]string{"Cancelable", strconv.FormatBool(e.Cancelable)})
+	if e.CancelInfo.Asked {
+		canceled := "not acknowledged yet"
+		if e.CancelInfo.Canceled {
+			canceled = "acknowledged at " + e.CancelInfo.AckTime.Local().Format(time.Stamp)
+		}
+		fields = append(fields,
+			[2]string{"Cancel requested by", fmt.Sprintf("%s at %s", e.CancelInfo.Owner, e.CancelInfo.StartTime.Local().Format(time.Stamp))},
+			[2]string{"Cancel reason", e.CancelInfo.Reason},
+			[2]string{"Cancel", canceled},
+		)
+	}
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s: %s\n", cmd.Colorfy(f[0], "", "", "bold"), f[1])
+	}
+	customData := []struct {
+		title string
+		raw   bson.Raw
+	}{
+		{"Start Custom Data", e.StartCustomData},
+		{"End Custom Data", e.EndCustomData},
+		{"Other Custom Data", e.OtherCustomData},
+	}
+	for _, data := range customData {
+		if data.raw.Kind == 0 {
+			continue
+		}
+		var value interface{}
+		err := data.raw.Unmarshal(&value)
+		if err != nil {
+			return errors.Wrapf(err, "unable to decode %s", strings.ToLower(data.title))
+		}
+		formatted, err := json.MarshalIndent(value, "    ", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s:\n    %s\n", cmd.Colorfy(data.title, "", "", "bold"), formatted)
+	}
+	if e.Log != "" {
+		fmt.Fprintf(w, "%s:\n", cmd.Colorfy("Log", "", "", "bold"))
+		for _, line := range strings.Split(strings.TrimRight(e.Log, "\n"), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+	return nil
+}
+
+type eventCancel struct {
+	cmd.ConfirmationCommand
+}
+
+func (c *eventCancel) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "event-cancel",
+		Usage: "event-cancel <event-id> <reason> [-y]",
+		Desc: `Requests the cancellation of a running event. Only events marked as
+cancelable can be canceled, and the reason is recorded in the event.`,
+		MinArgs: 2,
+	}
+}
+
+func (c *eventCancel) Run(context *cmd.Context, client *cmd.Client) error {
+	id := context.Args[0]
+	reason := strings.Join(context.Args[1:], " ")
+	if !c.Confirm(context, fmt.Sprintf("Are you sure you want to cancel the event %q?", id)) {
+		return nil
+	}
+	u, err := cmd.GetURLVersion("1.1", "/events/"+id+"/cancel")
+	if err != nil {
+		return err
+	}
+	v := url.Values{"reason": {reason}}
+	req, err := http.NewRequest("POST", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(context.Stdout, "Cancellation successfully requested.")
+	return nil
+}
+
+// eventTailer keeps track of the events already printed by event-tail, so
+// each event is printed when it starts and again when it finishes. With
+// runningOnly, events that already finished when first seen are not printed;
+// the API filter can't be used for that, as it would hide the end of the
+// events being watched.
+type eventTailer struct {
+	filter      url.Values
+	since       time.Time
+	seen        map[string]eventEntry
+	runningOnly bool
+}
+
+func newEventTailer(filter url.Values, since time.Time) *eventTailer {
+	return &eventTailer{filter: filter, since: since, seen: map[string]eventEntry{}}
+}
+
+// poll prints the events started since the last poll and the running events
+// that finished since then.
+func (t *eventTailer) poll(client *cmd.Client, w io.Writer, now time.Time) error {
+	filter := url.Values{}
+	for key, values := range t.filter {
+		filter[key] = values
+	}
+	filter.Set("since", t.since.UTC().Format(time.RFC3339))
+	filter.Set("sort", "starttime")
+	events, err := listEvents(client, filter)
+	if err != nil {
+		return err
+	}
+	var oldestRunning, newest time.Time
+	for i := range events {
+		e := &events[i]
+		previous, seen := t.seen[e.UniqueID]
+		if (!seen && (e.Running || !t.runningOnly)) || (seen && previous.Running && !e.Running) {
+			fmt.Fprintln(w, formatEventLine(e, now))
+		}
+		t.seen[e.UniqueID] = *e
+		if e.Running && (oldestRunning.IsZero() || e.StartTime.Before(oldestRunning)) {
+			oldestRunning = e.StartTime
+		}
+		if e.StartTime.After(newest) {
+			newest = e.StartTime
+		}
+	}
+	// Events still running must be fetched again in the next poll, so their
+	// end is reported.
+	switch {
+	case !oldestRunning.IsZero():
+		t.since = oldestRunning
+	case !newest.IsZero():
+		t.since = newest
+	}
+	// The API filter has a precision of seconds, so events started in the
+	// same second as since are returned again and must be kept.
+	cutoff := t.since.Truncate(time.Second)
+	for id, e := range t.seen {
+		if e.StartTime.Before(cutoff) {
+			delete(t.seen, id)
+		}
+	}
+	return nil
+}
+
+func formatEventLine(e *eventEntry, now time.Time) string {
+	line := fmt.Sprintf("%s %s %s %s by %s: %s",
+		e.StartTime.Local().Format(time.Stamp),
+		e.UniqueID,
+		e.Kind.Name,
+		formatEventTarget(e.Target),
+		e.Owner.Name,
+		colorfyEventStatus(e),
+	)
+	if !e.Running {
+		line += fmt.Sprintf(" (%s)", e.duration(now))
+	}
+	if e.Error != "" {
+		line += ": " + e.Error
+	}
+	return line
+}
+
+type eventTail struct {
+	fs       *gnuflag.FlagSet
+	filter   eventFilter
+	interval time.Duration
+}
+
+func (c *eventTail) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "event-tail",
+		Usage: "event-tail [-t/--target-type <type>] [-v/--target-value <value>] [-k/--kind <kind>] [-o/--owner <owner>] [-r/--running] [--errors] [--since <time>] [--interval/-i 2s]",
+		Desc: `Watches events as they happen, printing a line when each event starts and
+another one when it finishes, until interrupted.
+
+By default, only events started after the command is invoked are displayed.
+Use the [[--since]] flag to include recent events, using either a time in RFC
+3339 format or a duration relative to now, like 30m.
+
+With [[--running]], events that already finished when first seen are skipped,
+but the end of the events displayed as running is still reported.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *eventTail) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		c.filter.flags(c.fs)
+		interval := "Time between requests for new events"
+		c.fs.DurationVar(&c.interval, "interval", 2*time.Second, interval)
+		c.fs.DurationVar(&c.interval, "i", 2*time.Second, interval)
+	}
+	return c.fs
+}
+
+// eventTailSleep is replaced in tests to stop event-tail.
+var eventTailSleep = time.Sleep
+
+func (c *eventTail) Run(context *cmd.Context, client *cmd.Client) error {
+	if c.interval < time.Second {
+		return errors.New("the polling interval must be at least 1s")
+	}
+	if c.filter.until != "" {
+		return errors.New("--until can't be used with event-tail")
+	}
+	now := time.Now()
+	filter, err := c.filter.values(now)
+	if err != nil {
+		return err
+	}
+	since := now
+	if s := filter.Get("since"); s != "" {
+		since, _ = time.Parse(time.RFC3339, s)
+		filter.Del("since")
+	}
+	tailer := newEventTailer(filter, since)
+	if filter.Get("running") != "" {
+		filter.Del("running")
+		tailer.runningOnly = true
+	}
+	for {
+		err = tailer.poll(client, context.Stdout, time.Now())
+		if err != nil {
+			return err
+		}
+		eventTailSleep(c.interval)
+	}
+}
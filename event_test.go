@@ -0,0 +1,329 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestEventFilterValues(c *check.C) {
+	now := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	command := eventList{}
+	err := command.Flags().Parse(true, []string{"-t", "node", "-v", "http://n1:2375", "-k", "node.update", "-o", "admin", "-r", "--errors", "--since", "2h", "--until", "2016-05-01T09:30:00-03:00"})
+	c.Assert(err, check.IsNil)
+	values, err := command.filter.values(now)
+	c.Assert(err, check.IsNil)
+	c.Assert(values, check.DeepEquals, url.Values{
+		"target.type":  {"node"},
+		"target.value": {"http://n1:2375"},
+		"kindname":     {"node.update"},
+		"ownername":    {"admin"},
+		"running":      {"true"},
+		"erroronly":    {"true"},
+		"since":        {"2016-05-01T08:00:00Z"},
+		"until":        {"2016-05-01T12:30:00Z"},
+	})
+	command = eventList{}
+	err = command.Flags().Parse(true, []string{"--since", "yesterday"})
+	c.Assert(err, check.IsNil)
+	_, err = command.filter.values(now)
+	c.Assert(err, check.ErrorMatches, `invalid value for --since: "yesterday"`)
+}
+
+func (s *S) TestParseEventTimeDays(c *check.C) {
+	now := time.Date(2016, 5, 31, 10, 0, 0, 0, time.UTC)
+	t, err := parseEventTime("30d", now)
+	c.Assert(err, check.IsNil)
+	c.Assert(t, check.DeepEquals, time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC))
+	_, err = parseEventTime("xd", now)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestEventListRun(c *check.C) {
+	defer disableColors()()
+	events := `[
+	{"UniqueID": "5728bc4f1c1d2b2bc2a3e4a1", "StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:00:05Z", "Target": {"Type": "node", "Value": "http://n1:2375"}, "Kind": {"Type": "permission", "Name": "node.update"}, "Owner": {"Type": "user", "Name": "admin@tsuru.io"}},
+	{"UniqueID": "5728bc4f1c1d2b2bc2a3e4a2", "StartTime": "2016-05-01T09:00:00Z", "EndTime": "2016-05-01T09:01:00Z", "Target": {"Type": "pool", "Value": "p1"}, "Kind": {"Type": "internal", "Name": "healer"}, "Owner": {"Type": "internal", "Name": "healer"}, "Error": "failed"}
+]`
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: events, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && req.URL.Path == "/1.1/events" && req.URL.RawQuery == "kindname=node.update&limit=10&target.type=node"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := eventList{}
+	err := command.Flags().Parse(true, []string{"-t", "node", "-k", "node.update", "-l", "10"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	first := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC).Local().Format(time.Stamp)
+	second := time.Date(2016, 5, 1, 9, 0, 0, 0, time.UTC).Local().Format(time.Stamp)
+	expected := `+--------------------------+------------------------+---------+----------------+-------------+----------------------+
+| ID                       | Start (duration)       | Status  | Owner          | Kind        | Target               |
++--------------------------+------------------------+---------+----------------+-------------+----------------------+
+| 5728bc4f1c1d2b2bc2a3e4a1 | ` + first + ` (5s)   | success | admin@tsuru.io | node.update | node: http://n1:2375 |
+| 5728bc4f1c1d2b2bc2a3e4a2 | ` + second + ` (1m0s) | error   | healer         | healer      | pool: p1             |
++--------------------------+------------------------+---------+----------------+-------------+----------------------+
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestEventListRunMachineReadable(c *check.C) {
+	trans := &cmdtest.Transport{Status: http.StatusNoContent}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	outputFormat = "json"
+	command := eventList{}
+	command.Flags()
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "[]\n")
+}
+
+func (s *S) TestEventListRunCSV(c *check.C) {
+	os.Unsetenv("TSURU_DISABLE_COLORS")
+	events := `[{"UniqueID": "5728bc4f1c1d2b2bc2a3e4a2", "StartTime": "2016-05-01T09:00:00Z", "EndTime": "2016-05-01T09:01:00Z", "Target": {"Type": "pool", "Value": "p1"}, "Kind": {"Type": "internal", "Name": "healer"}, "Owner": {"Type": "internal", "Name": "healer"}, "Error": "failed"}]`
+	trans := &cmdtest.Transport{Message: events, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	outputFormat = "csv"
+	command := eventList{}
+	command.Flags()
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	start := time.Date(2016, 5, 1, 9, 0, 0, 0, time.UTC).Local().Format(time.Stamp)
+	expected := "ID,Start (duration),Status,Owner,Kind,Target\n5728bc4f1c1d2b2bc2a3e4a2," + start + " (1m0s),error,healer,healer,pool: p1\n"
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestEventInfoRun(c *check.C) {
+	defer disableColors()()
+	data, err := bson.Marshal(bson.M{"image": "tsuru/bs:v2", "nodes": 3})
+	c.Assert(err, check.IsNil)
+	raw := base64.StdEncoding.EncodeToString(data)
+	e := `{"UniqueID": "5728bc4f1c1d2b2bc2a3e4a1", "StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:00:05Z",
+	"Target": {"Type": "node", "Value": "http://n1:2375"}, "Kind": {"Type": "permission", "Name": "node.update"},
+	"Owner": {"Type": "user", "Name": "admin@tsuru.io"}, "Error": "node unreachable", "Cancelable": true,
+	"StartCustomData": {"Kind": 3, "Data": "` + raw + `"}, "EndCustomData": {"Kind": 0, "Data": null},
+	"CancelInfo": {"Owner": "admin@tsuru.io", "StartTime": "2016-05-01T10:00:02Z", "Reason": "wrong node", "Asked": true},
+	"Log": "updating node\nfailed\n"}`
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: e, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && req.URL.Path == "/1.1/events/5728bc4f1c1d2b2bc2a3e4a1"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Args: []string{"5728bc4f1c1d2b2bc2a3e4a1"}}
+	command := eventInfo{}
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC).Local()
+	expected := `ID: 5728bc4f1c1d2b2bc2a3e4a1
+Start: ` + start.Format(time.Stamp) + `
+End: ` + start.Add(5*time.Second).Format(time.Stamp) + ` (5s)
+Target: node: http://n1:2375
+Kind: permission(node.update)
+Owner: user(admin@tsuru.io)
+Status: error
+Error: node unreachable
+Cancelable: true
+Cancel requested by: admin@tsuru.io at ` + start.Add(2*time.Second).Format(time.Stamp) + `
+Cancel reason: wrong node
+Cancel: not acknowledged yet
+Start Custom Data:
+    {
+      "image": "tsuru/bs:v2",
+      "nodes": 3
+    }
+Log:
+    updating node
+    failed
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestEventCancelRun(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusNoContent},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "POST" && req.URL.Path == "/1.1/events/5728bc4f1c1d2b2bc2a3e4a1/cancel" &&
+				req.FormValue("reason") == "wrong node"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stdin:  strings.NewReader("y\n"),
+		Args:   []string{"5728bc4f1c1d2b2bc2a3e4a1", "wrong", "node"},
+	}
+	command := eventCancel{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to cancel the event "5728bc4f1c1d2b2bc2a3e4a1"? (y/n) Cancellation successfully requested.`+"\n")
+}
+
+func (s *S) TestEventCancelRunAborted(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stdin:  strings.NewReader("n\n"),
+		Args:   []string{"5728bc4f1c1d2b2bc2a3e4a1", "wrong node"},
+	}
+	command := eventCancel{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to cancel the event "5728bc4f1c1d2b2bc2a3e4a1"? (y/n) Abort.`+"\n")
+}
+
+func (s *S) TestEventTailerPoll(c *check.C) {
+	defer disableColors()()
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	running := `{"UniqueID": "a1", "StartTime": "2016-05-01T10:00:00Z", "Target": {"Type": "node", "Value": "http://n1:2375"}, "Kind": {"Name": "node.update"}, "Owner": {"Name": "admin"}, "Running": true}`
+	finished := `{"UniqueID": "a1", "StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:00:04Z", "Target": {"Type": "node", "Value": "http://n1:2375"}, "Kind": {"Name": "node.update"}, "Owner": {"Name": "admin"}}`
+	other := `{"UniqueID": "a2", "StartTime": "2016-05-01T10:00:02Z", "EndTime": "2016-05-01T10:00:03Z", "Target": {"Type": "pool", "Value": "p1"}, "Kind": {"Name": "healer"}, "Owner": {"Name": "healer"}, "Error": "failed"}`
+	query := func(since string) func(*http.Request) bool {
+		return func(req *http.Request) bool {
+			return req.URL.Path == "/1.1/events" && req.URL.RawQuery == "kindname=node.update&since="+url.QueryEscape(since)+"&sort=starttime"
+		}
+	}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{Transport: cmdtest.Transport{Message: "[" + running + "]", Status: http.StatusOK}, CondFunc: query("2016-05-01T09:59:00Z")},
+			{Transport: cmdtest.Transport{Message: "[" + running + "," + other + "]", Status: http.StatusOK}, CondFunc: query("2016-05-01T10:00:00Z")},
+			{Transport: cmdtest.Transport{Message: "[" + finished + "," + other + "]", Status: http.StatusOK}, CondFunc: query("2016-05-01T10:00:00Z")},
+			{Transport: cmdtest.Transport{Message: "[" + other + "]", Status: http.StatusOK}, CondFunc: query("2016-05-01T10:00:02Z")},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	tailer := newEventTailer(url.Values{"kindname": {"node.update"}}, start.Add(-time.Minute))
+	var buf bytes.Buffer
+	for i := 0; i < 4; i++ {
+		err := tailer.poll(client, &buf, start.Add(10*time.Second))
+		c.Assert(err, check.IsNil)
+	}
+	first := start.Local().Format(time.Stamp)
+	second := start.Add(2 * time.Second).Local().Format(time.Stamp)
+	c.Assert(buf.String(), check.Equals, first+` a1 node.update node: http://n1:2375 by admin: running
+`+second+` a2 healer pool: p1 by healer: error (1s): failed
+`+first+` a1 node.update node: http://n1:2375 by admin: success (4s)
+`)
+	c.Assert(tailer.seen, check.HasLen, 1)
+}
+
+func (s *S) TestEventTailerPollSameSecond(c *check.C) {
+	defer disableColors()()
+	first := `{"UniqueID": "a1", "StartTime": "2016-05-01T10:00:02.100Z", "EndTime": "2016-05-01T10:00:03Z", "Kind": {"Name": "healer"}, "Owner": {"Name": "healer"}}`
+	second := `{"UniqueID": "a2", "StartTime": "2016-05-01T10:00:02.300Z", "EndTime": "2016-05-01T10:00:03Z", "Kind": {"Name": "healer"}, "Owner": {"Name": "healer"}}`
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "[" + first + "," + second + "]", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.URL.Path == "/1.1/events"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	tailer := newEventTailer(url.Values{}, time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC))
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		err := tailer.poll(client, &buf, time.Date(2016, 5, 1, 10, 0, 10, 0, time.UTC))
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(strings.Count(buf.String(), "\n"), check.Equals, 2)
+	c.Assert(tailer.seen, check.HasLen, 2)
+}
+
+func (s *S) TestEventTailerPollRunningOnly(c *check.C) {
+	defer disableColors()()
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	running := `{"UniqueID": "a1", "StartTime": "2016-05-01T10:00:00Z", "Target": {"Type": "node", "Value": "n1"}, "Kind": {"Name": "node.update"}, "Owner": {"Name": "admin"}, "Running": true}`
+	finished := `{"UniqueID": "a1", "StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:00:04Z", "Target": {"Type": "node", "Value": "n1"}, "Kind": {"Name": "node.update"}, "Owner": {"Name": "admin"}}`
+	other := `{"UniqueID": "a2", "StartTime": "2016-05-01T10:00:02Z", "EndTime": "2016-05-01T10:00:03Z", "Kind": {"Name": "healer"}, "Owner": {"Name": "healer"}}`
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{Transport: cmdtest.Transport{Message: "[" + running + "," + other + "]", Status: http.StatusOK}, CondFunc: func(req *http.Request) bool {
+				return req.URL.Query().Get("running") == ""
+			}},
+			{Transport: cmdtest.Transport{Message: "[" + finished + "," + other + "]", Status: http.StatusOK}, CondFunc: func(req *http.Request) bool {
+				return req.URL.Query().Get("running") == ""
+			}},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	tailer := newEventTailer(url.Values{}, start)
+	tailer.runningOnly = true
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		err := tailer.poll(client, &buf, start.Add(10*time.Second))
+		c.Assert(err, check.IsNil)
+	}
+	stamp := start.Local().Format(time.Stamp)
+	c.Assert(buf.String(), check.Equals, stamp+" a1 node.update node: n1 by admin: running\n"+stamp+" a1 node.update node: n1 by admin: success (4s)\n")
+}
+
+func (s *S) TestEventTailRunValidation(c *check.C) {
+	command := eventTail{}
+	err := command.Flags().Parse(true, []string{"-i", "1ms"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, "the polling interval must be at least 1s")
+	command = eventTail{}
+	err = command.Flags().Parse(true, []string{"--until", "1h"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, "--until can't be used with event-tail")
+}
+
+type stopTail struct{}
+
+func (s *S) TestEventTailRun(c *check.C) {
+	defer disableColors()()
+	oldSleep := eventTailSleep
+	defer func() { eventTailSleep = oldSleep }()
+	var sleeps []time.Duration
+	eventTailSleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		panic(stopTail{})
+	}
+	e := `[{"UniqueID": "a1", "StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:00:01Z", "Target": {"Type": "node", "Value": "n1"}, "Kind": {"Name": "node.create"}, "Owner": {"Name": "admin"}}]`
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: e, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.URL.Path == "/1.1/events" && req.URL.Query().Get("since") == "2016-05-01T09:00:00Z" &&
+				req.URL.Query().Get("target.type") == "node"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := eventTail{}
+	err := command.Flags().Parse(true, []string{"-t", "node", "--since", "2016-05-01T09:00:00Z", "-i", "5s"})
+	c.Assert(err, check.IsNil)
+	func() {
+		defer func() {
+			c.Assert(recover(), check.Equals, stopTail{})
+		}()
+		command.Run(&context, client)
+	}()
+	c.Assert(sleeps, check.DeepEquals, []time.Duration{5 * time.Second})
+	c.Assert(stdout.String(), check.Equals, time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC).Local().Format(time.Stamp)+" a1 node.create node: n1 by admin: success (1s)\n")
+}
@@ -0,0 +1,15 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.8
+// +build !go1.8
+
+package main
+
+import "github.com/pkg/errors"
+
+// executable is only available from os.Executable starting with Go 1.8.
+var executable = func() (string, error) {
+	return "", errors.New("os.Executable is not supported")
+}
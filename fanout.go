@@ -0,0 +1,331 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// labelledTarget is a target registered with target-add.
+type labelledTarget struct {
+	Label string
+	URL   string
+}
+
+// targetSelection holds the value of the --targets and --all-targets global
+// flags.
+type targetSelection struct {
+	labels []string
+	all    bool
+}
+
+// parseTargetsFlag removes the --targets and --all-targets global flags from
+// args, which must come before the command name. The returned selection is
+// nil when none of them was used.
+func parseTargetsFlag(args []string) ([]string, *targetSelection, error) {
+	end := commandIndex(args)
+	result := make([]string, 0, len(args))
+	var selection *targetSelection
+	for i := 0; i < end; i++ {
+		arg := args[i]
+		var value string
+		switch {
+		case arg == "--all-targets":
+			if selection == nil {
+				selection = &targetSelection{}
+			}
+			selection.all = true
+			continue
+		case arg == "--targets":
+			if i+1 >= len(args) {
+				return nil, nil, errors.New("flag needs an argument: --targets")
+			}
+			i++
+			value = args[i]
+		case strings.HasPrefix(arg, "--targets="):
+			value = strings.TrimPrefix(arg, "--targets=")
+		default:
+			result = append(result, arg)
+			continue
+		}
+		if selection == nil {
+			selection = &targetSelection{}
+		}
+		for _, label := range strings.Split(value, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				selection.labels = append(selection.labels, label)
+			}
+		}
+	}
+	result = append(result, args[end:]...)
+	if selection == nil {
+		return result, nil, nil
+	}
+	if selection.all && len(selection.labels) > 0 {
+		return nil, nil, errors.New("--targets and --all-targets are mutually exclusive")
+	}
+	if !selection.all && len(selection.labels) == 0 {
+		return nil, nil, errors.New("flag needs an argument: --targets")
+	}
+	return result, selection, nil
+}
+
+// readTargets returns the targets registered with target-add, sorted by
+// label.
+func readTargets() ([]labelledTarget, error) {
+	data, err := ioutil.ReadFile(cmd.JoinWithUserDir(".tsuru", "targets"))
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(cmd.JoinWithUserDir(".tsuru_targets"))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var targets []labelledTarget
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.Split(line, "\t")
+		if len(parts) == 2 {
+			targets = append(targets, labelledTarget{Label: parts[0], URL: parts[1]})
+		}
+	}
+	sort.Sort(targetsByLabel(targets))
+	return targets, nil
+}
+
+type targetsByLabel []labelledTarget
+
+func (l targetsByLabel) Len() int           { return len(l) }
+func (l targetsByLabel) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l targetsByLabel) Less(i, j int) bool { return l[i].Label < l[j].Label }
+
+func (s *targetSelection) targets(available []labelledTarget) ([]labelledTarget, error) {
+	if s.all {
+		if len(available) == 0 {
+			return nil, errors.New("no targets registered, see target-add")
+		}
+		return available, nil
+	}
+	byLabel := map[string]labelledTarget{}
+	for _, t := range available {
+		byLabel[t.Label] = t
+	}
+	var selected []labelledTarget
+	seen := map[string]bool{}
+	for _, label := range s.labels {
+		t, ok := byLabel[label]
+		if !ok {
+			return nil, errors.Errorf("unknown target %q, see target-list", label)
+		}
+		if !seen[label] {
+			seen[label] = true
+			selected = append(selected, t)
+		}
+	}
+	return selected, nil
+}
+
+// localCommands change the local client configuration, so running them once
+// per target makes no sense.
+var localCommands = map[string]bool{
+	"login":         true,
+	"logout":        true,
+	"target-add":    true,
+	"target-list":   true,
+	"target-remove": true,
+	"target-set":    true,
+}
+
+func checkFanOutSupport(m *cmd.Manager, args []string) error {
+	i := commandIndex(args)
+	if i == len(args) {
+		return errors.New("a command is required when using --targets or --all-targets")
+	}
+	name := args[i]
+	if localCommands[name] {
+		return errors.Errorf("command %q can't run against multiple targets", name)
+	}
+	if confirmable(m, name) && !hasAssumeYes(args[i+1:]) {
+		return errors.Errorf("command %q asks for confirmation, use -y to run it against multiple targets", name)
+	}
+	return nil
+}
+
+// confirmable reports whether the named command asks for confirmation, which
+// can't be answered when it runs against multiple targets, as each run gets
+// no standard input.
+func confirmable(m *cmd.Manager, name string) bool {
+	command, ok := m.Commands[name]
+	if !ok {
+		return false
+	}
+	if deprecated, ok := command.(*cmd.DeprecatedCommand); ok {
+		command = deprecated.Command
+	}
+	flagged, ok := command.(cmd.FlaggedCommand)
+	return ok && flagged.Flags().Lookup("y") != nil
+}
+
+func hasAssumeYes(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--":
+			return false
+		case "-y", "--y", "-assume-yes", "--assume-yes", "-y=true", "--y=true", "-assume-yes=true", "--assume-yes=true":
+			return true
+		}
+	}
+	return false
+}
+
+// runOnTargets runs the command in args against the selected targets, each
+// one with the token stored for it, unless a token is set in the TSURU_TOKEN
+// environment variable.
+func runOnTargets(m *cmd.Manager, selection *targetSelection, args []string, store tokenStore) int {
+	err := checkFanOutSupport(m, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	available, err := readTargets()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	targets, err := selection.targets(available)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var tokens map[string]string
+	if os.Getenv("TSURU_TOKEN") == "" && store != nil {
+		tokens, err = validTokens(store)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return fanOut(targets, tokens, args, os.Stdout, os.Stderr)
+}
+
+func validTokens(store tokenStore) (map[string]string, error) {
+	stored, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tokens := map[string]string{}
+	for _, t := range stored {
+		if t.valid(now) {
+			tokens[t.Target] = t.Token
+		}
+	}
+	return tokens, nil
+}
+
+// executablePath returns the path of the running tsuru-admin binary, falling
+// back to os.Args[0] when it can't be found.
+func executablePath() string {
+	path, err := executable()
+	if err != nil {
+		return os.Args[0]
+	}
+	return path
+}
+
+// runOnTarget runs the tsuru-admin binary with the given arguments against a
+// single target. An empty token means the one in the environment is used.
+var runOnTarget = func(t labelledTarget, token string, args []string, output io.Writer) error {
+	command := exec.Command(executablePath(), args...)
+	command.Env = []string{"TSURU_TARGET=" + t.URL}
+	if token != "" {
+		command.Env = append(command.Env, "TSURU_TOKEN="+token)
+	}
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "TSURU_TARGET=") && (token == "" || !strings.HasPrefix(env, "TSURU_TOKEN=")) {
+			command.Env = append(command.Env, env)
+		}
+	}
+	command.Stdout = output
+	command.Stderr = output
+	return command.Run()
+}
+
+// fanOut runs the command in args concurrently against every target and
+// prints the output of each one grouped under a header, in the order the
+// targets were given. It returns the highest exit status among the runs.
+//
+// When tokens is not nil, each target runs with its token from the map, and
+// targets without a token fail without running the command, so a token is
+// never sent to the wrong target.
+func fanOut(targets []labelledTarget, tokens map[string]string, args []string, stdout, stderr io.Writer) int {
+	outputs := make([]bytes.Buffer, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		var token string
+		if tokens != nil {
+			token = tokens[targets[i].Label]
+			if token == "" {
+				errs[i] = errors.Errorf("there is no valid session for target %q, please use target-set and login", targets[i].Label)
+				continue
+			}
+		}
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			errs[i] = runOnTarget(targets[i], token, args, &outputs[i])
+		}(i, token)
+	}
+	wg.Wait()
+	var status int
+	var failed []string
+	for i, t := range targets {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "=== %s (%s) ===\n", t.Label, t.URL)
+		output := outputs[i].Bytes()
+		stdout.Write(output)
+		if len(output) > 0 && output[len(output)-1] != '\n' {
+			fmt.Fprintln(stdout)
+		}
+		if errs[i] == nil {
+			continue
+		}
+		failed = append(failed, t.Label)
+		code := exitStatus(errs[i])
+		if _, ok := errs[i].(*exec.ExitError); !ok {
+			fmt.Fprintf(stdout, "Error: %s\n", errs[i])
+		}
+		if code > status {
+			status = code
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(stderr, "Command failed on %d of %d targets: %s\n", len(failed), len(targets), strings.Join(failed, ", "))
+	}
+	return status
+}
+
+func exitStatus(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseTargetsFlag(c *check.C) {
+	args, selection, err := parseTargetsFlag([]string{"--targets", "prod,staging", "node-list", "--format=json"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"node-list", "--format=json"})
+	c.Assert(selection, check.DeepEquals, &targetSelection{labels: []string{"prod", "staging"}})
+	args, selection, err = parseTargetsFlag([]string{"--targets=prod", "--targets", "dev", "node-list"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"node-list"})
+	c.Assert(selection, check.DeepEquals, &targetSelection{labels: []string{"prod", "dev"}})
+	args, selection, err = parseTargetsFlag([]string{"node-list", "--targets", "prod"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"node-list", "--targets", "prod"})
+	c.Assert(selection, check.IsNil)
+	args, selection, err = parseTargetsFlag([]string{"--all-targets", "node-list"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"node-list"})
+	c.Assert(selection, check.DeepEquals, &targetSelection{all: true})
+	args, selection, err = parseTargetsFlag([]string{"node-list", "--", "--all-targets"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"node-list", "--", "--all-targets"})
+	c.Assert(selection, check.IsNil)
+}
+
+func (s *S) TestParseTargetsFlagErrors(c *check.C) {
+	_, _, err := parseTargetsFlag([]string{"--targets"})
+	c.Assert(err, check.ErrorMatches, "flag needs an argument: --targets")
+	_, _, err = parseTargetsFlag([]string{"--targets=,", "node-list"})
+	c.Assert(err, check.ErrorMatches, "flag needs an argument: --targets")
+	_, _, err = parseTargetsFlag([]string{"--targets", "prod", "--all-targets", "node-list"})
+	c.Assert(err, check.ErrorMatches, "--targets and --all-targets are mutually exclusive")
+}
+
+func (s *S) TestReadTargets(c *check.C) {
+	home := c.MkDir()
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+	targets, err := readTargets()
+	c.Assert(err, check.IsNil)
+	c.Assert(targets, check.HasLen, 0)
+	err = os.MkdirAll(filepath.Join(home, ".tsuru"), 0700)
+	c.Assert(err, check.IsNil)
+	content := "staging\thttp://staging.tsuru.io\nprod\thttps://tsuru.io\ninvalid line\n"
+	err = ioutil.WriteFile(filepath.Join(home, ".tsuru", "targets"), []byte(content), 0600)
+	c.Assert(err, check.IsNil)
+	targets, err = readTargets()
+	c.Assert(err, check.IsNil)
+	c.Assert(targets, check.DeepEquals, []labelledTarget{
+		{Label: "prod", URL: "https://tsuru.io"},
+		{Label: "staging", URL: "http://staging.tsuru.io"},
+	})
+}
+
+func (s *S) TestTargetSelectionTargets(c *check.C) {
+	available := []labelledTarget{{Label: "dev", URL: "http://dev"}, {Label: "prod", URL: "http://prod"}}
+	targets, err := (&targetSelection{all: true}).targets(available)
+	c.Assert(err, check.IsNil)
+	c.Assert(targets, check.DeepEquals, available)
+	targets, err = (&targetSelection{labels: []string{"prod", "dev", "prod"}}).targets(available)
+	c.Assert(err, check.IsNil)
+	c.Assert(targets, check.DeepEquals, []labelledTarget{available[1], available[0]})
+	_, err = (&targetSelection{labels: []string{"qa"}}).targets(available)
+	c.Assert(err, check.ErrorMatches, `unknown target "qa", see target-list`)
+	_, err = (&targetSelection{all: true}).targets(nil)
+	c.Assert(err, check.ErrorMatches, "no targets registered, see target-add")
+}
+
+func (s *S) TestCheckFanOutSupport(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	c.Assert(checkFanOutSupport(manager, []string{"-v", "2", "node-list"}), check.IsNil)
+	c.Assert(checkFanOutSupport(manager, []string{"target-set", "prod"}), check.ErrorMatches, `command "target-set" can't run against multiple targets`)
+	c.Assert(checkFanOutSupport(manager, nil), check.ErrorMatches, "a command is required when using --targets or --all-targets")
+}
+
+func (s *S) TestCheckFanOutSupportConfirmation(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	err := checkFanOutSupport(manager, []string{"pool-remove", "p1"})
+	c.Assert(err, check.ErrorMatches, `command "pool-remove" asks for confirmation, use -y to run it against multiple targets`)
+	err = checkFanOutSupport(manager, []string{"pool-remove", "p1", "--", "-y"})
+	c.Assert(err, check.NotNil)
+	c.Assert(checkFanOutSupport(manager, []string{"pool-remove", "-y", "p1"}), check.IsNil)
+	c.Assert(checkFanOutSupport(manager, []string{"pool-remove", "p1", "--assume-yes"}), check.IsNil)
+}
+
+func (s *S) TestFanOut(c *check.C) {
+	oldRunOnTarget := runOnTarget
+	defer func() { runOnTarget = oldRunOnTarget }()
+	runOnTarget = func(t labelledTarget, token string, args []string, output io.Writer) error {
+		switch t.Label {
+		case "dev":
+			return errors.New("exec: not found")
+		case "qa":
+			fmt.Fprint(output, "failed")
+			return exec.Command("sh", "-c", "exit 3").Run()
+		}
+		fmt.Fprintf(output, "%s on %s\n", strings.Join(args, " "), t.URL)
+		return nil
+	}
+	var stdout, stderr bytes.Buffer
+	targets := []labelledTarget{
+		{Label: "prod", URL: "http://prod"},
+		{Label: "dev", URL: "http://dev"},
+		{Label: "qa", URL: "http://qa"},
+	}
+	status := fanOut(targets, nil, []string{"node-list"}, &stdout, &stderr)
+	c.Assert(status, check.Equals, 3)
+	expected := `=== prod (http://prod) ===
+node-list on http://prod
+
+=== dev (http://dev) ===
+Error: exec: not found
+
+=== qa (http://qa) ===
+failed
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+	c.Assert(stderr.String(), check.Equals, "Command failed on 2 of 3 targets: dev, qa\n")
+}
+
+func (s *S) TestFanOutSuccess(c *check.C) {
+	oldRunOnTarget := runOnTarget
+	defer func() { runOnTarget = oldRunOnTarget }()
+	runOnTarget = func(t labelledTarget, token string, args []string, output io.Writer) error {
+		return nil
+	}
+	var stdout, stderr bytes.Buffer
+	status := fanOut([]labelledTarget{{Label: "prod", URL: "http://prod"}}, nil, nil, &stdout, &stderr)
+	c.Assert(status, check.Equals, 0)
+	c.Assert(stdout.String(), check.Equals, "=== prod (http://prod) ===\n")
+	c.Assert(stderr.String(), check.Equals, "")
+}
+
+func (s *S) TestExecutablePath(c *check.C) {
+	oldExecutable := executable
+	defer func() { executable = oldExecutable }()
+	executable = func() (string, error) {
+		return "/usr/local/bin/tsuru-admin", nil
+	}
+	c.Assert(executablePath(), check.Equals, "/usr/local/bin/tsuru-admin")
+	executable = func() (string, error) {
+		return "", errors.New("not found")
+	}
+	c.Assert(executablePath(), check.Equals, os.Args[0])
+}
@@ -0,0 +1,408 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/healer"
+	"github.com/tsuru/tsuru/provision"
+	dockerHealer "github.com/tsuru/tsuru/provision/docker/healer"
+)
+
+func getNodeHealingConfig(client *cmd.Client) (map[string]healer.NodeHealerConfig, error) {
+	u, err := cmd.GetURLVersion("1.3", "/healing/node")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var conf map[string]healer.NodeHealerConfig
+	err = json.NewDecoder(resp.Body).Decode(&conf)
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// nodeHealingConfigEntry is the healing configuration for one pool. The
+// default configuration, applied to pools without their own, has an empty
+// Pool.
+type nodeHealingConfigEntry struct {
+	Pool string
+	healer.NodeHealerConfig
+}
+
+type getNodeHealingConfigCmd struct {
+	fs   *gnuflag.FlagSet
+	node string
+}
+
+func (c *getNodeHealingConfigCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "node-healing-info",
+		Usage: "node-healing-info [--node/-n <address>]",
+		Desc: `Show the current configuration for active healing nodes.
+
+With [[--node]], shows the configuration that applies to a single node,
+resolved from the configuration of its pool and the default one, with the
+source of each value. The health data kept by the cluster for the node is
+displayed as well: its status, consecutive failures, last success and last
+error.`,
+	}
+}
+
+func (c *getNodeHealingConfigCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		node := "Show the configuration that applies to the node with this address"
+		c.fs.StringVar(&c.node, "node", "", node)
+		c.fs.StringVar(&c.node, "n", "", node)
+	}
+	return c.fs
+}
+
+func (c *getNodeHealingConfigCmd) formatted() {}
+
+func (c *getNodeHealingConfigCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	conf, err := getNodeHealingConfig(client)
+	if err != nil {
+		return err
+	}
+	if c.node != "" {
+		return c.runNode(ctx, client, conf)
+	}
+	poolNames := make([]string, 0, len(conf))
+	for pool := range conf {
+		if pool != "" {
+			poolNames = append(poolNames, pool)
+		}
+	}
+	sort.Strings(poolNames)
+	if machineReadable() {
+		return c.render(ctx, conf, poolNames)
+	}
+	baseConf := conf[""]
+	fmt.Fprint(ctx.Stdout, "Default:\n")
+	tbl := cmd.NewTable()
+	tbl.Headers = cmd.Row{"Config", "Value"}
+	for _, row := range healingConfigRows(baseConf) {
+		tbl.AddRow(row[:2])
+	}
+	fmt.Fprint(ctx.Stdout, tbl.String())
+	if len(poolNames) > 0 {
+		fmt.Fprintln(ctx.Stdout)
+	}
+	for i, name := range poolNames {
+		fmt.Fprintf(ctx.Stdout, "Pool %q:\n", name)
+		tbl := cmd.NewTable()
+		tbl.Headers = cmd.Row{"Config", "Value", "Inherited"}
+		for _, row := range healingConfigRows(conf[name]) {
+			tbl.AddRow(row)
+		}
+		fmt.Fprint(ctx.Stdout, tbl.String())
+		if i < len(poolNames)-1 {
+			fmt.Fprintln(ctx.Stdout)
+		}
+	}
+	return nil
+}
+
+// nodeHealingInfo is the healing configuration that applies to a node, with
+// the source of each value, and the health data the cluster keeps in the
+// node metadata.
+type nodeHealingInfo struct {
+	Address       string
+	Pool          string
+	Status        string
+	Config        healer.NodeHealerConfig
+	Sources       map[string]string
+	Failures      int
+	LastSuccess   string
+	LastError     string
+	DisabledUntil string
+}
+
+// healingConfigFields are the names of the healing config fields, in the
+// order of the rows returned by healingConfigRows.
+var healingConfigFields = []string{"Enabled", "MaxUnresponsiveTime", "MaxTimeSinceSuccess"}
+
+func newNodeHealingInfo(node provision.NodeSpec, conf map[string]healer.NodeHealerConfig) *nodeHealingInfo {
+	info := nodeHealingInfo{
+		Address:       node.Address,
+		Pool:          nodePool(node),
+		Status:        node.Status,
+		Config:        conf[""],
+		LastSuccess:   node.Metadata["LastSuccess"],
+		LastError:     node.Metadata["LastError"],
+		DisabledUntil: node.Metadata["DisabledUntil"],
+	}
+	info.Failures, _ = strconv.Atoi(node.Metadata["Failures"])
+	inherited := []bool{true, true, true}
+	if poolConf, ok := conf[info.Pool]; ok && info.Pool != "" {
+		info.Config = poolConf
+		inherited = []bool{poolConf.EnabledInherited, poolConf.MaxUnresponsiveTimeInherited, poolConf.MaxTimeSinceSuccessInherited}
+	}
+	info.Sources = make(map[string]string, len(healingConfigFields))
+	for i, field := range healingConfigFields {
+		info.Sources[field] = "default"
+		if !inherited[i] {
+			info.Sources[field] = fmt.Sprintf("pool %q", info.Pool)
+		}
+	}
+	return &info
+}
+
+func (c *getNodeHealingConfigCmd) runNode(ctx *cmd.Context, client *cmd.Client, conf map[string]healer.NodeHealerConfig) error {
+	result, err := listNodes(client)
+	if err != nil {
+		return err
+	}
+	var info *nodeHealingInfo
+	for _, node := range result.Nodes {
+		if node.Address == c.node {
+			info = newNodeHealingInfo(node, conf)
+			break
+		}
+	}
+	if info == nil {
+		return errors.Errorf("node %s not found", c.node)
+	}
+	l := listing{
+		Headers: cmd.Row{"Config", "Value", "Source"},
+		Data:    info,
+	}
+	for i, row := range healingConfigRows(info.Config) {
+		l.Rows = append(l.Rows, cmd.Row{row[0], row[1], info.Sources[healingConfigFields[i]]})
+	}
+	if machineReadable() {
+		return render(ctx.Stdout, &l)
+	}
+	pool := info.Pool
+	if pool == "" {
+		pool = "-"
+	}
+	fmt.Fprintf(ctx.Stdout, "Node: %s\nPool: %s\n", info.Address, pool)
+	err = render(ctx.Stdout, &l)
+	if err != nil {
+		return err
+	}
+	lastSuccess := "never"
+	if info.LastSuccess != "" {
+		lastSuccess = formatMetadataTime(info.LastSuccess)
+	}
+	fmt.Fprintf(ctx.Stdout, "Status: %s\nFailures: %d\nLast success: %s\n", info.Status, info.Failures, lastSuccess)
+	if info.LastError != "" {
+		fmt.Fprintf(ctx.Stdout, "Last error: %s\n", info.LastError)
+	}
+	if info.DisabledUntil != "" {
+		fmt.Fprintf(ctx.Stdout, "Disabled until: %s\n", formatMetadataTime(info.DisabledUntil))
+	}
+	return nil
+}
+
+// formatMetadataTime formats a time stored as RFC3339 in the node metadata,
+// returning the raw value when it can't be parsed.
+func formatMetadataTime(value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.Local().Format(time.Stamp)
+}
+
+func (c *getNodeHealingConfigCmd) render(ctx *cmd.Context, conf map[string]healer.NodeHealerConfig, poolNames []string) error {
+	entries := []nodeHealingConfigEntry{{NodeHealerConfig: conf[""]}}
+	for _, name := range poolNames {
+		entries = append(entries, nodeHealingConfigEntry{Pool: name, NodeHealerConfig: conf[name]})
+	}
+	l := listing{
+		Headers: cmd.Row{"Pool", "Config", "Value", "Inherited"},
+		Data:    entries,
+	}
+	for _, entry := range entries {
+		for _, row := range healingConfigRows(entry.NodeHealerConfig) {
+			l.Rows = append(l.Rows, append(cmd.Row{entry.Pool}, row...))
+		}
+	}
+	return render(ctx.Stdout, &l)
+}
+
+func healingConfigRows(conf healer.NodeHealerConfig) []cmd.Row {
+	v := func(v *int) string {
+		if v == nil || *v == 0 {
+			return "disabled"
+		}
+		return fmt.Sprintf("%ds", *v)
+	}
+	return []cmd.Row{
+		{"Enabled", fmt.Sprintf("%v", conf.Enabled != nil && *conf.Enabled), strconv.FormatBool(conf.EnabledInherited)},
+		{"Max unresponsive time", v(conf.MaxUnresponsiveTime), strconv.FormatBool(conf.MaxUnresponsiveTimeInherited)},
+		{"Max time since success", v(conf.MaxTimeSinceSuccess), strconv.FormatBool(conf.MaxTimeSinceSuccessInherited)},
+	}
+}
+
+type listHealingHistoryCmd struct {
+	fs            *gnuflag.FlagSet
+	nodeOnly      bool
+	containerOnly bool
+}
+
+func (c *listHealingHistoryCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "docker-healing-list",
+		Usage: "docker-healing-list [--node] [--container]",
+		Desc:  "List healing history for nodes or containers.",
+	}
+}
+
+func (c *listHealingHistoryCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		c.fs.BoolVar(&c.nodeOnly, "node", false, "List only healing process started for nodes")
+		c.fs.BoolVar(&c.containerOnly, "container", false, "List only healing process started for containers")
+	}
+	return c.fs
+}
+
+func (c *listHealingHistoryCmd) formatted() {}
+
+func (c *listHealingHistoryCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	var filter string
+	if c.nodeOnly && !c.containerOnly {
+		filter = "node"
+	}
+	if c.containerOnly && !c.nodeOnly {
+		filter = "container"
+	}
+	history, err := listHealingHistory(client, filter)
+	if err != nil {
+		return err
+	}
+	filters := []string{"node", "container"}
+	if filter != "" {
+		filters = []string{filter}
+	}
+	if machineReadable() {
+		return renderHealingHistory(ctx, history, filters)
+	}
+	for _, f := range filters {
+		fmt.Fprintln(ctx.Stdout, strings.ToUpper(f[:1])+f[1:]+":")
+		t := cmd.Table{Headers: cmd.Row{"Start", "Finish", "Success", "Failing", "Created", "Error"}}
+		for _, event := range healingEventsFor(history, f) {
+			failing, created := healingEventTargets(event, f)
+			if len(failing) > 10 && f == "container" {
+				failing = failing[:10]
+			}
+			if len(created) > 10 && f == "container" {
+				created = created[:10]
+			}
+			var endTime string
+			if event.EndTime.IsZero() {
+				endTime = "in progress"
+			} else {
+				endTime = event.EndTime.Local().Format(time.Stamp)
+			}
+			t.AddRow(cmd.Row{
+				event.StartTime.Local().Format(time.Stamp),
+				endTime,
+				fmt.Sprintf("%t", event.Successful),
+				failing,
+				created,
+				event.Error,
+			})
+		}
+		t.LineSeparator = true
+		ctx.Stdout.Write(t.Bytes())
+	}
+	return nil
+}
+
+func listHealingHistory(client *cmd.Client, filter string) ([]dockerHealer.HealingEvent, error) {
+	url, err := cmd.GetURL(fmt.Sprintf("/docker/healing?filter=%s", filter))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var history []dockerHealer.HealingEvent
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&history)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+func healingEventsFor(history []dockerHealer.HealingEvent, filter string) []dockerHealer.HealingEvent {
+	var events []dockerHealer.HealingEvent
+	for _, event := range history {
+		if event.Action == filter+"-healing" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// healingEventTargets returns the failing and created node addresses, or
+// container IDs, of a healing event.
+func healingEventTargets(event dockerHealer.HealingEvent, filter string) (string, string) {
+	if filter == "node" {
+		return event.FailingNode.Address, event.CreatedNode.Address
+	}
+	return event.FailingContainer.ID, event.CreatedContainer.ID
+}
+
+func renderHealingHistory(ctx *cmd.Context, history []dockerHealer.HealingEvent, filters []string) error {
+	events := []dockerHealer.HealingEvent{}
+	l := listing{
+		Headers: cmd.Row{"Action", "Start", "Finish", "Success", "Failing", "Created", "Error"},
+	}
+	for _, f := range filters {
+		for _, event := range healingEventsFor(history, f) {
+			events = append(events, event)
+			failing, created := healingEventTargets(event, f)
+			var endTime string
+			if !event.EndTime.IsZero() {
+				endTime = event.EndTime.Format(time.RFC3339)
+			}
+			l.Rows = append(l.Rows, cmd.Row{
+				event.Action,
+				event.StartTime.Format(time.RFC3339),
+				endTime,
+				strconv.FormatBool(event.Successful),
+				failing,
+				created,
+				event.Error,
+			})
+		}
+	}
+	l.Data = events
+	return render(ctx.Stdout, &l)
+}
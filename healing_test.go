@@ -0,0 +1,236 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+const nodeHealingConfigJSON = `{
+	"": {"Enabled": true, "MaxUnresponsiveTime": 30, "MaxTimeSinceSuccess": 60},
+	"p1": {"Enabled": false, "MaxUnresponsiveTime": 30, "MaxTimeSinceSuccess": 120, "MaxUnresponsiveTimeInherited": true}
+}`
+
+func (s *S) TestGetNodeHealingConfigCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: nodeHealingConfigJSON, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/1.3/healing/node")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := getNodeHealingConfigCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Default:
++------------------------+-------+
+| Config                 | Value |
++------------------------+-------+
+| Enabled                | true  |
+| Max unresponsive time  | 30s   |
+| Max time since success | 60s   |
++------------------------+-------+
+
+Pool "p1":
++------------------------+-------+-----------+
+| Config                 | Value | Inherited |
++------------------------+-------+-----------+
+| Enabled                | false | false     |
+| Max unresponsive time  | 30s   | true      |
+| Max time since success | 120s  | false     |
++------------------------+-------+-----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestGetNodeHealingConfigCmdRunCSV(c *check.C) {
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: nodeHealingConfigJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := getNodeHealingConfigCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Pool,Config,Value,Inherited
+,Enabled,true,false
+,Max unresponsive time,30s,false
+,Max time since success,60s,false
+p1,Enabled,false,false
+p1,Max unresponsive time,30s,true
+p1,Max time since success,120s,false
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestGetNodeHealingConfigCmdRunJSON(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: `{"": {"Enabled": true, "MaxUnresponsiveTime": 30}}`, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := getNodeHealingConfigCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s)\[\n  \{\n    "Pool": "",\n    "Enabled": true,\n.*"MaxUnresponsiveTime": 30,\n.*`)
+}
+
+const healingNodesJSON = `{"nodes": [
+	{"Address": "http://n1:2375", "Status": "ready", "Metadata": {"pool": "p1", "Failures": "2", "LastSuccess": "2016-05-01T10:00:00Z", "LastError": "connection refused"}},
+	{"Address": "http://n2:2375", "Status": "waiting", "Metadata": {"pool": "p2"}}
+]}`
+
+func nodeHealingInfoTransport() http.RoundTripper {
+	return &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/1.3/healing/node", nodeHealingConfigJSON),
+			getTransport("/1.2/node", healingNodesJSON),
+		},
+	}
+}
+
+func (s *S) TestGetNodeHealingConfigCmdRunNode(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: nodeHealingInfoTransport()}, nil, s.manager)
+	command := getNodeHealingConfigCmd{}
+	command.Flags().Parse(true, []string{"--node", "http://n1:2375"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	lastSuccess := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC).Local().Format(time.Stamp)
+	expected := `Node: http://n1:2375
+Pool: p1
++------------------------+-------+-----------+
+| Config                 | Value | Source    |
++------------------------+-------+-----------+
+| Enabled                | false | pool "p1" |
+| Max unresponsive time  | 30s   | default   |
+| Max time since success | 120s  | pool "p1" |
++------------------------+-------+-----------+
+Status: ready
+Failures: 2
+Last success: ` + lastSuccess + `
+Last error: connection refused
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestGetNodeHealingConfigCmdRunNodeDefaultConfig(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: nodeHealingInfoTransport()}, nil, s.manager)
+	command := getNodeHealingConfigCmd{}
+	command.Flags().Parse(true, []string{"-n", "http://n2:2375"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Node: http://n2:2375
+Pool: p2
++------------------------+-------+---------+
+| Config                 | Value | Source  |
++------------------------+-------+---------+
+| Enabled                | true  | default |
+| Max unresponsive time  | 30s   | default |
+| Max time since success | 60s   | default |
++------------------------+-------+---------+
+Status: waiting
+Failures: 0
+Last success: never
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestGetNodeHealingConfigCmdRunNodeJSON(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: nodeHealingInfoTransport()}, nil, s.manager)
+	command := getNodeHealingConfigCmd{}
+	command.Flags().Parse(true, []string{"--node", "http://n1:2375"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	var info nodeHealingInfo
+	err = json.Unmarshal(buf.Bytes(), &info)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Pool, check.Equals, "p1")
+	c.Assert(info.Failures, check.Equals, 2)
+	c.Assert(*info.Config.MaxTimeSinceSuccess, check.Equals, 120)
+	c.Assert(info.Sources, check.DeepEquals, map[string]string{
+		"Enabled":             `pool "p1"`,
+		"MaxUnresponsiveTime": "default",
+		"MaxTimeSinceSuccess": `pool "p1"`,
+	})
+}
+
+func (s *S) TestGetNodeHealingConfigCmdRunNodeNotFound(c *check.C) {
+	client := cmd.NewClient(&http.Client{Transport: nodeHealingInfoTransport()}, nil, s.manager)
+	command := getNodeHealingConfigCmd{}
+	command.Flags().Parse(true, []string{"--node", "http://n9:2375"})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, client)
+	c.Assert(err, check.ErrorMatches, "node http://n9:2375 not found")
+}
+
+func healingHistoryJSON() string {
+	start := time.Date(2016, time.March, 2, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+	return fmt.Sprintf(`[
+		{"Action": "node-healing", "StartTime": %q, "EndTime": %q, "Successful": true,
+		 "FailingNode": {"Address": "addr1"}, "CreatedNode": {"Address": "addr2"}},
+		{"Action": "container-healing", "StartTime": %q, "Successful": false, "Error": "boom",
+		 "FailingContainer": {"ID": "123456789012345"}}
+	]`, start.Format(time.RFC3339), end.Format(time.RFC3339), start.Format(time.RFC3339))
+}
+
+func (s *S) TestListHealingHistoryCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: healingHistoryJSON(), Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/healing") &&
+				req.URL.Query().Get("filter") == "container"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listHealingHistoryCmd{}
+	command.Flags().Parse(true, []string{"--container"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	start := time.Date(2016, time.March, 2, 10, 0, 0, 0, time.UTC).Local().Format(time.Stamp)
+	expected := `Container:
++-----------------+-------------+---------+------------+---------+-------+
+| Start           | Finish      | Success | Failing    | Created | Error |
++-----------------+-------------+---------+------------+---------+-------+
+| ` + start + ` | in progress | false   | 1234567890 |         | boom  |
++-----------------+-------------+---------+------------+---------+-------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestListHealingHistoryCmdRunCSV(c *check.C) {
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: healingHistoryJSON(), Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listHealingHistoryCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Action,Start,Finish,Success,Failing,Created,Error
+node-healing,2016-03-02T10:00:00Z,2016-03-02T10:01:00Z,true,addr1,addr2,
+container-healing,2016-03-02T10:00:00Z,,false,123456789012345,,boom
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
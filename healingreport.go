@@ -0,0 +1,233 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	dockerHealer "github.com/tsuru/tsuru/provision/docker/healer"
+)
+
+// healingStats aggregates the node healings of a pool or of a single node.
+// Node is empty for the totals of a pool.
+type healingStats struct {
+	Pool                    string
+	Node                    string `json:",omitempty"`
+	Healings                int
+	Successful              int
+	Failed                  int
+	MeanTimeBetweenHealings time.Duration
+	MeanTimeToRecover       time.Duration
+	ReplacementCandidate    bool `json:",omitempty"`
+	starts                  []time.Time
+	recovering              time.Duration
+}
+
+func (s *healingStats) add(event *dockerHealer.HealingEvent) {
+	s.Healings++
+	s.starts = append(s.starts, event.StartTime)
+	if event.EndTime.IsZero() {
+		return
+	}
+	if !event.Successful {
+		s.Failed++
+		return
+	}
+	s.Successful++
+	s.recovering += event.EndTime.Sub(event.StartTime)
+}
+
+func (s *healingStats) finish() {
+	if s.Successful > 0 {
+		s.MeanTimeToRecover = s.recovering / time.Duration(s.Successful) / time.Second * time.Second
+	}
+	if len(s.starts) < 2 {
+		return
+	}
+	sort.Sort(timeSlice(s.starts))
+	between := s.starts[len(s.starts)-1].Sub(s.starts[0])
+	s.MeanTimeBetweenHealings = between / time.Duration(len(s.starts)-1) / time.Second * time.Second
+}
+
+func (s *healingStats) successRatio() string {
+	finished := s.Successful + s.Failed
+	if finished == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d%%", s.Successful*100/finished)
+}
+
+type timeSlice []time.Time
+
+func (s timeSlice) Len() int           { return len(s) }
+func (s timeSlice) Less(i, j int) bool { return s[i].Before(s[j]) }
+func (s timeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type healingStatsList []*healingStats
+
+func (l healingStatsList) Len() int      { return len(l) }
+func (l healingStatsList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l healingStatsList) Less(i, j int) bool {
+	if l[i].Pool != l[j].Pool {
+		return l[i].Pool < l[j].Pool
+	}
+	return l[i].Node < l[j].Node
+}
+
+type healingReport struct {
+	Pools []*healingStats
+	Nodes []*healingStats
+}
+
+// newHealingReport aggregates the node healings started after since in the
+// given pool, or in all pools when pool is empty. Nodes healed more than
+// replaceAfter times are flagged as candidates for replacement.
+func newHealingReport(history []dockerHealer.HealingEvent, since time.Time, pool string, replaceAfter int) *healingReport {
+	pools := map[string]*healingStats{}
+	nodes := map[string]*healingStats{}
+	for i := range history {
+		event := &history[i]
+		if event.Action != "node-healing" || event.StartTime.Before(since) {
+			continue
+		}
+		poolName := nodePool(event.FailingNode)
+		if pool != "" && poolName != pool {
+			continue
+		}
+		if pools[poolName] == nil {
+			pools[poolName] = &healingStats{Pool: poolName}
+		}
+		pools[poolName].add(event)
+		addr := event.FailingNode.Address
+		if nodes[addr] == nil {
+			nodes[addr] = &healingStats{Pool: poolName, Node: addr}
+		}
+		nodes[addr].add(event)
+	}
+	report := healingReport{Pools: []*healingStats{}, Nodes: []*healingStats{}}
+	for _, stats := range pools {
+		stats.finish()
+		report.Pools = append(report.Pools, stats)
+	}
+	for _, stats := range nodes {
+		stats.finish()
+		stats.ReplacementCandidate = stats.Healings > replaceAfter
+		report.Nodes = append(report.Nodes, stats)
+	}
+	sort.Sort(healingStatsList(report.Pools))
+	sort.Sort(healingStatsList(report.Nodes))
+	return &report
+}
+
+type healingReportCmd struct {
+	fs           *gnuflag.FlagSet
+	since        string
+	pool         string
+	replaceAfter int
+}
+
+func (c *healingReportCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "healing-report",
+		Usage: "healing-report [--since <time>] [-p/--pool <pool>] [--replace-after 3]",
+		Desc: `Summarizes the node healing history per pool and per node: the number of
+healings, how many succeeded and failed, the mean time between healings and
+the mean time to recover, that is, the mean duration of successful healings.
+
+The [[--since]] flag accepts either a time in RFC 3339 format or a duration
+relative to now, like 12h or 30d. Nodes healed more than [[--replace-after]]
+times are flagged as candidates for permanent replacement.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *healingReportCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		c.fs.StringVar(&c.since, "since", "", "Consider only healings started after the given time, either in RFC 3339 format or as a duration relative to now, like 30d")
+		pool := "Consider only healings of nodes in this pool"
+		c.fs.StringVar(&c.pool, "pool", "", pool)
+		c.fs.StringVar(&c.pool, "p", "", pool)
+		c.fs.IntVar(&c.replaceAfter, "replace-after", 3, "Flag nodes healed more than this number of times as candidates for replacement")
+	}
+	return c.fs
+}
+
+func (c *healingReportCmd) formatted() {}
+
+func (c *healingReportCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	var since time.Time
+	if c.since != "" {
+		var err error
+		since, err = parseEventTime(c.since, time.Now())
+		if err != nil {
+			return errors.Errorf("invalid value for --since: %q", c.since)
+		}
+	}
+	history, err := listHealingHistory(client, "node")
+	if err != nil {
+		return err
+	}
+	report := newHealingReport(history, since, c.pool, c.replaceAfter)
+	if machineReadable() {
+		l := listing{
+			Headers: cmd.Row{"Pool", "Node", "Healings", "Successful", "Failed", "Mean time between healings", "Mean time to recover", "Replacement candidate"},
+			Data:    report,
+		}
+		for _, stats := range append(report.Pools, report.Nodes...) {
+			l.Rows = append(l.Rows, cmd.Row{
+				stats.Pool,
+				stats.Node,
+				strconv.Itoa(stats.Healings),
+				strconv.Itoa(stats.Successful),
+				strconv.Itoa(stats.Failed),
+				stats.MeanTimeBetweenHealings.String(),
+				stats.MeanTimeToRecover.String(),
+				strconv.FormatBool(stats.ReplacementCandidate),
+			})
+		}
+		return render(ctx.Stdout, &l)
+	}
+	if len(report.Nodes) == 0 {
+		fmt.Fprintln(ctx.Stdout, "No node healings found.")
+		return nil
+	}
+	duration := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return d.String()
+	}
+	fmt.Fprintln(ctx.Stdout, "Pools:")
+	tbl := cmd.NewTable()
+	tbl.Headers = cmd.Row{"Pool", "Healings", "Success ratio", "Mean time between healings", "Mean time to recover"}
+	for _, stats := range report.Pools {
+		tbl.AddRow(cmd.Row{stats.Pool, strconv.Itoa(stats.Healings), stats.successRatio(), duration(stats.MeanTimeBetweenHealings), duration(stats.MeanTimeToRecover)})
+	}
+	fmt.Fprint(ctx.Stdout, tbl.String())
+	fmt.Fprintln(ctx.Stdout, "Nodes:")
+	tbl = cmd.NewTable()
+	tbl.Headers = cmd.Row{"Pool", "Node", "Healings", "Success ratio", "Mean time between healings", "Mean time to recover"}
+	var candidates int
+	for _, stats := range report.Nodes {
+		healings := strconv.Itoa(stats.Healings)
+		if stats.ReplacementCandidate {
+			candidates++
+			healings = cmd.Colorfy(healings+" (*)", "red", "", "")
+		}
+		tbl.AddRow(cmd.Row{stats.Pool, stats.Node, healings, stats.successRatio(), duration(stats.MeanTimeBetweenHealings), duration(stats.MeanTimeToRecover)})
+	}
+	fmt.Fprint(ctx.Stdout, tbl.String())
+	if candidates > 0 {
+		fmt.Fprintf(ctx.Stdout, "(*) %d node(s) healed more than %d times, consider replacing them.\n", candidates, c.replaceAfter)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"github.com/tsuru/tsuru/provision"
+	dockerHealer "github.com/tsuru/tsuru/provision/docker/healer"
+	"gopkg.in/check.v1"
+)
+
+func nodeHealing(addr, pool string, start time.Time, took time.Duration, successful bool) dockerHealer.HealingEvent {
+	event := dockerHealer.HealingEvent{
+		Action:      "node-healing",
+		StartTime:   start,
+		FailingNode: provision.NodeSpec{Address: addr, Metadata: map[string]string{"pool": pool}},
+		Successful:  successful,
+	}
+	if took > 0 {
+		event.EndTime = start.Add(took)
+	}
+	return event
+}
+
+func (s *S) TestNewHealingReport(c *check.C) {
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	history := []dockerHealer.HealingEvent{
+		nodeHealing("http://n1:2375", "p1", start.Add(2*time.Hour), 3*time.Minute, true),
+		nodeHealing("http://n1:2375", "p1", start, time.Minute, true),
+		nodeHealing("http://n1:2375", "p1", start.Add(4*time.Hour), time.Minute, false),
+		nodeHealing("http://n2:2375", "p1", start.Add(time.Hour), 0, false),
+		nodeHealing("http://n3:2375", "p2", start.Add(-48*time.Hour), time.Minute, true),
+		{Action: "container-healing", StartTime: start},
+	}
+	report := newHealingReport(history, start.Add(-time.Hour), "", 2)
+	c.Assert(report.Pools, check.DeepEquals, []*healingStats{{
+		Pool:                    "p1",
+		Healings:                4,
+		Successful:              2,
+		Failed:                  1,
+		MeanTimeBetweenHealings: 80 * time.Minute,
+		MeanTimeToRecover:       2 * time.Minute,
+		starts:                  []time.Time{start, start.Add(time.Hour), start.Add(2 * time.Hour), start.Add(4 * time.Hour)},
+		recovering:              4 * time.Minute,
+	}})
+	c.Assert(report.Nodes, check.HasLen, 2)
+	c.Assert(report.Nodes[0].Node, check.Equals, "http://n1:2375")
+	c.Assert(report.Nodes[0].Healings, check.Equals, 3)
+	c.Assert(report.Nodes[0].MeanTimeBetweenHealings, check.Equals, 2*time.Hour)
+	c.Assert(report.Nodes[0].ReplacementCandidate, check.Equals, true)
+	c.Assert(report.Nodes[0].successRatio(), check.Equals, "66%")
+	c.Assert(report.Nodes[1].Node, check.Equals, "http://n2:2375")
+	c.Assert(report.Nodes[1].ReplacementCandidate, check.Equals, false)
+	c.Assert(report.Nodes[1].MeanTimeBetweenHealings, check.Equals, time.Duration(0))
+	c.Assert(report.Nodes[1].successRatio(), check.Equals, "-")
+	report = newHealingReport(history, time.Time{}, "p2", 2)
+	c.Assert(report.Pools, check.HasLen, 1)
+	c.Assert(report.Nodes, check.HasLen, 1)
+	c.Assert(report.Nodes[0].Node, check.Equals, "http://n3:2375")
+}
+
+const healingReportHistoryJSON = `[
+	{"Action": "node-healing", "StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:02:00Z", "Successful": true,
+	 "FailingNode": {"Address": "http://n1:2375", "Metadata": {"pool": "p1"}}},
+	{"Action": "node-healing", "StartTime": "2016-05-01T12:00:00Z", "EndTime": "2016-05-01T12:04:00Z", "Successful": true,
+	 "FailingNode": {"Address": "http://n1:2375", "Metadata": {"pool": "p1"}}},
+	{"Action": "node-healing", "StartTime": "2016-05-01T11:00:00Z", "EndTime": "2016-05-01T11:01:00Z", "Successful": false,
+	 "FailingNode": {"Address": "http://n2:2375", "Metadata": {"pool": "p1"}}}
+]`
+
+func healingReportTransport() *cmdtest.ConditionalTransport {
+	return &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: healingReportHistoryJSON, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/healing") && req.URL.Query().Get("filter") == "node"
+		},
+	}
+}
+
+func (s *S) TestHealingReportCmdRun(c *check.C) {
+	defer disableColors()()
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: healingReportTransport()}, nil, s.manager)
+	command := healingReportCmd{}
+	command.Flags().Parse(true, []string{"--replace-after", "1"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Pools:
++------+----------+---------------+----------------------------+----------------------+
+| Pool | Healings | Success ratio | Mean time between healings | Mean time to recover |
++------+----------+---------------+----------------------------+----------------------+
+| p1   | 3        | 66%           | 1h0m0s                     | 3m0s                 |
++------+----------+---------------+----------------------------+----------------------+
+Nodes:
++------+----------------+----------+---------------+----------------------------+----------------------+
+| Pool | Node           | Healings | Success ratio | Mean time between healings | Mean time to recover |
++------+----------------+----------+---------------+----------------------------+----------------------+
+| p1   | http://n1:2375 | 2 (*)    | 100%          | 2h0m0s                     | 3m0s                 |
+| p1   | http://n2:2375 | 1        | 0%            | -                          | -                    |
++------+----------------+----------+---------------+----------------------------+----------------------+
+(*) 1 node(s) healed more than 1 times, consider replacing them.
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestHealingReportCmdRunCSV(c *check.C) {
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: healingReportTransport()}, nil, s.manager)
+	command := healingReportCmd{}
+	command.Flags().Parse(true, []string{"-p", "p1"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Pool,Node,Healings,Successful,Failed,Mean time between healings,Mean time to recover,Replacement candidate
+p1,,3,2,1,1h0m0s,3m0s,false
+p1,http://n1:2375,2,2,0,2h0m0s,3m0s,false
+p1,http://n2:2375,1,0,1,0s,0s,false
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestHealingReportCmdRunEmpty(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: healingReportTransport()}, nil, s.manager)
+	command := healingReportCmd{}
+	command.Flags().Parse(true, []string{"--pool", "other"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "No node healings found.\n")
+}
+
+func (s *S) TestHealingReportCmdRunInvalidSince(c *check.C) {
+	command := healingReportCmd{}
+	command.Flags().Parse(true, []string{"--since", "last week"})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, nil)
+	c.Assert(err, check.ErrorMatches, `invalid value for --since: "last week"`)
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	tsuruErrors "github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/hc"
+)
+
+// getHealthCheck runs the full healthcheck of the API, returning the result
+// of each component. The API answers with an internal server error when any
+// component fails, still listing all results.
+func getHealthCheck(client *cmd.Client) ([]hc.Result, error) {
+	u, err := cmd.GetURL("/healthcheck?check=all")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		httpErr, ok := err.(*tsuruErrors.HTTP)
+		if !ok || httpErr.Code != http.StatusInternalServerError {
+			return nil, err
+		}
+		results, parseErr := parseHealthCheck(httpErr.Message)
+		if parseErr != nil {
+			return nil, err
+		}
+		return results, nil
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseHealthCheck(string(body))
+}
+
+// parseHealthCheck parses the lines written by the API full healthcheck, in
+// the format "<name>: <status> (<duration>)".
+func parseHealthCheck(output string) ([]hc.Result, error) {
+	results := []hc.Result{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		nameEnd := strings.Index(line, ": ")
+		durationStart := strings.LastIndex(line, " (")
+		if nameEnd < 0 || durationStart < nameEnd || !strings.HasSuffix(line, ")") {
+			return nil, errors.Errorf("unable to parse healthcheck result: %q", line)
+		}
+		duration, err := time.ParseDuration(line[durationStart+2 : len(line)-1])
+		if err != nil {
+			return nil, errors.Errorf("unable to parse healthcheck result: %q", line)
+		}
+		results = append(results, hc.Result{
+			Name:     line[:nameEnd],
+			Status:   line[nameEnd+2 : durationStart],
+			Duration: duration,
+		})
+	}
+	return results, nil
+}
+
+func colorfyHealthStatus(status string) string {
+	if status == hc.HealthCheckOK {
+		return cmd.Colorfy(status, "green", "", "")
+	}
+	return cmd.Colorfy(status, "red", "", "")
+}
+
+type healthCmd struct {
+	fs       *gnuflag.FlagSet
+	watch    bool
+	interval time.Duration
+}
+
+func (c *healthCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "health",
+		Usage: "health [--watch/-w] [--interval/-i 10s]",
+		Desc: `Runs the full healthcheck of the tsuru API, displaying the status of each
+component, like the database, routers and IaaS providers, and how long its
+check took. The command fails when any component is failing, so it can be
+used as a monitoring probe.
+
+With [[--watch]], the healthcheck runs periodically until interrupted, and a
+line is printed only when a component changes its status.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *healthCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		watch := "Keep running the healthcheck, printing status changes"
+		c.fs.BoolVar(&c.watch, "watch", false, watch)
+		c.fs.BoolVar(&c.watch, "w", false, watch)
+		interval := "Time between healthchecks in watch mode"
+		c.fs.DurationVar(&c.interval, "interval", 10*time.Second, interval)
+		c.fs.DurationVar(&c.interval, "i", 10*time.Second, interval)
+	}
+	return c.fs
+}
+
+func (c *healthCmd) formatted() {}
+
+// healthWatchSleep is replaced in tests to stop health --watch.
+var healthWatchSleep = time.Sleep
+
+func (c *healthCmd) Run(context *cmd.Context, client *cmd.Client) error {
+	if c.watch {
+		return c.runWatch(context.Stdout, client)
+	}
+	results, err := getHealthCheck(client)
+	if err != nil {
+		return err
+	}
+	l := listing{
+		Headers: cmd.Row{"Component", "Status", "Duration"},
+		Data:    results,
+	}
+	var failing int
+	for _, result := range results {
+		if result.Status != hc.HealthCheckOK {
+			failing++
+		}
+		status := result.Status
+		if !machineReadable() {
+			status = colorfyHealthStatus(status)
+		}
+		l.Rows = append(l.Rows, cmd.Row{result.Name, status, result.Duration.String()})
+	}
+	err = render(context.Stdout, &l)
+	if err != nil {
+		return err
+	}
+	if failing > 0 {
+		return errors.Errorf("%d of %d components failing", failing, len(results))
+	}
+	return nil
+}
+
+func (c *healthCmd) runWatch(w io.Writer, client *cmd.Client) error {
+	if machineReadable() {
+		return errors.New("--format is not supported with --watch")
+	}
+	if c.interval < time.Second {
+		return errors.New("the healthcheck interval must be at least 1s")
+	}
+	var statuses map[string]string
+	for {
+		statuses = c.poll(w, client, statuses, time.Now())
+		healthWatchSleep(c.interval)
+	}
+}
+
+// poll runs the healthcheck and prints the components whose status changed
+// since the previous statuses, returning the current ones. Errors running the
+// healthcheck are reported as a change in the status of the API itself.
+func (c *healthCmd) poll(w io.Writer, client *cmd.Client, previous map[string]string, now time.Time) map[string]string {
+	current := map[string]string{}
+	results, err := getHealthCheck(client)
+	if err != nil {
+		current["API"] = "fail - " + err.Error()
+	} else {
+		current["API"] = hc.HealthCheckOK
+	}
+	stamp := now.Local().Format(time.Stamp)
+	if previous == nil || previous["API"] != current["API"] {
+		fmt.Fprintf(w, "%s %s: %s\n", stamp, "API", colorfyHealthStatus(current["API"]))
+	}
+	if err != nil {
+		for name, status := range previous {
+			if name != "API" {
+				current[name] = status
+			}
+		}
+		return current
+	}
+	for _, result := range results {
+		current[result.Name] = result.Status
+		if previous == nil || previous[result.Name] != result.Status {
+			fmt.Fprintf(w, "%s %s: %s\n", stamp, result.Name, colorfyHealthStatus(result.Status))
+		}
+	}
+	return current
+}
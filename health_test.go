@@ -0,0 +1,163 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"github.com/tsuru/tsuru/hc"
+	"gopkg.in/check.v1"
+)
+
+const healthCheckFailOutput = `MongoDB: WORKING (1.5ms)
+Router Hipache: WORKING (2ms)
+CloudStack: fail - unable to connect: dial tcp (10.0.0.1:443): timeout (10s)
+`
+
+func healthCheckTransport(output string, status int) *cmdtest.ConditionalTransport {
+	return &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: output, Status: status},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/healthcheck") && req.URL.Query().Get("check") == "all"
+		},
+	}
+}
+
+func (s *S) TestParseHealthCheck(c *check.C) {
+	results, err := parseHealthCheck(healthCheckFailOutput)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.DeepEquals, []hc.Result{
+		{Name: "MongoDB", Status: "WORKING", Duration: 1500 * time.Microsecond},
+		{Name: "Router Hipache", Status: "WORKING", Duration: 2 * time.Millisecond},
+		{Name: "CloudStack", Status: "fail - unable to connect: dial tcp (10.0.0.1:443): timeout", Duration: 10 * time.Second},
+	})
+	_, err = parseHealthCheck("WORKING")
+	c.Assert(err, check.ErrorMatches, `unable to parse healthcheck result: "WORKING"`)
+}
+
+func (s *S) TestGetHealthCheckFailure(c *check.C) {
+	client := cmd.NewClient(&http.Client{Transport: healthCheckTransport(healthCheckFailOutput, http.StatusInternalServerError)}, nil, s.manager)
+	results, err := getHealthCheck(client)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 3)
+	c.Assert(results[2].Name, check.Equals, "CloudStack")
+}
+
+func (s *S) TestGetHealthCheckServerError(c *check.C) {
+	client := cmd.NewClient(&http.Client{Transport: healthCheckTransport("something bad happened", http.StatusInternalServerError)}, nil, s.manager)
+	_, err := getHealthCheck(client)
+	c.Assert(err, check.ErrorMatches, "something bad happened")
+}
+
+func (s *S) TestHealthCmdRun(c *check.C) {
+	defer disableColors()()
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	output := "MongoDB: WORKING (1.5ms)\nRouter Hipache: WORKING (2ms)\n"
+	client := cmd.NewClient(&http.Client{Transport: healthCheckTransport(output, http.StatusOK)}, nil, s.manager)
+	command := healthCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+----------------+---------+----------+
+| Component      | Status  | Duration |
++----------------+---------+----------+
+| MongoDB        | WORKING | 1.5ms    |
+| Router Hipache | WORKING | 2ms      |
++----------------+---------+----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestHealthCmdRunFailure(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: healthCheckTransport(healthCheckFailOutput, http.StatusInternalServerError)}, nil, s.manager)
+	command := healthCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "1 of 3 components failing")
+	var results []hc.Result
+	err = json.Unmarshal(buf.Bytes(), &results)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 3)
+	c.Assert(results[2].Status, check.Equals, "fail - unable to connect: dial tcp (10.0.0.1:443): timeout")
+}
+
+func (s *S) TestHealthCmdRunCSV(c *check.C) {
+	os.Unsetenv("TSURU_DISABLE_COLORS")
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: healthCheckTransport(healthCheckFailOutput, http.StatusInternalServerError)}, nil, s.manager)
+	command := healthCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "1 of 3 components failing")
+	expected := `Component,Status,Duration
+MongoDB,WORKING,1.5ms
+Router Hipache,WORKING,2ms
+CloudStack,fail - unable to connect: dial tcp (10.0.0.1:443): timeout,10s
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+type stopHealthWatch struct{}
+
+func (s *S) TestHealthCmdRunWatch(c *check.C) {
+	defer disableColors()()
+	oldSleep := healthWatchSleep
+	defer func() { healthWatchSleep = oldSleep }()
+	var sleeps []time.Duration
+	healthWatchSleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		if len(sleeps) == 4 {
+			panic(stopHealthWatch{})
+		}
+	}
+	ok := "MongoDB: WORKING (1ms)\nCloudStack: WORKING (1ms)\n"
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			*healthCheckTransport(ok, http.StatusOK),
+			*healthCheckTransport("MongoDB: WORKING (2ms)\nCloudStack: fail - timeout (10s)\n", http.StatusInternalServerError),
+			*healthCheckTransport("bad gateway", http.StatusBadGateway),
+			*healthCheckTransport(ok, http.StatusOK),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var buf bytes.Buffer
+	command := healthCmd{}
+	err := command.Flags().Parse(true, []string{"-w", "-i", "5s"})
+	c.Assert(err, check.IsNil)
+	func() {
+		defer func() {
+			c.Assert(recover(), check.Equals, stopHealthWatch{})
+		}()
+		command.Run(&cmd.Context{Stdout: &buf}, client)
+	}()
+	c.Assert(sleeps, check.DeepEquals, []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, check.HasLen, 7)
+	c.Assert(lines[0], check.Matches, `.* API: WORKING`)
+	c.Assert(lines[1], check.Matches, `.* MongoDB: WORKING`)
+	c.Assert(lines[2], check.Matches, `.* CloudStack: WORKING`)
+	c.Assert(lines[3], check.Matches, `.* CloudStack: fail - timeout`)
+	c.Assert(lines[4], check.Matches, `.* API: fail - bad gateway`)
+	c.Assert(lines[5], check.Matches, `.* API: WORKING`)
+	c.Assert(lines[6], check.Matches, `.* CloudStack: WORKING`)
+}
+
+func (s *S) TestHealthCmdRunWatchFormat(c *check.C) {
+	outputFormat = "json"
+	command := healthCmd{}
+	command.Flags().Parse(true, []string{"--watch"})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, nil)
+	c.Assert(err, check.ErrorMatches, "--format is not supported with --watch")
+}
@@ -0,0 +1,374 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/install"
+)
+
+const redactedSecret = "(redacted)"
+
+// redactHost hides the private keys of the host, unless they are empty.
+func redactHost(host *install.Host) {
+	if host.SSHPrivateKey != "" {
+		host.SSHPrivateKey = redactedSecret
+	}
+	if host.CaPrivateKey != "" {
+		host.CaPrivateKey = redactedSecret
+	}
+}
+
+func driverValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+type installHostAdd struct {
+	fs           *gnuflag.FlagSet
+	driverConfig string
+	sshKey       string
+	caCert       string
+	caKey        string
+}
+
+func (c *installHostAdd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "install-host-add",
+		Usage: "install-host-add <name> <driver-name> [--driver-config/-d <file>] [--ssh-key <file>] [--ca-cert <file>] [--ca-key <file>]",
+		Desc: `Registers a host created by the tsuru installer, using docker-machine, in the
+tsuru API.
+
+The [[--driver-config]] flag points to a JSON file with the configuration of
+the docker-machine driver, like the "Driver" section of the config.json file
+of the machine. The remaining flags point to the files with the SSH private
+key used to access the host and with the certificate authority used to issue
+its TLS certificates.`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *installHostAdd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		driverConfig := "JSON file with the configuration of the docker-machine driver"
+		c.fs.StringVar(&c.driverConfig, "driver-config", "", driverConfig)
+		c.fs.StringVar(&c.driverConfig, "d", "", driverConfig)
+		c.fs.StringVar(&c.sshKey, "ssh-key", "", "File with the SSH private key used to access the host")
+		c.fs.StringVar(&c.caCert, "ca-cert", "", "File with the certificate of the certificate authority")
+		c.fs.StringVar(&c.caKey, "ca-key", "", "File with the private key of the certificate authority")
+	}
+	return c.fs
+}
+
+func readOptionalFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (c *installHostAdd) Run(context *cmd.Context, client *cmd.Client) error {
+	driver := "{}"
+	if c.driverConfig != "" {
+		data, err := ioutil.ReadFile(c.driverConfig)
+		if err != nil {
+			return err
+		}
+		var config map[string]interface{}
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse %s", c.driverConfig)
+		}
+		driver = string(data)
+	}
+	values := url.Values{
+		"name":       []string{context.Args[0]},
+		"driverName": []string{context.Args[1]},
+		"driver":     []string{driver},
+	}
+	files := []struct {
+		field string
+		path  string
+	}{
+		{"sshPrivateKey", c.sshKey},
+		{"caCert", c.caCert},
+		{"caPrivateKey", c.caKey},
+	}
+	for _, f := range files {
+		content, err := readOptionalFile(f.path)
+		if err != nil {
+			return err
+		}
+		if content != "" {
+			values.Set(f.field, content)
+		}
+	}
+	u, err := cmd.GetURLVersion("1.3", "/install/hosts")
+	if err != nil {
+		return err
+	}
+	err = doForm(client, "POST", u, values)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Host %q successfully added.\n", context.Args[0])
+	return nil
+}
+
+func listInstallHosts(client *cmd.Client) ([]install.Host, error) {
+	u, err := cmd.GetURLVersion("1.3", "/install/hosts")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var hosts []install.Host
+	err = json.NewDecoder(response.Body).Decode(&hosts)
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func getInstallHost(client *cmd.Client, name string) (*install.Host, error) {
+	u, err := cmd.GetURLVersion("1.3", "/install/hosts/"+name)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var host install.Host
+	err = json.NewDecoder(response.Body).Decode(&host)
+	if err != nil {
+		return nil, err
+	}
+	return &host, nil
+}
+
+type installHostList struct {
+	fs          *gnuflag.FlagSet
+	showSecrets bool
+}
+
+func (c *installHostList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "install-host-list",
+		Usage: "install-host-list [--show-secrets]",
+		Desc: `Lists the hosts created by the tsuru installer. Private keys are only
+included in the machine readable formats when [[--show-secrets]] is given.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *installHostList) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		c.fs.BoolVar(&c.showSecrets, "show-secrets", false, "Include the private keys of the hosts in the output")
+	}
+	return c.fs
+}
+
+func (c *installHostList) formatted() {}
+
+func (c *installHostList) Run(context *cmd.Context, client *cmd.Client) error {
+	hosts, err := listInstallHosts(client)
+	if err != nil {
+		return err
+	}
+	if hosts == nil {
+		hosts = []install.Host{}
+	}
+	l := listing{
+		Headers: cmd.Row{"Name", "Driver", "Address"},
+		Sort:    true,
+		Data:    hosts,
+	}
+	for i := range hosts {
+		if !c.showSecrets {
+			redactHost(&hosts[i])
+		}
+		var address string
+		if ip, ok := hosts[i].Driver["IPAddress"]; ok {
+			address = driverValue(ip)
+		}
+		l.Rows = append(l.Rows, cmd.Row{hosts[i].Name, hosts[i].DriverName, address})
+	}
+	return render(context.Stdout, &l)
+}
+
+type installHostInfo struct {
+	fs               *gnuflag.FlagSet
+	showSecrets      bool
+	writeCredentials string
+}
+
+func (c *installHostInfo) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "install-host-info",
+		Usage: "install-host-info <name> [--show-secrets] [--write-credentials/-o <dir>]",
+		Desc: `Shows the details of a host created by the tsuru installer, including the
+configuration of its docker-machine driver. Private keys are redacted unless
+[[--show-secrets]] is given.
+
+With [[--write-credentials]], the SSH private key and the certificate
+authority of the host are written to the given directory, as id_rsa, ca.pem
+and ca-key.pem, so they can be used to access the host.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *installHostInfo) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		c.fs.BoolVar(&c.showSecrets, "show-secrets", false, "Display the private keys of the host")
+		writeCredentials := "Directory where the SSH key and the certificate authority of the host are written"
+		c.fs.StringVar(&c.writeCredentials, "write-credentials", "", writeCredentials)
+		c.fs.StringVar(&c.writeCredentials, "o", "", writeCredentials)
+	}
+	return c.fs
+}
+
+func (c *installHostInfo) formatted() {}
+
+func (c *installHostInfo) Run(context *cmd.Context, client *cmd.Client) error {
+	host, err := getInstallHost(client, context.Args[0])
+	if err != nil {
+		return err
+	}
+	if c.writeCredentials != "" {
+		err = writeHostCredentials(host, c.writeCredentials)
+		if err != nil {
+			return err
+		}
+	}
+	if !c.showSecrets {
+		redactHost(host)
+	}
+	l := listing{
+		Headers: cmd.Row{"Param", "Value"},
+		Sort:    true,
+		Data:    host,
+	}
+	for key, value := range host.Driver {
+		l.Rows = append(l.Rows, cmd.Row{key, driverValue(value)})
+	}
+	if machineReadable() {
+		return render(context.Stdout, &l)
+	}
+	fmt.Fprintf(context.Stdout, "Name: %s\n", host.Name)
+	fmt.Fprintf(context.Stdout, "Driver: %s\n", host.DriverName)
+	if len(l.Rows) > 0 {
+		fmt.Fprintln(context.Stdout, "Driver config:")
+		err = render(context.Stdout, &l)
+		if err != nil {
+			return err
+		}
+	}
+	secrets := [][2]string{
+		{"SSH private key", host.SSHPrivateKey},
+		{"CA certificate", host.CaCert},
+		{"CA private key", host.CaPrivateKey},
+	}
+	for _, s := range secrets {
+		if s[1] == "" {
+			fmt.Fprintf(context.Stdout, "%s: -\n", s[0])
+		} else if s[1] == redactedSecret {
+			fmt.Fprintf(context.Stdout, "%s: %s\n", s[0], s[1])
+		} else {
+			fmt.Fprintf(context.Stdout, "%s:\n%s\n", s[0], s[1])
+		}
+	}
+	if c.writeCredentials != "" {
+		fmt.Fprintf(context.Stdout, "Credentials written to %s.\n", c.writeCredentials)
+		if ssh := sshCommand(host, c.writeCredentials); ssh != "" {
+			fmt.Fprintf(context.Stdout, "Access the host with: %s\n", ssh)
+		}
+	}
+	return nil
+}
+
+// writeHostCredentials writes the non empty SSH private key and certificate
+// authority files of the host to dir, using the names docker-machine uses.
+func writeHostCredentials(host *install.Host, dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		{"id_rsa", host.SSHPrivateKey, 0600},
+		{"ca.pem", host.CaCert, 0644},
+		{"ca-key.pem", host.CaPrivateKey, 0600},
+	}
+	for _, f := range files {
+		if f.content == "" {
+			continue
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, f.name), []byte(f.content), f.mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sshCommand returns the command line to access the host over SSH, using the
+// address, user and port stored by the docker-machine driver, or an empty
+// string when any of them is missing.
+func sshCommand(host *install.Host, dir string) string {
+	if host.SSHPrivateKey == "" {
+		return ""
+	}
+	ip, hasIP := host.Driver["IPAddress"]
+	user, hasUser := host.Driver["SSHUser"]
+	if !hasIP || !hasUser {
+		return ""
+	}
+	command := fmt.Sprintf("ssh -i %s", filepath.Join(dir, "id_rsa"))
+	if port, ok := host.Driver["SSHPort"]; ok {
+		command += " -p " + driverValue(port)
+	}
+	return fmt.Sprintf("%s %s@%s", command, driverValue(user), driverValue(ip))
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+const installHostJSON = `{"Name": "host1", "DriverName": "amazonec2",
+	"Driver": {"IPAddress": "10.0.0.1", "SSHUser": "ubuntu", "SSHPort": 22},
+	"SSHPrivateKey": "ssh-key", "CaCert": "ca-cert", "CaPrivateKey": "ca-key"}`
+
+func (s *S) TestInstallHostAddRun(c *check.C) {
+	dir := c.MkDir()
+	driverPath := filepath.Join(dir, "driver.json")
+	err := ioutil.WriteFile(driverPath, []byte(`{"IPAddress": "10.0.0.1"}`), 0644)
+	c.Assert(err, check.IsNil)
+	keyPath := filepath.Join(dir, "id_rsa")
+	err = ioutil.WriteFile(keyPath, []byte("ssh-key"), 0600)
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"host1", "amazonec2"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusCreated},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/1.3/install/hosts") &&
+				req.FormValue("name") == "host1" && req.FormValue("driverName") == "amazonec2" &&
+				req.FormValue("driver") == `{"IPAddress": "10.0.0.1"}` &&
+				req.FormValue("sshPrivateKey") == "ssh-key" && req.FormValue("caCert") == ""
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := installHostAdd{}
+	command.Flags().Parse(true, []string{"-d", driverPath, "--ssh-key", keyPath})
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Host \"host1\" successfully added.\n")
+}
+
+func (s *S) TestInstallHostAddRunInvalidDriverConfig(c *check.C) {
+	driverPath := filepath.Join(c.MkDir(), "driver.json")
+	err := ioutil.WriteFile(driverPath, []byte(`not json`), 0644)
+	c.Assert(err, check.IsNil)
+	context := cmd.Context{Args: []string{"host1", "amazonec2"}, Stdout: &bytes.Buffer{}}
+	command := installHostAdd{}
+	command.Flags().Parse(true, []string{"--driver-config", driverPath})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "unable to parse .*driver.json: .*")
+}
+
+func (s *S) TestInstallHostListRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := getTransport("/1.3/install/hosts", "["+installHostJSON+`, {"Name": "host0", "DriverName": "virtualbox"}]`)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := installHostList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+-------+------------+----------+
+| Name  | Driver     | Address  |
++-------+------------+----------+
+| host0 | virtualbox |          |
+| host1 | amazonec2  | 10.0.0.1 |
++-------+------------+----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestInstallHostListRunJSONRedacted(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := getTransport("/1.3/install/hosts", "["+installHostJSON+"]")
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := installHostList{}
+	command.Flags().Parse(true, []string{})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*"SSHPrivateKey": "\(redacted\)".*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*"CaCert": "ca-cert".*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*"CaPrivateKey": "\(redacted\)".*`)
+	buf.Reset()
+	command = installHostList{}
+	command.Flags().Parse(true, []string{"--show-secrets"})
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*"SSHPrivateKey": "ssh-key".*`)
+}
+
+func (s *S) TestInstallHostInfoRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"host1"}, Stdout: &buf}
+	trans := getTransport("/1.3/install/hosts/host1", installHostJSON)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := installHostInfo{}
+	command.Flags().Parse(true, []string{})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Name: host1
+Driver: amazonec2
+Driver config:
++-----------+----------+
+| Param     | Value    |
++-----------+----------+
+| IPAddress | 10.0.0.1 |
+| SSHPort   | 22       |
+| SSHUser   | ubuntu   |
++-----------+----------+
+SSH private key: (redacted)
+CA certificate:
+ca-cert
+CA private key: (redacted)
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestInstallHostInfoRunWriteCredentials(c *check.C) {
+	dir := filepath.Join(c.MkDir(), "host1")
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"host1"}, Stdout: &buf}
+	trans := getTransport("/1.3/install/hosts/host1", installHostJSON)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := installHostInfo{}
+	command.Flags().Parse(true, []string{"-o", dir, "--show-secrets"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, "(?s).*SSH private key:\nssh-key\n.*")
+	c.Assert(buf.String(), check.Matches, "(?s).*Credentials written to "+dir+".\n"+
+		"Access the host with: ssh -i "+filepath.Join(dir, "id_rsa")+" -p 22 ubuntu@10.0.0.1\n")
+	files := map[string]string{"id_rsa": "ssh-key", "ca.pem": "ca-cert", "ca-key.pem": "ca-key"}
+	for name, content := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		c.Assert(err, check.IsNil)
+		c.Assert(string(data), check.Equals, content)
+	}
+	info, err := os.Stat(filepath.Join(dir, "id_rsa"))
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0600))
+}
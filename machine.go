@@ -0,0 +1,470 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/hc"
+	"github.com/tsuru/tsuru/iaas"
+	"github.com/tsuru/tsuru/net"
+	"github.com/tsuru/tsuru/provision"
+)
+
+func listMachines(client *cmd.Client) ([]iaas.Machine, error) {
+	u, err := cmd.GetURL("/iaas/machines")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var machines []iaas.Machine
+	err = json.NewDecoder(response.Body).Decode(&machines)
+	if err != nil {
+		return nil, err
+	}
+	return machines, nil
+}
+
+func listTemplates(client *cmd.Client) ([]iaas.Template, error) {
+	u, err := cmd.GetURL("/iaas/templates")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var templates []iaas.Template
+	err = json.NewDecoder(response.Body).Decode(&templates)
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+type machineList struct{}
+
+func (c *machineList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "machine-list",
+		Usage: "machine-list",
+		Desc: `Lists all machines created using an IaaS provider.
+These machines were created with the [[node-add]] command.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *machineList) formatted() {}
+
+func (c *machineList) Run(context *cmd.Context, client *cmd.Client) error {
+	machines, err := listMachines(client)
+	if err != nil {
+		return err
+	}
+	for i := range machines {
+		// Private keys are never part of a listing, whatever the format.
+		machines[i].ClientKey = nil
+	}
+	l := listing{
+		Headers:       cmd.Row{"Id", "IaaS", "Address", "Creation Params"},
+		LineSeparator: true,
+		Sort:          true,
+		Data:          machines,
+	}
+	for _, machine := range machines {
+		l.Rows = append(l.Rows, cmd.Row{machine.Id, machine.Iaas, machine.Address, formatParams(machine.CreationParams)})
+	}
+	return render(context.Stdout, &l)
+}
+
+type templateList struct{}
+
+func (c *templateList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "machine-template-list",
+		Usage:   "machine-template-list",
+		Desc:    "Lists all machine templates.",
+		MinArgs: 0,
+	}
+}
+
+func (c *templateList) formatted() {}
+
+func (c *templateList) Run(context *cmd.Context, client *cmd.Client) error {
+	templates, err := listTemplates(client)
+	if err != nil {
+		return err
+	}
+	l := listing{
+		Headers:       cmd.Row{"Name", "IaaS", "Params"},
+		LineSeparator: true,
+		Sort:          true,
+		Data:          templates,
+	}
+	for _, template := range templates {
+		var params []string
+		for _, data := range template.Data {
+			params = append(params, fmt.Sprintf("%s=%s", data.Name, data.Value))
+		}
+		sort.Strings(params)
+		l.Rows = append(l.Rows, cmd.Row{template.Name, template.IaaSName, strings.Join(params, "\n")})
+	}
+	return render(context.Stdout, &l)
+}
+
+// iaasEntry summarizes an IaaS provider with machines or templates. Health is
+// the result of the healthcheck of the provider, when the API has one with
+// the same name.
+type iaasEntry struct {
+	Name      string
+	Machines  int
+	Templates []string
+	Health    string `json:",omitempty"`
+}
+
+type iaasList struct{}
+
+func (c *iaasList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "iaas-list",
+		Usage: "iaas-list",
+		Desc: `Lists the IaaS providers used by machines and templates, with the number of
+machines, the templates of each provider and the result of the provider
+healthcheck in the API, when it has one.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *iaasList) formatted() {}
+
+func (c *iaasList) Run(context *cmd.Context, client *cmd.Client) error {
+	machines, err := listMachines(client)
+	if err != nil {
+		return err
+	}
+	templates, err := listTemplates(client)
+	if err != nil {
+		return err
+	}
+	results, err := getHealthCheck(client)
+	if err != nil {
+		return err
+	}
+	entries := map[string]*iaasEntry{}
+	entry := func(name string) *iaasEntry {
+		if entries[name] == nil {
+			entries[name] = &iaasEntry{Name: name, Templates: []string{}}
+		}
+		return entries[name]
+	}
+	for _, machine := range machines {
+		entry(machine.Iaas).Machines++
+	}
+	for _, template := range templates {
+		e := entry(template.IaaSName)
+		e.Templates = append(e.Templates, template.Name)
+	}
+	names := make([]string, 0, len(entries))
+	for name, e := range entries {
+		names = append(names, name)
+		sort.Strings(e.Templates)
+		for _, result := range results {
+			if strings.EqualFold(result.Name, name) {
+				e.Health = result.Status
+			}
+		}
+	}
+	sort.Strings(names)
+	list := make([]iaasEntry, len(names))
+	l := listing{
+		Headers:       cmd.Row{"IaaS", "Machines", "Templates", "Health"},
+		LineSeparator: true,
+		Data:          list,
+	}
+	for i, name := range names {
+		list[i] = *entries[name]
+		machines := strconv.Itoa(list[i].Machines)
+		health := list[i].Health
+		if machineReadable() {
+			l.Rows = append(l.Rows, cmd.Row{name, machines, strings.Join(list[i].Templates, ";"), health})
+			continue
+		}
+		switch {
+		case health == "":
+			health = "-"
+		case health != hc.HealthCheckOK:
+			health = cmd.Colorfy(health, "red", "", "")
+		}
+		l.Rows = append(l.Rows, cmd.Row{name, machines, strings.Join(list[i].Templates, "\n"), health})
+	}
+	return render(context.Stdout, &l)
+}
+
+// expandTemplate returns the parameters used to create a machine from the
+// template, like iaas.ExpandTemplate: the template data and its IaaS, with
+// params overriding them. It also returns the source of each parameter.
+func expandTemplate(template *iaas.Template, params map[string]string) (map[string]string, map[string]string) {
+	expanded := map[string]string{}
+	sources := map[string]string{}
+	for _, data := range template.Data {
+		expanded[data.Name] = data.Value
+		sources[data.Name] = "template"
+	}
+	expanded["iaas"] = template.IaaSName
+	sources["iaas"] = "template"
+	for key, value := range params {
+		if key == "template" {
+			continue
+		}
+		expanded[key] = value
+		sources[key] = "argument"
+	}
+	return expanded, sources
+}
+
+type templateRender struct{}
+
+func (c *templateRender) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "machine-template-render",
+		Usage: "machine-template-render <name> [param=value]...",
+		Desc: `Prints the parameters sent to the IaaS provider when creating a machine from
+the template, as in "node-add template=<name>". Parameters given as
+arguments override the ones in the template, as they do in [[node-add]].`,
+		MinArgs: 1,
+	}
+}
+
+func (c *templateRender) formatted() {}
+
+func (c *templateRender) Run(context *cmd.Context, client *cmd.Client) error {
+	params := map[string]string{}
+	for _, arg := range context.Args[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid parameter %q, expected param=value", arg)
+		}
+		params[parts[0]] = parts[1]
+	}
+	templates, err := listTemplates(client)
+	if err != nil {
+		return err
+	}
+	var template *iaas.Template
+	for i := range templates {
+		if templates[i].Name == context.Args[0] {
+			template = &templates[i]
+			break
+		}
+	}
+	if template == nil {
+		return errors.Errorf("template %s not found", context.Args[0])
+	}
+	expanded, sources := expandTemplate(template, params)
+	l := listing{
+		Headers: cmd.Row{"Param", "Value", "Source"},
+		Sort:    true,
+		Data:    expanded,
+	}
+	for key, value := range expanded {
+		l.Rows = append(l.Rows, cmd.Row{key, value, sources[key]})
+	}
+	return render(context.Stdout, &l)
+}
+
+// machineForNode returns the machine backing the node, looked up like
+// iaas.FindMachineByIdOrAddress: by the iaas-id metadata when the node has
+// it, otherwise by the node host.
+func machineForNode(node provision.NodeSpec, machines []iaas.Machine) *iaas.Machine {
+	id := node.Metadata["iaas-id"]
+	host := net.URLToHost(node.Address)
+	for i := range machines {
+		if (id != "" && machines[i].Id == id) || (id == "" && machines[i].Address == host) {
+			return &machines[i]
+		}
+	}
+	return nil
+}
+
+type machineInfo struct{}
+
+func (c *machineInfo) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "machine-info",
+		Usage: "machine-info <id>",
+		Desc: `Shows the details of a machine created using an IaaS provider, including the
+parameters used to create it and the node backed by it.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *machineInfo) formatted() {}
+
+func (c *machineInfo) Run(context *cmd.Context, client *cmd.Client) error {
+	result, err := listNodes(client)
+	if err != nil {
+		return err
+	}
+	var machine *iaas.Machine
+	for i := range result.Machines {
+		if result.Machines[i].Id == context.Args[0] {
+			machine = &result.Machines[i]
+			break
+		}
+	}
+	if machine == nil {
+		return errors.Errorf("machine %s not found", context.Args[0])
+	}
+	// Private keys are never displayed, whatever the format.
+	machine.ClientKey = nil
+	var node string
+	for _, n := range result.Nodes {
+		if m := machineForNode(n, result.Machines); m != nil && m.Id == machine.Id {
+			node = n.Address
+			break
+		}
+	}
+	l := listing{
+		Headers: cmd.Row{"Param", "Value"},
+		Sort:    true,
+		Data:    machine,
+	}
+	for key, value := range machine.CreationParams {
+		l.Rows = append(l.Rows, cmd.Row{key, value})
+	}
+	if machineReadable() {
+		return render(context.Stdout, &l)
+	}
+	if node == "" {
+		node = "-"
+	}
+	fields := [][2]string{
+		{"Id", machine.Id},
+		{"IaaS", machine.Iaas},
+		{"Status", machine.Status},
+		{"Address", machine.Address},
+		{"Node", node},
+	}
+	for _, f := range fields {
+		fmt.Fprintf(context.Stdout, "%s: %s\n", f[0], f[1])
+	}
+	if len(l.Rows) == 0 {
+		return nil
+	}
+	fmt.Fprintln(context.Stdout, "Creation params:")
+	return render(context.Stdout, &l)
+}
+
+// machineMismatch is an inconsistency between the IaaS machines and the nodes
+// in the cluster.
+type machineMismatch struct {
+	Problem        string
+	MachineID      string
+	MachineAddress string
+	Node           string
+}
+
+type machineMismatchList []machineMismatch
+
+func (l machineMismatchList) Len() int      { return len(l) }
+func (l machineMismatchList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l machineMismatchList) Less(i, j int) bool {
+	if l[i].Problem != l[j].Problem {
+		return l[i].Problem < l[j].Problem
+	}
+	return l[i].MachineID+l[i].Node < l[j].MachineID+l[j].Node
+}
+
+// reconcileMachines returns the machines without a node, the nodes created
+// using an IaaS whose machine can't be found and the nodes whose address
+// doesn't match the address of their machine.
+func reconcileMachines(nodes []provision.NodeSpec, machines []iaas.Machine) []machineMismatch {
+	used := map[string]bool{}
+	mismatches := machineMismatchList{}
+	for _, node := range nodes {
+		machine := machineForNode(node, machines)
+		if machine == nil {
+			if node.Metadata["iaas-id"] != "" || node.Metadata["iaas"] != "" {
+				mismatches = append(mismatches, machineMismatch{Problem: "node without machine", MachineID: node.Metadata["iaas-id"], Node: node.Address})
+			}
+			continue
+		}
+		used[machine.Id] = true
+		if machine.Address != net.URLToHost(node.Address) {
+			mismatches = append(mismatches, machineMismatch{Problem: "address changed", MachineID: machine.Id, MachineAddress: machine.Address, Node: node.Address})
+		}
+	}
+	for _, machine := range machines {
+		if !used[machine.Id] {
+			mismatches = append(mismatches, machineMismatch{Problem: "machine without node", MachineID: machine.Id, MachineAddress: machine.Address})
+		}
+	}
+	sort.Sort(mismatches)
+	return mismatches
+}
+
+type machineReconcile struct{}
+
+func (c *machineReconcile) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "machine-reconcile",
+		Usage: "machine-reconcile",
+		Desc: `Cross-references the machines created using IaaS providers with the nodes in
+the cluster and reports:
+
+  * machines without node: machines not backing any node, which may be
+    destroyed with [[machine-destroy]];
+  * nodes without machine: nodes added using an IaaS whose machine can't be
+    found anymore;
+  * address changed: nodes whose address doesn't match the address of their
+    machine.
+
+Nothing is changed by this command.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *machineReconcile) formatted() {}
+
+func (c *machineReconcile) Run(context *cmd.Context, client *cmd.Client) error {
+	result, err := listNodes(client)
+	if err != nil {
+		return err
+	}
+	mismatches := reconcileMachines(result.Nodes, result.Machines)
+	if len(mismatches) == 0 && !machineReadable() {
+		fmt.Fprintln(context.Stdout, "All machines and nodes match.")
+		return nil
+	}
+	l := listing{
+		Headers: cmd.Row{"Problem", "Machine", "Machine Address", "Node"},
+		Data:    mismatches,
+	}
+	for _, m := range mismatches {
+		l.Rows = append(l.Rows, cmd.Row{m.Problem, m.MachineID, m.MachineAddress, m.Node})
+	}
+	return render(context.Stdout, &l)
+}
@@ -0,0 +1,294 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestMachineListRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	data := `[
+		{"Id": "id2", "Iaas": "ec2", "Address": "10.0.0.2", "CreationParams": {"pool": "p1"}},
+		{"Id": "id1", "Iaas": "ec2", "Address": "10.0.0.1", "CreationParams": {"pool": "p1", "type": "m1"}}
+	]`
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: data, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/iaas/machines")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := machineList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+-----+------+----------+-----------------+
+| Id  | IaaS | Address  | Creation Params |
++-----+------+----------+-----------------+
+| id1 | ec2  | 10.0.0.1 | pool=p1         |
+|     |      |          | type=m1         |
++-----+------+----------+-----------------+
+| id2 | ec2  | 10.0.0.2 | pool=p1         |
++-----+------+----------+-----------------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestMachineListRunYAML(c *check.C) {
+	outputFormat = "yaml"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	data := `[{"Id": "id1", "Iaas": "ec2", "Address": "10.0.0.1", "CreationParams": {"pool": "p1"}, "ClientKey": "c2VjcmV0"}]`
+	trans := &cmdtest.Transport{Message: data, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := machineList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s)- Address: 10\.0\.0\.1\n.*  ClientKey: null\n  CreationParams:\n    pool: p1\n.*  Iaas: ec2\n  Id: id1\n.*`)
+}
+
+func (s *S) TestTemplateListRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	data := `[{"Name": "tpl1", "IaaSName": "ec2", "Data": [{"Name": "region", "Value": "us"}, {"Name": "key", "Value": "k1"}]}]`
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: data, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/iaas/templates")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := templateList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+------+------+-----------+
+| Name | IaaS | Params    |
++------+------+-----------+
+| tpl1 | ec2  | key=k1    |
+|      |      | region=us |
++------+------+-----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestTemplateListRunJSON(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	data := `[{"Name": "tpl1", "IaaSName": "ec2", "Data": [{"Name": "region", "Value": "us"}]}]`
+	trans := &cmdtest.Transport{Message: data, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := templateList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `[
+  {
+    "Name": "tpl1",
+    "IaaSName": "ec2",
+    "Data": [
+      {
+        "Name": "region",
+        "Value": "us"
+      }
+    ]
+  }
+]
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+const machineNodesJSON = `{
+	"nodes": [
+		{"Address": "http://10.0.0.1:2375", "Metadata": {"pool": "p1", "iaas": "ec2", "iaas-id": "id1"}},
+		{"Address": "http://10.0.0.9:2375", "Metadata": {"pool": "p1", "iaas": "ec2", "iaas-id": "id2"}},
+		{"Address": "http://10.0.0.3:2375", "Metadata": {"pool": "p1"}},
+		{"Address": "http://10.0.0.4:2375", "Metadata": {"pool": "p1", "iaas": "ec2"}},
+		{"Address": "http://10.0.0.5:2375", "Metadata": {"pool": "p1"}}
+	],
+	"machines": [
+		{"Id": "id1", "Iaas": "ec2", "Status": "running", "Address": "10.0.0.1", "CreationParams": {"pool": "p1", "type": "m1"}, "ClientKey": "c2VjcmV0"},
+		{"Id": "id2", "Iaas": "ec2", "Status": "running", "Address": "10.0.0.2"},
+		{"Id": "id3", "Iaas": "ec2", "Status": "running", "Address": "10.0.0.3"},
+		{"Id": "id4", "Iaas": "ec2", "Status": "running", "Address": "10.0.0.6"}
+	]
+}`
+
+func (s *S) TestMachineInfoRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf, Args: []string{"id1"}}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: machineNodesJSON, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/1.2/node")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := machineInfo{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Id: id1
+IaaS: ec2
+Status: running
+Address: 10.0.0.1
+Node: http://10.0.0.1:2375
+Creation params:
++-------+-------+
+| Param | Value |
++-------+-------+
+| pool  | p1    |
+| type  | m1    |
++-------+-------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestMachineInfoRunJSON(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf, Args: []string{"id1"}}
+	trans := &cmdtest.Transport{Message: machineNodesJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := machineInfo{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*"Id": "id1".*`)
+	c.Assert(buf.String(), check.Not(check.Matches), `(?s).*c2VjcmV0.*`)
+}
+
+func (s *S) TestMachineInfoRunNotFound(c *check.C) {
+	context := cmd.Context{Stdout: &bytes.Buffer{}, Args: []string{"id9"}}
+	trans := &cmdtest.Transport{Message: machineNodesJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := machineInfo{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "machine id9 not found")
+}
+
+func (s *S) TestMachineReconcileRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: machineNodesJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := machineReconcile{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+----------------------+---------+-----------------+----------------------+
+| Problem              | Machine | Machine Address | Node                 |
++----------------------+---------+-----------------+----------------------+
+| address changed      | id2     | 10.0.0.2        | http://10.0.0.9:2375 |
+| machine without node | id4     | 10.0.0.6        |                      |
+| node without machine |         |                 | http://10.0.0.4:2375 |
++----------------------+---------+-----------------+----------------------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestMachineReconcileRunNoMismatches(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	data := `{"nodes": [{"Address": "http://10.0.0.1:2375"}], "machines": [{"Id": "id1", "Address": "10.0.0.1"}]}`
+	trans := &cmdtest.Transport{Message: data, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := machineReconcile{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "All machines and nodes match.\n")
+}
+
+func (s *S) TestTemplateRenderRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf, Args: []string{"tpl1", "region=eu", "template=tpl1", "zone=a"}}
+	data := `[{"Name": "tpl0", "IaaSName": "other"}, {"Name": "tpl1", "IaaSName": "ec2", "Data": [{"Name": "region", "Value": "us"}, {"Name": "key", "Value": "k1"}]}]`
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: data, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/iaas/templates")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := templateRender{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+--------+-------+----------+
+| Param  | Value | Source   |
++--------+-------+----------+
+| iaas   | ec2   | template |
+| key    | k1    | template |
+| region | eu    | argument |
+| zone   | a     | argument |
++--------+-------+----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestTemplateRenderRunErrors(c *check.C) {
+	trans := &cmdtest.Transport{Message: `[{"Name": "tpl1", "IaaSName": "ec2"}]`, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := templateRender{}
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}, Args: []string{"tpl9"}}, client)
+	c.Assert(err, check.ErrorMatches, "template tpl9 not found")
+	err = command.Run(&cmd.Context{Stdout: &bytes.Buffer{}, Args: []string{"tpl1", "region"}}, client)
+	c.Assert(err, check.ErrorMatches, `invalid parameter "region", expected param=value`)
+}
+
+func (s *S) TestIaaSListRun(c *check.C) {
+	defer disableColors()()
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/iaas/machines", `[{"Id": "id1", "Iaas": "ec2"}, {"Id": "id2", "Iaas": "cloudstack"}, {"Id": "id3", "Iaas": "ec2"}]`),
+			getTransport("/iaas/templates", `[{"Name": "small", "IaaSName": "ec2"}, {"Name": "cs1", "IaaSName": "cloudstack"}, {"Name": "large", "IaaSName": "ec2"}, {"Name": "do", "IaaSName": "digitalocean"}]`),
+			*healthCheckTransport(healthCheckFailOutput, http.StatusInternalServerError),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := iaasList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+--------------+----------+-----------+------------------------------------------------------------+
+| IaaS         | Machines | Templates | Health                                                     |
++--------------+----------+-----------+------------------------------------------------------------+
+| cloudstack   | 1        | cs1       | fail - unable to connect: dial tcp (10.0.0.1:443): timeout |
++--------------+----------+-----------+------------------------------------------------------------+
+| digitalocean | 0        | do        | -                                                          |
++--------------+----------+-----------+------------------------------------------------------------+
+| ec2          | 2        | large     | -                                                          |
+|              |          | small     |                                                            |
++--------------+----------+-----------+------------------------------------------------------------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestIaaSListRunCSV(c *check.C) {
+	os.Unsetenv("TSURU_DISABLE_COLORS")
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/iaas/machines", `[{"Id": "id1", "Iaas": "ec2"}, {"Id": "id2", "Iaas": "cloudstack"}]`),
+			getTransport("/iaas/templates", `[{"Name": "small", "IaaSName": "ec2"}, {"Name": "large", "IaaSName": "ec2"}]`),
+			*healthCheckTransport(healthCheckFailOutput, http.StatusInternalServerError),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := iaasList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `IaaS,Machines,Templates,Health
+cloudstack,1,,fail - unable to connect: dial tcp (10.0.0.1:443): timeout
+ec2,1,large;small,
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
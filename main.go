@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/tsuru/tsuru-client/tsuru/admin"
 	"github.com/tsuru/tsuru/cmd"
 	"github.com/tsuru/tsuru/provision"
 	_ "github.com/tsuru/tsuru/provision/docker"
@@ -28,12 +29,80 @@ func buildManager(name string) *cmd.Manager {
 		m.RegisterRemoved(cmd, fmt.Sprintf("You should use `tsuru %s` instead.", newCmd))
 	}
 	m.RegisterRemoved("log-remove", "This action is no longer supported.")
-	registerProvisionersCommands(m)
+	m.RegisterDeprecated(&admin.AddNodeCmd{}, "docker-node-add")
+	m.RegisterDeprecated(&admin.RemoveNodeCmd{}, "docker-node-remove")
+	m.RegisterDeprecated(&admin.UpdateNodeCmd{}, "docker-node-update")
+	m.RegisterDeprecated(&listNodesCmd{}, "docker-node-list")
+	m.RegisterDeprecated(&getNodeHealingConfigCmd{}, "docker-healing-info")
+	m.RegisterDeprecated(&admin.SetNodeHealingConfigCmd{}, "docker-healing-update")
+	m.RegisterDeprecated(&admin.DeleteNodeHealingConfigCmd{}, "docker-healing-delete")
+	m.Register(&machineList{})
+	m.Register(&admin.MachineDestroy{})
+	m.Register(&machineInfo{})
+	m.Register(&machineReconcile{})
+	m.Register(&iaasList{})
+	m.Register(&healthCmd{})
+	m.Register(&templateList{})
+	m.Register(&admin.TemplateAdd{})
+	m.Register(&admin.TemplateRemove{})
+	m.Register(&admin.TemplateUpdate{})
+	m.Register(&templateRender{})
+	m.Register(&installHostAdd{})
+	m.Register(&installHostList{})
+	m.Register(&installHostInfo{})
+	m.Register(platformList{})
+	m.Register(&admin.PlatformAdd{})
+	m.Register(&listHealingHistoryCmd{})
+	m.Register(&listAutoScaleHistoryCmd{})
+	m.Register(&autoScaleInfoCmd{})
+	m.Register(&nodeContainerList{})
+	m.RegisterDeprecated(&admin.AddPoolToSchedulerCmd{}, "docker-pool-add")
+	m.Register(&updatePoolToSchedulerCmd{})
+	m.RegisterDeprecated(&removePoolFromSchedulerCmd{}, "docker-pool-remove")
+	m.RegisterDeprecated(addTeamsToPoolCmd{}, "docker-pool-teams-add")
+	m.RegisterDeprecated(removeTeamsFromPoolCmd{}, "docker-pool-teams-remove")
+	m.Register(&applyCmd{})
+	m.Register(&clusterExportCmd{})
+	m.Register(&clusterImportCmd{})
+	m.Register(&tokenList{})
+	m.Register(&roleAdd{})
+	m.Register(&roleRemove{})
+	m.Register(&roleInfo{})
+	m.Register(&rolePermissionAdd{})
+	m.Register(&rolePermissionRemove{})
+	m.Register(&roleAssign{})
+	m.Register(&roleDissociate{})
+	m.Register(&roleDefaultAdd{})
+	m.Register(&roleDefaultRemove{})
+	m.Register(&roleDefaultList{})
+	m.Register(&permissionTree{})
+	m.Register(&permissionWho{})
+	m.Register(&userPermissions{})
+	m.Register(&roleExport{})
+	m.Register(&roleImport{})
+	m.Register(&topCmd{})
+	m.Register(&eventList{})
+	m.Register(&eventInfo{})
+	m.Register(&eventCancel{})
+	m.Register(&eventTail{})
+	m.Register(&nodeCordonCmd{})
+	m.Register(&nodeDrainCmd{})
+	m.Register(&nodeUncordonCmd{})
+	m.Register(&nodeRotateCmd{})
+	// Replaces the containers-rebalance command of the docker provisioner,
+	// as provisioner commands are only registered when the name is free.
+	m.Register(&containersRebalance{})
+	m.Register(&autoScaleSimulateCmd{})
+	m.Register(&autoScaleEventInfoCmd{})
+	m.Register(&healingReportCmd{})
+	for _, name := range []string{"login", "logout", "target-add", "target-set"} {
+		if command, ok := m.Commands[name]; ok {
+			m.Commands[name] = wrapSessionCommand(command)
+		}
+	}
 	registerMigrated("app-shell", "")
 	registerMigrated("platform-update", "")
 	registerMigrated("platform-remove", "")
-	registerMigrated("machine-list", "")
-	registerMigrated("machine-destroy", "")
 	registerMigrated("app-unlock", "")
 	registerMigrated("plan-create", "")
 	registerMigrated("plan-remove", "")
@@ -41,11 +110,6 @@ func buildManager(name string) *cmd.Manager {
 	registerMigrated("user-list", "")
 	registerMigrated("pool-list", "")
 	registerMigrated("app-routes-rebuild", "")
-	registerMigrated("platform-add", "")
-	registerMigrated("machine-template-list", "")
-	registerMigrated("machine-template-add", "")
-	registerMigrated("machine-template-remove", "")
-	registerMigrated("machine-template-update", "")
 	registerMigrated("user-quota-view", "")
 	registerMigrated("user-quota-change", "")
 	registerMigrated("app-quota-view", "")
@@ -54,19 +118,7 @@ func buildManager(name string) *cmd.Manager {
 	registerMigrated("change-user-quota", "user-quota-change")
 	registerMigrated("view-app-quota", "app-quota-view")
 	registerMigrated("change-app-quota", "app-quota-change")
-	registerMigrated("docker-node-add", "node-add")
-	registerMigrated("docker-node-remove", "node-remove")
-	registerMigrated("docker-node-update", "node-update")
-	registerMigrated("docker-node-list", "node-list")
-	registerMigrated("docker-pool-add", "pool-add")
-	registerMigrated("pool-add", "")
-	registerMigrated("pool-update", "")
-	registerMigrated("docker-pool-remove", "pool-remove")
-	registerMigrated("pool-remove", "")
-	registerMigrated("docker-pool-teams-add", "pool-teams-add")
-	registerMigrated("pool-teams-add", "")
-	registerMigrated("docker-pool-teams-remove", "pool-teams-remove")
-	registerMigrated("pool-teams-remove", "")
+	registerProvisionersCommands(m)
 	return m
 }
 
@@ -79,8 +131,10 @@ func registerProvisionersCommands(m *cmd.Manager) {
 		if c, ok := p.(cmd.AdminCommandable); ok {
 			commands := c.AdminCommands()
 			for _, cmd := range commands {
-				name := cmd.Info().Name
-				m.RegisterRemoved(name, fmt.Sprintf("You should use `tsuru %s` instead.", name))
+				if _, found := m.Commands[cmd.Info().Name]; found {
+					continue
+				}
+				m.Register(cmd)
 			}
 		}
 	}
@@ -89,6 +143,30 @@ func registerProvisionersCommands(m *cmd.Manager) {
 func main() {
 	name := cmd.ExtractProgramName(os.Args[0])
 	manager := buildManager(name)
-	args := os.Args[1:]
+	targetArgs, selection, err := parseTargetsFlag(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	args, err := parseFormatFlag(targetArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	err = checkFormatSupport(manager, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	store, err := newTokenStore()
+	if err == nil {
+		_, err = beginTokenSession(store)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: unable to use the token store: %s\n", err)
+	}
+	if selection != nil {
+		os.Exit(runOnTargets(manager, selection, targetArgs, store))
+	}
 	manager.Run(args)
 }
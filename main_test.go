@@ -17,10 +17,24 @@ func (s *S) TestCommandsFromBaseManagerAreRegistered(c *check.C) {
 	for name, instance := range baseManager.Commands {
 		command, ok := manager.Commands[name]
 		c.Assert(ok, check.Equals, true)
+		switch session := command.(type) {
+		case *sessionCommand:
+			command = session.Command
+		case *flaggedSessionCommand:
+			command = session.Command
+		}
 		c.Assert(command, check.FitsTypeOf, instance)
 	}
 }
 
+func (s *S) TestSessionCommandsAreWrapped(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	c.Assert(manager.Commands["login"], check.FitsTypeOf, &sessionCommand{})
+	c.Assert(manager.Commands["logout"], check.FitsTypeOf, &sessionCommand{})
+	c.Assert(manager.Commands["target-set"], check.FitsTypeOf, &sessionCommand{})
+	c.Assert(manager.Commands["target-add"], check.FitsTypeOf, &flaggedSessionCommand{})
+}
+
 func (s *S) TestShouldRegisterAllCommandsFromProvisioners(c *check.C) {
 	fp := provisiontest.NewFakeProvisioner()
 	p := AdminCommandableProvisioner{FakeProvisioner: fp}
@@ -28,7 +42,53 @@ func (s *S) TestShouldRegisterAllCommandsFromProvisioners(c *check.C) {
 	manager := buildManager("tsuru-admin")
 	fake, ok := manager.Commands["fake-admin"]
 	c.Assert(ok, check.Equals, true)
-	c.Assert(fake, check.FitsTypeOf, &cmd.RemovedCommand{})
+	c.Assert(fake, check.FitsTypeOf, &FakeAdminCommand{})
+}
+
+func (s *S) TestNodeCommandsAreRegistered(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	for _, name := range []string{"node-add", "node-list", "node-update", "node-remove"} {
+		command, ok := manager.Commands[name]
+		c.Assert(ok, check.Equals, true)
+		c.Assert(command, check.Not(check.FitsTypeOf), &cmd.RemovedCommand{})
+		deprecated, ok := manager.Commands["docker-"+name]
+		c.Assert(ok, check.Equals, true)
+		c.Assert(deprecated, check.FitsTypeOf, &cmd.DeprecatedCommand{})
+	}
+}
+
+func (s *S) TestMachineCommandsAreRegistered(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	names := []string{
+		"machine-list", "machine-destroy", "machine-template-list",
+		"machine-template-add", "machine-template-remove", "machine-template-update",
+	}
+	for _, name := range names {
+		command, ok := manager.Commands[name]
+		c.Assert(ok, check.Equals, true)
+		c.Assert(command, check.Not(check.FitsTypeOf), &cmd.RemovedCommand{})
+	}
+}
+
+func (s *S) TestDockerProvisionerCommandsAreRegistered(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	names := []string{
+		"containers-rebalance", "docker-autoscale-list", "docker-healing-list",
+		"node-container-list", "node-container-upgrade",
+	}
+	for _, name := range names {
+		command, ok := manager.Commands[name]
+		c.Assert(ok, check.Equals, true)
+		c.Assert(command, check.Not(check.FitsTypeOf), &cmd.RemovedCommand{})
+	}
+}
+
+func (s *S) TestLocalListingsOverrideProvisionerCommands(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	c.Assert(manager.Commands["docker-healing-list"], check.FitsTypeOf, &listHealingHistoryCmd{})
+	c.Assert(manager.Commands["docker-autoscale-list"], check.FitsTypeOf, &listAutoScaleHistoryCmd{})
+	c.Assert(manager.Commands["docker-autoscale-info"], check.FitsTypeOf, &autoScaleInfoCmd{})
+	c.Assert(manager.Commands["node-container-list"], check.FitsTypeOf, &nodeContainerList{})
 }
 
 func (s *S) TestUserQuotaViewIsRegistered(c *check.C) {
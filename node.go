@@ -0,0 +1,320 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ajg/form"
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/iaas"
+	"github.com/tsuru/tsuru/net"
+	"github.com/tsuru/tsuru/provision"
+)
+
+type listNodesResult struct {
+	Nodes    []provision.NodeSpec `json:"nodes"`
+	Machines []iaas.Machine       `json:"machines"`
+}
+
+func listNodes(client *cmd.Client) (*listNodesResult, error) {
+	u, err := cmd.GetURLVersion("1.2", "/node")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result listNodesResult
+	if resp.StatusCode == http.StatusNoContent {
+		return &result, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// nodePool returns the pool of the node, which older tsuru API versions only
+// report in the node metadata.
+func nodePool(node provision.NodeSpec) string {
+	if node.Pool != "" {
+		return node.Pool
+	}
+	return node.Metadata["pool"]
+}
+
+// nodeEntry is a node as displayed by node-list, along with the ID of the
+// IaaS machine backing it, when there is one.
+type nodeEntry struct {
+	Address  string
+	IaaSID   string
+	Status   string
+	Metadata map[string]string
+}
+
+type nodeEntryList []nodeEntry
+
+func (l nodeEntryList) Len() int           { return len(l) }
+func (l nodeEntryList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l nodeEntryList) Less(i, j int) bool { return l[i].Address < l[j].Address }
+
+type listNodesCmd struct {
+	fs         *gnuflag.FlagSet
+	filter     cmd.MapFlag
+	simplified bool
+}
+
+func (c *listNodesCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "node-list",
+		Usage: "node-list [--filter/-f <metadata>=<value>]... [-q]",
+		Desc: `Lists nodes in the cluster. It will also show you metadata associated to each
+node and the IaaS ID if the node was added using tsuru IaaS providers.
+
+Using the [[-f/--filter]] flag, the user is able to filter the nodes that
+appear in the list based on the key pairs displayed in the metadata column.
+Users can also combine filters using [[-f]] multiple times.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *listNodesCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		filter := "Filter by metadata name and value"
+		c.fs.Var(&c.filter, "filter", filter)
+		c.fs.Var(&c.filter, "f", filter)
+		c.fs.BoolVar(&c.simplified, "q", false, "Display only nodes IP address")
+	}
+	return c.fs
+}
+
+func (c *listNodesCmd) formatted() {}
+
+func (c *listNodesCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	result, err := listNodes(client)
+	if err != nil {
+		return err
+	}
+	machines := make(map[string]iaas.Machine, len(result.Machines))
+	for _, m := range result.Machines {
+		machines[m.Address] = m
+	}
+	nodes := make(nodeEntryList, 0, len(result.Nodes))
+	for _, node := range result.Nodes {
+		if !c.matchesFilter(node) {
+			continue
+		}
+		nodes = append(nodes, nodeEntry{
+			Address:  node.Address,
+			IaaSID:   machines[net.URLToHost(node.Address)].Id,
+			Status:   node.Status,
+			Metadata: node.Metadata,
+		})
+	}
+	if c.simplified {
+		for _, node := range nodes {
+			fmt.Fprintln(ctx.Stdout, node.Address)
+		}
+		return nil
+	}
+	sort.Sort(nodes)
+	l := listing{
+		Headers:       cmd.Row{"Address", "IaaS ID", "Status", "Metadata"},
+		LineSeparator: true,
+		Sort:          true,
+		Data:          nodes,
+	}
+	for _, node := range nodes {
+		l.Rows = append(l.Rows, cmd.Row{node.Address, node.IaaSID, node.Status, formatParams(node.Metadata)})
+	}
+	return render(ctx.Stdout, &l)
+}
+
+func (c *listNodesCmd) matchesFilter(node provision.NodeSpec) bool {
+	if c.filter != nil && node.Metadata == nil {
+		return false
+	}
+	for key, value := range c.filter {
+		if node.Metadata[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// formatParams renders a map as sorted key=value lines, the way listings show
+// metadata and creation params in a single table cell.
+func formatParams(params map[string]string) string {
+	result := make([]string, 0, len(params))
+	for key, value := range params {
+		result = append(result, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(result)
+	return strings.Join(result, "\n")
+}
+
+// drainMetadata is the node metadata set by node-drain. Its value is unique to
+// each node, so the rebalance started by node-drain only moves the containers
+// from the node being drained.
+const drainMetadata = "drain"
+
+func updateNode(client *cmd.Client, opts provision.UpdateNodeOptions) error {
+	u, err := cmd.GetURLVersion("1.2", "/node")
+	if err != nil {
+		return err
+	}
+	v, err := form.EncodeToValues(&opts)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = client.Do(req)
+	return err
+}
+
+type nodeCordonCmd struct{}
+
+func (c *nodeCordonCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "node-cordon",
+		Usage: "node-cordon <address>",
+		Desc: `Marks a node as disabled, so no new containers are scheduled to it. The
+containers already running on the node are kept. Use node-drain to move them
+to other nodes and node-uncordon to return the node to the scheduler.`,
+		MinArgs: 1,
+	}
+}
+
+func (c *nodeCordonCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	err := updateNode(client, provision.UpdateNodeOptions{Address: ctx.Args[0], Disable: true})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Node successfully cordoned.")
+	return nil
+}
+
+// drainNode disables the node and moves all its containers to other nodes,
+// streaming the progress of the moves to w.
+func drainNode(client *cmd.Client, w io.Writer, address string) error {
+	marker := net.URLToHost(address)
+	err := updateNode(client, provision.UpdateNodeOptions{
+		Address:  address,
+		Disable:  true,
+		Metadata: map[string]string{drainMetadata: marker},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Node %s cordoned, moving its containers to other nodes...\n", address)
+	u, err := cmd.GetURL("/docker/containers/rebalance")
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	v.Set("Dry", "false")
+	v.Set("MetadataFilter."+drainMetadata, marker)
+	req, err := http.NewRequest("POST", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	err = cmd.StreamJSONResponse(w, resp)
+	if err != nil {
+		return err
+	}
+	units, err := listNodeUnits(client, address)
+	if err != nil {
+		return err
+	}
+	if len(units) > 0 {
+		return errors.Errorf("%d containers are still in node %s, run node-drain again to retry", len(units), address)
+	}
+	return nil
+}
+
+type nodeDrainCmd struct {
+	cmd.ConfirmationCommand
+}
+
+func (c *nodeDrainCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "node-drain",
+		Usage: "node-drain <address> [-y]",
+		Desc: `Prepares a node for maintenance. The node is marked as disabled, like in
+node-cordon, and all its containers are moved to other nodes by the docker
+provisioner rebalance, which chooses the destination of each container. The
+command waits for the moves to finish and the node is kept registered.
+
+The node gets the "drain" metadata while drained, which is removed by
+node-uncordon.`,
+		MinArgs: 1,
+	}
+}
+
+func (c *nodeDrainCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	ctx.RawOutput()
+	address := ctx.Args[0]
+	if !c.Confirm(ctx, fmt.Sprintf("Are you sure you want to drain the node %q? All its containers will be moved to other nodes.", address)) {
+		return nil
+	}
+	err := drainNode(client, ctx.Stdout, address)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.Stdout, "Node %s successfully drained. Use node-uncordon to return it to the scheduler.\n", address)
+	return nil
+}
+
+type nodeUncordonCmd struct{}
+
+func (c *nodeUncordonCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "node-uncordon",
+		Usage: "node-uncordon <address>",
+		Desc: `Returns a node disabled by node-cordon or node-drain to the scheduler, so
+new containers can be created in it. Containers moved away by node-drain are
+not moved back, use containers-rebalance for that.`,
+		MinArgs: 1,
+	}
+}
+
+func (c *nodeUncordonCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	err := updateNode(client, provision.UpdateNodeOptions{
+		Address:  ctx.Args[0],
+		Enable:   true,
+		Metadata: map[string]string{drainMetadata: ""},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Node successfully uncordoned.")
+	return nil
+}
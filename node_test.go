@@ -0,0 +1,227 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+const nodeListJSON = `{
+	"machines": [{"Id": "m-1", "Address": "10.0.0.1"}],
+	"nodes": [
+		{"Address": "http://10.0.0.2:2375", "Status": "disabled", "Metadata": {"pool": "p2"}},
+		{"Address": "http://10.0.0.1:2375", "Status": "ready", "Metadata": {"pool": "p1", "iaas": "ec2"}}
+	]
+}`
+
+func (s *S) TestListNodesCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: nodeListJSON, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/1.2/node")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listNodesCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+----------------------+---------+----------+----------+
+| Address              | IaaS ID | Status   | Metadata |
++----------------------+---------+----------+----------+
+| http://10.0.0.1:2375 | m-1     | ready    | iaas=ec2 |
+|                      |         |          | pool=p1  |
++----------------------+---------+----------+----------+
+| http://10.0.0.2:2375 |         | disabled | pool=p2  |
++----------------------+---------+----------+----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestListNodesCmdRunFiltered(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: nodeListJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listNodesCmd{}
+	command.Flags().Parse(true, []string{"-q", "-f", "pool=p2"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "http://10.0.0.2:2375\n")
+}
+
+func (s *S) TestListNodesCmdRunNoContent(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Status: http.StatusNoContent}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listNodesCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "+---------+---------+--------+----------+\n| Address | IaaS ID | Status | Metadata |\n+---------+---------+--------+----------+\n")
+}
+
+func (s *S) TestListNodesCmdRunJSON(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: nodeListJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listNodesCmd{}
+	command.Flags().Parse(true, []string{"-f", "pool=p1"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `[
+  {
+    "Address": "http://10.0.0.1:2375",
+    "IaaSID": "m-1",
+    "Status": "ready",
+    "Metadata": {
+      "iaas": "ec2",
+      "pool": "p1"
+    }
+  }
+]
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestListNodesCmdRunCSV(c *check.C) {
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: nodeListJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := listNodesCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := "Address,IaaS ID,Status,Metadata\n" +
+		"http://10.0.0.1:2375,m-1,ready,\"iaas=ec2\npool=p1\"\n" +
+		"http://10.0.0.2:2375,,disabled,pool=p2\n"
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestNodeCordonCmdRun(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			return req.Method == "PUT" && req.URL.Path == "/1.2/node" &&
+				req.Form.Get("Address") == "http://10.0.0.1:2375" && req.Form.Get("Disable") == "true" &&
+				req.Form.Get("Enable") == ""
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Args: []string{"http://10.0.0.1:2375"}}
+	command := nodeCordonCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Node successfully cordoned.\n")
+}
+
+func nodeDrainTransports(units string) []cmdtest.ConditionalTransport {
+	return []cmdtest.ConditionalTransport{
+		okTransport(func(req *http.Request) bool {
+			req.ParseForm()
+			return req.Method == "PUT" && req.URL.Path == "/1.2/node" &&
+				req.Form.Get("Address") == "http://10.0.0.1:2375" && req.Form.Get("Disable") == "true" &&
+				req.Form.Get("Metadata.drain") == "10.0.0.1"
+		}),
+		{
+			Transport: cmdtest.Transport{
+				Message: `{"Message": "Rebalancing 2 units...\n"}` + "\n" + `{"Message": "Moving unit abc for app myapp...\n"}` + "\n",
+				Status:  http.StatusOK,
+			},
+			CondFunc: func(req *http.Request) bool {
+				req.ParseForm()
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/containers/rebalance") &&
+					req.Form.Get("MetadataFilter.drain") == "10.0.0.1" && req.Form.Get("Dry") == "false"
+			},
+		},
+		getTransport("/1.2/node/http://10.0.0.1:2375/containers", units),
+	}
+}
+
+func (s *S) TestNodeDrainCmdRun(c *check.C) {
+	trans := &cmdtest.MultiConditionalTransport{ConditionalTransports: nodeDrainTransports("")}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Stdin: strings.NewReader("y\n"), Args: []string{"http://10.0.0.1:2375"}}
+	command := nodeDrainCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to drain the node "http://10.0.0.1:2375"? All its containers will be moved to other nodes. (y/n) Node http://10.0.0.1:2375 cordoned, moving its containers to other nodes...
+Rebalancing 2 units...
+Moving unit abc for app myapp...
+Node http://10.0.0.1:2375 successfully drained. Use node-uncordon to return it to the scheduler.
+`)
+}
+
+func (s *S) TestNodeDrainCmdRunContainersLeft(c *check.C) {
+	trans := &cmdtest.MultiConditionalTransport{ConditionalTransports: nodeDrainTransports(`[{"ID": "abc", "Status": "error"}]`)}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Args: []string{"http://10.0.0.1:2375"}}
+	command := nodeDrainCmd{}
+	err := command.Flags().Parse(true, []string{"-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "1 containers are still in node http://10.0.0.1:2375, run node-drain again to retry")
+}
+
+func (s *S) TestNodeDrainCmdRunRebalanceError(c *check.C) {
+	trans := &cmdtest.MultiConditionalTransport{ConditionalTransports: []cmdtest.ConditionalTransport{
+		okTransport(func(req *http.Request) bool { return req.Method == "PUT" }),
+		{
+			Transport: cmdtest.Transport{Message: `{"Message": "Rebalancing 1 units...\n"}` + "\n" + `{"Message": "", "Error": "no nodes available"}` + "\n", Status: http.StatusOK},
+			CondFunc:  func(req *http.Request) bool { return strings.HasSuffix(req.URL.Path, "/docker/containers/rebalance") },
+		},
+	}}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Args: []string{"http://10.0.0.1:2375"}}
+	command := nodeDrainCmd{}
+	err := command.Flags().Parse(true, []string{"-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "no nodes available")
+}
+
+func (s *S) TestNodeDrainCmdRunAborted(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Stdin: strings.NewReader("n\n"), Args: []string{"http://10.0.0.1:2375"}}
+	command := nodeDrainCmd{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\(y/n\) Abort.\n`)
+}
+
+func (s *S) TestNodeUncordonCmdRun(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			drain, ok := req.Form["Metadata.drain"]
+			return req.Method == "PUT" && req.URL.Path == "/1.2/node" &&
+				req.Form.Get("Address") == "http://10.0.0.1:2375" && req.Form.Get("Enable") == "true" &&
+				req.Form.Get("Disable") == "" && ok && drain[0] == ""
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Args: []string{"http://10.0.0.1:2375"}}
+	command := nodeUncordonCmd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Node successfully uncordoned.\n")
+}
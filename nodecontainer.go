@@ -0,0 +1,104 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/provision/nodecontainer"
+)
+
+const emptyPoolLabel = "<all>"
+
+func listNodeContainers(client *cmd.Client) ([]nodecontainer.NodeContainerConfigGroup, error) {
+	u, err := cmd.GetURL("/docker/nodecontainers")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	var all []nodecontainer.NodeContainerConfigGroup
+	err = json.NewDecoder(rsp.Body).Decode(&all)
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+type nodeContainerList struct {
+	fs        *gnuflag.FlagSet
+	namesOnly bool
+}
+
+func (c *nodeContainerList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "node-container-list",
+		Usage: "node-container-list [-q]",
+		Desc:  "List all existing node containers.",
+	}
+}
+
+func (c *nodeContainerList) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("flags", gnuflag.ExitOnError)
+		c.fs.BoolVar(&c.namesOnly, "q", false, "Show only names of existing node containers.")
+	}
+	return c.fs
+}
+
+func (c *nodeContainerList) formatted() {}
+
+func (c *nodeContainerList) Run(context *cmd.Context, client *cmd.Client) error {
+	all, err := listNodeContainers(client)
+	if err != nil {
+		return err
+	}
+	if c.namesOnly {
+		for _, entry := range all {
+			fmt.Fprintln(context.Stdout, entry.Name)
+		}
+		return nil
+	}
+	sort.Sort(nodecontainer.NodeContainerConfigGroupSlice(all))
+	l := listing{
+		Headers:       cmd.Row{"Name", "Pool Configs", "Image"},
+		LineSeparator: true,
+		Sort:          true,
+		Data:          all,
+	}
+	for _, entry := range all {
+		var pools []string
+		for poolName := range entry.ConfigPools {
+			if poolName == "" {
+				poolName = emptyPoolLabel
+			}
+			pools = append(pools, poolName)
+		}
+		sort.Strings(pools)
+		var images []string
+		for _, p := range pools {
+			if p == emptyPoolLabel {
+				p = ""
+			}
+			poolEntry := entry.ConfigPools[p]
+			images = append(images, poolEntry.Image())
+		}
+		l.Rows = append(l.Rows, cmd.Row{entry.Name, strings.Join(pools, "\n"), strings.Join(images, "\n")})
+	}
+	return render(context.Stdout, &l)
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+const nodeContainersJSON = `[
+	{"Name": "c2", "ConfigPools": {"": {"Name": "c2", "Config": {"Image": "img2"}}}},
+	{"Name": "c1", "ConfigPools": {
+		"": {"Name": "c1", "Config": {"Image": "img1"}},
+		"p1": {"Name": "c1", "PinnedImage": "img1@sha256:abc", "Config": {"Image": "img1"}}
+	}}
+]`
+
+func (s *S) TestNodeContainerListRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: nodeContainersJSON, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/docker/nodecontainers")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := nodeContainerList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+------+--------------+-----------------+
+| Name | Pool Configs | Image           |
++------+--------------+-----------------+
+| c1   | <all>        | img1            |
+|      | p1           | img1@sha256:abc |
++------+--------------+-----------------+
+| c2   | <all>        | img2            |
++------+--------------+-----------------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestNodeContainerListRunNamesOnly(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: nodeContainersJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := nodeContainerList{}
+	command.Flags().Parse(true, []string{"-q"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "c2\nc1\n")
+}
+
+func (s *S) TestNodeContainerListRunCSV(c *check.C) {
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.Transport{Message: nodeContainersJSON, Status: http.StatusOK}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := nodeContainerList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := "Name,Pool Configs,Image\n" +
+		"c1,\"<all>\np1\",\"img1\nimg1@sha256:abc\"\n" +
+		"c2,<all>,img2\n"
+	c.Assert(buf.String(), check.Equals, expected)
+}
@@ -0,0 +1,499 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ajg/form"
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/provision"
+)
+
+var nodeRotateSleep = time.Sleep
+
+const nodeRotatePollInterval = 5 * time.Second
+
+// nodeRotateIDField is sent along with the options of the node being added.
+// The API ignores it, but records it in the node.create event, whose target is
+// the address of the new node.
+const nodeRotateIDField = "NodeRotateID"
+
+// rotationNode is an old node being replaced. AddID identifies the request
+// adding its replacement and is saved before the request is sent, so a
+// resumed rotation looks for the node added by it instead of adding another
+// one. Replacement is the address of the node created to take its place,
+// empty until the machine is created.
+type rotationNode struct {
+	Address     string
+	AddID       string `json:",omitempty"`
+	Replacement string
+	Cordoned    bool `json:",omitempty"`
+	Done        bool
+}
+
+// rotationState is the progress of a node-rotate run, saved after each step
+// so an interrupted rotation can be resumed.
+type rotationState struct {
+	Target   string
+	Pool     string
+	Template string
+	Nodes    []rotationNode
+}
+
+func rotationStatePath(pool string) string {
+	return cmd.JoinWithUserDir(".tsuru", "node-rotate-"+pool+".json")
+}
+
+func loadRotationState(pool string) (*rotationState, error) {
+	path := rotationStatePath(pool)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state rotationState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s", path)
+	}
+	return &state, nil
+}
+
+func (s *rotationState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := rotationStatePath(s.Pool)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (s *rotationState) remove() error {
+	err := os.Remove(rotationStatePath(s.Pool))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *rotationState) pending() []*rotationNode {
+	var nodes []*rotationNode
+	for i := range s.Nodes {
+		if !s.Nodes[i].Done {
+			nodes = append(nodes, &s.Nodes[i])
+		}
+	}
+	return nodes
+}
+
+func addNode(client *cmd.Client, w io.Writer, opts provision.AddNodeOptions, id string) error {
+	v, err := form.EncodeToValues(&opts)
+	if err != nil {
+		return err
+	}
+	v.Set(nodeRotateIDField, id)
+	u, err := cmd.GetURLVersion("1.2", "/node")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return cmd.StreamJSONResponse(w, resp)
+}
+
+// removeNode removes the node from the cluster and destroys its IaaS machine,
+// without rebalancing its containers.
+func removeNode(client *cmd.Client, address string) error {
+	v := url.Values{}
+	v.Set("no-rebalance", "true")
+	v.Set("remove-iaas", "true")
+	u, err := cmd.GetURLVersion("1.2", fmt.Sprintf("/node/%s?%s", address, v.Encode()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(req)
+	return err
+}
+
+type nodeRotateCmd struct {
+	cmd.ConfirmationCommand
+	fs       *gnuflag.FlagSet
+	pool     string
+	template string
+	batch    int
+	timeout  time.Duration
+	reset    bool
+}
+
+func (c *nodeRotateCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "node-rotate",
+		Usage: "node-rotate --pool/-p <pool> --template/-t <template> [--batch/-b 1] [--timeout 10m] [--reset] [-y]",
+		Desc: `Replaces all nodes in a pool with new machines created from a template.
+
+For each batch of old nodes, node-rotate creates one new machine per node
+using the given template and waits for the new nodes to become ready. It then
+cordons all the old nodes, so that containers are only moved to new nodes,
+drains the old nodes in the batch and finally removes them from the cluster
+and destroys their machines.
+
+The progress is saved in the ~/.tsuru directory, so running the same command
+again resumes an interrupted rotation. Use [[--reset]] to discard the saved
+progress and start a new rotation.
+
+The [[--timeout]] flag sets how long to wait for each new node to become
+ready.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *nodeRotateCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+		pool := "Pool whose nodes will be replaced"
+		c.fs.StringVar(&c.pool, "pool", "", pool)
+		c.fs.StringVar(&c.pool, "p", "", pool)
+		template := "Machine template used to create the new nodes"
+		c.fs.StringVar(&c.template, "template", "", template)
+		c.fs.StringVar(&c.template, "t", "", template)
+		batch := "Number of nodes replaced at a time"
+		c.fs.IntVar(&c.batch, "batch", 1, batch)
+		c.fs.IntVar(&c.batch, "b", 1, batch)
+		c.fs.DurationVar(&c.timeout, "timeout", 10*time.Minute, "Time to wait for each new node to become ready")
+		c.fs.BoolVar(&c.reset, "reset", false, "Discard the progress of a previous rotation of the pool")
+	}
+	return c.fs
+}
+
+func (c *nodeRotateCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	ctx.RawOutput()
+	if c.pool == "" || c.template == "" {
+		return errors.New("the pool and the template are required, use --pool and --template")
+	}
+	if c.batch < 1 {
+		return errors.New("the batch size must be at least 1")
+	}
+	target, err := cmd.GetTarget()
+	if err != nil {
+		return err
+	}
+	state, err := c.prepareState(target)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		if !c.Confirm(ctx, fmt.Sprintf("Are you sure you want to resume the rotation of the pool %q? %d of %d nodes are left.", c.pool, len(state.pending()), len(state.Nodes))) {
+			return nil
+		}
+	} else {
+		state, err = c.newState(client, target)
+		if err != nil {
+			return err
+		}
+		if len(state.Nodes) == 0 {
+			return errors.Errorf("no nodes found in pool %q", c.pool)
+		}
+		if !c.Confirm(ctx, fmt.Sprintf("Are you sure you want to replace the %d nodes in the pool %q? Their machines will be destroyed.", len(state.Nodes), c.pool)) {
+			return nil
+		}
+		err = state.save()
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		pending := state.pending()
+		if len(pending) == 0 {
+			break
+		}
+		if len(pending) > c.batch {
+			pending = pending[:c.batch]
+		}
+		err = c.rotateBatch(ctx.Stdout, client, state, pending)
+		if err != nil {
+			return errors.Wrap(err, "rotation interrupted, run node-rotate again to resume it")
+		}
+	}
+	err = state.remove()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.Stdout, "Pool %s successfully rotated.\n", c.pool)
+	return nil
+}
+
+// prepareState returns the saved progress of the rotation of the pool, or nil
+// when a new rotation should be started.
+func (c *nodeRotateCmd) prepareState(target string) (*rotationState, error) {
+	state, err := loadRotationState(c.pool)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, nil
+	}
+	if c.reset {
+		return nil, state.remove()
+	}
+	if state.Target != target || state.Template != c.template {
+		return nil, errors.Errorf("there is an unfinished rotation of pool %q in %s using template %q, run it again with the same target and template or use --reset to discard it", state.Pool, state.Target, state.Template)
+	}
+	return state, nil
+}
+
+func (c *nodeRotateCmd) newState(client *cmd.Client, target string) (*rotationState, error) {
+	result, err := listNodes(client)
+	if err != nil {
+		return nil, err
+	}
+	state := rotationState{Target: target, Pool: c.pool, Template: c.template}
+	var addresses []string
+	for _, node := range result.Nodes {
+		if nodePool(node) == c.pool {
+			addresses = append(addresses, node.Address)
+		}
+	}
+	sort.Strings(addresses)
+	for _, addr := range addresses {
+		state.Nodes = append(state.Nodes, rotationNode{Address: addr})
+	}
+	return &state, nil
+}
+
+func (c *nodeRotateCmd) rotateBatch(w io.Writer, client *cmd.Client, state *rotationState, batch []*rotationNode) error {
+	result, err := listNodes(client)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(result.Nodes))
+	for _, node := range result.Nodes {
+		current[node.Address] = true
+	}
+	var nodes []*rotationNode
+	for _, node := range batch {
+		if !current[node.Address] {
+			fmt.Fprintf(w, "Node %s is not in the cluster anymore, skipping it.\n", node.Address)
+			node.Done = true
+			err = state.save()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes {
+		if node.Replacement != "" {
+			continue
+		}
+		fmt.Fprintf(w, "Creating replacement for node %s...\n", node.Address)
+		node.Replacement, err = c.createReplacement(w, client, state, node)
+		if err != nil {
+			return err
+		}
+		err = state.save()
+		if err != nil {
+			return err
+		}
+	}
+	for _, node := range nodes {
+		err = c.waitReady(w, client, node.Replacement)
+		if err != nil {
+			return err
+		}
+	}
+	// All old nodes are cordoned, not only the ones in the batch, so the
+	// containers being drained are only moved to the new nodes.
+	for _, node := range state.pending() {
+		if node.Cordoned || !current[node.Address] {
+			continue
+		}
+		err = updateNode(client, provision.UpdateNodeOptions{Address: node.Address, Disable: true})
+		if err != nil {
+			return err
+		}
+		node.Cordoned = true
+	}
+	err = state.save()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		err = drainNode(client, w, node.Address)
+		if err != nil {
+			return err
+		}
+		err = removeNode(client, node.Address)
+		if err != nil {
+			return err
+		}
+		node.Done = true
+		err = state.save()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Node %s replaced by %s.\n", node.Address, node.Replacement)
+	}
+	return nil
+}
+
+// createReplacement adds a node from the template and returns its address.
+// When a previous run already sent the request adding the node, the node it
+// added is used instead.
+func (c *nodeRotateCmd) createReplacement(w io.Writer, client *cmd.Client, state *rotationState, node *rotationNode) (string, error) {
+	if node.AddID != "" {
+		addr, err := c.addedNode(client, node.AddID)
+		if err != nil || addr != "" {
+			return addr, err
+		}
+	}
+	id, err := newRotationID()
+	if err != nil {
+		return "", err
+	}
+	node.AddID = id
+	err = state.save()
+	if err != nil {
+		return "", err
+	}
+	err = addNode(client, w, provision.AddNodeOptions{
+		Metadata: map[string]string{"template": c.template, "pool": c.pool},
+	}, id)
+	if err != nil {
+		return "", err
+	}
+	addr, err := c.addedNode(client, id)
+	if err != nil {
+		return "", err
+	}
+	if addr == "" {
+		return "", errors.Errorf("unable to find the node added to replace %s", node.Address)
+	}
+	return addr, nil
+}
+
+// addedNode returns the address of the node added by the request with the
+// given id, looking for it in the node.create events. It returns an empty
+// address when the request didn't reach the API or failed, in which case the
+// node can be added again.
+func (c *nodeRotateCmd) addedNode(client *cmd.Client, id string) (string, error) {
+	filter := url.Values{"kindname": {"node.create"}, "target.type": {"node"}}
+	var waited time.Duration
+	for {
+		events, err := listEventDetails(client, filter)
+		if err != nil {
+			return "", err
+		}
+		var evt *eventDetails
+		for i := range events {
+			if eventField(&events[i], nodeRotateIDField) == id {
+				evt = &events[i]
+				break
+			}
+		}
+		if evt == nil || (!evt.Running && evt.Error != "") {
+			return "", nil
+		}
+		if !evt.Running {
+			return evt.Target.Value, nil
+		}
+		if waited >= c.timeout {
+			return "", errors.Errorf("timeout waiting for the node being added in event %s", evt.UniqueID)
+		}
+		nodeRotateSleep(nodeRotatePollInterval)
+		waited += nodeRotatePollInterval
+	}
+}
+
+// eventField returns the value of a form field sent in the request that
+// started the event.
+func eventField(e *eventDetails, name string) string {
+	if e.StartCustomData.Kind == 0 {
+		return ""
+	}
+	var fields []struct {
+		Name  string      `bson:"name"`
+		Value interface{} `bson:"value"`
+	}
+	if e.StartCustomData.Unmarshal(&fields) != nil {
+		return ""
+	}
+	for _, f := range fields {
+		if value, ok := f.Value.(string); ok && f.Name == name {
+			return value
+		}
+	}
+	return ""
+}
+
+func newRotationID() (string, error) {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+func (c *nodeRotateCmd) waitReady(w io.Writer, client *cmd.Client, address string) error {
+	fmt.Fprintf(w, "Waiting for node %s to become ready...\n", address)
+	var waited time.Duration
+	for {
+		result, err := listNodes(client)
+		if err != nil {
+			return err
+		}
+		var status string
+		for _, node := range result.Nodes {
+			if node.Address == address {
+				status = node.Status
+				break
+			}
+		}
+		if status == "" {
+			return errors.Errorf("node %s is not in the cluster", address)
+		}
+		if status == "ready" {
+			return nil
+		}
+		if waited >= c.timeout {
+			return errors.Errorf("timeout waiting for node %s to become ready, its status is %q", address, status)
+		}
+		nodeRotateSleep(nodeRotatePollInterval)
+		waited += nodeRotatePollInterval
+	}
+}
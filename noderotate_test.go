@@ -0,0 +1,360 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"github.com/tsuru/tsuru/provision"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeRotationCluster is a transport that keeps the list of nodes, so nodes
+// added and removed by node-rotate show up in the following listings. New
+// nodes report the waiting status in their first three listings.
+type fakeRotationCluster struct {
+	nodes      []provision.NodeSpec
+	waiting    map[string]int
+	newNodes   []string
+	events     []eventDetails
+	failAdd    bool
+	failDelete string
+	calls      []string
+}
+
+func (f *fakeRotationCluster) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.ParseForm()
+	t := cmdtest.Transport{Status: http.StatusOK}
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/1.2/node":
+		for i, node := range f.nodes {
+			if f.waiting[node.Address] > 0 {
+				f.nodes[i].Status = "waiting"
+				f.waiting[node.Address]--
+			} else {
+				f.nodes[i].Status = "ready"
+			}
+		}
+		data, _ := json.Marshal(listNodesResult{Nodes: f.nodes})
+		t.Message = string(data)
+	case req.Method == "POST" && req.URL.Path == "/1.2/node":
+		f.calls = append(f.calls, "add "+req.Form.Get("Metadata.pool")+" "+req.Form.Get("Metadata.template"))
+		addr := f.newNodes[0]
+		f.newNodes = f.newNodes[1:]
+		f.nodes = append(f.nodes, provision.NodeSpec{Address: addr, Pool: req.Form.Get("Metadata.pool")})
+		if _, ok := f.waiting[addr]; !ok {
+			f.waiting[addr] = 3
+		}
+		data, _ := bson.Marshal(bson.D{{Name: "0", Value: bson.M{"name": nodeRotateIDField, "value": req.Form.Get(nodeRotateIDField)}}})
+		evt := eventDetails{
+			eventEntry:      eventEntry{Target: eventTarget{Type: "node", Value: addr}, Kind: eventKind{Type: "permission", Name: "node.create"}},
+			StartCustomData: bson.Raw{Kind: 4, Data: data},
+		}
+		f.events = append([]eventDetails{evt}, f.events...)
+		if f.failAdd {
+			f.failAdd = false
+			t.Status = http.StatusGatewayTimeout
+			t.Message = "timeout"
+			break
+		}
+		t.Message = `{"Message": "creating machine\n"}` + "\n"
+	case req.Method == "GET" && req.URL.Path == "/1.1/events":
+		if req.Form.Get("kindname") != "node.create" || len(f.events) == 0 {
+			t.Status = http.StatusNoContent
+			break
+		}
+		data, _ := json.Marshal(f.events)
+		t.Message = string(data)
+	case req.Method == "PUT" && req.URL.Path == "/1.2/node":
+		f.calls = append(f.calls, "disable "+req.Form.Get("Address"))
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/docker/containers/rebalance"):
+		f.calls = append(f.calls, "rebalance "+req.Form.Get("MetadataFilter.drain"))
+		t.Message = `{"Message": "rebalancing\n"}` + "\n"
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/containers"):
+		t.Status = http.StatusNoContent
+	case req.Method == "DELETE":
+		addr := strings.TrimPrefix(req.URL.Path, "/1.2/node/")
+		if addr == f.failDelete {
+			f.failDelete = ""
+			t.Status = http.StatusInternalServerError
+			t.Message = "machine not found"
+			break
+		}
+		f.calls = append(f.calls, "remove "+addr+" "+req.URL.RawQuery)
+		for i, node := range f.nodes {
+			if node.Address == addr {
+				f.nodes = append(f.nodes[:i], f.nodes[i+1:]...)
+				break
+			}
+		}
+	default:
+		t.Status = http.StatusNotFound
+	}
+	return t.RoundTrip(req)
+}
+
+func newFakeRotationCluster() *fakeRotationCluster {
+	return &fakeRotationCluster{
+		nodes: []provision.NodeSpec{
+			{Address: "http://10.0.0.2:2375", Pool: "p1"},
+			{Address: "http://10.0.0.1:2375", Metadata: map[string]string{"pool": "p1"}},
+			{Address: "http://10.0.0.3:2375", Pool: "p2"},
+		},
+		waiting:  map[string]int{},
+		newNodes: []string{"http://10.0.0.10:2375", "http://10.0.0.11:2375", "http://10.0.0.12:2375"},
+	}
+}
+
+func (s *S) stubNodeRotateSleep() *[]time.Duration {
+	var sleeps []time.Duration
+	nodeRotateSleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return &sleeps
+}
+
+func (s *S) TestNodeRotateCmdInfo(c *check.C) {
+	c.Assert((&nodeRotateCmd{}).Info(), check.NotNil)
+}
+
+func (s *S) TestNodeRotateCmdRun(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	sleeps := s.stubNodeRotateSleep()
+	defer func() { nodeRotateSleep = time.Sleep }()
+	cluster := newFakeRotationCluster()
+	client := cmd.NewClient(&http.Client{Transport: cluster}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Stdin: strings.NewReader("y\n")}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "-b", "2"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to replace the 2 nodes in the pool "p1"? Their machines will be destroyed. (y/n) Creating replacement for node http://10.0.0.1:2375...
+creating machine
+Creating replacement for node http://10.0.0.2:2375...
+creating machine
+Waiting for node http://10.0.0.10:2375 to become ready...
+Waiting for node http://10.0.0.11:2375 to become ready...
+Node http://10.0.0.1:2375 cordoned, moving its containers to other nodes...
+rebalancing
+Node http://10.0.0.1:2375 replaced by http://10.0.0.10:2375.
+Node http://10.0.0.2:2375 cordoned, moving its containers to other nodes...
+rebalancing
+Node http://10.0.0.2:2375 replaced by http://10.0.0.11:2375.
+Pool p1 successfully rotated.
+`)
+	c.Assert(cluster.calls, check.DeepEquals, []string{
+		"add p1 small",
+		"add p1 small",
+		"disable http://10.0.0.1:2375",
+		"disable http://10.0.0.2:2375",
+		"disable http://10.0.0.1:2375",
+		"rebalance 10.0.0.1",
+		"remove http://10.0.0.1:2375 no-rebalance=true&remove-iaas=true",
+		"disable http://10.0.0.2:2375",
+		"rebalance 10.0.0.2",
+		"remove http://10.0.0.2:2375 no-rebalance=true&remove-iaas=true",
+	})
+	c.Assert(*sleeps, check.DeepEquals, []time.Duration{nodeRotatePollInterval, nodeRotatePollInterval, nodeRotatePollInterval})
+	_, err = os.Stat(rotationStatePath("p1"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestNodeRotateCmdRunResume(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	s.stubNodeRotateSleep()
+	defer func() { nodeRotateSleep = time.Sleep }()
+	cluster := newFakeRotationCluster()
+	cluster.failDelete = "http://10.0.0.2:2375"
+	client := cmd.NewClient(&http.Client{Transport: cluster}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "rotation interrupted, run node-rotate again to resume it: .*machine not found")
+	c.Assert(cluster.calls, check.DeepEquals, []string{
+		"add p1 small",
+		"disable http://10.0.0.1:2375",
+		"disable http://10.0.0.2:2375",
+		"disable http://10.0.0.1:2375",
+		"rebalance 10.0.0.1",
+		"remove http://10.0.0.1:2375 no-rebalance=true&remove-iaas=true",
+		"add p1 small",
+		"disable http://10.0.0.2:2375",
+		"rebalance 10.0.0.2",
+	})
+	state, err := loadRotationState("p1")
+	c.Assert(err, check.IsNil)
+	for i := range state.Nodes {
+		c.Assert(state.Nodes[i].AddID, check.Not(check.Equals), "")
+		state.Nodes[i].AddID = ""
+	}
+	c.Assert(state, check.DeepEquals, &rotationState{
+		Target:   "http://localhost",
+		Pool:     "p1",
+		Template: "small",
+		Nodes: []rotationNode{
+			{Address: "http://10.0.0.1:2375", Replacement: "http://10.0.0.10:2375", Cordoned: true, Done: true},
+			{Address: "http://10.0.0.2:2375", Replacement: "http://10.0.0.11:2375", Cordoned: true},
+		},
+	})
+	cluster.calls = nil
+	stdout.Reset()
+	command = nodeRotateCmd{}
+	err = command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(cluster.calls, check.DeepEquals, []string{
+		"disable http://10.0.0.2:2375",
+		"rebalance 10.0.0.2",
+		"remove http://10.0.0.2:2375 no-rebalance=true&remove-iaas=true",
+	})
+	c.Assert(stdout.String(), check.Matches, "(?s).*Pool p1 successfully rotated.\n")
+}
+
+func (s *S) TestNodeRotateCmdRunResumeInterruptedAdd(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	s.stubNodeRotateSleep()
+	defer func() { nodeRotateSleep = time.Sleep }()
+	cluster := newFakeRotationCluster()
+	cluster.nodes = cluster.nodes[1:]
+	cluster.failAdd = true
+	client := cmd.NewClient(&http.Client{Transport: cluster}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "rotation interrupted, run node-rotate again to resume it: .*timeout")
+	state, err := loadRotationState("p1")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Nodes, check.HasLen, 1)
+	c.Assert(state.Nodes[0].AddID, check.Not(check.Equals), "")
+	c.Assert(state.Nodes[0].Replacement, check.Equals, "")
+	cluster.calls = nil
+	command = nodeRotateCmd{}
+	err = command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(cluster.calls, check.DeepEquals, []string{
+		"disable http://10.0.0.1:2375",
+		"disable http://10.0.0.1:2375",
+		"rebalance 10.0.0.1",
+		"remove http://10.0.0.1:2375 no-rebalance=true&remove-iaas=true",
+	})
+	c.Assert(stdout.String(), check.Matches, "(?s).*Node http://10.0.0.1:2375 replaced by http://10.0.0.10:2375.\nPool p1 successfully rotated.\n")
+}
+
+func (s *S) TestNodeRotateCmdRunSkipsRemovedNodes(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	s.stubNodeRotateSleep()
+	defer func() { nodeRotateSleep = time.Sleep }()
+	state := rotationState{
+		Target:   "http://localhost",
+		Pool:     "p1",
+		Template: "small",
+		Nodes:    []rotationNode{{Address: "http://10.0.0.9:2375"}},
+	}
+	c.Assert(state.save(), check.IsNil)
+	cluster := newFakeRotationCluster()
+	client := cmd.NewClient(&http.Client{Transport: cluster}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Node http://10.0.0.9:2375 is not in the cluster anymore, skipping it.
+Pool p1 successfully rotated.
+`)
+	c.Assert(cluster.calls, check.IsNil)
+}
+
+func (s *S) TestNodeRotateCmdRunStateMismatch(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	state := rotationState{Target: "http://localhost", Pool: "p1", Template: "large"}
+	c.Assert(state.save(), check.IsNil)
+	client := cmd.NewClient(&http.Client{Transport: newFakeRotationCluster()}, nil, s.manager)
+	context := cmd.Context{Stdout: ioutil.Discard}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `there is an unfinished rotation of pool "p1" in http://localhost using template "large", .*--reset to discard it`)
+}
+
+func (s *S) TestNodeRotateCmdRunReset(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	s.stubNodeRotateSleep()
+	defer func() { nodeRotateSleep = time.Sleep }()
+	state := rotationState{Target: "http://localhost", Pool: "p1", Template: "large"}
+	c.Assert(state.save(), check.IsNil)
+	cluster := newFakeRotationCluster()
+	client := cmd.NewClient(&http.Client{Transport: cluster}, nil, s.manager)
+	context := cmd.Context{Stdout: ioutil.Discard}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "--reset", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(cluster.calls[0], check.Equals, "add p1 small")
+}
+
+func (s *S) TestNodeRotateCmdRunNoNodes(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	client := cmd.NewClient(&http.Client{Transport: newFakeRotationCluster()}, nil, s.manager)
+	context := cmd.Context{Stdout: ioutil.Discard}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p9", "-t", "small", "-y"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `no nodes found in pool "p9"`)
+}
+
+func (s *S) TestNodeRotateCmdRunRequiresPoolAndTemplate(c *check.C) {
+	context := cmd.Context{Stdout: ioutil.Discard}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "the pool and the template are required, use --pool and --template")
+}
+
+func (s *S) TestNodeRotateCmdRunReadyTimeout(c *check.C) {
+	_, restore := setHome(c)
+	defer restore()
+	s.stubNodeRotateSleep()
+	defer func() { nodeRotateSleep = time.Sleep }()
+	cluster := newFakeRotationCluster()
+	client := cmd.NewClient(&http.Client{Transport: cluster}, nil, s.manager)
+	context := cmd.Context{Stdout: ioutil.Discard}
+	command := nodeRotateCmd{}
+	err := command.Flags().Parse(true, []string{"-p", "p1", "-t", "small", "--timeout", "1s", "-y"})
+	c.Assert(err, check.IsNil)
+	cluster.waiting["http://10.0.0.10:2375"] = 100
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `rotation interrupted, run node-rotate again to resume it: timeout waiting for node http://10.0.0.10:2375 to become ready, its status is "waiting"`)
+}
@@ -0,0 +1,306 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// roleInstance is a role assigned to a user in a context.
+type roleInstance struct {
+	Name         string
+	ContextType  string
+	ContextValue string
+}
+
+type user struct {
+	Email string
+	Roles []roleInstance
+}
+
+func listUsers(client *cmd.Client, filter url.Values) ([]user, error) {
+	path := "/users"
+	if len(filter) > 0 {
+		path += "?" + filter.Encode()
+	}
+	u, err := cmd.GetURL(path)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var users []user
+	err = json.NewDecoder(response.Body).Decode(&users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// permissionGrant is a permission held by a user through one of its roles.
+type permissionGrant struct {
+	User         string
+	Permission   string
+	Role         string
+	ContextType  string
+	ContextValue string
+}
+
+func (g *permissionGrant) context() string {
+	if g.ContextValue == "" {
+		return g.ContextType
+	}
+	return g.ContextType + ":" + g.ContextValue
+}
+
+type permissionGrantList []permissionGrant
+
+func (l permissionGrantList) Len() int      { return len(l) }
+func (l permissionGrantList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l permissionGrantList) Less(i, j int) bool {
+	if l[i].User != l[j].User {
+		return l[i].User < l[j].User
+	}
+	if l[i].Permission != l[j].Permission {
+		return l[i].Permission < l[j].Permission
+	}
+	if l[i].context() != l[j].context() {
+		return l[i].context() < l[j].context()
+	}
+	return l[i].Role < l[j].Role
+}
+
+// permissionGrants flattens the roles assigned to the user into the
+// permissions they grant. Permissions no longer known by the API are ignored,
+// as they are by the API when checking permissions.
+func permissionGrants(u *user, roles map[string]role, known map[string]bool) []permissionGrant {
+	var grants []permissionGrant
+	for _, instance := range u.Roles {
+		r, ok := roles[instance.Name]
+		if !ok {
+			continue
+		}
+		for _, scheme := range r.SchemeNames {
+			// The root permission is added to roles as *, but listed by the
+			// API with an empty name.
+			if scheme == "*" {
+				scheme = ""
+			}
+			if !known[scheme] {
+				continue
+			}
+			if scheme == "" {
+				scheme = "*"
+			}
+			grants = append(grants, permissionGrant{
+				User:         u.Email,
+				Permission:   scheme,
+				Role:         instance.Name,
+				ContextType:  r.ContextType,
+				ContextValue: instance.ContextValue,
+			})
+		}
+	}
+	return grants
+}
+
+// includesPermission reports whether granting scheme also grants perm, that
+// is, whether scheme is perm itself or one of its parents.
+func includesPermission(scheme, perm string) bool {
+	return scheme == "*" || scheme == perm || strings.HasPrefix(perm, scheme+".")
+}
+
+// permissionData holds what is needed to compute the permissions of users:
+// the roles by name and the known permissions with their allowed contexts.
+type permissionData struct {
+	roles   map[string]role
+	schemes map[string][]string
+}
+
+func loadPermissionData(client *cmd.Client) (*permissionData, error) {
+	roles, err := listRoles(client)
+	if err != nil {
+		return nil, err
+	}
+	schemes, err := listPermissionSchemes(client)
+	if err != nil {
+		return nil, err
+	}
+	data := permissionData{roles: map[string]role{}, schemes: map[string][]string{}}
+	for _, r := range roles {
+		data.roles[r.Name] = r
+	}
+	for _, s := range schemes {
+		data.schemes[s.Name] = s.Contexts
+	}
+	return &data, nil
+}
+
+func (d *permissionData) grants(u *user) []permissionGrant {
+	known := map[string]bool{}
+	for name := range d.schemes {
+		known[name] = true
+	}
+	return permissionGrants(u, d.roles, known)
+}
+
+type permissionWho struct {
+	fs      *gnuflag.FlagSet
+	context string
+}
+
+func (c *permissionWho) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "permission-who",
+		Usage: "permission-who <permission-name> [--context/-c <type>:<value>]",
+		Desc: `Lists the users holding a permission, along with the role granting it and the
+context it was granted in. Roles granting a parent of the permission, like app
+for app.deploy, are also considered.
+
+With [[--context]], like pool:prod or team:admin, only users holding the
+permission in the given context are listed. Permissions granted in the global
+context are valid in any context. Contexts are matched exactly: a permission
+granted for a team is not reported for the apps of that team.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *permissionWho) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		context := "Only list users holding the permission in this context, in the format <type>:<value>"
+		c.fs.StringVar(&c.context, "context", "", context)
+		c.fs.StringVar(&c.context, "c", "", context)
+	}
+	return c.fs
+}
+
+func (c *permissionWho) formatted() {}
+
+func (c *permissionWho) Run(context *cmd.Context, client *cmd.Client) error {
+	perm := context.Args[0]
+	scheme := perm
+	if scheme == "*" {
+		scheme = ""
+	}
+	data, err := loadPermissionData(client)
+	if err != nil {
+		return err
+	}
+	allowed, ok := data.schemes[scheme]
+	if !ok {
+		return errors.Errorf("permission %q not found", perm)
+	}
+	var ctxType, ctxValue string
+	if c.context != "" {
+		parts := strings.SplitN(c.context, ":", 2)
+		ctxType = parts[0]
+		if len(parts) > 1 {
+			ctxValue = parts[1]
+		}
+		var valid bool
+		for _, t := range allowed {
+			valid = valid || t == ctxType
+		}
+		if !valid {
+			return errors.Errorf("permission %q cannot be granted in context %q, valid types are: %s", perm, ctxType, strings.Join(allowed, ", "))
+		}
+	}
+	users, err := listUsers(client, nil)
+	if err != nil {
+		return err
+	}
+	var grants []permissionGrant
+	for i := range users {
+		for _, g := range data.grants(&users[i]) {
+			if !includesPermission(g.Permission, perm) {
+				continue
+			}
+			if ctxType != "" && g.ContextType != "global" && (g.ContextType != ctxType || g.ContextValue != ctxValue) {
+				continue
+			}
+			grants = append(grants, g)
+		}
+	}
+	sort.Sort(permissionGrantList(grants))
+	if grants == nil {
+		grants = []permissionGrant{}
+	}
+	l := listing{
+		Headers: cmd.Row{"User", "Role", "Granted permission", "Context"},
+		Data:    grants,
+	}
+	for _, g := range grants {
+		l.Rows = append(l.Rows, cmd.Row{g.User, g.Role, g.Permission, g.context()})
+	}
+	return render(context.Stdout, &l)
+}
+
+type userPermissions struct{}
+
+func (c *userPermissions) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "user-permissions",
+		Usage: "user-permissions <email>",
+		Desc: `Lists the effective permissions of a user, flattening all the roles assigned
+to the user into the permissions they grant and the context each one is
+valid in, along with the role granting it.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *userPermissions) formatted() {}
+
+func (c *userPermissions) Run(context *cmd.Context, client *cmd.Client) error {
+	email := context.Args[0]
+	users, err := listUsers(client, url.Values{"userEmail": {email}})
+	if err != nil {
+		return err
+	}
+	var u *user
+	for i := range users {
+		if users[i].Email == email {
+			u = &users[i]
+			break
+		}
+	}
+	if u == nil {
+		return errors.Errorf("user %s not found", email)
+	}
+	data, err := loadPermissionData(client)
+	if err != nil {
+		return err
+	}
+	grants := data.grants(u)
+	sort.Sort(permissionGrantList(grants))
+	if grants == nil {
+		grants = []permissionGrant{}
+	}
+	l := listing{
+		Headers: cmd.Row{"Permission", "Context", "Role"},
+		Data:    grants,
+	}
+	for _, g := range grants {
+		l.Rows = append(l.Rows, cmd.Row{g.Permission, g.context(), g.Role})
+	}
+	return render(context.Stdout, &l)
+}
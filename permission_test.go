@@ -0,0 +1,154 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+const permissionRolesJSON = `[
+	{"name": "admin", "context": "global", "scheme_names": ["*"]},
+	{"name": "deployer", "context": "pool", "scheme_names": ["app.deploy", "app.removed"]},
+	{"name": "team-member", "context": "team", "scheme_names": ["app"]}
+]`
+
+const permissionUsersJSON = `[
+	{"Email": "root@tsuru.io", "Roles": [{"Name": "admin", "ContextType": "global"}]},
+	{"Email": "dev@tsuru.io", "Roles": [
+		{"Name": "deployer", "ContextType": "pool", "ContextValue": "prod"},
+		{"Name": "team-member", "ContextType": "team", "ContextValue": "t1"}
+	]},
+	{"Email": "ops@tsuru.io", "Roles": [{"Name": "deployer", "ContextType": "pool", "ContextValue": "dev"}]}
+]`
+
+func (s *S) TestIncludesPermission(c *check.C) {
+	c.Assert(includesPermission("*", "app.deploy"), check.Equals, true)
+	c.Assert(includesPermission("app", "app.deploy"), check.Equals, true)
+	c.Assert(includesPermission("app.deploy", "app.deploy"), check.Equals, true)
+	c.Assert(includesPermission("app.deploy", "app"), check.Equals, false)
+	c.Assert(includesPermission("app.dep", "app.deploy"), check.Equals, false)
+}
+
+func (s *S) TestPermissionGrants(c *check.C) {
+	u := user{Email: "dev@tsuru.io", Roles: []roleInstance{
+		{Name: "deployer", ContextType: "pool", ContextValue: "prod"},
+		{Name: "removed-role", ContextType: "team", ContextValue: "t1"},
+	}}
+	roles := map[string]role{"deployer": {Name: "deployer", ContextType: "pool", SchemeNames: []string{"app.deploy", "app.removed"}}}
+	grants := permissionGrants(&u, roles, map[string]bool{"app.deploy": true})
+	c.Assert(grants, check.DeepEquals, []permissionGrant{
+		{User: "dev@tsuru.io", Permission: "app.deploy", Role: "deployer", ContextType: "pool", ContextValue: "prod"},
+	})
+}
+
+func permissionWhoTransport() *cmdtest.MultiConditionalTransport {
+	roles := getTransport("/roles", permissionRolesJSON)
+	permissions := getTransport("/permissions", permissionsJSON)
+	users := getTransport("/users", permissionUsersJSON)
+	return &cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{roles, permissions, users},
+	}
+}
+
+func (s *S) TestPermissionWhoRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"app.deploy.rollback"}, Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: permissionWhoTransport()}, nil, s.manager)
+	command := permissionWho{}
+	command.Flags().Parse(true, []string{})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+---------------+-------------+--------------------+-----------+
+| User          | Role        | Granted permission | Context   |
++---------------+-------------+--------------------+-----------+
+| dev@tsuru.io  | team-member | app                | team:t1   |
+| dev@tsuru.io  | deployer    | app.deploy         | pool:prod |
+| ops@tsuru.io  | deployer    | app.deploy         | pool:dev  |
+| root@tsuru.io | admin       | *                  | global    |
++---------------+-------------+--------------------+-----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestPermissionWhoRunWithContext(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"app.deploy"}, Stdout: &buf}
+	client := cmd.NewClient(&http.Client{Transport: permissionWhoTransport()}, nil, s.manager)
+	command := permissionWho{}
+	command.Flags().Parse(true, []string{"--context", "pool:prod"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+---------------+----------+--------------------+-----------+
+| User          | Role     | Granted permission | Context   |
++---------------+----------+--------------------+-----------+
+| dev@tsuru.io  | deployer | app.deploy         | pool:prod |
+| root@tsuru.io | admin    | *                  | global    |
++---------------+----------+--------------------+-----------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestPermissionWhoRunInvalidContext(c *check.C) {
+	context := cmd.Context{Args: []string{"node"}, Stdout: &bytes.Buffer{}}
+	client := cmd.NewClient(&http.Client{Transport: permissionWhoTransport()}, nil, s.manager)
+	command := permissionWho{}
+	command.Flags().Parse(true, []string{"-c", "team:t1"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `permission "node" cannot be granted in context "team", valid types are: global, pool`)
+}
+
+func (s *S) TestPermissionWhoRunNotFound(c *check.C) {
+	context := cmd.Context{Args: []string{"app.unknown"}, Stdout: &bytes.Buffer{}}
+	client := cmd.NewClient(&http.Client{Transport: permissionWhoTransport()}, nil, s.manager)
+	command := permissionWho{}
+	command.Flags().Parse(true, []string{})
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `permission "app.unknown" not found`)
+}
+
+func (s *S) TestUserPermissionsRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"dev@tsuru.io"}, Stdout: &buf}
+	users := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: permissionUsersJSON, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return strings.HasSuffix(req.URL.Path, "/users") && req.URL.Query().Get("userEmail") == "dev@tsuru.io"
+		},
+	}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			users,
+			getTransport("/roles", permissionRolesJSON),
+			getTransport("/permissions", permissionsJSON),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := userPermissions{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+------------+-----------+-------------+
+| Permission | Context   | Role        |
++------------+-----------+-------------+
+| app        | team:t1   | team-member |
+| app.deploy | pool:prod | deployer    |
++------------+-----------+-------------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestUserPermissionsRunNotFound(c *check.C) {
+	context := cmd.Context{Args: []string{"nobody@tsuru.io"}, Stdout: &bytes.Buffer{}}
+	trans := getTransport("/users", "[]")
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := userPermissions{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "user nobody@tsuru.io not found")
+}
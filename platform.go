@@ -0,0 +1,91 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/tsuru/tsuru/cmd"
+)
+
+type platform struct {
+	Name     string
+	Disabled bool
+}
+
+type platformList struct{}
+
+func (platformList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "platform-list",
+		Usage:   "platform-list",
+		Desc:    "Lists the available platforms. All platforms displayed in this list may be used to create new apps (see app-create).",
+		MinArgs: 0,
+	}
+}
+
+func (platformList) formatted() {}
+
+func listPlatforms(client *cmd.Client) ([]platform, error) {
+	url, err := cmd.GetURL("/platforms")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	platforms := []platform{}
+	if resp.StatusCode != http.StatusNoContent {
+		err = json.NewDecoder(resp.Body).Decode(&platforms)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return platforms, nil
+}
+
+func (platformList) Run(context *cmd.Context, client *cmd.Client) error {
+	platforms, err := listPlatforms(client)
+	if err != nil {
+		return err
+	}
+	l := listing{
+		Headers: cmd.Row{"Name", "Disabled"},
+		Sort:    true,
+		Data:    platforms,
+	}
+	for _, p := range platforms {
+		l.Rows = append(l.Rows, cmd.Row{p.Name, strconv.FormatBool(p.Disabled)})
+	}
+	if machineReadable() {
+		return render(context.Stdout, &l)
+	}
+	if len(platforms) == 0 {
+		fmt.Fprintln(context.Stdout, "No platforms available.")
+		return nil
+	}
+	platformNames := make([]string, len(platforms))
+	for i, p := range platforms {
+		platformNames[i] = p.Name
+		if p.Disabled {
+			platformNames[i] += " (disabled)"
+		}
+	}
+	sort.Strings(platformNames)
+	for _, p := range platformNames {
+		fmt.Fprintf(context.Stdout, "- %s\n", p)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+type pointerBoolFlag struct {
+	value *bool
+}
+
+func (p *pointerBoolFlag) String() string {
+	if p.value == nil {
+		return "not set"
+	}
+	return strconv.FormatBool(*p.value)
+}
+
+func (p *pointerBoolFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.value = &v
+	return nil
+}
+
+func (p *pointerBoolFlag) IsBoolFlag() bool {
+	return true
+}
+
+type updatePoolToSchedulerCmd struct {
+	fs          *gnuflag.FlagSet
+	public      pointerBoolFlag
+	defaultPool pointerBoolFlag
+	force       bool
+}
+
+func (c *updatePoolToSchedulerCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "pool-update",
+		Usage:   "pool-update <pool> [--public=true/false] [--default=true/false] [-f/--force]",
+		Desc:    `Updates attributes for a pool.`,
+		MinArgs: 1,
+	}
+}
+
+func (c *updatePoolToSchedulerCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("", gnuflag.ExitOnError)
+		c.fs.Var(&c.public, "public", "Make pool public (all teams can use it)")
+		c.fs.Var(&c.defaultPool, "default", "Make pool default (when none is specified during [[app-create]] this pool will be used)")
+		msg := "Force pool to be default."
+		c.fs.BoolVar(&c.force, "force", false, msg)
+		c.fs.BoolVar(&c.force, "f", false, msg)
+	}
+	return c.fs
+}
+
+func (c *updatePoolToSchedulerCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	v := url.Values{}
+	if c.public.value != nil {
+		v.Set("public", strconv.FormatBool(*c.public.value))
+	}
+	if c.defaultPool.value != nil {
+		v.Set("default", strconv.FormatBool(*c.defaultPool.value))
+	}
+	v.Set("force", strconv.FormatBool(c.force))
+	u, err := cmd.GetURL("/pools/" + ctx.Args[0])
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("PUT", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Pool successfully updated.")
+	return nil
+}
+
+type removePoolFromSchedulerCmd struct {
+	cmd.ConfirmationCommand
+}
+
+func (c *removePoolFromSchedulerCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "pool-remove",
+		Usage:   "pool-remove <pool> [-y]",
+		Desc:    "Remove an existing pool.",
+		MinArgs: 1,
+	}
+}
+
+func (c *removePoolFromSchedulerCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	if !c.Confirm(ctx, fmt.Sprintf("Are you sure you want to remove %q pool?", ctx.Args[0])) {
+		return nil
+	}
+	u, err := cmd.GetURL("/pools/" + ctx.Args[0])
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Pool successfully removed.")
+	return nil
+}
+
+type addTeamsToPoolCmd struct{}
+
+func (addTeamsToPoolCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "pool-teams-add",
+		Usage: "pool-teams-add <pool> <teams>...",
+		Desc: `Adds teams to a pool. This will make the specified pool available when
+creating a new application for one of the added teams.`,
+		MinArgs: 2,
+	}
+}
+
+func (addTeamsToPoolCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	v := url.Values{}
+	for _, team := range ctx.Args[1:] {
+		v.Add("team", team)
+	}
+	u, err := cmd.GetURL(fmt.Sprintf("/pools/%s/team", ctx.Args[0]))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Teams successfully registered.")
+	return nil
+}
+
+type removeTeamsFromPoolCmd struct{}
+
+func (removeTeamsFromPoolCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "pool-teams-remove",
+		Usage: "pool-teams-remove <pool> <teams>...",
+		Desc: `Removes teams from a pool. Listed teams will be no longer able to use this
+pool when creating a new application.`,
+		MinArgs: 2,
+	}
+}
+
+func (removeTeamsFromPoolCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	v := url.Values{}
+	for _, team := range ctx.Args[1:] {
+		v.Add("team", team)
+	}
+	u, err := cmd.GetURL(fmt.Sprintf("/pools/%s/team?%s", ctx.Args[0], v.Encode()))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Teams successfully removed.")
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestUpdatePoolToSchedulerCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"test"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			_, hasDefault := req.Form["default"]
+			return req.Method == "PUT" && strings.HasSuffix(req.URL.Path, "/pools/test") &&
+				req.FormValue("public") == "false" && !hasDefault
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := updatePoolToSchedulerCmd{}
+	command.Flags().Parse(true, []string{"--public=false"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Pool successfully updated.\n")
+}
+
+func (s *S) TestRemovePoolFromSchedulerCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"test"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/pools/test")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := removePoolFromSchedulerCmd{}
+	command.Flags().Parse(true, []string{"-y"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Pool successfully removed.\n")
+}
+
+func (s *S) TestAddTeamsToPoolCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"pool1", "team1", "team2"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			teams := req.Form["team"]
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/pools/pool1/team") &&
+				len(teams) == 2 && teams[0] == "team1" && teams[1] == "team2"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	err := addTeamsToPoolCmd{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Teams successfully registered.\n")
+}
+
+func (s *S) TestRemoveTeamsFromPoolCmdRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"pool1", "team1"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/pools/pool1/team") &&
+				req.URL.Query().Get("team") == "team1"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	err := removeTeamsFromPoolCmd{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Teams successfully removed.\n")
+}
@@ -0,0 +1,254 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/yaml.v1"
+)
+
+const defaultOutputFormat = "table"
+
+// outputFormat is the value of the global --format flag, set by
+// parseFormatFlag before the manager runs the command.
+var outputFormat = defaultOutputFormat
+
+// listing holds everything a listing command needs to print its result. Table
+// output uses Headers and Rows, exactly like cmd.Table. JSON and YAML output
+// serialize Data, so field names follow the API structs instead of the column
+// titles. CSV output uses Headers and Rows, one record per row.
+type listing struct {
+	Headers       cmd.Row
+	Rows          []cmd.Row
+	LineSeparator bool
+	Sort          bool
+	Data          interface{}
+}
+
+func (l *listing) table() *cmd.Table {
+	table := cmd.NewTable()
+	table.Headers = l.Headers
+	table.LineSeparator = l.LineSeparator
+	for _, row := range l.Rows {
+		table.AddRow(row)
+	}
+	if l.Sort {
+		table.Sort()
+	}
+	return table
+}
+
+type renderer interface {
+	Render(w io.Writer, l *listing) error
+}
+
+var renderers = map[string]renderer{
+	"table": tableRenderer{},
+	"json":  jsonRenderer{},
+	"yaml":  yamlRenderer{},
+	"csv":   csvRenderer{},
+}
+
+type tableRenderer struct{}
+
+func (tableRenderer) Render(w io.Writer, l *listing) error {
+	_, err := w.Write(l.table().Bytes())
+	return err
+}
+
+type jsonRenderer struct{}
+
+func (jsonRenderer) Render(w io.Writer, l *listing) error {
+	data, err := json.MarshalIndent(l.Data, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+type yamlRenderer struct{}
+
+// Render marshals Data to JSON first, so YAML documents use the same field
+// names and time representation as the JSON output.
+func (yamlRenderer) Render(w io.Writer, l *listing) error {
+	data, err := json.Marshal(l.Data)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	err = json.Unmarshal(data, &generic)
+	if err != nil {
+		return err
+	}
+	data, err = yaml.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ansiEscape matches the escape sequences added by cmd.Colorfy.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+type csvRenderer struct{}
+
+// Render writes the rows without the colors used by the table output, so
+// commands can share the same rows between both formats.
+func (csvRenderer) Render(w io.Writer, l *listing) error {
+	rows := make([]cmd.Row, len(l.Rows))
+	for i, row := range l.Rows {
+		rows[i] = make(cmd.Row, len(row))
+		for j, cell := range row {
+			rows[i][j] = ansiEscape.ReplaceAllString(cell, "")
+		}
+	}
+	if l.Sort {
+		sort.Stable(rowsByFirstColumn(rows))
+	}
+	writer := csv.NewWriter(w)
+	err := writer.Write(l.Headers)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err = writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type rowsByFirstColumn []cmd.Row
+
+func (l rowsByFirstColumn) Len() int      { return len(l) }
+func (l rowsByFirstColumn) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l rowsByFirstColumn) Less(i, j int) bool {
+	return strings.ToLower(l[i][0]) < strings.ToLower(l[j][0])
+}
+
+// render writes l to w using the format selected with --format.
+func render(w io.Writer, l *listing) error {
+	return renderers[outputFormat].Render(w, l)
+}
+
+// machineReadable reports whether --format asked for something other than
+// the default table output. Commands that print more than one table use it to
+// switch to a single rendered listing.
+func machineReadable() bool {
+	return outputFormat != defaultOutputFormat
+}
+
+// formattedCommand is implemented by commands that honor the global --format
+// flag.
+type formattedCommand interface {
+	cmd.Command
+	formatted()
+}
+
+// parseFormatFlag removes --format <value> (or --format=<value>) from the
+// global flags in args, storing the value in outputFormat. Only the flags
+// before the command name are global, the ones after it belong to the
+// command.
+func parseFormatFlag(args []string) ([]string, error) {
+	end := commandIndex(args)
+	result := make([]string, 0, len(args))
+	for i := 0; i < end; i++ {
+		arg := args[i]
+		var value string
+		switch {
+		case arg == "--format":
+			if i+1 >= len(args) {
+				return nil, errors.New("flag needs an argument: --format")
+			}
+			i++
+			value = args[i]
+		case strings.HasPrefix(arg, "--format="):
+			value = strings.TrimPrefix(arg, "--format=")
+		default:
+			result = append(result, arg)
+			continue
+		}
+		if _, ok := renderers[value]; !ok {
+			return nil, errors.Errorf("invalid output format %q, expected one of: %s", value, strings.Join(formatNames(), ", "))
+		}
+		outputFormat = value
+	}
+	return append(result, args[end:]...), nil
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(renderers))
+	for name := range renderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkFormatSupport returns an error when a machine-readable format was
+// requested for a command that only knows how to print tables or messages.
+func checkFormatSupport(m *cmd.Manager, args []string) error {
+	if !machineReadable() {
+		return nil
+	}
+	name := commandName(args)
+	command, ok := m.Commands[name]
+	if !ok {
+		return nil
+	}
+	if deprecated, ok := command.(*cmd.DeprecatedCommand); ok {
+		command = deprecated.Command
+	}
+	if _, ok := command.(formattedCommand); !ok {
+		return errors.Errorf("command %q does not support --format %s", name, outputFormat)
+	}
+	return nil
+}
+
+// globalValueFlags are the global flags followed by a value, either from the
+// manager or handled by tsuru-admin before running the command.
+var globalValueFlags = map[string]bool{
+	"-v":          true,
+	"--verbosity": true,
+	"--format":    true,
+	"--targets":   true,
+}
+
+// commandIndex returns the index of the command name in args, which is the
+// first argument that is not a global flag, or len(args) when there is none.
+func commandIndex(args []string) int {
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case globalValueFlags[arg]:
+			i++
+		case strings.HasPrefix(arg, "-"):
+		default:
+			return i
+		}
+	}
+	return len(args)
+}
+
+// commandName returns the first argument that is not one of the global
+// flags.
+func commandName(args []string) string {
+	if i := commandIndex(args); i < len(args) {
+		return args[i]
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+type renderItem struct {
+	Name  string
+	Count int
+}
+
+func sampleListing() *listing {
+	return &listing{
+		Headers: cmd.Row{"Name", "Count"},
+		Rows:    []cmd.Row{{"b", "2"}, {"a", "1\n3"}},
+		Sort:    true,
+		Data:    []renderItem{{Name: "b", Count: 2}, {Name: "a", Count: 1}},
+	}
+}
+
+func (s *S) TestRenderTable(c *check.C) {
+	var buf bytes.Buffer
+	err := render(&buf, sampleListing())
+	c.Assert(err, check.IsNil)
+	expected := `+------+-------+
+| Name | Count |
++------+-------+
+| a    | 1     |
+|      | 3     |
+| b    | 2     |
++------+-------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestRenderJSON(c *check.C) {
+	outputFormat = "json"
+	var buf bytes.Buffer
+	err := render(&buf, sampleListing())
+	c.Assert(err, check.IsNil)
+	expected := `[
+  {
+    "Name": "b",
+    "Count": 2
+  },
+  {
+    "Name": "a",
+    "Count": 1
+  }
+]
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestRenderYAML(c *check.C) {
+	outputFormat = "yaml"
+	var buf bytes.Buffer
+	err := render(&buf, sampleListing())
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "- Count: 2\n  Name: b\n- Count: 1\n  Name: a\n")
+}
+
+func (s *S) TestRenderCSV(c *check.C) {
+	outputFormat = "csv"
+	var buf bytes.Buffer
+	err := render(&buf, sampleListing())
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Name,Count\na,\"1\n3\"\nb,2\n")
+}
+
+func (s *S) TestRenderCSVWithoutColors(c *check.C) {
+	os.Unsetenv("TSURU_DISABLE_COLORS")
+	outputFormat = "csv"
+	l := &listing{
+		Headers: cmd.Row{"Name", "Status"},
+		Rows:    []cmd.Row{{"a", cmd.Colorfy("error", "red", "", "")}},
+	}
+	c.Assert(l.Rows[0][1], check.Not(check.Equals), "error")
+	var buf bytes.Buffer
+	err := render(&buf, l)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Name,Status\na,error\n")
+}
+
+func (s *S) TestParseFormatFlag(c *check.C) {
+	args, err := parseFormatFlag([]string{"-v", "1", "--format", "json", "node-list", "-f", "pool=x"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"-v", "1", "node-list", "-f", "pool=x"})
+	c.Assert(outputFormat, check.Equals, "json")
+	args, err = parseFormatFlag([]string{"--format=csv", "machine-list"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"machine-list"})
+	c.Assert(outputFormat, check.Equals, "csv")
+}
+
+func (s *S) TestParseFormatFlagStopsAtCommandName(c *check.C) {
+	args, err := parseFormatFlag([]string{"node-list", "--format", "json"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"node-list", "--format", "json"})
+	c.Assert(outputFormat, check.Equals, defaultOutputFormat)
+	args, err = parseFormatFlag([]string{"app-run", "-a", "myapp", "--format=xml"})
+	c.Assert(err, check.IsNil)
+	c.Assert(args, check.DeepEquals, []string{"app-run", "-a", "myapp", "--format=xml"})
+	c.Assert(outputFormat, check.Equals, defaultOutputFormat)
+}
+
+func (s *S) TestParseFormatFlagInvalid(c *check.C) {
+	_, err := parseFormatFlag([]string{"--format", "xml", "node-list"})
+	c.Assert(err, check.ErrorMatches, `invalid output format "xml", expected one of: csv, json, table, yaml`)
+	_, err = parseFormatFlag([]string{"--format"})
+	c.Assert(err, check.ErrorMatches, "flag needs an argument: --format")
+}
+
+func (s *S) TestCheckFormatSupport(c *check.C) {
+	manager := buildManager("tsuru-admin")
+	c.Assert(checkFormatSupport(manager, []string{"node-add"}), check.IsNil)
+	outputFormat = "json"
+	c.Assert(checkFormatSupport(manager, []string{"-v", "2", "node-list"}), check.IsNil)
+	c.Assert(checkFormatSupport(manager, []string{"docker-node-list"}), check.IsNil)
+	err := checkFormatSupport(manager, []string{"node-add"})
+	c.Assert(err, check.ErrorMatches, `command "node-add" does not support --format json`)
+}
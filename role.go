@@ -0,0 +1,587 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/permission"
+)
+
+func getRole(client *cmd.Client, name string) (*role, error) {
+	u, err := cmd.GetURL("/roles/" + name)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var r role
+	err = json.NewDecoder(response.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func listDefaultRoles(client *cmd.Client) ([]role, error) {
+	u, err := cmd.GetURL("/role/default")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var roles []role
+	if response.StatusCode == http.StatusNoContent {
+		return roles, nil
+	}
+	err = json.NewDecoder(response.Body).Decode(&roles)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// permissionScheme is a permission as listed by the API, with the context
+// types it may be granted in.
+type permissionScheme struct {
+	Name     string
+	Contexts []string
+}
+
+func listPermissionSchemes(client *cmd.Client) ([]permissionScheme, error) {
+	u, err := cmd.GetURL("/permissions")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var schemes []permissionScheme
+	err = json.NewDecoder(response.Body).Decode(&schemes)
+	if err != nil {
+		return nil, err
+	}
+	return schemes, nil
+}
+
+// roleEventNames returns the names of the events that add default roles to
+// users, sorted.
+func roleEventNames() []string {
+	names := make([]string, 0, len(permission.RoleEventMap))
+	for name := range permission.RoleEventMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type roleAdd struct {
+	fs          *gnuflag.FlagSet
+	description string
+}
+
+func (c *roleAdd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-add",
+		Usage: "role-add <name> <context-type> [--description/-d <description>]",
+		Desc: `Creates a new role. The context type is one of global, team, app or pool, and
+limits both the permissions that can be added to the role and the values it
+can be assigned with. Use [[permission-tree]] to see the context types allowed
+for each permission.`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *roleAdd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		description := "Description of the role"
+		c.fs.StringVar(&c.description, "description", "", description)
+		c.fs.StringVar(&c.description, "d", "", description)
+	}
+	return c.fs
+}
+
+func (c *roleAdd) Run(context *cmd.Context, client *cmd.Client) error {
+	u, err := cmd.GetURL("/roles")
+	if err != nil {
+		return err
+	}
+	values := url.Values{}
+	values.Set("name", context.Args[0])
+	values.Set("context", context.Args[1])
+	values.Set("description", c.description)
+	err = doForm(client, "POST", u, values)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Role %q successfully created!\n", context.Args[0])
+	return nil
+}
+
+type roleRemove struct {
+	cmd.ConfirmationCommand
+}
+
+func (c *roleRemove) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-remove",
+		Usage: "role-remove <name> [-y]",
+		Desc: `Removes a role. The role is also dissociated from all users it was assigned
+to.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *roleRemove) Run(context *cmd.Context, client *cmd.Client) error {
+	name := context.Args[0]
+	if !c.Confirm(context, fmt.Sprintf("Are you sure you want to remove the role %q?", name)) {
+		return nil
+	}
+	u, err := cmd.GetURL("/roles/" + name)
+	if err != nil {
+		return err
+	}
+	err = doForm(client, "DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Role %q successfully removed!\n", name)
+	return nil
+}
+
+type roleInfo struct{}
+
+func (c *roleInfo) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "role-info",
+		Usage:   "role-info <name>",
+		Desc:    `Shows the context type, the permissions and the default events of a role.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *roleInfo) formatted() {}
+
+func (c *roleInfo) Run(context *cmd.Context, client *cmd.Client) error {
+	r, err := getRole(client, context.Args[0])
+	if err != nil {
+		return err
+	}
+	l := listing{
+		Headers: cmd.Row{"Permission"},
+		Sort:    true,
+		Data:    r,
+	}
+	for _, name := range r.SchemeNames {
+		if name == "" {
+			name = "*"
+		}
+		l.Rows = append(l.Rows, cmd.Row{name})
+	}
+	if machineReadable() {
+		return render(context.Stdout, &l)
+	}
+	events := "-"
+	if len(r.Events) > 0 {
+		events = strings.Join(r.Events, ", ")
+	}
+	fmt.Fprintf(context.Stdout, "Name: %s\n", r.Name)
+	fmt.Fprintf(context.Stdout, "Context: %s\n", r.ContextType)
+	fmt.Fprintf(context.Stdout, "Description: %s\n", r.Description)
+	fmt.Fprintf(context.Stdout, "Default for: %s\n", events)
+	if len(l.Rows) == 0 {
+		fmt.Fprintln(context.Stdout, "Permissions: -")
+		return nil
+	}
+	fmt.Fprintln(context.Stdout, "Permissions:")
+	return render(context.Stdout, &l)
+}
+
+type rolePermissionAdd struct{}
+
+func (c *rolePermissionAdd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-permission-add",
+		Usage: "role-permission-add <role-name> <permission-name>...",
+		Desc: `Adds permissions to a role. Adding a permission also grants all the
+permissions below it, for instance, app.update grants app.update.env.set.
+Use * to grant all permissions.`,
+		MinArgs: 2,
+	}
+}
+
+func (c *rolePermissionAdd) Run(context *cmd.Context, client *cmd.Client) error {
+	name := context.Args[0]
+	u, err := cmd.GetURL(fmt.Sprintf("/roles/%s/permissions", name))
+	if err != nil {
+		return err
+	}
+	err = doForm(client, "POST", u, url.Values{"permission": context.Args[1:]})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Permission successfully added to role %q!\n", name)
+	return nil
+}
+
+type rolePermissionRemove struct{}
+
+func (c *rolePermissionRemove) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "role-permission-remove",
+		Usage:   "role-permission-remove <role-name> <permission-name>...",
+		Desc:    `Removes permissions from a role.`,
+		MinArgs: 2,
+	}
+}
+
+func (c *rolePermissionRemove) Run(context *cmd.Context, client *cmd.Client) error {
+	name := context.Args[0]
+	for _, perm := range context.Args[1:] {
+		u, err := cmd.GetURL(fmt.Sprintf("/roles/%s/permissions/%s", name, perm))
+		if err != nil {
+			return err
+		}
+		err = doForm(client, "DELETE", u, nil)
+		if err != nil {
+			return errors.Wrapf(err, "unable to remove permission %q", perm)
+		}
+	}
+	fmt.Fprintf(context.Stdout, "Permission successfully removed from role %q!\n", name)
+	return nil
+}
+
+type roleAssign struct{}
+
+func (c *roleAssign) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-assign",
+		Usage: "role-assign <role-name> <user-email> [<context-value>]",
+		Desc: `Assigns a role to a user. The context value is the name of the team, app or
+pool the permissions of the role apply to, and must be omitted for roles with
+the global context type.`,
+		MinArgs: 2,
+		MaxArgs: 3,
+	}
+}
+
+func (c *roleAssign) Run(context *cmd.Context, client *cmd.Client) error {
+	name := context.Args[0]
+	values := url.Values{}
+	values.Set("email", context.Args[1])
+	if len(context.Args) > 2 {
+		values.Set("context", context.Args[2])
+	}
+	u, err := cmd.GetURL(fmt.Sprintf("/roles/%s/user", name))
+	if err != nil {
+		return err
+	}
+	err = doForm(client, "POST", u, values)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Role %q successfully assigned to %q!\n", name, context.Args[1])
+	return nil
+}
+
+type roleDissociate struct{}
+
+func (c *roleDissociate) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-dissociate",
+		Usage: "role-dissociate <role-name> <user-email> [<context-value>]",
+		Desc: `Dissociates a role from a user. The context value must match the one used
+when the role was assigned.`,
+		MinArgs: 2,
+		MaxArgs: 3,
+	}
+}
+
+func (c *roleDissociate) Run(context *cmd.Context, client *cmd.Client) error {
+	name := context.Args[0]
+	path := fmt.Sprintf("/roles/%s/user/%s", name, context.Args[1])
+	if len(context.Args) > 2 {
+		path += "?" + url.Values{"context": {context.Args[2]}}.Encode()
+	}
+	u, err := cmd.GetURL(path)
+	if err != nil {
+		return err
+	}
+	err = doForm(client, "DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Role %q successfully dissociated from %q!\n", name, context.Args[1])
+	return nil
+}
+
+// roleEventFlags holds one flag per role event, each one listing the roles
+// added to or removed from the event.
+type roleEventFlags struct {
+	fs    *gnuflag.FlagSet
+	roles map[string]*cmd.StringSliceFlag
+}
+
+func (f *roleEventFlags) flags(action string) *gnuflag.FlagSet {
+	if f.fs == nil {
+		f.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		f.roles = map[string]*cmd.StringSliceFlag{}
+		for _, name := range roleEventNames() {
+			roles := &cmd.StringSliceFlag{}
+			f.roles[name] = roles
+			desc := fmt.Sprintf("Role to %s as default for the event: %s", action, permission.RoleEventMap[name].Description)
+			f.fs.Var(roles, name, desc)
+		}
+	}
+	return f.fs
+}
+
+func (f *roleEventFlags) values() (url.Values, error) {
+	values := url.Values{}
+	for name, roles := range f.roles {
+		for _, r := range *roles {
+			values.Add(name, r)
+		}
+	}
+	if len(values) == 0 {
+		return nil, errors.Errorf("at least one of --%s must be given", strings.Join(roleEventNames(), ", --"))
+	}
+	return values, nil
+}
+
+type roleDefaultAdd struct {
+	roleEventFlags
+}
+
+func (c *roleDefaultAdd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-default-add",
+		Usage: "role-default-add [--user-create <role>]... [--team-create <role>]...",
+		Desc: `Sets roles as default for events, so they are automatically assigned to
+users when the event happens. Roles set for user-create are assigned to every
+new user, and must have the global context type. Roles set for team-create
+are assigned to the user creating a team, with the new team as context value.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *roleDefaultAdd) Flags() *gnuflag.FlagSet {
+	return c.flags("add")
+}
+
+func (c *roleDefaultAdd) Run(context *cmd.Context, client *cmd.Client) error {
+	values, err := c.values()
+	if err != nil {
+		return err
+	}
+	u, err := cmd.GetURL("/role/default")
+	if err != nil {
+		return err
+	}
+	err = doForm(client, "POST", u, values)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(context.Stdout, "Roles successfully added as default!")
+	return nil
+}
+
+type roleDefaultRemove struct {
+	roleEventFlags
+}
+
+func (c *roleDefaultRemove) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "role-default-remove",
+		Usage:   "role-default-remove [--user-create <role>]... [--team-create <role>]...",
+		Desc:    `Stops assigning roles automatically when events happen.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *roleDefaultRemove) Flags() *gnuflag.FlagSet {
+	return c.flags("remove")
+}
+
+func (c *roleDefaultRemove) Run(context *cmd.Context, client *cmd.Client) error {
+	values, err := c.values()
+	if err != nil {
+		return err
+	}
+	// The API only reads the form from the query string in DELETE requests.
+	u, err := cmd.GetURL("/role/default?" + values.Encode())
+	if err != nil {
+		return err
+	}
+	err = doForm(client, "DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(context.Stdout, "Roles successfully removed as default!")
+	return nil
+}
+
+type roleDefaultList struct{}
+
+func (c *roleDefaultList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "role-default-list",
+		Usage:   "role-default-list",
+		Desc:    `Lists the events that assign roles automatically and the roles they assign.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *roleDefaultList) formatted() {}
+
+func (c *roleDefaultList) Run(context *cmd.Context, client *cmd.Client) error {
+	roles, err := listDefaultRoles(client)
+	if err != nil {
+		return err
+	}
+	if roles == nil {
+		roles = []role{}
+	}
+	byEvent := map[string][]string{}
+	for _, r := range roles {
+		for _, evt := range r.Events {
+			byEvent[evt] = append(byEvent[evt], r.Name)
+		}
+	}
+	l := listing{
+		Headers:       cmd.Row{"Event", "Description", "Roles"},
+		Data:          roles,
+		LineSeparator: true,
+	}
+	for _, name := range roleEventNames() {
+		sort.Strings(byEvent[name])
+		l.Rows = append(l.Rows, cmd.Row{name, permission.RoleEventMap[name].Description, strings.Join(byEvent[name], "\n")})
+	}
+	return render(context.Stdout, &l)
+}
+
+type permissionTree struct{}
+
+func (c *permissionTree) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "permission-tree",
+		Usage: "permission-tree [<permission-name>]",
+		Desc: `Displays the hierarchy of permissions, with the context types each permission
+may be granted in. Granting a permission also grants all permissions below it.
+
+When a permission name is given, only the permissions below it are displayed.`,
+		MinArgs: 0,
+		MaxArgs: 1,
+	}
+}
+
+func (c *permissionTree) formatted() {}
+
+func (c *permissionTree) Run(context *cmd.Context, client *cmd.Client) error {
+	schemes, err := listPermissionSchemes(client)
+	if err != nil {
+		return err
+	}
+	var root string
+	if len(context.Args) > 0 && context.Args[0] != "*" {
+		root = context.Args[0]
+	}
+	contexts := map[string][]string{}
+	children := map[string][]string{}
+	var selected []permissionScheme
+	for _, s := range schemes {
+		if root != "" && s.Name != root && !strings.HasPrefix(s.Name, root+".") {
+			continue
+		}
+		selected = append(selected, s)
+		contexts[s.Name] = s.Contexts
+		if s.Name == "" {
+			continue
+		}
+		var parent string
+		if i := strings.LastIndex(s.Name, "."); i >= 0 {
+			parent = s.Name[:i]
+		}
+		children[parent] = append(children[parent], s.Name)
+	}
+	if _, ok := contexts[root]; !ok {
+		return errors.Errorf("permission %q not found", root)
+	}
+	if machineReadable() {
+		l := listing{
+			Headers: cmd.Row{"Permission", "Contexts"},
+			Data:    selected,
+		}
+		for _, s := range selected {
+			name := s.Name
+			if name == "" {
+				name = "*"
+			}
+			l.Rows = append(l.Rows, cmd.Row{name, strings.Join(s.Contexts, ", ")})
+		}
+		return render(context.Stdout, &l)
+	}
+	for _, names := range children {
+		sort.Strings(names)
+	}
+	t := permissionTreeWriter{w: context.Stdout, contexts: contexts, children: children}
+	t.write(root, "", "")
+	return nil
+}
+
+type permissionTreeWriter struct {
+	w        io.Writer
+	contexts map[string][]string
+	children map[string][]string
+}
+
+func (t *permissionTreeWriter) write(name, prefix, childPrefix string) {
+	display := name
+	if display == "" {
+		display = "*"
+	}
+	fmt.Fprintf(t.w, "%s%s (%s)\n", prefix, display, strings.Join(t.contexts[name], ", "))
+	children := t.children[name]
+	for i, child := range children {
+		if i == len(children)-1 {
+			t.write(child, childPrefix+"└── ", childPrefix+"    ")
+		} else {
+			t.write(child, childPrefix+"├── ", childPrefix+"│   ")
+		}
+	}
+}
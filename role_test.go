@@ -0,0 +1,262 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestRoleAddRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"deployer", "team"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusCreated},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles") &&
+				req.FormValue("name") == "deployer" && req.FormValue("context") == "team" &&
+				req.FormValue("description") == "deploys apps"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := roleAdd{}
+	command.Flags().Parse(true, []string{"-d", "deploys apps"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Role \"deployer\" successfully created!\n")
+}
+
+func (s *S) TestRoleRemoveRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"deployer"}, Stdout: &buf, Stdin: strings.NewReader("y\n")}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/roles/deployer")
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := roleRemove{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Are you sure you want to remove the role \"deployer\"? (y/n) Role \"deployer\" successfully removed!\n")
+}
+
+func (s *S) TestRoleInfoRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"deployer"}, Stdout: &buf}
+	trans := getTransport("/roles/deployer", `{"name": "deployer", "context": "team", "Description": "deploys apps",
+		"scheme_names": ["app.update", "app.deploy"], "events": ["team-create"]}`)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleInfo{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Name: deployer
+Context: team
+Description: deploys apps
+Default for: team-create
+Permissions:
++------------+
+| Permission |
++------------+
+| app.deploy |
+| app.update |
++------------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestRolePermissionAddRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"deployer", "app.deploy", "app.read"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles/deployer/permissions") &&
+				strings.Join(req.Form["permission"], ",") == "app.deploy,app.read"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := rolePermissionAdd{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Permission successfully added to role \"deployer\"!\n")
+}
+
+func (s *S) TestRolePermissionRemoveRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"deployer", "app.deploy", "app.read"}, Stdout: &buf}
+	remove := func(perm string) func(*http.Request) bool {
+		return func(req *http.Request) bool {
+			return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/roles/deployer/permissions/"+perm)
+		}
+	}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			okTransport(remove("app.deploy")),
+			okTransport(remove("app.read")),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := rolePermissionRemove{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Permission successfully removed from role \"deployer\"!\n")
+}
+
+func (s *S) TestRoleAssignRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"deployer", "me@tsuru.io", "team1"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles/deployer/user") &&
+				req.FormValue("email") == "me@tsuru.io" && req.FormValue("context") == "team1"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := roleAssign{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Role \"deployer\" successfully assigned to \"me@tsuru.io\"!\n")
+}
+
+func (s *S) TestRoleDissociateRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"deployer", "me@tsuru.io", "team1"}, Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/roles/deployer/user/me@tsuru.io") &&
+				req.URL.Query().Get("context") == "team1"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := roleDissociate{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Role \"deployer\" successfully dissociated from \"me@tsuru.io\"!\n")
+}
+
+func (s *S) TestRoleDefaultAddRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			req.ParseForm()
+			return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/role/default") &&
+				strings.Join(req.Form["user-create"], ",") == "r1,r2" && req.FormValue("team-create") == "r3"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := roleDefaultAdd{}
+	command.Flags().Parse(true, []string{"--user-create", "r1", "--user-create", "r2", "--team-create", "r3"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Roles successfully added as default!\n")
+}
+
+func (s *S) TestRoleDefaultAddRunWithoutEvents(c *check.C) {
+	command := roleDefaultAdd{}
+	command.Flags().Parse(true, []string{})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, nil)
+	c.Assert(err, check.ErrorMatches, "at least one of --team-create, --user-create must be given")
+}
+
+func (s *S) TestRoleDefaultRemoveRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/role/default") &&
+				req.URL.Query().Get("user-create") == "r1"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, s.manager)
+	command := roleDefaultRemove{}
+	command.Flags().Parse(true, []string{"--user-create", "r1"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Roles successfully removed as default!\n")
+}
+
+func (s *S) TestRoleDefaultListRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := getTransport("/role/default", `[{"name": "r2", "context": "global", "events": ["user-create"]},
+		{"name": "r1", "context": "global", "events": ["user-create"]}]`)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleDefaultList{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+-------------+-----------------------------------------------+-------+
+| Event       | Description                                   | Roles |
++-------------+-----------------------------------------------+-------+
+| team-create | role added to user when a new team is created |       |
++-------------+-----------------------------------------------+-------+
+| user-create | role added to user when user is created       | r1    |
+|             |                                               | r2    |
++-------------+-----------------------------------------------+-------+
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+const permissionsJSON = `[
+	{"Name": "", "Contexts": ["global"]},
+	{"Name": "app", "Contexts": ["global", "app", "team", "pool"]},
+	{"Name": "app.create", "Contexts": ["global", "team"]},
+	{"Name": "app.deploy", "Contexts": ["global", "app", "team", "pool"]},
+	{"Name": "app.deploy.rollback", "Contexts": ["global", "app", "team", "pool"]},
+	{"Name": "node", "Contexts": ["global", "pool"]}
+]`
+
+func (s *S) TestPermissionTreeRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := getTransport("/permissions", permissionsJSON)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := permissionTree{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `* (global)
+├── app (global, app, team, pool)
+│   ├── app.create (global, team)
+│   └── app.deploy (global, app, team, pool)
+│       └── app.deploy.rollback (global, app, team, pool)
+└── node (global, pool)
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestPermissionTreeRunSubtree(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Args: []string{"app.deploy"}, Stdout: &buf}
+	trans := getTransport("/permissions", permissionsJSON)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := permissionTree{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `app.deploy (global, app, team, pool)
+└── app.deploy.rollback (global, app, team, pool)
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestPermissionTreeRunNotFound(c *check.C) {
+	context := cmd.Context{Args: []string{"app.unknown"}, Stdout: &bytes.Buffer{}}
+	trans := getTransport("/permissions", permissionsJSON)
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := permissionTree{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `permission "app.unknown" not found`)
+}
@@ -0,0 +1,579 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/yaml.v1"
+)
+
+// rolesManifest is the declarative description of the roles of a tsuru
+// cluster, as written by role-export and read by role-import.
+type rolesManifest struct {
+	Roles       []roleSpec           `yaml:"roles,omitempty"`
+	Assignments []roleAssignmentSpec `yaml:"assignments,omitempty"`
+}
+
+type roleSpec struct {
+	Name        string   `yaml:"name"`
+	Context     string   `yaml:"context"`
+	Description string   `yaml:"description,omitempty"`
+	Permissions []string `yaml:"permissions,omitempty"`
+	Events      []string `yaml:"events,omitempty"`
+}
+
+// roleAssignmentSpec is a role assigned to a user. The context is the name of
+// the team, app or pool the role applies to, and is empty for global roles.
+type roleAssignmentSpec struct {
+	User    string `yaml:"user"`
+	Role    string `yaml:"role"`
+	Context string `yaml:"context,omitempty"`
+}
+
+func (a *roleAssignmentSpec) key() string {
+	return a.User + "\x00" + a.Role + "\x00" + a.Context
+}
+
+type roleAssignmentList []roleAssignmentSpec
+
+func (l roleAssignmentList) Len() int           { return len(l) }
+func (l roleAssignmentList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l roleAssignmentList) Less(i, j int) bool { return l[i].key() < l[j].key() }
+
+func readRolesManifest(r io.Reader) (*rolesManifest, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var manifest rolesManifest
+	err = yaml.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse roles")
+	}
+	return &manifest, manifest.validate()
+}
+
+func (m *rolesManifest) validate() error {
+	roles := map[string]bool{}
+	for _, r := range m.Roles {
+		if r.Name == "" || r.Context == "" {
+			return errors.New("role name and context are required")
+		}
+		if roles[r.Name] {
+			return errors.Errorf("duplicated role %q in manifest", r.Name)
+		}
+		roles[r.Name] = true
+	}
+	assignments := map[string]bool{}
+	for _, a := range m.Assignments {
+		if a.User == "" || a.Role == "" {
+			return errors.New("assignment user and role are required")
+		}
+		if assignments[a.key()] {
+			return errors.Errorf("duplicated assignment of role %q to %q in manifest", a.Role, a.User)
+		}
+		assignments[a.key()] = true
+	}
+	return nil
+}
+
+// roleSchemeName returns the name of a permission as used in manifests,
+// where the root permission, listed by the API with an empty name, is
+// written as *, the name used to add it to roles.
+func roleSchemeName(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return name
+}
+
+// exportRoles builds a manifest with the roles and the role assignments of
+// the users in the cluster.
+func exportRoles(client *cmd.Client) (*rolesManifest, error) {
+	roles, err := listRoles(client)
+	if err != nil {
+		return nil, err
+	}
+	users, err := listUsers(client, nil)
+	if err != nil {
+		return nil, err
+	}
+	var manifest rolesManifest
+	for _, r := range roles {
+		spec := roleSpec{
+			Name:        r.Name,
+			Context:     r.ContextType,
+			Description: r.Description,
+			Events:      r.Events,
+		}
+		for _, name := range r.SchemeNames {
+			spec.Permissions = append(spec.Permissions, roleSchemeName(name))
+		}
+		sort.Strings(spec.Permissions)
+		sort.Strings(spec.Events)
+		manifest.Roles = append(manifest.Roles, spec)
+	}
+	sort.Sort(roleSpecList(manifest.Roles))
+	for _, u := range users {
+		for _, instance := range u.Roles {
+			manifest.Assignments = append(manifest.Assignments, roleAssignmentSpec{
+				User:    u.Email,
+				Role:    instance.Name,
+				Context: instance.ContextValue,
+			})
+		}
+	}
+	sort.Sort(roleAssignmentList(manifest.Assignments))
+	return &manifest, nil
+}
+
+type roleSpecList []roleSpec
+
+func (l roleSpecList) Len() int           { return len(l) }
+func (l roleSpecList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l roleSpecList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+type roleExport struct {
+	fs     *gnuflag.FlagSet
+	output string
+}
+
+func (c *roleExport) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-export",
+		Usage: "role-export [-o/--output <roles.yaml>]",
+		Desc: `Writes all roles, including their permissions and the events they are
+default for, and the roles assigned to each user to a YAML document, which can
+be later applied to this or another cluster with [[role-import]].`,
+		MinArgs: 0,
+	}
+}
+
+func (c *roleExport) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		output := "File to write the roles to, instead of the standard output"
+		c.fs.StringVar(&c.output, "output", "", output)
+		c.fs.StringVar(&c.output, "o", "", output)
+	}
+	return c.fs
+}
+
+func (c *roleExport) Run(context *cmd.Context, client *cmd.Client) error {
+	manifest, err := exportRoles(client)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if c.output == "" {
+		_, err = context.Stdout.Write(data)
+		return err
+	}
+	err = ioutil.WriteFile(c.output, data, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Roles successfully exported to %s.\n", c.output)
+	return nil
+}
+
+// buildRolesPlan compares the manifest with the roles and assignments in the
+// API. Permissions added to roles must be known by the API, while removed
+// permissions unknown by the API are flagged as stale.
+func buildRolesPlan(client *cmd.Client, m *rolesManifest, prune bool) (*clusterPlan, error) {
+	roles, err := listRoles(client)
+	if err != nil {
+		return nil, err
+	}
+	schemes, err := listPermissionSchemes(client)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, s := range schemes {
+		known[roleSchemeName(s.Name)] = true
+	}
+	live := map[string]role{}
+	for _, r := range roles {
+		live[r.Name] = r
+	}
+	var plan clusterPlan
+	declared := map[string]bool{}
+	for _, spec := range m.Roles {
+		spec := spec
+		declared[spec.Name] = true
+		for _, perm := range spec.Permissions {
+			if !known[perm] {
+				return nil, errors.Errorf("role %q: permission named %q not found", spec.Name, perm)
+			}
+		}
+		current, ok := live[spec.Name]
+		if !ok {
+			plan.add(&clusterChange{
+				action:  "create",
+				kind:    "role",
+				name:    spec.Name,
+				details: roleDetails(spec),
+				apply: func(client *cmd.Client) error {
+					return createRole(client, spec)
+				},
+			})
+			continue
+		}
+		if current.ContextType != spec.Context {
+			return nil, errors.Errorf("role %q has context %q, changing it to %q requires removing the role first", spec.Name, current.ContextType, spec.Context)
+		}
+		var currentPerms []string
+		for _, name := range current.SchemeNames {
+			currentPerms = append(currentPerms, roleSchemeName(name))
+		}
+		permsToAdd, permsToRemove := diffStrings(currentPerms, spec.Permissions)
+		eventsToAdd, eventsToRemove := diffStrings(current.Events, spec.Events)
+		var details []string
+		if len(permsToAdd) > 0 {
+			details = append(details, fmt.Sprintf("add permissions: %s", strings.Join(permsToAdd, ", ")))
+		}
+		if len(permsToRemove) > 0 {
+			names := make([]string, len(permsToRemove))
+			for i, perm := range permsToRemove {
+				names[i] = perm
+				if !known[perm] {
+					names[i] += " (stale)"
+				}
+			}
+			details = append(details, fmt.Sprintf("remove permissions: %s", strings.Join(names, ", ")))
+		}
+		if len(eventsToAdd) > 0 {
+			details = append(details, fmt.Sprintf("add events: %s", strings.Join(eventsToAdd, ", ")))
+		}
+		if len(eventsToRemove) > 0 {
+			details = append(details, fmt.Sprintf("remove events: %s", strings.Join(eventsToRemove, ", ")))
+		}
+		if len(details) == 0 {
+			continue
+		}
+		plan.add(&clusterChange{
+			action:  "update",
+			kind:    "role",
+			name:    spec.Name,
+			details: details,
+			apply: func(client *cmd.Client) error {
+				err := addRolePermissions(client, spec.Name, permsToAdd)
+				if err != nil {
+					return err
+				}
+				for _, perm := range permsToRemove {
+					u, err := cmd.GetURL(fmt.Sprintf("/roles/%s/permissions/%s", spec.Name, perm))
+					if err != nil {
+						return err
+					}
+					err = doForm(client, "DELETE", u, nil)
+					if err != nil {
+						return err
+					}
+				}
+				return updateRoleEvents(client, spec.Name, eventsToAdd, eventsToRemove)
+			},
+		})
+	}
+	if prune {
+		for _, r := range roles {
+			name := r.Name
+			if declared[name] {
+				continue
+			}
+			plan.add(&clusterChange{
+				action: "delete",
+				kind:   "role",
+				name:   name,
+				apply: func(client *cmd.Client) error {
+					u, err := cmd.GetURL("/roles/" + name)
+					if err != nil {
+						return err
+					}
+					return doForm(client, "DELETE", u, nil)
+				},
+			})
+		}
+	}
+	if m.Assignments == nil {
+		return &plan, nil
+	}
+	err = planRoleAssignments(client, m, prune, &plan)
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func planRoleAssignments(client *cmd.Client, m *rolesManifest, prune bool, plan *clusterPlan) error {
+	users, err := listUsers(client, nil)
+	if err != nil {
+		return err
+	}
+	live := map[string]bool{}
+	var current []roleAssignmentSpec
+	for _, u := range users {
+		for _, instance := range u.Roles {
+			a := roleAssignmentSpec{User: u.Email, Role: instance.Name, Context: instance.ContextValue}
+			live[a.key()] = true
+			current = append(current, a)
+		}
+	}
+	declared := map[string]bool{}
+	for _, a := range m.Assignments {
+		a := a
+		declared[a.key()] = true
+		if live[a.key()] {
+			continue
+		}
+		plan.add(&clusterChange{
+			action:  "create",
+			kind:    "role assignment",
+			name:    a.Role,
+			details: assignmentDetails(a),
+			apply: func(client *cmd.Client) error {
+				values := url.Values{}
+				values.Set("email", a.User)
+				values.Set("context", a.Context)
+				u, err := cmd.GetURL(fmt.Sprintf("/roles/%s/user", a.Role))
+				if err != nil {
+					return err
+				}
+				return doForm(client, "POST", u, values)
+			},
+		})
+	}
+	if !prune {
+		return nil
+	}
+	sort.Sort(roleAssignmentList(current))
+	for _, a := range current {
+		a := a
+		if declared[a.key()] {
+			continue
+		}
+		plan.add(&clusterChange{
+			action:  "delete",
+			kind:    "role assignment",
+			name:    a.Role,
+			details: assignmentDetails(a),
+			apply: func(client *cmd.Client) error {
+				path := fmt.Sprintf("/roles/%s/user/%s", a.Role, a.User)
+				if a.Context != "" {
+					path += "?" + url.Values{"context": {a.Context}}.Encode()
+				}
+				u, err := cmd.GetURL(path)
+				if err != nil {
+					return err
+				}
+				return doForm(client, "DELETE", u, nil)
+			},
+		})
+	}
+	return nil
+}
+
+func roleDetails(spec roleSpec) []string {
+	details := []string{fmt.Sprintf("context: %s", spec.Context)}
+	if spec.Description != "" {
+		details = append(details, fmt.Sprintf("description: %s", spec.Description))
+	}
+	if len(spec.Permissions) > 0 {
+		details = append(details, fmt.Sprintf("permissions: %s", strings.Join(spec.Permissions, ", ")))
+	}
+	if len(spec.Events) > 0 {
+		details = append(details, fmt.Sprintf("events: %s", strings.Join(spec.Events, ", ")))
+	}
+	return details
+}
+
+func assignmentDetails(a roleAssignmentSpec) []string {
+	details := []string{fmt.Sprintf("user: %s", a.User)}
+	if a.Context != "" {
+		details = append(details, fmt.Sprintf("context: %s", a.Context))
+	}
+	return details
+}
+
+func createRole(client *cmd.Client, spec roleSpec) error {
+	u, err := cmd.GetURL("/roles")
+	if err != nil {
+		return err
+	}
+	values := url.Values{}
+	values.Set("name", spec.Name)
+	values.Set("context", spec.Context)
+	values.Set("description", spec.Description)
+	err = doForm(client, "POST", u, values)
+	if err != nil {
+		return err
+	}
+	err = addRolePermissions(client, spec.Name, spec.Permissions)
+	if err != nil {
+		return err
+	}
+	return updateRoleEvents(client, spec.Name, spec.Events, nil)
+}
+
+func addRolePermissions(client *cmd.Client, name string, perms []string) error {
+	if len(perms) == 0 {
+		return nil
+	}
+	u, err := cmd.GetURL(fmt.Sprintf("/roles/%s/permissions", name))
+	if err != nil {
+		return err
+	}
+	return doForm(client, "POST", u, url.Values{"permission": perms})
+}
+
+func updateRoleEvents(client *cmd.Client, name string, toAdd, toRemove []string) error {
+	if len(toAdd) > 0 {
+		values := url.Values{}
+		for _, evt := range toAdd {
+			values.Add(evt, name)
+		}
+		u, err := cmd.GetURL("/role/default")
+		if err != nil {
+			return err
+		}
+		err = doForm(client, "POST", u, values)
+		if err != nil {
+			return err
+		}
+	}
+	if len(toRemove) > 0 {
+		values := url.Values{}
+		for _, evt := range toRemove {
+			values.Add(evt, name)
+		}
+		u, err := cmd.GetURL("/role/default?" + values.Encode())
+		if err != nil {
+			return err
+		}
+		return doForm(client, "DELETE", u, nil)
+	}
+	return nil
+}
+
+type roleImport struct {
+	cmd.ConfirmationCommand
+	fs     *gnuflag.FlagSet
+	file   string
+	prune  bool
+	dryRun bool
+}
+
+func (c *roleImport) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "role-import",
+		Usage: "role-import -f/--file <roles.yaml> [--prune] [--dry-run] [-y]",
+		Desc: `Makes the roles in the cluster match a YAML document, usually written by
+[[role-export]]. The permissions and default events of each role, and the
+roles assigned to users, are compared with the ones in the tsuru API and a
+plan with the needed changes is displayed before anything is applied.
+
+Permissions unknown by the API can't be added to roles, and the ones being
+removed are flagged as stale. Descriptions are only used when creating roles,
+and changing the context of a role requires removing it first.
+
+Roles and assignments that are not in the document are left untouched, unless
+the [[--prune]] flag is used, in which case they are removed. Assignments are
+only compared when the document has an assignments section. The [[--dry-run]]
+flag displays the plan without applying it. When the document is read from
+stdin, with [[-f -]], [[-y]] is required to apply the plan.
+
+Example document:
+
+  roles:
+  - name: deployer
+    context: team
+    permissions: [app.deploy, app.read]
+    events: [team-create]
+  assignments:
+  - user: dev@example.com
+    role: deployer
+    context: team1`,
+		MinArgs: 0,
+	}
+}
+
+func (c *roleImport) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+		msg := "YAML document describing the roles (use - to read from stdin)"
+		c.fs.StringVar(&c.file, "file", "", msg)
+		c.fs.StringVar(&c.file, "f", "", msg)
+		c.fs.BoolVar(&c.prune, "prune", false, "Remove roles and assignments that are not described in the document")
+		c.fs.BoolVar(&c.dryRun, "dry-run", false, "Only display the plan, without applying it")
+	}
+	return c.fs
+}
+
+func (c *roleImport) Run(ctx *cmd.Context, client *cmd.Client) error {
+	if c.file == "" {
+		return errors.New("the roles file is required, use -f/--file")
+	}
+	if c.file == "-" && !c.dryRun && !assumeYes(c.fs) {
+		return errors.New("the roles file is read from stdin, use -y to import it without confirmation")
+	}
+	manifest, err := c.readManifest(ctx)
+	if err != nil {
+		return err
+	}
+	plan, err := buildRolesPlan(client, manifest, c.prune)
+	if err != nil {
+		return err
+	}
+	steps := plan.steps()
+	if len(steps) == 0 {
+		fmt.Fprintln(ctx.Stdout, "No changes, the roles match the document.")
+		return nil
+	}
+	fmt.Fprintln(ctx.Stdout, "Plan:")
+	for _, step := range steps {
+		fmt.Fprintln(ctx.Stdout, step)
+	}
+	fmt.Fprintf(ctx.Stdout, "\n%s.\n", planSummary(steps))
+	if c.dryRun {
+		return nil
+	}
+	if !c.Confirm(ctx, "Are you sure you want to apply these changes?") {
+		return nil
+	}
+	for _, step := range steps {
+		err = step.apply(client)
+		if err != nil {
+			return errors.Wrapf(err, "unable to %s %s %q", step.action, step.kind, step.name)
+		}
+	}
+	fmt.Fprintln(ctx.Stdout, "Roles successfully imported.")
+	return nil
+}
+
+func (c *roleImport) readManifest(ctx *cmd.Context) (*rolesManifest, error) {
+	if c.file == "-" {
+		return readRolesManifest(ctx.Stdin)
+	}
+	f, err := os.Open(c.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRolesManifest(f)
+}
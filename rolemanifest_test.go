@@ -0,0 +1,284 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestReadRolesManifestValidate(c *check.C) {
+	_, err := readRolesManifest(strings.NewReader("roles:\n- name: r1\n"))
+	c.Assert(err, check.ErrorMatches, "role name and context are required")
+	_, err = readRolesManifest(strings.NewReader("roles:\n- name: r1\n  context: team\n- name: r1\n  context: pool\n"))
+	c.Assert(err, check.ErrorMatches, `duplicated role "r1" in manifest`)
+	_, err = readRolesManifest(strings.NewReader("assignments:\n- user: a@a.com\n"))
+	c.Assert(err, check.ErrorMatches, "assignment user and role are required")
+	_, err = readRolesManifest(strings.NewReader("assignments:\n- {user: a@a.com, role: r1}\n- {user: a@a.com, role: r1}\n"))
+	c.Assert(err, check.ErrorMatches, `duplicated assignment of role "r1" to "a@a.com" in manifest`)
+}
+
+func (s *S) TestRoleExportRun(c *check.C) {
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", permissionRolesJSON),
+			getTransport("/users", permissionUsersJSON),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleExport{}
+	command.Flags().Parse(true, []string{})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `roles:
+- name: admin
+  context: global
+  permissions:
+  - '*'
+- name: deployer
+  context: pool
+  permissions:
+  - app.deploy
+  - app.removed
+- name: team-member
+  context: team
+  permissions:
+  - app
+assignments:
+- user: dev@tsuru.io
+  role: deployer
+  context: prod
+- user: dev@tsuru.io
+  role: team-member
+  context: t1
+- user: ops@tsuru.io
+  role: deployer
+  context: dev
+- user: root@tsuru.io
+  role: admin
+`
+	c.Assert(buf.String(), check.Equals, expected)
+	manifest, err := readRolesManifest(strings.NewReader(expected))
+	c.Assert(err, check.IsNil)
+	c.Assert(manifest.Roles, check.HasLen, 3)
+	c.Assert(manifest.Assignments, check.HasLen, 4)
+}
+
+func (s *S) TestRoleExportRunToFile(c *check.C) {
+	path := filepath.Join(c.MkDir(), "roles.yaml")
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", `[{"name": "r1", "context": "global"}]`),
+			getTransport("/users", "[]"),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleExport{}
+	command.Flags().Parse(true, []string{"-o", path})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "Roles successfully exported to "+path+".\n")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "roles:\n- name: r1\n  context: global\n")
+}
+
+const rolesImportManifest = `
+roles:
+- name: deployer
+  context: pool
+  permissions: [app.deploy, app.create]
+- name: viewer
+  context: team
+  description: reads apps
+  permissions: [app]
+  events: [team-create]
+assignments:
+- user: dev@tsuru.io
+  role: deployer
+  context: prod
+- user: new@tsuru.io
+  role: viewer
+  context: t1
+`
+
+func (s *S) TestRoleImportRunDryRun(c *check.C) {
+	manifest := s.writeManifest(c, rolesImportManifest)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", permissionRolesJSON),
+			getTransport("/permissions", permissionsJSON),
+			getTransport("/users", permissionUsersJSON),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleImport{}
+	command.Flags().Parse(true, []string{"-f", manifest, "--prune", "--dry-run"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Plan:
+~ role "deployer"
+    add permissions: app.create
+    remove permissions: app.removed (stale)
++ role "viewer"
+    context: team
+    description: reads apps
+    permissions: app
+    events: team-create
++ role assignment "viewer"
+    user: new@tsuru.io
+    context: t1
+- role assignment "admin"
+    user: root@tsuru.io
+- role assignment "deployer"
+    user: ops@tsuru.io
+    context: dev
+- role assignment "team-member"
+    user: dev@tsuru.io
+    context: t1
+- role "team-member"
+- role "admin"
+
+2 to create, 1 to update, 5 to delete.
+`
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestRoleImportRun(c *check.C) {
+	manifest := s.writeManifest(c, rolesImportManifest)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", permissionRolesJSON),
+			getTransport("/permissions", permissionsJSON),
+			getTransport("/users", permissionUsersJSON),
+			okTransport(func(req *http.Request) bool {
+				req.ParseForm()
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles/deployer/permissions") &&
+					strings.Join(req.Form["permission"], ",") == "app.create"
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "DELETE" && strings.HasSuffix(req.URL.Path, "/roles/deployer/permissions/app.removed")
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles") &&
+					req.FormValue("name") == "viewer" && req.FormValue("context") == "team" &&
+					req.FormValue("description") == "reads apps"
+			}),
+			okTransport(func(req *http.Request) bool {
+				req.ParseForm()
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles/viewer/permissions") &&
+					strings.Join(req.Form["permission"], ",") == "app"
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/role/default") &&
+					req.FormValue("team-create") == "viewer"
+			}),
+			okTransport(func(req *http.Request) bool {
+				return req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/roles/viewer/user") &&
+					req.FormValue("email") == "new@tsuru.io" && req.FormValue("context") == "t1"
+			}),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleImport{}
+	command.Flags().Parse(true, []string{"-f", manifest, "-y"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s)Plan:.*2 to create, 1 to update, 0 to delete.
+Roles successfully imported.
+`)
+}
+
+func (s *S) TestRoleImportRunNoChanges(c *check.C) {
+	manifest := s.writeManifest(c, `
+roles:
+- name: team-member
+  context: team
+  permissions: [app]
+`)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", permissionRolesJSON),
+			getTransport("/permissions", permissionsJSON),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleImport{}
+	command.Flags().Parse(true, []string{"-f", manifest})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "No changes, the roles match the document.\n")
+}
+
+func (s *S) TestRoleImportRunUnknownPermission(c *check.C) {
+	manifest := s.writeManifest(c, `
+roles:
+- name: r1
+  context: team
+  permissions: [app.unknown]
+`)
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", "[]"),
+			getTransport("/permissions", permissionsJSON),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleImport{}
+	command.Flags().Parse(true, []string{"-f", manifest, "--dry-run"})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, client)
+	c.Assert(err, check.ErrorMatches, `role "r1": permission named "app.unknown" not found`)
+}
+
+func (s *S) TestRoleImportRunContextChange(c *check.C) {
+	manifest := s.writeManifest(c, `
+roles:
+- name: deployer
+  context: team
+`)
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/roles", permissionRolesJSON),
+			getTransport("/permissions", permissionsJSON),
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	command := roleImport{}
+	command.Flags().Parse(true, []string{"-f", manifest, "--dry-run"})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, client)
+	c.Assert(err, check.ErrorMatches, `role "deployer" has context "pool", changing it to "team" requires removing the role first`)
+}
+
+func (s *S) TestRoleImportRunWithoutFile(c *check.C) {
+	command := roleImport{}
+	command.Flags().Parse(true, []string{})
+	err := command.Run(&cmd.Context{Stdout: &bytes.Buffer{}}, nil)
+	c.Assert(err, check.ErrorMatches, `the roles file is required, use -f/--file`)
+}
+
+func (s *S) TestRoleImportRunFromStdinRequiresYes(c *check.C) {
+	context := cmd.Context{Stdout: &bytes.Buffer{}, Stdin: strings.NewReader("roles: []\n")}
+	command := roleImport{}
+	command.Flags().Parse(true, []string{"-f", "-"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "the roles file is read from stdin, use -y to import it without confirmation")
+}
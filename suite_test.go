@@ -25,6 +25,10 @@ func (s *S) SetUpSuite(c *check.C) {
 	os.Setenv("TSURU_TARGET", "http://localhost")
 }
 
+func (s *S) TearDownTest(c *check.C) {
+	outputFormat = defaultOutputFormat
+}
+
 func (s *S) TearDownSuite(c *check.C) {
 	os.Unsetenv("TSURU_TARGET")
 }
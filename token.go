@@ -0,0 +1,496 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// defaultTokenLifetime is the lifetime assumed for tokens obtained with the
+// login command. It matches the default value of the auth:token-expire-days
+// setting of the tsuru API.
+const defaultTokenLifetime = 7 * 24 * time.Hour
+
+var errTokenNotFound = errors.New("token not found")
+
+// storedToken is the session of the user in one target. Target is the label
+// of the target, or its URL when it has no label.
+type storedToken struct {
+	Target    string
+	URL       string
+	Token     string
+	CreatedAt time.Time
+	ExpiresAt time.Time `json:",omitempty"`
+}
+
+// valid reports whether the token has not expired. Tokens with unknown
+// expiration are considered valid.
+func (t *storedToken) valid(now time.Time) bool {
+	return t.ExpiresAt.IsZero() || now.Before(t.ExpiresAt)
+}
+
+// tokenStore keeps one token per target.
+type tokenStore interface {
+	Get(target string) (*storedToken, error)
+	Save(token storedToken) error
+	Remove(target string) error
+	List() ([]storedToken, error)
+}
+
+// tokenCipher encrypts and decrypts the contents of a token file.
+type tokenCipher interface {
+	Seal(data []byte) ([]byte, error)
+	Open(data []byte) ([]byte, error)
+}
+
+// fileTokenStore stores tokens as a JSON document in a file, optionally
+// encrypted.
+type fileTokenStore struct {
+	path   string
+	cipher tokenCipher
+}
+
+func newFileTokenStore(path string) *fileTokenStore {
+	return &fileTokenStore{path: path}
+}
+
+// newEncryptedTokenStore returns a store whose file is encrypted with
+// AES-GCM, using a key derived from passphrase.
+func newEncryptedTokenStore(path, passphrase string) (*fileTokenStore, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTokenStore{path: path, cipher: gcmTokenCipher{aead: aead}}, nil
+}
+
+// newTokenStore returns the token store of the current user. The store is
+// encrypted when the TSURU_TOKEN_STORE_KEY environment variable is set.
+func newTokenStore() (tokenStore, error) {
+	if passphrase := os.Getenv("TSURU_TOKEN_STORE_KEY"); passphrase != "" {
+		return newEncryptedTokenStore(cmd.JoinWithUserDir(".tsuru", "tokens.enc"), passphrase)
+	}
+	return newFileTokenStore(cmd.JoinWithUserDir(".tsuru", "tokens")), nil
+}
+
+func (s *fileTokenStore) load() (map[string]storedToken, error) {
+	tokens := map[string]storedToken{}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.cipher != nil {
+		data, err = s.cipher.Open(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decrypt %s", s.path)
+		}
+	}
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s", s.path)
+	}
+	return tokens, nil
+}
+
+func (s *fileTokenStore) write(tokens map[string]storedToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.cipher != nil {
+		data, err = s.cipher.Seal(data)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0600)
+}
+
+func (s *fileTokenStore) Get(target string) (*storedToken, error) {
+	tokens, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	token, ok := tokens[target]
+	if !ok {
+		return nil, errTokenNotFound
+	}
+	return &token, nil
+}
+
+func (s *fileTokenStore) Save(token storedToken) error {
+	tokens, err := s.load()
+	if err != nil {
+		return err
+	}
+	tokens[token.Target] = token
+	return s.write(tokens)
+}
+
+func (s *fileTokenStore) Remove(target string) error {
+	tokens, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[target]; !ok {
+		return nil
+	}
+	delete(tokens, target)
+	return s.write(tokens)
+}
+
+func (s *fileTokenStore) List() ([]storedToken, error) {
+	tokens, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]storedToken, 0, len(tokens))
+	for _, token := range tokens {
+		result = append(result, token)
+	}
+	sort.Sort(tokensByTarget(result))
+	return result, nil
+}
+
+type tokensByTarget []storedToken
+
+func (l tokensByTarget) Len() int           { return len(l) }
+func (l tokensByTarget) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l tokensByTarget) Less(i, j int) bool { return l[i].Target < l[j].Target }
+
+type gcmTokenCipher struct {
+	aead cipher.AEAD
+}
+
+func (c gcmTokenCipher) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (c gcmTokenCipher) Open(data []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("invalid encrypted data")
+	}
+	return c.aead.Open(nil, data[:size], data[size:], nil)
+}
+
+// currentTarget returns the current target, with its label when it was
+// registered with target-add.
+func currentTarget() (labelledTarget, error) {
+	url, err := cmd.ReadTarget()
+	if err != nil {
+		return labelledTarget{}, err
+	}
+	targets, err := readTargets()
+	if err != nil {
+		return labelledTarget{}, err
+	}
+	for _, t := range targets {
+		if sameTargetURL(t.URL, url) {
+			return t, nil
+		}
+	}
+	return labelledTarget{Label: url, URL: url}, nil
+}
+
+func tokenFilePath() string {
+	return cmd.JoinWithUserDir(".tsuru", "token")
+}
+
+func readTokenFile() (string, error) {
+	data, err := ioutil.ReadFile(tokenFilePath())
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+func writeTokenFile(token string) error {
+	if token == "" {
+		err := os.Remove(tokenFilePath())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(tokenFilePath()), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tokenFilePath(), []byte(token), 0600)
+}
+
+// tokenTargetPath is the file recording the URL of the target the token file
+// was written for, as other tools may change the current target without
+// touching the token file.
+func tokenTargetPath() string {
+	return cmd.JoinWithUserDir(".tsuru", "token-target")
+}
+
+func readTokenTarget() (string, error) {
+	data, err := ioutil.ReadFile(tokenTargetPath())
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// saveTokenFile writes the token file along with the URL of the target it
+// belongs to. An empty token removes both.
+func saveTokenFile(token, targetURL string) error {
+	err := writeTokenFile(token)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		err = os.Remove(tokenTargetPath())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(tokenTargetPath(), []byte(targetURL), 0600)
+}
+
+func sameTargetURL(a, b string) bool {
+	return strings.TrimRight(a, "/") == strings.TrimRight(b, "/")
+}
+
+// tokenSession keeps ~/.tsuru/token, which is the token sent by the client,
+// in sync with the token store, so that each target uses its own token.
+type tokenSession struct {
+	store  tokenStore
+	target labelledTarget
+	token  string
+}
+
+// beginTokenSession records the token written by login for the current
+// target, or restores the stored one when there is no token file for it. The
+// token file is only recorded when it was written for the current target, as
+// the target may have been changed with another tool. It returns nil when the
+// token is set in the TSURU_TOKEN environment variable or there is no current
+// target.
+func beginTokenSession(store tokenStore) (*tokenSession, error) {
+	if os.Getenv("TSURU_TOKEN") != "" {
+		return nil, nil
+	}
+	target, err := currentTarget()
+	if err != nil {
+		return nil, nil
+	}
+	token, err := readTokenFile()
+	if err != nil {
+		return nil, err
+	}
+	tokenTarget, err := readTokenTarget()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := store.Get(target.Label)
+	if err == errTokenNotFound {
+		stored, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	owned := token != "" && sameTargetURL(tokenTarget, target.URL)
+	switch {
+	case owned && (stored == nil || stored.Token != token):
+		// Tokens found in the file have an unknown age.
+		err = store.Save(storedToken{Target: target.Label, URL: target.URL, Token: token, CreatedAt: time.Now().UTC()})
+	case !owned && stored != nil && stored.valid(time.Now()):
+		token = stored.Token
+		err = saveTokenFile(token, target.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tokenSession{store: store, target: target, token: token}, nil
+}
+
+// end updates the store after a command ran: it saves the token obtained by
+// login, forgets the token removed by logout and switches the token file when
+// the current target changes.
+func (s *tokenSession) end(w io.Writer) error {
+	token, err := readTokenFile()
+	if err != nil {
+		return err
+	}
+	if token != s.token {
+		if token == "" {
+			err = s.store.Remove(s.target.Label)
+		} else {
+			now := time.Now().UTC()
+			err = s.store.Save(storedToken{
+				Target:    s.target.Label,
+				URL:       s.target.URL,
+				Token:     token,
+				CreatedAt: now,
+				ExpiresAt: now.Add(defaultTokenLifetime),
+			})
+		}
+		if err != nil {
+			return err
+		}
+		err = saveTokenFile(token, s.target.URL)
+		if err != nil {
+			return err
+		}
+	}
+	target, err := currentTarget()
+	if err != nil || target.Label == s.target.Label {
+		return nil
+	}
+	stored, err := s.store.Get(target.Label)
+	if err != nil && err != errTokenNotFound {
+		return err
+	}
+	if stored != nil && stored.valid(time.Now()) {
+		return saveTokenFile(stored.Token, target.URL)
+	}
+	fmt.Fprintf(w, "There is no valid session for target %q, please use the login command.\n", target.Label)
+	return saveTokenFile("", "")
+}
+
+// sessionCommand wraps the commands that change the token file or the
+// current target, like login and target-set, keeping the token store in sync.
+type sessionCommand struct {
+	cmd.Command
+}
+
+type flaggedSessionCommand struct {
+	sessionCommand
+}
+
+func (c *flaggedSessionCommand) Flags() *gnuflag.FlagSet {
+	return c.Command.(cmd.FlaggedCommand).Flags()
+}
+
+func wrapSessionCommand(command cmd.Command) cmd.Command {
+	if _, ok := command.(cmd.FlaggedCommand); ok {
+		return &flaggedSessionCommand{sessionCommand{Command: command}}
+	}
+	return &sessionCommand{Command: command}
+}
+
+func (c *sessionCommand) Run(context *cmd.Context, client *cmd.Client) error {
+	store, err := newTokenStore()
+	if err != nil {
+		return err
+	}
+	session, err := beginTokenSession(store)
+	if err != nil {
+		return err
+	}
+	err = c.Command.Run(context, client)
+	if err != nil || session == nil {
+		return err
+	}
+	return session.end(context.Stderr)
+}
+
+// tokenInfo is the listing entry of a stored token. The token itself is never
+// displayed.
+type tokenInfo struct {
+	Target    string
+	URL       string
+	Current   bool
+	CreatedAt time.Time
+	ExpiresAt time.Time `json:",omitempty"`
+	Valid     bool
+}
+
+type tokenList struct{}
+
+func (c *tokenList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "token-list",
+		Usage: "token-list",
+		Desc: `Lists the targets with a stored session and whether the session is still
+valid. The current target is marked with an asterisk.
+
+Tokens are stored per target when the login command is used, and switched
+automatically by target-set. When the TSURU_TOKEN_STORE_KEY environment
+variable is set, tokens are stored encrypted with the given passphrase.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *tokenList) formatted() {}
+
+func (c *tokenList) Run(context *cmd.Context, client *cmd.Client) error {
+	store, err := newTokenStore()
+	if err != nil {
+		return err
+	}
+	tokens, err := store.List()
+	if err != nil {
+		return err
+	}
+	current, _ := currentTarget()
+	now := time.Now()
+	infos := make([]tokenInfo, len(tokens))
+	l := listing{
+		Headers: cmd.Row{"Target", "URL", "Expires", "Status"},
+		Data:    infos,
+	}
+	for i, t := range tokens {
+		infos[i] = tokenInfo{
+			Target:    t.Target,
+			URL:       t.URL,
+			Current:   t.Target == current.Label,
+			CreatedAt: t.CreatedAt,
+			ExpiresAt: t.ExpiresAt,
+			Valid:     t.valid(now),
+		}
+		label := "  " + t.Target
+		if infos[i].Current {
+			label = "* " + t.Target
+		}
+		expires := "unknown"
+		if !t.ExpiresAt.IsZero() {
+			expires = t.ExpiresAt.Local().Format(time.Stamp)
+		}
+		status := "valid"
+		if !infos[i].Valid {
+			status = "expired"
+		}
+		l.Rows = append(l.Rows, cmd.Row{label, t.URL, expires, status})
+	}
+	return render(context.Stdout, &l)
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+// setHome points HOME to a temporary directory, returning a function that
+// restores it.
+func setHome(c *check.C) (string, func()) {
+	home := c.MkDir()
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	return home, func() { os.Setenv("HOME", oldHome) }
+}
+
+func (s *S) TestFileTokenStore(c *check.C) {
+	store := newFileTokenStore(filepath.Join(c.MkDir(), "tokens"))
+	_, err := store.Get("prod")
+	c.Assert(err, check.Equals, errTokenNotFound)
+	created := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	prod := storedToken{Target: "prod", URL: "https://tsuru.io", Token: "abc", CreatedAt: created, ExpiresAt: created.Add(time.Hour)}
+	dev := storedToken{Target: "dev", URL: "http://dev", Token: "def", CreatedAt: created}
+	c.Assert(store.Save(prod), check.IsNil)
+	c.Assert(store.Save(dev), check.IsNil)
+	token, err := store.Get("prod")
+	c.Assert(err, check.IsNil)
+	c.Assert(*token, check.DeepEquals, prod)
+	tokens, err := store.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.DeepEquals, []storedToken{dev, prod})
+	c.Assert(store.Remove("prod"), check.IsNil)
+	c.Assert(store.Remove("unknown"), check.IsNil)
+	tokens, err = store.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.DeepEquals, []storedToken{dev})
+	info, err := os.Stat(store.path)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0600))
+}
+
+func (s *S) TestEncryptedTokenStore(c *check.C) {
+	path := filepath.Join(c.MkDir(), "tokens.enc")
+	store, err := newEncryptedTokenStore(path, "secret")
+	c.Assert(err, check.IsNil)
+	c.Assert(store.Save(storedToken{Target: "prod", Token: "my-token"}), check.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Contains(data, []byte("my-token")), check.Equals, false)
+	token, err := store.Get("prod")
+	c.Assert(err, check.IsNil)
+	c.Assert(token.Token, check.Equals, "my-token")
+	other, err := newEncryptedTokenStore(path, "wrong")
+	c.Assert(err, check.IsNil)
+	_, err = other.Get("prod")
+	c.Assert(err, check.ErrorMatches, "unable to decrypt .*")
+}
+
+func (s *S) TestNewTokenStore(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	store, err := newTokenStore()
+	c.Assert(err, check.IsNil)
+	c.Assert(store.(*fileTokenStore).path, check.Equals, filepath.Join(home, ".tsuru", "tokens"))
+	c.Assert(store.(*fileTokenStore).cipher, check.IsNil)
+	os.Setenv("TSURU_TOKEN_STORE_KEY", "secret")
+	defer os.Unsetenv("TSURU_TOKEN_STORE_KEY")
+	store, err = newTokenStore()
+	c.Assert(err, check.IsNil)
+	c.Assert(store.(*fileTokenStore).path, check.Equals, filepath.Join(home, ".tsuru", "tokens.enc"))
+	c.Assert(store.(*fileTokenStore).cipher, check.NotNil)
+}
+
+func (s *S) TestBeginTokenSessionAdoptsTokenFile(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	c.Assert(saveTokenFile("file-token", "http://localhost/"), check.IsNil)
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	session, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	c.Assert(session.target, check.DeepEquals, labelledTarget{Label: "http://localhost", URL: "http://localhost"})
+	token, err := store.Get("http://localhost")
+	c.Assert(err, check.IsNil)
+	c.Assert(token.Token, check.Equals, "file-token")
+	c.Assert(token.ExpiresAt.IsZero(), check.Equals, true)
+}
+
+func (s *S) TestBeginTokenSessionRestoresToken(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	c.Assert(store.Save(storedToken{Target: "http://localhost", Token: "stored"}), check.IsNil)
+	_, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	token, err := readTokenFile()
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "stored")
+}
+
+func (s *S) TestBeginTokenSessionIgnoresExpiredToken(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	expired := storedToken{Target: "http://localhost", Token: "stored", ExpiresAt: time.Now().Add(-time.Minute)}
+	c.Assert(store.Save(expired), check.IsNil)
+	_, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	token, err := readTokenFile()
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "")
+}
+
+func (s *S) TestBeginTokenSessionAfterExternalTargetSwitch(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	err := os.MkdirAll(filepath.Join(home, ".tsuru"), 0700)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(home, ".tsuru", "targets"), []byte("prod\thttp://prod\ndev\thttp://dev\n"), 0600)
+	c.Assert(err, check.IsNil)
+	c.Assert(saveTokenFile("prod-token", "http://prod"), check.IsNil)
+	os.Setenv("TSURU_TARGET", "http://dev")
+	defer os.Setenv("TSURU_TARGET", "http://localhost")
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	session, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	c.Assert(session.end(&bytes.Buffer{}), check.IsNil)
+	_, err = store.Get("dev")
+	c.Assert(err, check.Equals, errTokenNotFound)
+	c.Assert(store.Save(storedToken{Target: "dev", URL: "http://dev", Token: "dev-token"}), check.IsNil)
+	_, err = beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	token, err := readTokenFile()
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "dev-token")
+	tokenTarget, err := readTokenTarget()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokenTarget, check.Equals, "http://dev")
+	_, err = store.Get("prod")
+	c.Assert(err, check.Equals, errTokenNotFound)
+}
+
+func (s *S) TestBeginTokenSessionWithTokenEnv(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	os.Setenv("TSURU_TOKEN", "env-token")
+	defer os.Unsetenv("TSURU_TOKEN")
+	c.Assert(writeTokenFile("file-token"), check.IsNil)
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	session, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	c.Assert(session, check.IsNil)
+	tokens, err := store.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.HasLen, 0)
+}
+
+func (s *S) TestTokenSessionEndAfterLogin(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	session, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	c.Assert(writeTokenFile("new-token"), check.IsNil)
+	var buf bytes.Buffer
+	c.Assert(session.end(&buf), check.IsNil)
+	token, err := store.Get("http://localhost")
+	c.Assert(err, check.IsNil)
+	c.Assert(token.Token, check.Equals, "new-token")
+	c.Assert(token.ExpiresAt.Sub(token.CreatedAt), check.Equals, defaultTokenLifetime)
+	c.Assert(buf.String(), check.Equals, "")
+}
+
+func (s *S) TestTokenSessionEndAfterLogout(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	c.Assert(writeTokenFile("token"), check.IsNil)
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	session, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	c.Assert(writeTokenFile(""), check.IsNil)
+	c.Assert(session.end(&bytes.Buffer{}), check.IsNil)
+	_, err = store.Get("http://localhost")
+	c.Assert(err, check.Equals, errTokenNotFound)
+}
+
+func (s *S) TestTokenSessionEndSwitchesTarget(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	err := os.MkdirAll(filepath.Join(home, ".tsuru"), 0700)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(home, ".tsuru", "targets"), []byte("prod\thttp://prod\ndev\thttp://dev\n"), 0600)
+	c.Assert(err, check.IsNil)
+	store := newFileTokenStore(filepath.Join(home, "tokens"))
+	c.Assert(store.Save(storedToken{Target: "dev", URL: "http://dev", Token: "dev-token"}), check.IsNil)
+	c.Assert(saveTokenFile("prod-token", "http://prod"), check.IsNil)
+	os.Setenv("TSURU_TARGET", "http://prod")
+	defer os.Setenv("TSURU_TARGET", "http://localhost")
+	session, err := beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	os.Setenv("TSURU_TARGET", "http://dev")
+	var buf bytes.Buffer
+	c.Assert(session.end(&buf), check.IsNil)
+	token, err := readTokenFile()
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "dev-token")
+	tokenTarget, err := readTokenTarget()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokenTarget, check.Equals, "http://dev")
+	prod, err := store.Get("prod")
+	c.Assert(err, check.IsNil)
+	c.Assert(prod.Token, check.Equals, "prod-token")
+	session, err = beginTokenSession(store)
+	c.Assert(err, check.IsNil)
+	os.Setenv("TSURU_TARGET", "http://localhost")
+	c.Assert(session.end(&buf), check.IsNil)
+	token, err = readTokenFile()
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "")
+	c.Assert(buf.String(), check.Equals, "There is no valid session for target \"http://localhost\", please use the login command.\n")
+}
+
+type fakeSessionCommand struct {
+	token string
+}
+
+func (c *fakeSessionCommand) Info() *cmd.Info {
+	return &cmd.Info{Name: "login"}
+}
+
+func (c *fakeSessionCommand) Run(context *cmd.Context, client *cmd.Client) error {
+	return writeTokenFile(c.token)
+}
+
+func (s *S) TestSessionCommandRun(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	command := wrapSessionCommand(&fakeSessionCommand{token: "logged-in"})
+	c.Assert(command, check.FitsTypeOf, &sessionCommand{})
+	context := cmd.Context{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	store := newFileTokenStore(filepath.Join(home, ".tsuru", "tokens"))
+	token, err := store.Get("http://localhost")
+	c.Assert(err, check.IsNil)
+	c.Assert(token.Token, check.Equals, "logged-in")
+}
+
+func (s *S) TestTokenListRun(c *check.C) {
+	home, restore := setHome(c)
+	defer restore()
+	store := newFileTokenStore(filepath.Join(home, ".tsuru", "tokens"))
+	expires := time.Now().Add(time.Hour)
+	c.Assert(store.Save(storedToken{Target: "http://localhost", URL: "http://localhost", Token: "a", ExpiresAt: expires}), check.IsNil)
+	c.Assert(store.Save(storedToken{Target: "old", URL: "http://old", Token: "b", ExpiresAt: time.Now().Add(-time.Hour)}), check.IsNil)
+	c.Assert(store.Save(storedToken{Target: "prod", URL: "http://prod", Token: "c"}), check.IsNil)
+	var buf bytes.Buffer
+	context := cmd.Context{Stdout: &buf}
+	command := tokenList{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*\| \* http://localhost \| http://localhost \| `+expires.Local().Format(time.Stamp)+` \| valid   \|.*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*\|   old              \| http://old       \| .* \| expired \|.*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*\|   prod             \| http://prod      \| unknown         \| valid   \|.*`)
+	outputFormat = "json"
+	buf.Reset()
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte(`"Token"`)), check.Equals, false)
+	c.Assert(buf.String(), check.Matches, `(?s).*"Target": "prod",.*"Valid": true.*`)
+}
+
+func (s *S) TestFanOutRequiresTokens(c *check.C) {
+	oldRunOnTarget := runOnTarget
+	defer func() { runOnTarget = oldRunOnTarget }()
+	var tokens []string
+	runOnTarget = func(t labelledTarget, token string, args []string, output io.Writer) error {
+		tokens = append(tokens, token)
+		return nil
+	}
+	var stdout, stderr bytes.Buffer
+	targets := []labelledTarget{{Label: "prod", URL: "http://prod"}, {Label: "dev", URL: "http://dev"}}
+	status := fanOut(targets, map[string]string{"prod": "prod-token"}, []string{"node-list"}, &stdout, &stderr)
+	c.Assert(status, check.Equals, 1)
+	c.Assert(tokens, check.DeepEquals, []string{"prod-token"})
+	c.Assert(stdout.String(), check.Equals, `=== prod (http://prod) ===
+
+=== dev (http://dev) ===
+Error: there is no valid session for target "dev", please use target-set and login
+`)
+	c.Assert(stderr.String(), check.Equals, "Command failed on 1 of 2 targets: dev\n")
+}
+
+func (s *S) TestValidTokens(c *check.C) {
+	store := newFileTokenStore(filepath.Join(c.MkDir(), "tokens"))
+	c.Assert(store.Save(storedToken{Target: "prod", Token: "a"}), check.IsNil)
+	c.Assert(store.Save(storedToken{Target: "old", Token: "b", ExpiresAt: time.Now().Add(-time.Hour)}), check.IsNil)
+	tokens, err := validTokens(store)
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.DeepEquals, map[string]string{"prod": "a"})
+}
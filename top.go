@@ -0,0 +1,609 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/healer"
+	dockerHealer "github.com/tsuru/tsuru/provision/docker/healer"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// dashboardEventsLimit is the number of recent events of each kind displayed
+// by top.
+const dashboardEventsLimit = 5
+
+// nodeUnit mirrors the fields of provision.Unit displayed by top.
+type nodeUnit struct {
+	ID          string
+	AppName     string
+	ProcessName string
+	Status      string
+}
+
+func listNodeUnits(client *cmd.Client, address string) ([]nodeUnit, error) {
+	u, err := cmd.GetURLVersion("1.2", "/node/"+address+"/containers")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var units []nodeUnit
+	if resp.StatusCode == http.StatusNoContent {
+		return units, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&units)
+	if err != nil {
+		return nil, err
+	}
+	return units, nil
+}
+
+// topNode is a node as displayed by top. LastSuccess and Failures come from
+// the metadata updated by the node health checks.
+type topNode struct {
+	Address     string
+	Pool        string
+	Status      string
+	LastSuccess time.Time
+	Failures    int
+	Metadata    map[string]string
+	Units       []nodeUnit
+}
+
+type topNodeList []topNode
+
+func (l topNodeList) Len() int      { return len(l) }
+func (l topNodeList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l topNodeList) Less(i, j int) bool {
+	if l[i].Pool != l[j].Pool {
+		return l[i].Pool < l[j].Pool
+	}
+	return l[i].Address < l[j].Address
+}
+
+// dashboard is a snapshot of the cluster state displayed by top.
+type dashboard struct {
+	Nodes       []topNode
+	Healing     map[string]healer.NodeHealerConfig
+	AutoScale   []autoScaleEvent
+	NodeHealing []dockerHealer.HealingEvent
+	Events      []eventEntry
+}
+
+func fetchDashboard(client *cmd.Client) (*dashboard, error) {
+	result, err := listNodes(client)
+	if err != nil {
+		return nil, err
+	}
+	var d dashboard
+	for _, node := range result.Nodes {
+		n := topNode{
+			Address:  node.Address,
+			Pool:     nodePool(node),
+			Status:   node.Status,
+			Metadata: node.Metadata,
+		}
+		n.LastSuccess, _ = time.Parse(time.RFC3339, node.Metadata["LastSuccess"])
+		n.Failures, _ = strconv.Atoi(node.Metadata["Failures"])
+		n.Units, err = listNodeUnits(client, node.Address)
+		if err != nil {
+			return nil, err
+		}
+		d.Nodes = append(d.Nodes, n)
+	}
+	sort.Sort(topNodeList(d.Nodes))
+	d.Healing, err = getNodeHealingConfig(client)
+	if err != nil {
+		return nil, err
+	}
+	d.AutoScale, err = listAutoScaleHistory(client, 0, dashboardEventsLimit)
+	if err != nil {
+		return nil, err
+	}
+	d.NodeHealing, err = listHealingHistory(client, "node")
+	if err != nil {
+		return nil, err
+	}
+	if len(d.NodeHealing) > dashboardEventsLimit {
+		d.NodeHealing = d.NodeHealing[:dashboardEventsLimit]
+	}
+	d.Events, err = listEvents(client, url.Values{
+		"target.type": {"node"},
+		"limit":       {strconv.Itoa(dashboardEventsLimit)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (d *dashboard) healingEnabled(pool string) bool {
+	conf, ok := d.Healing[pool]
+	if !ok {
+		conf = d.Healing[""]
+	}
+	return conf.Enabled != nil && *conf.Enabled
+}
+
+type topAction int
+
+const (
+	topRedraw topAction = iota
+	topRefresh
+	topQuit
+)
+
+// topView holds the state of the dashboard: the last snapshot fetched from
+// the API and what the user is looking at.
+type topView struct {
+	target      string
+	interval    time.Duration
+	interactive bool
+	dashboard   *dashboard
+	updatedAt   time.Time
+	err         error
+	selected    int
+	detail      bool
+}
+
+func (v *topView) refresh(client *cmd.Client) {
+	d, err := fetchDashboard(client)
+	v.err = err
+	if err != nil {
+		return
+	}
+	v.dashboard = d
+	v.updatedAt = time.Now()
+	if v.selected >= len(d.Nodes) {
+		v.selected = len(d.Nodes) - 1
+	}
+	if v.selected < 0 {
+		v.selected = 0
+	}
+	if len(d.Nodes) == 0 {
+		v.detail = false
+	}
+}
+
+func (v *topView) handleKey(key string) topAction {
+	var nodes int
+	if v.dashboard != nil {
+		nodes = len(v.dashboard.Nodes)
+	}
+	switch key {
+	case "q", "ctrl-c":
+		return topQuit
+	case "r":
+		return topRefresh
+	case "j", "down":
+		if !v.detail && v.selected < nodes-1 {
+			v.selected++
+		}
+	case "k", "up":
+		if !v.detail && v.selected > 0 {
+			v.selected--
+		}
+	case "enter":
+		if nodes > 0 {
+			v.detail = true
+		}
+	case "esc", "backspace", "b":
+		v.detail = false
+	}
+	return topRedraw
+}
+
+func (v *topView) render(w io.Writer, now time.Time) {
+	header := fmt.Sprintf("tsuru-admin top - %s", v.target)
+	if !v.updatedAt.IsZero() {
+		header += fmt.Sprintf(" - updated at %s", v.updatedAt.Local().Format("15:04:05"))
+	}
+	if v.interactive {
+		header += fmt.Sprintf(", refreshing every %s", v.interval)
+	}
+	fmt.Fprintln(w, cmd.Colorfy(header, "", "", "bold"))
+	if v.interactive {
+		if v.detail {
+			fmt.Fprintln(w, "esc/b: back  r: refresh  q: quit")
+		} else {
+			fmt.Fprintln(w, "j/k: select node  enter: node details  r: refresh  q: quit")
+		}
+	}
+	if v.err != nil {
+		fmt.Fprintln(w, cmd.Colorfy("Error: "+v.err.Error(), "red", "", ""))
+	}
+	if v.dashboard == nil {
+		return
+	}
+	fmt.Fprintln(w)
+	if v.detail {
+		v.renderNode(w, v.dashboard.Nodes[v.selected], now)
+	} else {
+		v.renderOverview(w, now)
+	}
+}
+
+func (v *topView) renderOverview(w io.Writer, now time.Time) {
+	d := v.dashboard
+	if len(d.Nodes) == 0 {
+		fmt.Fprintln(w, "No nodes registered.")
+	}
+	var table *cmd.Table
+	for i, node := range d.Nodes {
+		if i == 0 || node.Pool != d.Nodes[i-1].Pool {
+			if table != nil {
+				fmt.Fprint(w, table.String())
+				fmt.Fprintln(w)
+			}
+			healing := "disabled"
+			if d.healingEnabled(node.Pool) {
+				healing = "enabled"
+			}
+			if node.Pool == "" {
+				fmt.Fprintf(w, "Nodes without pool (healing %s):\n", healing)
+			} else {
+				fmt.Fprintf(w, "Pool %q (healing %s):\n", node.Pool, healing)
+			}
+			table = cmd.NewTable()
+			table.Headers = cmd.Row{"Address", "Status", "Last success", "Failures", "Containers"}
+		}
+		address := node.Address
+		if v.interactive {
+			if i == v.selected {
+				address = cmd.Colorfy("> "+address, "", "", "bold")
+			} else {
+				address = "  " + address
+			}
+		}
+		table.AddRow(cmd.Row{
+			address,
+			colorfyNodeStatus(node.Status),
+			formatAge(node.LastSuccess, now),
+			strconv.Itoa(node.Failures),
+			unitsSummary(node.Units),
+		})
+	}
+	if table != nil {
+		fmt.Fprint(w, table.String())
+	}
+	fmt.Fprintln(w)
+	renderAutoScaleEvents(w, d.AutoScale)
+	fmt.Fprintln(w)
+	renderNodeHealingEvents(w, d.NodeHealing)
+	fmt.Fprintln(w)
+	renderNodeEvents(w, d.Events)
+}
+
+func (v *topView) renderNode(w io.Writer, node topNode, now time.Time) {
+	fmt.Fprintf(w, "Node: %s\n", node.Address)
+	fmt.Fprintf(w, "Pool: %s\n", node.Pool)
+	fmt.Fprintf(w, "Status: %s\n", colorfyNodeStatus(node.Status))
+	fmt.Fprintf(w, "Last success: %s\n", formatAge(node.LastSuccess, now))
+	fmt.Fprintf(w, "Failures: %d\n", node.Failures)
+	fmt.Fprintf(w, "Metadata: %s\n", strings.Replace(formatParams(node.Metadata), "\n", ", ", -1))
+	fmt.Fprintln(w)
+	if len(node.Units) == 0 {
+		fmt.Fprintln(w, "No containers on this node.")
+	} else {
+		fmt.Fprintln(w, "Containers:")
+		table := cmd.NewTable()
+		table.Headers = cmd.Row{"ID", "App", "Process", "Status"}
+		for _, unit := range node.Units {
+			id := unit.ID
+			if len(id) > 12 {
+				id = id[:12]
+			}
+			table.AddRow(cmd.Row{id, unit.AppName, unit.ProcessName, unit.Status})
+		}
+		table.Sort()
+		fmt.Fprint(w, table.String())
+	}
+	var healing []dockerHealer.HealingEvent
+	for _, event := range v.dashboard.NodeHealing {
+		if event.FailingNode.Address == node.Address || event.CreatedNode.Address == node.Address {
+			healing = append(healing, event)
+		}
+	}
+	var events []eventEntry
+	for _, event := range v.dashboard.Events {
+		if event.Target.Value == node.Address {
+			events = append(events, event)
+		}
+	}
+	fmt.Fprintln(w)
+	renderNodeHealingEvents(w, healing)
+	fmt.Fprintln(w)
+	renderNodeEvents(w, events)
+}
+
+func renderAutoScaleEvents(w io.Writer, events []autoScaleEvent) {
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No recent auto scale events.")
+		return
+	}
+	fmt.Fprintln(w, "Recent auto scale events:")
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Start", "Success", "Metadata", "Action", "Reason"}
+	for _, event := range events {
+		table.AddRow(cmd.Row{
+			event.StartTime.Local().Format(time.Stamp),
+			formatEventSuccess(event.EndTime, event.Successful),
+			event.MetadataValue,
+			event.Action,
+			event.Reason,
+		})
+	}
+	fmt.Fprint(w, table.String())
+}
+
+func renderNodeHealingEvents(w io.Writer, events []dockerHealer.HealingEvent) {
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No recent node healing events.")
+		return
+	}
+	fmt.Fprintln(w, "Recent node healing events:")
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Start", "Success", "Failing", "Created", "Error"}
+	for _, event := range events {
+		table.AddRow(cmd.Row{
+			event.StartTime.Local().Format(time.Stamp),
+			formatEventSuccess(event.EndTime, event.Successful),
+			event.FailingNode.Address,
+			event.CreatedNode.Address,
+			event.Error,
+		})
+	}
+	fmt.Fprint(w, table.String())
+}
+
+func renderNodeEvents(w io.Writer, events []eventEntry) {
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No recent node events.")
+		return
+	}
+	fmt.Fprintln(w, "Recent node events:")
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Start", "Kind", "Target", "Owner", "Status"}
+	for _, event := range events {
+		status := event.status()
+		if status == "error" {
+			status = cmd.Colorfy(status, "red", "", "")
+		}
+		table.AddRow(cmd.Row{
+			event.StartTime.Local().Format(time.Stamp),
+			event.Kind.Name,
+			event.Target.Value,
+			event.Owner.Name,
+			status,
+		})
+	}
+	fmt.Fprint(w, table.String())
+}
+
+func formatEventSuccess(end time.Time, successful bool) string {
+	if end.IsZero() {
+		return "in progress"
+	}
+	if !successful {
+		return cmd.Colorfy("false", "red", "", "")
+	}
+	return "true"
+}
+
+func colorfyNodeStatus(status string) string {
+	if status == "ready" {
+		return cmd.Colorfy(status, "green", "", "")
+	}
+	return cmd.Colorfy(status, "red", "", "")
+}
+
+// formatAge describes how long ago t happened, in whole seconds.
+func formatAge(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	age := now.Sub(t) / time.Second * time.Second
+	if age < 0 {
+		age = 0
+	}
+	return age.String() + " ago"
+}
+
+// unitsSummary returns the number of containers, along with how many of them
+// are in each status other than started.
+func unitsSummary(units []nodeUnit) string {
+	counts := map[string]int{}
+	for _, unit := range units {
+		if unit.Status != "started" {
+			counts[unit.Status]++
+		}
+	}
+	statuses := make([]string, 0, len(counts))
+	for status, count := range counts {
+		statuses = append(statuses, fmt.Sprintf("%d %s", count, status))
+	}
+	sort.Strings(statuses)
+	summary := strconv.Itoa(len(units))
+	if len(statuses) > 0 {
+		summary += " (" + strings.Join(statuses, ", ") + ")"
+	}
+	return summary
+}
+
+// parseKeys translates the bytes read from a terminal in raw mode into key
+// names.
+func parseKeys(data []byte) []string {
+	var keys []string
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\x1b':
+			if i+2 < len(data) && data[i+1] == '[' {
+				switch data[i+2] {
+				case 'A':
+					keys = append(keys, "up")
+				case 'B':
+					keys = append(keys, "down")
+				}
+				i += 2
+				continue
+			}
+			keys = append(keys, "esc")
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		case '\x7f', '\b':
+			keys = append(keys, "backspace")
+		case '\x03':
+			keys = append(keys, "ctrl-c")
+		default:
+			keys = append(keys, string(data[i]))
+		}
+	}
+	return keys
+}
+
+// crlfWriter translates line feeds into carriage return and line feed, as
+// terminals in raw mode don't do it.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	_, err := w.w.Write(bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type topCmd struct {
+	fs       *gnuflag.FlagSet
+	interval time.Duration
+	once     bool
+}
+
+func (c *topCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "top",
+		Usage: "top [--interval/-i 5s] [--once]",
+		Desc: `Displays a dashboard with the nodes in the cluster grouped by pool, along
+with their status, the last successful health check, the number of containers
+running on each node and the recent auto scale, healing and node events.
+
+The dashboard is refreshed periodically, according to the [[--interval]] flag.
+Use j/k or the arrow keys to select a node and enter to see its containers and
+events. Press q to quit.
+
+When the standard input is not a terminal, or when the [[--once]] flag is
+used, the dashboard is printed once, without the key bindings.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *topCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("with-flags", gnuflag.ContinueOnError)
+		interval := "Time between refreshes of the dashboard"
+		c.fs.DurationVar(&c.interval, "interval", 5*time.Second, interval)
+		c.fs.DurationVar(&c.interval, "i", 5*time.Second, interval)
+		c.fs.BoolVar(&c.once, "once", false, "Print the dashboard once and exit")
+	}
+	return c.fs
+}
+
+func (c *topCmd) Run(ctx *cmd.Context, client *cmd.Client) error {
+	if c.interval < time.Second {
+		return errors.New("the refresh interval must be at least 1s")
+	}
+	target, err := cmd.ReadTarget()
+	if err != nil {
+		return err
+	}
+	view := &topView{target: target, interval: c.interval}
+	stdin, ok := ctx.Stdin.(*os.File)
+	if c.once || !ok || !terminal.IsTerminal(int(stdin.Fd())) {
+		view.refresh(client)
+		if view.err != nil {
+			return view.err
+		}
+		view.render(ctx.Stdout, time.Now())
+		return nil
+	}
+	view.interactive = true
+	return c.runInteractive(ctx, client, stdin, view)
+}
+
+func (c *topCmd) runInteractive(ctx *cmd.Context, client *cmd.Client, stdin *os.File, view *topView) error {
+	fd := int(stdin.Fd())
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+	out := &crlfWriter{w: ctx.Stdout}
+	fmt.Fprint(out, "\033[?25l")
+	defer fmt.Fprint(out, "\033[?25h\033[H\033[2J")
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	view.refresh(client)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		var screen bytes.Buffer
+		view.render(&screen, time.Now())
+		lines := strings.Split(strings.TrimSuffix(screen.String(), "\n"), "\n")
+		if _, height, err := terminal.GetSize(fd); err == nil && height > 0 && len(lines) > height {
+			lines = lines[:height]
+		}
+		fmt.Fprint(out, "\033[H\033[2J"+strings.Join(lines, "\n"))
+		select {
+		case <-ticker.C:
+			view.refresh(client)
+		case data, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			for _, key := range parseKeys(data) {
+				switch view.handleKey(key) {
+				case topQuit:
+					return nil
+				case topRefresh:
+					view.refresh(client)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2016 tsuru-admin authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"github.com/tsuru/tsuru/healer"
+	dockerHealer "github.com/tsuru/tsuru/provision/docker/healer"
+	"gopkg.in/check.v1"
+)
+
+func disableColors() func() {
+	os.Setenv("TSURU_DISABLE_COLORS", "1")
+	return func() { os.Unsetenv("TSURU_DISABLE_COLORS") }
+}
+
+func (s *S) TestTopInfo(c *check.C) {
+	c.Assert((&topCmd{}).Info(), check.NotNil)
+}
+
+func (s *S) TestTopRunOnce(c *check.C) {
+	defer disableColors()()
+	lastSuccess := time.Now().Add(-30 * time.Second).Format(time.RFC3339)
+	nodes := `{"nodes": [
+	{"Address": "http://n2:2375", "Status": "disabled", "Metadata": {"pool": "p1", "Failures": "3"}},
+	{"Address": "http://n1:2375", "Status": "ready", "Pool": "p1", "Metadata": {"LastSuccess": "` + lastSuccess + `"}},
+	{"Address": "http://n3:2375", "Status": "ready", "Metadata": {}}
+]}`
+	units := `[{"ID": "0123456789abcdef", "AppName": "myapp", "ProcessName": "web", "Status": "started"},
+	{"ID": "abc", "AppName": "myapp", "ProcessName": "worker", "Status": "error"}]`
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	autoScale := `[{"StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:01:00Z", "Successful": true, "MetadataValue": "p1", "Action": "add", "Reason": "containers"}]`
+	healing := `[{"StartTime": "2016-05-01T10:00:00Z", "Action": "node-healing", "FailingNode": {"Address": "http://n0:2375"}, "CreatedNode": {"Address": "http://n2:2375"}}]`
+	events := `[{"StartTime": "2016-05-01T10:00:00Z", "EndTime": "2016-05-01T10:00:01Z", "Target": {"Type": "node", "Value": "http://n1:2375"}, "Kind": {"Type": "permission", "Name": "node.update"}, "Owner": {"Type": "user", "Name": "admin@tsuru.io"}, "Error": "failed"}]`
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			getTransport("/1.2/node", nodes),
+			getTransport("/1.2/node/http://n2:2375/containers", ""),
+			getTransport("/1.2/node/http://n1:2375/containers", units),
+			getTransport("/1.2/node/http://n3:2375/containers", ""),
+			getTransport("/1.3/healing/node", `{"": {"Enabled": false}, "p1": {"Enabled": true}}`),
+			{
+				Transport: cmdtest.Transport{Message: autoScale, Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return strings.HasSuffix(req.URL.Path, "/docker/autoscale") && req.URL.RawQuery == "skip=0&limit=5"
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Message: healing, Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return strings.HasSuffix(req.URL.Path, "/docker/healing") && req.URL.Query().Get("filter") == "node"
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Message: events, Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.URL.Path == "/1.1/events" && req.URL.RawQuery == "limit=5&target.type=node"
+				},
+			},
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: &trans}, nil, s.manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout, Stdin: &bytes.Buffer{}}
+	command := topCmd{}
+	err := command.Flags().Parse(true, []string{"--once"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	stamp := start.Local().Format(time.Stamp)
+	c.Assert(stdout.String(), check.Matches, `tsuru-admin top - http://localhost - updated at \d\d:\d\d:\d\d
+
+Nodes without pool \(healing disabled\):
+\+----------------\+--------\+--------------\+----------\+------------\+
+\| Address        \| Status \| Last success \| Failures \| Containers \|
+\+----------------\+--------\+--------------\+----------\+------------\+
+\| http://n3:2375 \| ready  \| never        \| 0        \| 0          \|
+\+----------------\+--------\+--------------\+----------\+------------\+
+
+Pool "p1" \(healing enabled\):
+\+----------------\+----------\+--------------\+----------\+-------------\+
+\| Address        \| Status   \| Last success \| Failures \| Containers  \|
+\+----------------\+----------\+--------------\+----------\+-------------\+
+\| http://n1:2375 \| ready    \| 3\ds ago      \| 0        \| 2 \(1 error\) \|
+\| http://n2:2375 \| disabled \| never        \| 3        \| 0           \|
+\+----------------\+----------\+--------------\+----------\+-------------\+
+
+Recent auto scale events:
+\+-----------------\+---------\+----------\+--------\+------------\+
+\| Start           \| Success \| Metadata \| Action \| Reason     \|
+\+-----------------\+---------\+----------\+--------\+------------\+
+\| `+stamp+` \| true    \| p1       \| add    \| containers \|
+\+-----------------\+---------\+----------\+--------\+------------\+
+
+Recent node healing events:
+\+-----------------\+-------------\+----------------\+----------------\+-------\+
+\| Start           \| Success     \| Failing        \| Created        \| Error \|
+\+-----------------\+-------------\+----------------\+----------------\+-------\+
+\| `+stamp+` \| in progress \| http://n0:2375 \| http://n2:2375 \|       \|
+\+-----------------\+-------------\+----------------\+----------------\+-------\+
+
+Recent node events:
+\+-----------------\+-------------\+----------------\+----------------\+--------\+
+\| Start           \| Kind        \| Target         \| Owner          \| Status \|
+\+-----------------\+-------------\+----------------\+----------------\+--------\+
+\| `+stamp+` \| node.update \| http://n1:2375 \| admin@tsuru.io \| error  \|
+\+-----------------\+-------------\+----------------\+----------------\+--------\+
+`)
+}
+
+func (s *S) TestTopRunInvalidInterval(c *check.C) {
+	command := topCmd{}
+	err := command.Flags().Parse(true, []string{"-i", "10ms"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, "the refresh interval must be at least 1s")
+}
+
+func (s *S) TestTopViewRenderNode(c *check.C) {
+	defer disableColors()()
+	now := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	start := now.Add(-time.Hour)
+	d := &dashboard{
+		Nodes: []topNode{
+			{Address: "http://n1:2375", Pool: "p1", Status: "ready"},
+			{
+				Address:     "http://n2:2375",
+				Pool:        "p1",
+				Status:      "ready",
+				LastSuccess: now.Add(-90 * time.Second),
+				Metadata:    map[string]string{"pool": "p1", "zone": "a"},
+				Units:       []nodeUnit{{ID: "0123456789abcdef", AppName: "myapp", ProcessName: "web", Status: "started"}},
+			},
+		},
+		NodeHealing: []dockerHealer.HealingEvent{
+			{StartTime: start, EndTime: start, Successful: true},
+		},
+		Events: []eventEntry{
+			{StartTime: start, Target: eventTarget{Type: "node", Value: "http://n2:2375"}, Kind: eventKind{Name: "node.update"}, Owner: eventOwner{Name: "admin"}, Running: true},
+			{StartTime: start, Target: eventTarget{Type: "node", Value: "http://n1:2375"}, Kind: eventKind{Name: "node.create"}},
+		},
+	}
+	view := topView{target: "http://localhost", interval: 5 * time.Second, interactive: true, dashboard: d, selected: 1, detail: true}
+	var buf bytes.Buffer
+	view.render(&buf, now)
+	stamp := start.Local().Format(time.Stamp)
+	c.Assert(buf.String(), check.Equals, `tsuru-admin top - http://localhost, refreshing every 5s
+esc/b: back  r: refresh  q: quit
+
+Node: http://n2:2375
+Pool: p1
+Status: ready
+Last success: 1m30s ago
+Failures: 0
+Metadata: pool=p1, zone=a
+
+Containers:
++--------------+-------+---------+---------+
+| ID           | App   | Process | Status  |
++--------------+-------+---------+---------+
+| 0123456789ab | myapp | web     | started |
++--------------+-------+---------+---------+
+
+No recent node healing events.
+
+Recent node events:
++-----------------+-------------+----------------+-------+---------+
+| Start           | Kind        | Target         | Owner | Status  |
++-----------------+-------------+----------------+-------+---------+
+| `+stamp+` | node.update | http://n2:2375 | admin | running |
++-----------------+-------------+----------------+-------+---------+
+`)
+}
+
+func (s *S) TestTopViewRenderOverviewSelection(c *check.C) {
+	defer disableColors()()
+	d := &dashboard{
+		Nodes: []topNode{
+			{Address: "http://n1:2375", Pool: "p1", Status: "ready"},
+			{Address: "http://n2:2375", Pool: "p1", Status: "ready"},
+		},
+		Healing: map[string]healer.NodeHealerConfig{},
+	}
+	view := topView{target: "http://localhost", interval: time.Second, interactive: true, dashboard: d, selected: 1}
+	var buf bytes.Buffer
+	view.render(&buf, time.Now())
+	c.Assert(buf.String(), check.Matches, `(?s).*j/k: select node  enter: node details  r: refresh  q: quit.*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*\|   http://n1:2375 \|.*\| > http://n2:2375 \|.*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*No recent auto scale events\.\n\nNo recent node healing events\.\n\nNo recent node events\.\n$`)
+}
+
+func (s *S) TestTopViewHandleKey(c *check.C) {
+	view := topView{dashboard: &dashboard{Nodes: make([]topNode, 3)}}
+	c.Assert(view.handleKey("k"), check.Equals, topRedraw)
+	c.Assert(view.selected, check.Equals, 0)
+	view.handleKey("j")
+	view.handleKey("down")
+	view.handleKey("j")
+	c.Assert(view.selected, check.Equals, 2)
+	view.handleKey("up")
+	c.Assert(view.selected, check.Equals, 1)
+	view.handleKey("enter")
+	c.Assert(view.detail, check.Equals, true)
+	view.handleKey("j")
+	c.Assert(view.selected, check.Equals, 1)
+	view.handleKey("esc")
+	c.Assert(view.detail, check.Equals, false)
+	c.Assert(view.handleKey("r"), check.Equals, topRefresh)
+	c.Assert(view.handleKey("q"), check.Equals, topQuit)
+	c.Assert(view.handleKey("ctrl-c"), check.Equals, topQuit)
+	empty := topView{dashboard: &dashboard{}}
+	empty.handleKey("enter")
+	c.Assert(empty.detail, check.Equals, false)
+}
+
+func (s *S) TestParseKeys(c *check.C) {
+	keys := parseKeys([]byte("j\x1b[A\x1b[B\r\x1bq\x7f\x03"))
+	c.Assert(keys, check.DeepEquals, []string{"j", "up", "down", "enter", "esc", "q", "backspace", "ctrl-c"})
+}
+
+func (s *S) TestUnitsSummary(c *check.C) {
+	c.Assert(unitsSummary(nil), check.Equals, "0")
+	units := []nodeUnit{{Status: "started"}, {Status: "stopped"}, {Status: "error"}, {Status: "error"}}
+	c.Assert(unitsSummary(units), check.Equals, "4 (1 stopped, 2 error)")
+}
+
+func (s *S) TestFormatAge(c *check.C) {
+	now := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	c.Assert(formatAge(time.Time{}, now), check.Equals, "never")
+	c.Assert(formatAge(now.Add(-1500*time.Millisecond), now), check.Equals, "1s ago")
+	c.Assert(formatAge(now.Add(time.Minute), now), check.Equals, "0s ago")
+}
+
+func (s *S) TestCRLFWriter(c *check.C) {
+	var buf bytes.Buffer
+	n, err := (&crlfWriter{w: &buf}).Write([]byte("a\nb\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 4)
+	c.Assert(buf.String(), check.Equals, "a\r\nb\r\n")
+}